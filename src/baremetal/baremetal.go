@@ -4,12 +4,16 @@ import (
 	"baremetal/plugin"
 	"baremetal/server"
 	"baremetal/utils"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
@@ -27,6 +31,11 @@ var bootstrapInfo map[string]interface{} = make(map[string]interface{})
 
 func loadPlugins() {
 	plugin.ApvmEntryPoint()
+	plugin.FirewallEntryPoint()
+	plugin.FirewallCountersEntryPoint()
+	plugin.ConntrackEntryPoint()
+	plugin.VyosConfigEntryPoint()
+	plugin.LinkEntryPoint()
 	// plugin.DhcpEntryPoint()
 	// plugin.MiscEntryPoint()
 	// plugin.DnsEntryPoint()
@@ -37,9 +46,12 @@ func loadPlugins() {
 	// plugin.LbEntryPoint()
 	// plugin.IPsecEntryPoint()
 	// plugin.ConfigureNicEntryPoint()
-	// plugin.RouteEntryPoint()
+	plugin.RouteEntryPoint()
+	plugin.SupervisorEntryPoint()
+	plugin.LogEntryPoint()
+	plugin.ServerEntryPoint()
 	// plugin.ZsnEntryPoint()
-	// plugin.PrometheusEntryPoint()
+	plugin.PrometheusEntryPoint()
 	// plugin.OspfEntryPoint()
 }
 
@@ -58,7 +70,46 @@ func parseAgentConfigInfo() {
 	if err = json.Unmarshal(content, &bootstrapInfo); err != nil {
 		panic(errors.Wrap(err, fmt.Sprintf("unable to JSON parse:\n %s", string(content))))
 	}
+
+	// how to run iptables, ip and others, e.g. "privilege": {"mode": "sudo"}
+	// the log level, format and rotation, e.g. "log": {"level": "info", "format": "json", "maxSizeMB": 50}
+	// the HTTP client of the callbacks, e.g. "http": {"timeout": 30, "proxy": "http://proxy:3128"}
+	// the helper daemons run by the supervisor, e.g. "daemons": [{"name": "dnsmasq", "argv": ["dnsmasq", "-k"]}]
+	// and the management node which must stay reachable after a vyos commit, e.g. "managementNodeIp": "172.20.0.10"
+	agentConfig := struct {
+		Privilege utils.PrivilegeConfig  `json:"privilege"`
+		Log       utils.LogConfig        `json:"log"`
+		Http      utils.HttpClientConfig `json:"http"`
+		Daemons   []utils.DaemonConfig   `json:"daemons"`
+		// the callbacks of the async commands may come from any host, e.g. baremetalctl
+		ManagementNodeIp string `json:"managementNodeIp"`
+	}{}
+	utils.PanicOnError(json.Unmarshal(content, &agentConfig))
+	utils.PanicOnError(utils.ConfigureLog(agentConfig.Log))
+	utils.PanicOnError(utils.ConfigureHttpClient(agentConfig.Http))
+	utils.PanicOnError(utils.ConfigurePrivilege(agentConfig.Privilege))
+	log.Debugf("run the privileged programs in %s mode", utils.PrivilegeMode())
+	if ip := agentConfig.ManagementNodeIp; ip != "" && net.ParseIP(ip) == nil {
+		panic(errors.New(fmt.Sprintf("invalid managementNodeIp[%s] in %s", ip, AGENT_CONFIG_FILE)))
+	}
+	server.SetManagementNodeIp(agentConfig.ManagementNodeIp)
 	checkAgentConfigInfo()
+	daemons = agentConfig.Daemons
+}
+
+var daemons []utils.DaemonConfig
+
+// stopDaemonsOnExit stops the supervised daemons when the agent is terminated,
+// otherwise they are left running without a supervisor
+func stopDaemonsOnExit() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		sig := <-c
+		log.Infof("received %v, stop the daemons and exit", sig)
+		utils.DefaultSupervisor.StopAll()
+		os.Exit(0)
+	}()
 }
 
 func findPxenicIps(nic string) ([]string, error) {
@@ -170,14 +221,14 @@ func parseCommandOptions() {
 
 func configureZvrFirewall() {
 	if utils.IsSkipVyosIptables() {
-		err := utils.InitNicFirewall("eth0", options.Ip, true, utils.ACCEPT)
+		err := utils.InitNicFirewall(context.Background(), "eth0", options.Ip, true, utils.ACCEPT)
 		if err != nil {
 			log.Debugf("zvr configureZvrFirewall failed %s", err.Error())
 		}
 		return
 	}
 
-	tree := server.NewParserFromShowConfiguration().Tree
+	tree := server.NewParserFromShowConfiguration(context.Background()).Tree
 
 	/* add description to avoid duplicated firewall rule when reconnect vr */
 	des := "management-port-rule"
@@ -185,15 +236,15 @@ func configureZvrFirewall() {
 		r.Delete()
 	}
 
-	tree.SetFirewallOnInterface("eth0", "local",
-		fmt.Sprintf("destination address %v", options.Ip),
-		fmt.Sprintf("destination port %v", options.Port),
-		"protocol tcp",
-		"action accept",
-		fmt.Sprintf("description %s", des),
-	)
+	tree.SetFirewallRule("eth0", "local", &server.VyosFirewallRule{
+		Action:             "accept",
+		Protocol:           "tcp",
+		DestinationAddress: options.Ip,
+		DestinationPort:    fmt.Sprint(options.Port),
+		Description:        des,
+	})
 
-	tree.Apply(false)
+	tree.Apply(context.Background(), false)
 }
 
 func main() {
@@ -202,6 +253,12 @@ func main() {
 	parseAgentConfigInfo()
 
 	loadPlugins()
+	stopDaemonsOnExit()
+	utils.PanicOnError(utils.DefaultSupervisor.StartDaemons(daemons))
+	// the routes and rules are persisted, install them again after the agent restarts
+	if err := utils.ReconcileRoutes(); err != nil {
+		log.Warnf("failed to reconcile the routes, %s", err)
+	}
 	// server.VyosLockInterface(configureZvrFirewall)()
 	options := server.Options{
 		Ip:           "0.0.0.0",
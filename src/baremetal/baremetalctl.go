@@ -0,0 +1,412 @@
+package main
+
+import (
+	"baremetal/plugin"
+	"baremetal/server"
+	"baremetal/utils"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	CTL_DEFAULT_AGENT_URL = "http://127.0.0.1:10002"
+	CTL_CALLBACK_PATH     = "/callback"
+)
+
+var ctlOptions struct {
+	agentUrl   string
+	timeout    time.Duration
+	callbackIp string
+	async      bool
+	sync       bool
+	json       bool
+	verbose    bool
+}
+
+func ctlUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage: %s [options] <command> [arguments]
+
+Commands:
+  commands                      list the commands registered by the agent
+  call <path> [body]            send a command, the body is JSON, @file or - for stdin, {} by default;
+                                an async command gets its reply through a local callback listener
+  status                        show the status of the agent
+  log-level [subsystem] [level] show the log levels, or set the level of a subsystem, 'default' by default
+  tasks [taskUuid]              list the recent async tasks, or show one
+
+Options:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func ctlAbort(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+func ctlUrl(path string) string {
+	return strings.TrimRight(ctlOptions.agentUrl, "/") + path
+}
+
+// ctlPost sends the JSON body and returns the response, a failed command
+// replies a CommandResponseHeader with success false
+func ctlPost(path string, headers map[string]string, body json.RawMessage) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctlOptions.timeout)
+	defer cancel()
+	rsp, err := utils.HttpDo(ctx, http.MethodPost, ctlUrl(path), headers, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rsp, ctlCheckFailure(rsp)
+}
+
+func ctlCheckFailure(rsp []byte) error {
+	h := struct {
+		Success *bool  `json:"success"`
+		Error   string `json:"error"`
+	}{}
+	if json.Unmarshal(rsp, &h) == nil && h.Success != nil && !*h.Success {
+		return fmt.Errorf("the command failed, %s", h.Error)
+	}
+	return nil
+}
+
+func ctlSync(path string, cmd interface{}, rsp interface{}) error {
+	body, err := json.Marshal(cmd)
+	utils.PanicOnError(err)
+	b, err := ctlPost(path, nil, body)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, rsp); err != nil {
+		return fmt.Errorf("unable to parse the response of %s, %v: %s", path, err, string(b))
+	}
+	return nil
+}
+
+func ctlPrintJson(b []byte) {
+	var out bytes.Buffer
+	if len(bytes.TrimSpace(b)) == 0 {
+		return
+	}
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		fmt.Println(string(b))
+		return
+	}
+	fmt.Println(out.String())
+}
+
+func ctlPrintObject(obj interface{}) {
+	b, err := json.MarshalIndent(obj, "", "  ")
+	utils.PanicOnError(err)
+	fmt.Println(string(b))
+}
+
+func ctlCommands() ([]server.CommandInfo, error) {
+	rsp := struct {
+		Commands []server.CommandInfo `json:"commands"`
+	}{}
+	if err := ctlSync(plugin.SERVER_COMMANDS_PATH, struct{}{}, &rsp); err != nil {
+		return nil, err
+	}
+	return rsp.Commands, nil
+}
+
+func ctlListCommands() error {
+	commands, err := ctlCommands()
+	if err != nil {
+		return err
+	}
+	if ctlOptions.json {
+		ctlPrintObject(commands)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tTYPE")
+	for _, c := range commands {
+		t := "sync"
+		if c.Async {
+			t = "async"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", c.Path, t)
+	}
+	return w.Flush()
+}
+
+func ctlReadBody(arg string) (json.RawMessage, error) {
+	var b []byte
+	var err error
+	switch {
+	case arg == "":
+		b = []byte("{}")
+	case arg == "-":
+		b, err = ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(arg, "@"):
+		b, err = ioutil.ReadFile(arg[1:])
+	default:
+		b = []byte(arg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("the body is not valid JSON: %s", string(b))
+	}
+	return json.RawMessage(b), nil
+}
+
+func ctlIsAsync(path string) (bool, error) {
+	if ctlOptions.async || ctlOptions.sync {
+		return ctlOptions.async, nil
+	}
+
+	commands, err := ctlCommands()
+	if err != nil {
+		return false, fmt.Errorf("unable to discover the commands, use -sync or -async to skip it, %v", err)
+	}
+	for _, c := range commands {
+		if c.Path == path {
+			return c.Async, nil
+		}
+	}
+	return false, fmt.Errorf("the agent has no command %s, see '%s commands'", path, os.Args[0])
+}
+
+// ctlLocalIp returns the IP the agent reaches this host through
+func ctlLocalIp() (string, error) {
+	if ctlOptions.callbackIp != "" {
+		return ctlOptions.callbackIp, nil
+	}
+
+	u, err := url.Parse(ctlOptions.agentUrl)
+	if err != nil {
+		return "", err
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return "127.0.0.1", nil
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	// no packet is sent, it only picks the route
+	conn, err := net.Dial("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// ctlCallAsync listens for the callback once, sends the command with the
+// callback URL and waits for the reply of the task
+func ctlCallAsync(path string, body json.RawMessage) ([]byte, error) {
+	ip, err := ctlLocalIp()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the callback IP, use -callback-ip to set it, %v", err)
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		return nil, err
+	}
+
+	taskUuid := utils.NewRequestId()
+	replies := make(chan []byte, 1)
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// 404 tells the agent to stop retrying the unknown tasks
+		if req.URL.Path != CTL_CALLBACK_PATH || req.Header.Get(server.TASK_UUID) != taskUuid {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		select {
+		case replies <- b:
+		default:
+		}
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	callbackUrl := fmt.Sprintf("http://%s%s", l.Addr().String(), CTL_CALLBACK_PATH)
+	if _, err := ctlPost(path, map[string]string{
+		server.CALLBACK_URL: callbackUrl,
+		server.TASK_UUID:    taskUuid,
+	}, body); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "task %s is sent, waiting for the reply on %s\n", taskUuid, callbackUrl)
+
+	select {
+	case b := <-replies:
+		return b, ctlCheckFailure(b)
+	case <-time.After(ctlOptions.timeout):
+		return nil, fmt.Errorf("no reply of the task %s in %v, see '%s tasks %s'", taskUuid, ctlOptions.timeout, os.Args[0], taskUuid)
+	}
+}
+
+func ctlCall(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		ctlAbort("error: call needs the path and an optional body")
+	}
+	path := args[0]
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	arg := ""
+	if len(args) == 2 {
+		arg = args[1]
+	}
+	body, err := ctlReadBody(arg)
+	if err != nil {
+		return err
+	}
+
+	async, err := ctlIsAsync(path)
+	if err != nil {
+		return err
+	}
+
+	var rsp []byte
+	if async {
+		rsp, err = ctlCallAsync(path, body)
+	} else {
+		rsp, err = ctlPost(path, nil, body)
+	}
+	// print the reply of a failed command too, it may have more than the error
+	ctlPrintJson(rsp)
+	return err
+}
+
+func ctlLogLevel(args []string) error {
+	cmd := map[string]string{}
+	switch len(args) {
+	case 0:
+	case 1:
+		cmd["level"] = args[0]
+	case 2:
+		cmd["subsystem"] = args[0]
+		cmd["level"] = args[1]
+	default:
+		ctlAbort("error: log-level takes an optional subsystem and a level")
+	}
+
+	rsp := struct {
+		Levels map[string]string `json:"levels"`
+	}{}
+	if err := ctlSync(plugin.LOG_LEVEL_PATH, cmd, &rsp); err != nil {
+		return err
+	}
+	ctlPrintObject(rsp.Levels)
+	return nil
+}
+
+func ctlTasks(args []string) error {
+	if len(args) > 1 {
+		ctlAbort("error: tasks takes an optional task UUID")
+	}
+	cmd := map[string]string{}
+	if len(args) == 1 {
+		cmd["taskUuid"] = args[0]
+	}
+
+	rsp := struct {
+		Tasks []server.Task `json:"tasks"`
+	}{}
+	if err := ctlSync(plugin.SERVER_TASKS_PATH, cmd, &rsp); err != nil {
+		return err
+	}
+	if ctlOptions.json || len(args) == 1 {
+		ctlPrintObject(rsp.Tasks)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tPATH\tSTATE\tSTART\tDURATION\tERROR")
+	for _, t := range rsp.Tasks {
+		end := t.EndTime
+		if end.IsZero() {
+			end = time.Now()
+		}
+		e := t.Error
+		if e == "" && t.CallbackError != "" {
+			e = "callback: " + t.CallbackError
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\n", t.TaskUuid, t.Path, t.State,
+			t.StartTime.Format("2006-01-02 15:04:05"), end.Sub(t.StartTime).Truncate(time.Millisecond), e)
+	}
+	return w.Flush()
+}
+
+func main() {
+	flag.Usage = ctlUsage
+	flag.StringVar(&ctlOptions.agentUrl, "agent", CTL_DEFAULT_AGENT_URL, "The URL of the agent")
+	flag.DurationVar(&ctlOptions.timeout, "timeout", 5*time.Minute, "The time to wait for the response, or the reply of an async command")
+	flag.StringVar(&ctlOptions.callbackIp, "callback-ip", "", "The IP the callback listener binds, the one routing to the agent by default")
+	flag.BoolVar(&ctlOptions.async, "async", false, "Send the command as async without discovering it")
+	flag.BoolVar(&ctlOptions.sync, "sync", false, "Send the command as sync without discovering it")
+	flag.BoolVar(&ctlOptions.json, "json", false, "Print the lists as JSON")
+	flag.BoolVar(&ctlOptions.verbose, "v", false, "Log the HTTP requests")
+	flag.Parse()
+
+	if ctlOptions.async && ctlOptions.sync {
+		ctlAbort("error: -async and -sync are exclusive")
+	}
+	log.SetOutput(os.Stderr)
+	log.SetLevel(log.WarnLevel)
+	if ctlOptions.verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	// the deadlines of the calls are set by -timeout
+	utils.PanicOnError(utils.ConfigureHttpClient(utils.HttpClientConfig{Timeout: int(ctlOptions.timeout/time.Second) + 1}))
+
+	args := flag.Args()
+	if len(args) == 0 {
+		ctlAbort("error: a command is required")
+	}
+
+	var err error
+	switch args[0] {
+	case "commands":
+		err = ctlListCommands()
+	case "call":
+		err = ctlCall(args[1:])
+	case "status":
+		rsp := map[string]interface{}{}
+		if err = ctlSync(plugin.SERVER_STATUS_PATH, struct{}{}, &rsp); err == nil {
+			ctlPrintObject(rsp)
+		}
+	case "log-level":
+		err = ctlLogLevel(args[1:])
+	case "tasks":
+		err = ctlTasks(args[1:])
+	default:
+		ctlAbort(fmt.Sprintf("error: unknown command %s", args[0]))
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+// baremetal-priv is the setuid helper of the privilege mode 'helper', it runs a
+// program in utils.DefaultPrivilegedPrograms as root, e.g.
+//
+//	baremetal-priv iptables -S
+//
+// only the user of the agent should run it, install it with
+//
+//	chown root:vyos baremetal-priv && chmod 4750 baremetal-priv
+
+import (
+	"baremetal/utils"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// the exit code of timeout(1) and the shells when the program cannot be run
+const PRIV_EXIT_CANNOT_RUN = 126
+
+func main() {
+	path, argv, err := utils.PrivilegeHelperArgv(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(PRIV_EXIT_CANNOT_RUN)
+	}
+
+	// nothing from the environment of the caller but the request ID is passed
+	env := []string{"PATH=" + utils.PRIVILEGE_HELPER_PATH}
+	if id := os.Getenv(utils.REQUEST_ID_ENV); id != "" {
+		env = append(env, utils.REQUEST_ID_ENV+"="+id)
+	}
+	err = syscall.Exec(path, argv, env)
+	fmt.Fprintf(os.Stderr, "unable to run %s, %s\n", path, err)
+	os.Exit(PRIV_EXIT_CANNOT_RUN)
+}
@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+)
+
+const (
+	CONNTRACK_LIST_PATH    = "/conntrack/list"
+	CONNTRACK_DELETE_PATH  = "/conntrack/delete"
+	CONNTRACK_SUMMARY_PATH = "/conntrack/summary"
+)
+
+type listConntrackCmd struct {
+	utils.ConntrackFilter
+	// 0 means no limit
+	Limit int `json:"limit"`
+}
+
+type listConntrackRsp struct {
+	Entries []*utils.ConntrackEntry `json:"entries"`
+	Total   int                     `json:"total"`
+}
+
+type deleteConntrackCmd struct {
+	utils.ConntrackFilter
+}
+
+type deleteConntrackRsp struct {
+	Deleted int `json:"deleted"`
+}
+
+type summaryConntrackCmd struct {
+	utils.ConntrackFilter
+}
+
+type summaryConntrackRsp struct {
+	utils.ConntrackSummary
+}
+
+func listConntrackHandler(ctx *server.CommandContext) interface{} {
+	cmd := &listConntrackCmd{}
+	ctx.GetCommand(cmd)
+
+	entries, err := utils.ListConntrackEntries(ctx.Context(), cmd.ConntrackFilter)
+	utils.PanicOnError(err)
+
+	rsp := listConntrackRsp{Entries: entries, Total: len(entries)}
+	if cmd.Limit > 0 && len(entries) > cmd.Limit {
+		rsp.Entries = entries[:cmd.Limit]
+	}
+	return rsp
+}
+
+func deleteConntrackHandler(ctx *server.CommandContext) interface{} {
+	cmd := &deleteConntrackCmd{}
+	ctx.GetCommand(cmd)
+
+	deleted, err := utils.DeleteConntrackEntries(ctx.Context(), cmd.ConntrackFilter)
+	utils.PanicOnError(err)
+	ctx.Log().Debugf("deleted %d conntrack entries matching %+v", deleted, cmd.ConntrackFilter)
+	return deleteConntrackRsp{Deleted: deleted}
+}
+
+func summaryConntrackHandler(ctx *server.CommandContext) interface{} {
+	cmd := &summaryConntrackCmd{}
+	ctx.GetCommand(cmd)
+
+	entries, err := utils.ListConntrackEntries(ctx.Context(), cmd.ConntrackFilter)
+	utils.PanicOnError(err)
+	return summaryConntrackRsp{utils.SummarizeConntrackEntries(entries)}
+}
+
+func ConntrackEntryPoint() {
+	server.RegisterSyncCommandHandler(CONNTRACK_LIST_PATH, listConntrackHandler)
+	server.RegisterSyncCommandHandler(CONNTRACK_DELETE_PATH, deleteConntrackHandler)
+	server.RegisterSyncCommandHandler(CONNTRACK_SUMMARY_PATH, summaryConntrackHandler)
+}
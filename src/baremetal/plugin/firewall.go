@@ -0,0 +1,309 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	FIREWALL_LIST_RULES_PATH   = "/firewall/rules/list"
+	FIREWALL_ADD_RULES_PATH    = "/firewall/rules/add"
+	FIREWALL_REMOVE_RULES_PATH = "/firewall/rules/remove"
+	FIREWALL_DEFAULT_RULE_PATH = "/firewall/default"
+	FIREWALL_DESTROY_NIC_PATH  = "/firewall/destroy"
+	FIREWALL_SNAPSHOTS_PATH    = "/firewall/snapshots"
+	FIREWALL_ROLLBACK_PATH     = "/firewall/rollback"
+	FIREWALL_CONFIRM_PATH      = "/firewall/confirm"
+	FIREWALL_CHAIN_IN          = "in"
+	FIREWALL_CHAIN_LOCAL       = "local"
+	FIREWALL_DEFAULT_ACCEPT    = "accept"
+	FIREWALL_DEFAULT_REJECT    = "reject"
+
+	// the limit of the iptables comment match
+	MAX_FIREWALL_COMMENT_LENGTH = 256
+)
+
+type listFirewallRulesCmd struct {
+	Nic   string `json:"nic"`
+	Chain string `json:"chain"`
+}
+
+type nicFirewallRules struct {
+	Nic   string               `json:"nic"`
+	Chain string               `json:"chain"`
+	Rules []utils.IptablesRule `json:"rules"`
+}
+
+type listFirewallRulesRsp struct {
+	Nics []nicFirewallRules `json:"nics"`
+}
+
+type addFirewallRulesCmd struct {
+	Nic     string               `json:"nic"`
+	Chain   string               `json:"chain"`
+	Comment string               `json:"comment"`
+	Rules   []utils.IptablesRule `json:"rules"`
+	// return the would-be iptables-restore file and its diff without applying
+	DryRun bool `json:"dryRun"`
+	// roll back the change unless FIREWALL_CONFIRM_PATH is called in time
+	ConfirmTimeout int `json:"confirmTimeout"`
+}
+
+// the reply of the commands changing the firewall, Snapshot is the state
+// before the change
+type firewallChangeRsp struct {
+	Preview  *utils.IptablesRestorePreview `json:"preview,omitempty"`
+	Snapshot string                        `json:"snapshot,omitempty"`
+}
+
+type removeFirewallRulesCmd struct {
+	Nic            string `json:"nic"`
+	Chain          string `json:"chain"`
+	Comment        string `json:"comment"`
+	DryRun         bool   `json:"dryRun"`
+	ConfirmTimeout int    `json:"confirmTimeout"`
+}
+
+type setFirewallDefaultRuleCmd struct {
+	Nic            string `json:"nic"`
+	Action         string `json:"action"`
+	DryRun         bool   `json:"dryRun"`
+	ConfirmTimeout int    `json:"confirmTimeout"`
+}
+
+type destroyNicFirewallCmd struct {
+	Nic            string `json:"nic"`
+	DryRun         bool   `json:"dryRun"`
+	ConfirmTimeout int    `json:"confirmTimeout"`
+}
+
+type listFirewallSnapshotsRsp struct {
+	Snapshots []*utils.IptablesSnapshot `json:"snapshots"`
+}
+
+type rollbackFirewallCmd struct {
+	Steps int `json:"steps"`
+}
+
+type rollbackFirewallRsp struct {
+	Snapshot string `json:"snapshot"`
+	// the state before the rollback, rolling back 1 step returns to it
+	Previous string `json:"previous"`
+}
+
+type confirmFirewallRsp struct {
+	Confirmed bool `json:"confirmed"`
+}
+
+func parseFirewallChain(name string) utils.Chain {
+	utils.Assertf(name == FIREWALL_CHAIN_IN || name == FIREWALL_CHAIN_LOCAL,
+		"the chain can only be [%s, %s], but %s got", FIREWALL_CHAIN_IN, FIREWALL_CHAIN_LOCAL, name)
+	if name == FIREWALL_CHAIN_IN {
+		return utils.IN
+	}
+	return utils.LOCAL
+}
+
+// the nic is written into the chain names of the iptables-restore input
+func checkFirewallNic(nic string) {
+	utils.Assert(nic != "", "nic cannot be empty")
+	utils.PanicOnError(utils.CheckLinkName(nic))
+}
+
+// the default rules are maintained by the agent itself, they can only
+// be changed through FIREWALL_DEFAULT_RULE_PATH. The comment is written
+// unquoted into the rules and identifies them exactly, so it must name the
+// rules inside a group, e.g. PF-rules-for-10.0.0.1, not the group itself
+func checkFirewallComment(comment string) {
+	utils.Assertf(len(comment) <= MAX_FIREWALL_COMMENT_LENGTH, "the comment[%s] is longer than %d", comment, MAX_FIREWALL_COMMENT_LENGTH)
+	utils.Assertf(!strings.ContainsAny(comment, "\"'\\") && !strings.ContainsFunc(comment, unicode.IsSpace),
+		"the comment[%s] cannot contain whitespaces, quotes or backslashes", comment)
+
+	group, _ := utils.GetCommentGroup(comment)
+	utils.Assertf(group != "", "the comment[%s] doesn't belong to any known rule group", comment)
+	utils.Assertf(group != utils.DefaultTopRuleComment && group != utils.DefaultBottomRuleComment,
+		"the rule group[%s] is managed by the agent and cannot be changed", group)
+
+	suffix := strings.TrimPrefix(strings.TrimPrefix(comment, group), "for")
+	utils.Assertf(strings.Trim(suffix, "-") != "",
+		"the comment[%s] must have a name after the rule group[%s], e.g. %sfor-10.0.0.1", comment, group, group)
+}
+
+func listFirewallRulesHandler(ctx *server.CommandContext) interface{} {
+	cmd := &listFirewallRulesCmd{}
+	ctx.GetCommand(cmd)
+
+	nicnames := []string{cmd.Nic}
+	if cmd.Nic != "" {
+		checkFirewallNic(cmd.Nic)
+	} else {
+		nics, err := utils.GetAllNics()
+		utils.PanicOnError(err)
+		nicnames = []string{}
+		for name := range nics {
+			nicnames = append(nicnames, name)
+		}
+	}
+
+	chains := []string{cmd.Chain}
+	if cmd.Chain == "" {
+		chains = []string{FIREWALL_CHAIN_IN, FIREWALL_CHAIN_LOCAL}
+	}
+
+	rsp := listFirewallRulesRsp{Nics: []nicFirewallRules{}}
+	for _, nicname := range nicnames {
+		for _, chain := range chains {
+			rules, err := utils.ListFirewallRules(ctx.Context(), nicname, parseFirewallChain(chain))
+			if err != nil {
+				utils.PanicIfError(cmd.Nic == "", err)
+				/* the nic is not managed by the agent */
+				ctx.Log().Debugf("skip listing firewall of nic %s: %s", nicname, err)
+				continue
+			}
+			rsp.Nics = append(rsp.Nics, nicFirewallRules{Nic: nicname, Chain: chain, Rules: rules})
+		}
+	}
+
+	return rsp
+}
+
+func addFirewallRulesHandler(ctx *server.CommandContext) interface{} {
+	cmd := &addFirewallRulesCmd{}
+	ctx.GetCommand(cmd)
+
+	checkFirewallNic(cmd.Nic)
+	checkFirewallComment(cmd.Comment)
+	ch := parseFirewallChain(cmd.Chain)
+
+	// the rules of a group share the comment of the group
+	rules := []utils.IptablesRule{}
+	for _, r := range cmd.Rules {
+		utils.Assert(r.Action() != "", "action cannot be empty")
+		utils.PanicOnError(r.Validate())
+		rules = append(rules, r.WithComment(cmd.Comment))
+	}
+
+	rulesMap := map[string][]utils.IptablesRule{cmd.Nic: rules}
+	if cmd.DryRun {
+		preview, err := utils.PreviewSyncFirewallRule(ctx.Context(), rulesMap, cmd.Comment, ch)
+		utils.PanicOnError(err)
+		return firewallChangeRsp{Preview: preview}
+	}
+
+	return changeFirewall(ctx, cmd.ConfirmTimeout, func() error {
+		return utils.SyncFirewallRule(ctx.Context(), rulesMap, cmd.Comment, ch)
+	})
+}
+
+// changeFirewall snapshots the tables before the change, and rolls them back
+// unless the change is confirmed in confirmTimeout seconds if it's set
+func changeFirewall(ctx *server.CommandContext, confirmTimeout int, change func() error) firewallChangeRsp {
+	snapshot, err := utils.SnapshotIptables(ctx.Context())
+	utils.PanicOnError(err)
+	utils.PanicOnError(change())
+	if confirmTimeout > 0 {
+		utils.ScheduleIptablesRollback(snapshot, time.Duration(confirmTimeout)*time.Second)
+	}
+
+	return firewallChangeRsp{Snapshot: snapshot.Id}
+}
+
+func removeFirewallRulesHandler(ctx *server.CommandContext) interface{} {
+	cmd := &removeFirewallRulesCmd{}
+	ctx.GetCommand(cmd)
+
+	checkFirewallNic(cmd.Nic)
+	checkFirewallComment(cmd.Comment)
+
+	chains := []utils.Chain{}
+	if cmd.Chain != "" {
+		chains = append(chains, parseFirewallChain(cmd.Chain))
+	}
+	if cmd.DryRun {
+		preview, err := utils.PreviewDeleteFirewallRuleByComment(ctx.Context(), cmd.Nic, cmd.Comment, chains...)
+		utils.PanicOnError(err)
+		return firewallChangeRsp{Preview: preview}
+	}
+
+	return changeFirewall(ctx, cmd.ConfirmTimeout, func() error {
+		if len(chains) == 0 {
+			return utils.DeleteFirewallRuleByComment(ctx.Context(), cmd.Nic, cmd.Comment)
+		} else if chains[0] == utils.IN {
+			return utils.DeleteInFirewallRuleByComment(ctx.Context(), cmd.Nic, cmd.Comment)
+		}
+		return utils.DeleteLocalFirewallRuleByComment(ctx.Context(), cmd.Nic, cmd.Comment)
+	})
+}
+
+func setFirewallDefaultRuleHandler(ctx *server.CommandContext) interface{} {
+	cmd := &setFirewallDefaultRuleCmd{}
+	ctx.GetCommand(cmd)
+
+	checkFirewallNic(cmd.Nic)
+	utils.Assertf(cmd.Action == FIREWALL_DEFAULT_ACCEPT || cmd.Action == FIREWALL_DEFAULT_REJECT,
+		"action must be %s or %s, but %s got", FIREWALL_DEFAULT_ACCEPT, FIREWALL_DEFAULT_REJECT, cmd.Action)
+
+	if cmd.DryRun {
+		preview, err := utils.PreviewSetDefaultRule(ctx.Context(), cmd.Nic, cmd.Action)
+		utils.PanicOnError(err)
+		return firewallChangeRsp{Preview: preview}
+	}
+
+	return changeFirewall(ctx, cmd.ConfirmTimeout, func() error {
+		return utils.SetDefaultRule(ctx.Context(), cmd.Nic, cmd.Action)
+	})
+}
+
+func destroyNicFirewallHandler(ctx *server.CommandContext) interface{} {
+	cmd := &destroyNicFirewallCmd{}
+	ctx.GetCommand(cmd)
+
+	checkFirewallNic(cmd.Nic)
+	if cmd.DryRun {
+		preview, err := utils.PreviewDestroyNicFirewall(ctx.Context(), cmd.Nic)
+		utils.PanicOnError(err)
+		return firewallChangeRsp{Preview: preview}
+	}
+
+	ctx.Log().Debugf("destroy firewall of nic %s", cmd.Nic)
+	return changeFirewall(ctx, cmd.ConfirmTimeout, func() error {
+		utils.DestroyNicFirewall(ctx.Context(), cmd.Nic)
+		return nil
+	})
+}
+
+func listFirewallSnapshotsHandler(ctx *server.CommandContext) interface{} {
+	snapshots, err := utils.ListIptablesSnapshots()
+	utils.PanicOnError(err)
+	return listFirewallSnapshotsRsp{Snapshots: snapshots}
+}
+
+func rollbackFirewallHandler(ctx *server.CommandContext) interface{} {
+	cmd := &rollbackFirewallCmd{}
+	ctx.GetCommand(cmd)
+
+	if cmd.Steps == 0 {
+		cmd.Steps = 1
+	}
+	snapshot, previous, err := utils.RollbackIptables(ctx.Context(), cmd.Steps)
+	utils.PanicOnError(err)
+	return rollbackFirewallRsp{Snapshot: snapshot.Id, Previous: previous.Id}
+}
+
+func confirmFirewallHandler(ctx *server.CommandContext) interface{} {
+	return confirmFirewallRsp{Confirmed: utils.ConfirmIptablesChange()}
+}
+
+func FirewallEntryPoint() {
+	server.RegisterSyncCommandHandler(FIREWALL_LIST_RULES_PATH, server.VyosLock(listFirewallRulesHandler))
+	server.RegisterAsyncCommandHandler(FIREWALL_ADD_RULES_PATH, server.VyosLock(addFirewallRulesHandler))
+	server.RegisterAsyncCommandHandler(FIREWALL_REMOVE_RULES_PATH, server.VyosLock(removeFirewallRulesHandler))
+	server.RegisterAsyncCommandHandler(FIREWALL_DEFAULT_RULE_PATH, server.VyosLock(setFirewallDefaultRuleHandler))
+	server.RegisterAsyncCommandHandler(FIREWALL_DESTROY_NIC_PATH, server.VyosLock(destroyNicFirewallHandler))
+	server.RegisterSyncCommandHandler(FIREWALL_SNAPSHOTS_PATH, listFirewallSnapshotsHandler)
+	server.RegisterAsyncCommandHandler(FIREWALL_ROLLBACK_PATH, server.VyosLock(rollbackFirewallHandler))
+	server.RegisterSyncCommandHandler(FIREWALL_CONFIRM_PATH, server.VyosLock(confirmFirewallHandler))
+}
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	FIREWALL_COUNTERS_PATH = "/firewall/counters"
+)
+
+type getFirewallCountersCmd struct {
+	// only return the rules never hit, useful to find dead rules
+	UnusedOnly bool `json:"unusedOnly"`
+}
+
+type getFirewallCountersRsp struct {
+	Rules  []utils.IptablesRuleCounter  `json:"rules"`
+	Groups []utils.IptablesGroupCounter `json:"groups"`
+}
+
+func getFirewallCountersHandler(ctx *server.CommandContext) interface{} {
+	cmd := &getFirewallCountersCmd{}
+	ctx.GetCommand(cmd)
+
+	counters, err := utils.GetIptablesRuleCounters(ctx.Context())
+	utils.PanicOnError(err)
+
+	rsp := getFirewallCountersRsp{Groups: utils.SumIptablesCountersByGroup(counters)}
+	if !cmd.UnusedOnly {
+		rsp.Rules = counters
+		return rsp
+	}
+
+	rsp.Rules = []utils.IptablesRuleCounter{}
+	for _, c := range counters {
+		if c.Packets == 0 {
+			rsp.Rules = append(rsp.Rules, c)
+		}
+	}
+	return rsp
+}
+
+type firewallCounterCollector struct {
+	packets *prometheus.Desc
+	bytes   *prometheus.Desc
+}
+
+func newFirewallCounterCollector() *firewallCounterCollector {
+	// the position of a rule changes whenever a rule is inserted before it, so
+	// it's not a label, the rules sharing a comment are summed instead
+	labels := []string{"table", "chain", "comment", "group"}
+	return &firewallCounterCollector{
+		packets: prometheus.NewDesc("baremetal_iptables_rule_packets_total",
+			"Packets matched by an iptables rule of the agent", labels, nil),
+		bytes: prometheus.NewDesc("baremetal_iptables_rule_bytes_total",
+			"Bytes matched by an iptables rule of the agent", labels, nil),
+	}
+}
+
+func (c *firewallCounterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.packets
+	ch <- c.bytes
+}
+
+func (c *firewallCounterCollector) Collect(ch chan<- prometheus.Metric) {
+	counters, err := utils.GetIptablesRuleCounters(context.Background())
+	if err != nil {
+		log.Warnf("unable to collect iptables counters: %s", err)
+		return
+	}
+
+	type ruleKey struct {
+		table, chain, comment, group string
+	}
+	keys := []ruleKey{}
+	sums := map[ruleKey]*utils.IptablesRuleCounter{}
+	for _, r := range counters {
+		k := ruleKey{r.Table, r.Chain, r.Comment, r.Group}
+		if sum, ok := sums[k]; ok {
+			sum.Packets += r.Packets
+			sum.Bytes += r.Bytes
+			continue
+		}
+		r := r
+		sums[k] = &r
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		r := sums[k]
+		labels := []string{k.table, k.chain, k.comment, k.group}
+		ch <- prometheus.MustNewConstMetric(c.packets, prometheus.CounterValue, float64(r.Packets), labels...)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, float64(r.Bytes), labels...)
+	}
+}
+
+func FirewallCountersEntryPoint() {
+	server.RegisterSyncCommandHandler(FIREWALL_COUNTERS_PATH, getFirewallCountersHandler)
+}
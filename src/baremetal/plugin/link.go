@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+)
+
+const (
+	LINK_ADD_PATH    = "/link/add"
+	LINK_REMOVE_PATH = "/link/remove"
+)
+
+type addLinkCmd struct {
+	Links []*utils.LinkSpec `json:"links"`
+}
+
+type removeLinkCmd struct {
+	Names []string `json:"names"`
+}
+
+// the links are added in order, so a vlan on a bond must be listed after the bond
+func addLinkHandler(ctx *server.CommandContext) interface{} {
+	cmd := &addLinkCmd{}
+	ctx.GetCommand(cmd)
+
+	for _, link := range cmd.Links {
+		utils.PanicOnError(link.Validate())
+	}
+	for _, link := range cmd.Links {
+		utils.PanicOnError(utils.AddLink(ctx.Context(), link))
+		ctx.Log().Debugf("added the %s link %s", link.Type, link.Name)
+	}
+	return nil
+}
+
+// the links are removed in the reverse order
+func removeLinkHandler(ctx *server.CommandContext) interface{} {
+	cmd := &removeLinkCmd{}
+	ctx.GetCommand(cmd)
+
+	for _, name := range cmd.Names {
+		utils.PanicOnError(utils.CheckLinkName(name))
+	}
+	for i := len(cmd.Names) - 1; i >= 0; i-- {
+		utils.PanicOnError(utils.DeleteLink(ctx.Context(), cmd.Names[i]))
+		ctx.Log().Debugf("removed the link %s", cmd.Names[i])
+	}
+	return nil
+}
+
+func LinkEntryPoint() {
+	server.RegisterAsyncCommandHandler(LINK_ADD_PATH, addLinkHandler)
+	server.RegisterAsyncCommandHandler(LINK_REMOVE_PATH, removeLinkHandler)
+}
@@ -0,0 +1,40 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+)
+
+const (
+	LOG_LEVEL_PATH = "/log/level"
+)
+
+// leave the level empty to only query the levels
+type setLogLevelCmd struct {
+	// utils.DEFAULT_LOG_SUBSYSTEM if it's empty
+	Subsystem string `json:"subsystem"`
+	Level     string `json:"level"`
+}
+
+type logLevelRsp struct {
+	Levels map[string]string `json:"levels"`
+}
+
+func setLogLevelHandler(ctx *server.CommandContext) interface{} {
+	cmd := &setLogLevelCmd{}
+	ctx.GetCommand(cmd)
+
+	if cmd.Level != "" {
+		subsystem := cmd.Subsystem
+		if subsystem == "" {
+			subsystem = utils.DEFAULT_LOG_SUBSYSTEM
+		}
+		utils.PanicOnError(utils.SetLogLevel(subsystem, cmd.Level))
+	}
+
+	return logLevelRsp{Levels: utils.GetLogLevels()}
+}
+
+func LogEntryPoint() {
+	server.RegisterSyncCommandHandler(LOG_LEVEL_PATH, setLogLevelHandler)
+}
@@ -0,0 +1,29 @@
+package plugin
+
+import (
+	"baremetal/server"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	PROMETHEUS_METRICS_PATH = "/metrics"
+)
+
+var prometheusCollectors = []prometheus.Collector{}
+
+// RegisterPrometheusCollector adds a collector exported by PROMETHEUS_METRICS_PATH,
+// plugins call it from their entry points before PrometheusEntryPoint runs
+func RegisterPrometheusCollector(c prometheus.Collector) {
+	prometheusCollectors = append(prometheusCollectors, c)
+}
+
+func PrometheusEntryPoint() {
+	RegisterPrometheusCollector(newFirewallCounterCollector())
+
+	for _, c := range prometheusCollectors {
+		prometheus.MustRegister(c)
+	}
+	server.RegisterRawHttpHandler(PROMETHEUS_METRICS_PATH, promhttp.Handler().ServeHTTP)
+}
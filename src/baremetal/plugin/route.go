@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+)
+
+const (
+	ROUTE_ADD_PATH          = "/route/add"
+	ROUTE_REMOVE_PATH       = "/route/remove"
+	ROUTE_LIST_PATH         = "/route/list"
+	POLICY_RULE_ADD_PATH    = "/route/rule/add"
+	POLICY_RULE_REMOVE_PATH = "/route/rule/remove"
+)
+
+type addRouteCmd struct {
+	Routes []utils.StaticRoute `json:"routes"`
+}
+
+type removeRouteCmd struct {
+	Routes []utils.StaticRoute `json:"routes"`
+}
+
+type addPolicyRuleCmd struct {
+	Rules []utils.PolicyRule `json:"rules"`
+}
+
+type removePolicyRuleCmd struct {
+	Priorities []int `json:"priorities"`
+}
+
+type listRouteRsp struct {
+	// the persisted routes and rules, they are reconciled when the agent starts
+	Routes []utils.StaticRoute `json:"routes"`
+	Rules  []utils.PolicyRule  `json:"rules"`
+	// the persisted routes and all rules in the kernel
+	KernelRoutes []utils.StaticRoute `json:"kernelRoutes"`
+	KernelRules  []utils.PolicyRule  `json:"kernelRules"`
+}
+
+func addRouteHandler(ctx *server.CommandContext) interface{} {
+	cmd := &addRouteCmd{}
+	ctx.GetCommand(cmd)
+
+	for i := range cmd.Routes {
+		utils.PanicOnError(cmd.Routes[i].Validate())
+	}
+	for _, r := range cmd.Routes {
+		utils.PanicOnError(utils.AddStaticRoute(ctx.Context(), r))
+		ctx.Log().Debugf("added the route %+v", r)
+	}
+	return nil
+}
+
+func removeRouteHandler(ctx *server.CommandContext) interface{} {
+	cmd := &removeRouteCmd{}
+	ctx.GetCommand(cmd)
+
+	for _, r := range cmd.Routes {
+		utils.PanicOnError(utils.DeleteStaticRoute(ctx.Context(), r))
+		ctx.Log().Debugf("removed the route %+v", r)
+	}
+	return nil
+}
+
+func addPolicyRuleHandler(ctx *server.CommandContext) interface{} {
+	cmd := &addPolicyRuleCmd{}
+	ctx.GetCommand(cmd)
+
+	for i := range cmd.Rules {
+		utils.PanicOnError(cmd.Rules[i].Validate())
+	}
+	for _, r := range cmd.Rules {
+		utils.PanicOnError(utils.AddPolicyRule(ctx.Context(), r))
+		ctx.Log().Debugf("added the policy rule %+v", r)
+	}
+	return nil
+}
+
+func removePolicyRuleHandler(ctx *server.CommandContext) interface{} {
+	cmd := &removePolicyRuleCmd{}
+	ctx.GetCommand(cmd)
+
+	for _, p := range cmd.Priorities {
+		utils.PanicOnError(utils.DeletePolicyRule(ctx.Context(), p))
+		ctx.Log().Debugf("removed the policy rule %d", p)
+	}
+	return nil
+}
+
+func listRouteHandler(ctx *server.CommandContext) interface{} {
+	config, err := utils.GetRouteConfig()
+	utils.PanicOnError(err)
+	routes, err := utils.ListKernelRoutes(ctx.Context())
+	utils.PanicOnError(err)
+	rules, err := utils.ListKernelPolicyRules(ctx.Context())
+	utils.PanicOnError(err)
+
+	return listRouteRsp{
+		Routes:       config.Routes,
+		Rules:        config.Rules,
+		KernelRoutes: routes,
+		KernelRules:  rules,
+	}
+}
+
+func RouteEntryPoint() {
+	server.RegisterAsyncCommandHandler(ROUTE_ADD_PATH, addRouteHandler)
+	server.RegisterAsyncCommandHandler(ROUTE_REMOVE_PATH, removeRouteHandler)
+	server.RegisterSyncCommandHandler(ROUTE_LIST_PATH, listRouteHandler)
+	server.RegisterAsyncCommandHandler(POLICY_RULE_ADD_PATH, addPolicyRuleHandler)
+	server.RegisterAsyncCommandHandler(POLICY_RULE_REMOVE_PATH, removePolicyRuleHandler)
+}
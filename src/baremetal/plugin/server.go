@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+	"os"
+	"time"
+)
+
+const (
+	SERVER_COMMANDS_PATH = "/server/commands"
+	SERVER_TASKS_PATH    = "/server/tasks"
+	SERVER_STATUS_PATH   = "/server/status"
+)
+
+var agentStartTime = time.Now()
+
+type serverCommandsRsp struct {
+	Commands []server.CommandInfo `json:"commands"`
+}
+
+// leave the task UUID empty to list all the tasks
+type serverTasksCmd struct {
+	TaskUuid string `json:"taskUuid"`
+}
+
+type serverTasksRsp struct {
+	Tasks []server.Task `json:"tasks"`
+}
+
+type serverStatusRsp struct {
+	Pid          int                   `json:"pid"`
+	Version      string                `json:"version"`
+	StartTime    time.Time             `json:"startTime"`
+	Uptime       string                `json:"uptime"`
+	Commands     int                   `json:"commands"`
+	RunningTasks int                   `json:"runningTasks"`
+	LogLevels    map[string]string     `json:"logLevels"`
+	Processes    []utils.ProcessStatus `json:"processes"`
+}
+
+func serverCommandsHandler(ctx *server.CommandContext) interface{} {
+	return serverCommandsRsp{Commands: server.Commands()}
+}
+
+func serverTasksHandler(ctx *server.CommandContext) interface{} {
+	cmd := &serverTasksCmd{}
+	ctx.GetCommand(cmd)
+
+	if cmd.TaskUuid == "" {
+		return serverTasksRsp{Tasks: server.Tasks()}
+	}
+
+	t := server.GetTask(cmd.TaskUuid)
+	utils.Assertf(t != nil, "no task[uuid:%s] found, it's unknown or dropped", cmd.TaskUuid)
+	return serverTasksRsp{Tasks: []server.Task{*t}}
+}
+
+func serverStatusHandler(ctx *server.CommandContext) interface{} {
+	running := 0
+	for _, t := range server.Tasks() {
+		if t.State == server.TASK_STATE_RUNNING {
+			running++
+		}
+	}
+
+	return serverStatusRsp{
+		Pid:          os.Getpid(),
+		Version:      VERSION,
+		StartTime:    agentStartTime,
+		Uptime:       time.Since(agentStartTime).Truncate(time.Second).String(),
+		Commands:     len(server.Commands()),
+		RunningTasks: running,
+		LogLevels:    utils.GetLogLevels(),
+		Processes:    utils.DefaultSupervisor.Status(),
+	}
+}
+
+func ServerEntryPoint() {
+	server.RegisterSyncCommandHandler(SERVER_COMMANDS_PATH, serverCommandsHandler)
+	server.RegisterSyncCommandHandler(SERVER_TASKS_PATH, serverTasksHandler)
+	server.RegisterSyncCommandHandler(SERVER_STATUS_PATH, serverStatusHandler)
+}
@@ -0,0 +1,22 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+)
+
+const (
+	SUPERVISOR_STATUS_PATH = "/supervisor/status"
+)
+
+type supervisorStatusRsp struct {
+	Processes []utils.ProcessStatus `json:"processes"`
+}
+
+func supervisorStatusHandler(ctx *server.CommandContext) interface{} {
+	return supervisorStatusRsp{Processes: utils.DefaultSupervisor.Status()}
+}
+
+func SupervisorEntryPoint() {
+	server.RegisterSyncCommandHandler(SUPERVISOR_STATUS_PATH, supervisorStatusHandler)
+}
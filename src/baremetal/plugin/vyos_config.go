@@ -0,0 +1,245 @@
+package plugin
+
+import (
+	"baremetal/server"
+	"baremetal/utils"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	VYOS_CONFIG_DIFF_PATH     = "/vyos/config/diff"
+	VYOS_CONFIG_ARCHIVES_PATH = "/vyos/config/archives"
+	VYOS_CONFIG_ARCHIVE_PATH  = "/vyos/config/archive"
+	VYOS_CONFIG_ROLLBACK_PATH = "/vyos/config/rollback"
+	VYOS_RULES_USAGE_PATH     = "/vyos/rules/utilization"
+	VYOS_CONFIG_EXPORT_PATH   = "/vyos/config/export"
+	VYOS_CONFIG_IMPORT_PATH   = "/vyos/config/import"
+
+	VYOS_CONFIG_FORMAT_TEXT = "text"
+	VYOS_CONFIG_FORMAT_SET  = "set"
+	VYOS_CONFIG_FORMAT_JSON = "json"
+
+	// the changes are always applied with commit-confirm, which counts in minutes
+	DEFAULT_VYOS_CONFIG_CONFIRM_TIMEOUT = 60
+)
+
+type diffVyosConfigCmd struct {
+	// the desired config in the format of showCfg
+	Config string `json:"config"`
+	// only compare the subtrees under the paths, e.g. "firewall" or "nat source",
+	// otherwise anything not in the config is deleted, so they are required by apply
+	Paths []string `json:"paths"`
+	Apply bool     `json:"apply"`
+	// the seconds of commit-confirm, the apply is rolled back if the agent is
+	// unreachable afterwards, DEFAULT_VYOS_CONFIG_CONFIRM_TIMEOUT if not set
+	ConfirmTimeout int `json:"confirmTimeout"`
+}
+
+type diffVyosConfigRsp struct {
+	Commands []string `json:"commands"`
+	Applied  bool     `json:"applied"`
+}
+
+func diffVyosConfigHandler(ctx *server.CommandContext) interface{} {
+	cmd := &diffVyosConfigCmd{}
+	ctx.GetCommand(cmd)
+
+	utils.Assert(cmd.Config != "", "config cannot be empty")
+	desired := server.NewParserFromConfiguration(cmd.Config).Tree
+	return syncVyosConfig(ctx, desired, cmd)
+}
+
+func syncVyosConfig(ctx *server.CommandContext, desired *server.VyosConfigTree, cmd *diffVyosConfigCmd) diffVyosConfigRsp {
+	tree := server.NewParserFromShowConfiguration(ctx.Context()).Tree
+
+	rsp := diffVyosConfigRsp{Commands: server.DiffVyosConfig(tree, desired, cmd.Paths...)}
+	if !cmd.Apply || len(rsp.Commands) == 0 {
+		return rsp
+	}
+
+	utils.Assert(len(cmd.Paths) != 0, "paths cannot be empty when applying, a whole config diff deletes everything missing in the config")
+	utils.PanicOnError(server.CheckVyosDiffDeletes(rsp.Commands))
+
+	ctx.Log().Debugf("apply %d vyos config changes", len(rsp.Commands))
+	tree.SetDiff(desired, cmd.Paths...)
+	applyVyosConfig(ctx, tree, cmd.ConfirmTimeout)
+	rsp.Applied = true
+	return rsp
+}
+
+// applyVyosConfig verifies, archives and rolls back the changes like any other
+// transactional apply, there is no plain commit
+func applyVyosConfig(ctx *server.CommandContext, tree *server.VyosConfigTree, confirmTimeout int) {
+	if confirmTimeout <= 0 {
+		confirmTimeout = DEFAULT_VYOS_CONFIG_CONFIRM_TIMEOUT
+	}
+	utils.PanicOnError(tree.ApplyTransaction(ctx.Context(), time.Duration(confirmTimeout)*time.Second))
+}
+
+type listVyosConfigArchivesRsp struct {
+	Archives []*server.VyosConfigArchive `json:"archives"`
+}
+
+type getVyosConfigArchiveCmd struct {
+	Id string `json:"id"`
+}
+
+type getVyosConfigArchiveRsp struct {
+	Archive *server.VyosConfigArchive `json:"archive"`
+}
+
+type rollbackVyosConfigCmd struct {
+	Id             string `json:"id"`
+	ConfirmTimeout int    `json:"confirmTimeout"`
+}
+
+type rollbackVyosConfigRsp struct {
+	Commands []string `json:"commands"`
+}
+
+func listVyosConfigArchivesHandler(ctx *server.CommandContext) interface{} {
+	archives, err := server.ListVyosConfigArchives()
+	utils.PanicOnError(err)
+	return listVyosConfigArchivesRsp{Archives: archives}
+}
+
+func getVyosConfigArchiveHandler(ctx *server.CommandContext) interface{} {
+	cmd := &getVyosConfigArchiveCmd{}
+	ctx.GetCommand(cmd)
+
+	utils.Assert(cmd.Id != "", "id cannot be empty")
+	archive, err := server.GetVyosConfigArchive(cmd.Id)
+	utils.PanicOnError(err)
+	return getVyosConfigArchiveRsp{Archive: archive}
+}
+
+func rollbackVyosConfigHandler(ctx *server.CommandContext) interface{} {
+	cmd := &rollbackVyosConfigCmd{}
+	ctx.GetCommand(cmd)
+
+	utils.Assert(cmd.Id != "", "id cannot be empty")
+	archive, err := server.GetVyosConfigArchive(cmd.Id)
+	utils.PanicOnError(err)
+
+	desired := server.NewParserFromConfiguration(archive.Config).Tree
+	tree := server.NewParserFromShowConfiguration(ctx.Context()).Tree
+	tree.SetDiff(desired)
+	utils.PanicOnError(server.CheckVyosDiffDeletes(tree.Commands()))
+	ctx.Log().Debugf("roll back vyos config to archive %s taken at %v", archive.Id, archive.Time)
+	applyVyosConfig(ctx, tree, cmd.ConfirmTimeout)
+	return rollbackVyosConfigRsp{Commands: tree.Commands()}
+}
+
+type vyosRuleChainUsage struct {
+	Chain  string                      `json:"chain"`
+	Ranges []server.VyosRuleRangeUsage `json:"ranges"`
+}
+
+type vyosRulesUsageRsp struct {
+	Chains []vyosRuleChainUsage `json:"chains"`
+}
+
+func vyosRulesUsageHandler(ctx *server.CommandContext) interface{} {
+	tree := server.NewParserFromShowConfiguration(ctx.Context()).Tree
+	rsp := vyosRulesUsageRsp{Chains: []vyosRuleChainUsage{
+		{Chain: "nat source", Ranges: tree.SnatRuleChain().Utilization()},
+		{Chain: "nat destination", Ranges: tree.DnatRuleChain().Utilization()},
+	}}
+
+	if names := tree.Get("firewall name"); names != nil {
+		for _, n := range names.ChildNodeKeys() {
+			// the firewall names are <nic>.<direction>
+			i := strings.LastIndex(n, ".")
+			if i < 0 {
+				continue
+			}
+			rsp.Chains = append(rsp.Chains, vyosRuleChainUsage{
+				Chain:  "firewall name " + n,
+				Ranges: tree.FirewallRuleChain(n[:i], n[i+1:]).Utilization(),
+			})
+		}
+	}
+
+	return rsp
+}
+
+type exportVyosConfigCmd struct {
+	Format string `json:"format"`
+}
+
+type exportVyosConfigRsp struct {
+	Format string `json:"format"`
+	// the config in text or set format
+	Config string `json:"config,omitempty"`
+	// the config in json format
+	Tree *server.VyosConfigTree `json:"tree,omitempty"`
+}
+
+// the config is in Config for the text and set formats, or in Tree for the json format
+type importVyosConfigCmd struct {
+	diffVyosConfigCmd
+	Format string          `json:"format"`
+	Tree   json.RawMessage `json:"tree"`
+}
+
+func exportVyosConfigHandler(ctx *server.CommandContext) interface{} {
+	cmd := &exportVyosConfigCmd{}
+	ctx.GetCommand(cmd)
+
+	rsp := exportVyosConfigRsp{Format: cmd.Format}
+	switch cmd.Format {
+	case VYOS_CONFIG_FORMAT_TEXT, "":
+		rsp.Format = VYOS_CONFIG_FORMAT_TEXT
+		rsp.Config = server.VyosShowConfiguration(ctx.Context())
+	case VYOS_CONFIG_FORMAT_SET:
+		rsp.Config = strings.Join(server.NewParserFromShowConfiguration(ctx.Context()).Tree.SetCommands(), "\n")
+	case VYOS_CONFIG_FORMAT_JSON:
+		rsp.Tree = server.NewParserFromShowConfiguration(ctx.Context()).Tree
+	default:
+		utils.Assertf(false, "unknown config format %s", cmd.Format)
+	}
+	return rsp
+}
+
+func importVyosConfigHandler(ctx *server.CommandContext) interface{} {
+	cmd := &importVyosConfigCmd{}
+	ctx.GetCommand(cmd)
+
+	var desired *server.VyosConfigTree
+	var err error
+	switch cmd.Format {
+	case VYOS_CONFIG_FORMAT_TEXT, "":
+		utils.Assert(cmd.Config != "", "config cannot be empty")
+		desired = server.NewParserFromConfiguration(cmd.Config).Tree
+	case VYOS_CONFIG_FORMAT_SET:
+		utils.Assert(cmd.Config != "", "config cannot be empty")
+		desired, err = server.ParseVyosSetCommands(cmd.Config)
+	case VYOS_CONFIG_FORMAT_JSON:
+		utils.Assert(len(cmd.Tree) != 0, "tree cannot be empty")
+		desired, err = server.ParseVyosConfigJson(cmd.Tree)
+	default:
+		utils.Assertf(false, "unknown config format %s", cmd.Format)
+	}
+	utils.PanicOnError(err)
+
+	return syncVyosConfig(ctx, desired, &cmd.diffVyosConfigCmd)
+}
+
+func VyosConfigEntryPoint() {
+	server.RegisterAsyncCommandHandler(VYOS_CONFIG_DIFF_PATH, server.VyosLock(diffVyosConfigHandler))
+	server.RegisterSyncCommandHandler(VYOS_CONFIG_ARCHIVES_PATH, listVyosConfigArchivesHandler)
+	server.RegisterSyncCommandHandler(VYOS_CONFIG_ARCHIVE_PATH, getVyosConfigArchiveHandler)
+	server.RegisterAsyncCommandHandler(VYOS_CONFIG_ROLLBACK_PATH, server.VyosLock(rollbackVyosConfigHandler))
+	server.RegisterSyncCommandHandler(VYOS_RULES_USAGE_PATH, vyosRulesUsageHandler)
+	server.RegisterSyncCommandHandler(VYOS_CONFIG_EXPORT_PATH, exportVyosConfigHandler)
+	server.RegisterAsyncCommandHandler(VYOS_CONFIG_IMPORT_PATH, server.VyosLock(importVyosConfigHandler))
+
+	// the configuration and the commands carry the passwords and keys
+	server.SetCommandSensitiveFields(VYOS_CONFIG_DIFF_PATH, "config", "commands")
+	server.SetCommandSensitiveFields(VYOS_CONFIG_ARCHIVE_PATH, "config")
+	server.SetCommandSensitiveFields(VYOS_CONFIG_ROLLBACK_PATH, "commands")
+	server.SetCommandSensitiveFields(VYOS_CONFIG_EXPORT_PATH, "config", "tree")
+	server.SetCommandSensitiveFields(VYOS_CONFIG_IMPORT_PATH, "config", "tree", "commands")
+}
@@ -2,10 +2,13 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 	"baremetal/utils"
@@ -14,6 +17,26 @@ import (
 	"github.com/pkg/errors"
 )
 
+// CallbackRetryPolicy posts the replies of async commands, it backs off so a
+// restarting management server is not hammered
+var CallbackRetryPolicy = &utils.RetryPolicy{
+	InitialDelay: time.Second,
+	Multiplier:   2,
+	MaxDelay:     30 * time.Second,
+	Jitter:       0.2,
+	MaxElapsed:   10 * time.Minute,
+	Retryable:    isCallbackRetryable,
+}
+
+// other client errors than timeout and throttling won't go away by retrying
+func isCallbackRetryable(err error) bool {
+	if he, ok := err.(*utils.HttpPostError); ok {
+		code := he.StatusCode()
+		return code < 400 || code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	return true
+}
+
 type commandHandlerWrap struct {
 	path    string
 	handler http.HandlerFunc
@@ -36,6 +59,9 @@ type CommandResponseHeader struct {
 type CommandContext struct {
 	responseWriter http.ResponseWriter
 	request        *http.Request
+	requestId      string
+	// carries the request ID, not canceled when the async command is acked
+	ctx context.Context
 }
 
 func (ctx *CommandContext) GetCommand(cmd interface{}) {
@@ -44,6 +70,31 @@ func (ctx *CommandContext) GetCommand(cmd interface{}) {
 	}
 }
 
+// RequestId returns the task UUID of the command, or the ID generated for a sync
+// command, it's in the logs of the command and the callback headers
+func (ctx *CommandContext) RequestId() string {
+	return ctx.requestId
+}
+
+// Context carries the request ID to the commands run for the request, pass it
+// to Command.Run and Bash.RunWithContext, and to the goroutines of the handler
+func (ctx *CommandContext) Context() context.Context {
+	if ctx.ctx == nil {
+		return context.Background()
+	}
+	return ctx.ctx
+}
+
+// Log returns the logger adding the request ID to the entries
+func (ctx *CommandContext) Log() *log.Entry {
+	return utils.RequestLogger(ctx.Context())
+}
+
+// requestLog returns the logger with the request ID set by the command handler
+func requestLog(req *http.Request) *log.Entry {
+	return log.WithField(utils.REQUEST_ID_FIELD, req.Header.Get(utils.HEADER_REQUEST_ID))
+}
+
 func (ctx *CommandContext) GetRemoteIp() (ip string) {
 	ip = ""
 	if tmp := ctx.request.RemoteAddr; tmp != "" {
@@ -60,19 +111,50 @@ var (
 	commandHandlers     map[string]*commandHandlerWrap = make(map[string]*commandHandlerWrap)
 	rawHandlers         map[string]http.HandlerFunc    = make(map[string]http.HandlerFunc)
 	commandOptions      Options
+	// the fields of the commands and their responses masked in the logs, see SetCommandSensitiveFields
+	commandSensitiveFields map[string][]string = make(map[string][]string)
+	// the host of the last async callback, it may be a baremetalctl on an
+	// operator's workstation, the management node is ManagementNodeIp
 	CALLBACK_IP         = ""
 	CURRENT_CALLBACK_IP = ""
+	managementNodeIp    = ""
 )
 
 const (
 	CALLBACK_URL = "callbackurl"
 	TASK_UUID    = "taskuuid"
+
+	// the deadline of each attempt to post the reply of an async command
+	CALLBACK_TIMEOUT = 30 * time.Second
 )
 
+// requestIdOf returns the task UUID of an async command, the request ID set by
+// the caller, or a new one
+func requestIdOf(req *http.Request) string {
+	if id := req.Header.Get(TASK_UUID); id != "" {
+		return id
+	}
+	if id := req.Header.Get(utils.HEADER_REQUEST_ID); id != "" {
+		return id
+	}
+	return utils.NewRequestId()
+}
+
 func SetOptions(o Options) {
 	commandOptions = o
 }
 
+// SetManagementNodeIp sets the management node from the agent config, the
+// callbacks of the async commands never change it
+func SetManagementNodeIp(ip string) {
+	managementNodeIp = ip
+}
+
+// ManagementNodeIp returns the management node the agent must keep reaching, or "" if it's not configured
+func ManagementNodeIp() string {
+	return managementNodeIp
+}
+
 func RegisterSyncCommandHandler(path string, chandler CommandHandler) {
 	registerCommandHandler(path, chandler, false)
 }
@@ -81,6 +163,13 @@ func RegisterAsyncCommandHandler(path string, chandler CommandHandler) {
 	registerCommandHandler(path, chandler, true)
 }
 
+// SetCommandSensitiveFields declares the JSON fields of the command on the path and
+// its response which are masked in the logs, in addition to the fields registered
+// by utils.RegisterSensitiveFields
+func SetCommandSensitiveFields(path string, fields ...string) {
+	commandSensitiveFields[path] = append(commandSensitiveFields[path], fields...)
+}
+
 func RegisterRawHttpHandler(path string, handler http.HandlerFunc) {
 	rawHandlers[path] = handler
 }
@@ -112,7 +201,8 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 			body = err.Error()
 		}
 
-		log.Debugf("[RESPONSE] to %v, status code: %v, body: %v", req.URL, statusCode, body)
+		requestLog(req).Debugf("[RESPONSE] to %v, status code: %v, body: %v", req.URL, statusCode, utils.RedactJson([]byte(body), commandSensitiveFields[path]...))
+		w.Header().Set(utils.HEADER_REQUEST_ID, req.Header.Get(utils.HEADER_REQUEST_ID))
 		w.WriteHeader(statusCode)
 		utils.LogError(fmt.Fprint(w, body))
 	}
@@ -120,13 +210,18 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 	asyncReply := func(rsp interface{}, req *http.Request) {
 		callbackURL := req.Header.Get(CALLBACK_URL)
 		taskUuid := req.Header.Get(TASK_UUID)
-		err := utils.Retry(func() error {
-			if e := utils.HttpPostForObject(callbackURL, map[string]string{
+		requestId := req.Header.Get(utils.HEADER_REQUEST_ID)
+		err := CallbackRetryPolicy.Do(context.Background(), func(ctx context.Context) error {
+			// a hung management server must not stall the reply, retry it instead
+			ctx, cancel := context.WithTimeout(ctx, CALLBACK_TIMEOUT)
+			defer cancel()
+			if e := utils.HttpPostForObjectWithContext(ctx, callbackURL, map[string]string{
 				TASK_UUID:                taskUuid,
+				utils.HEADER_REQUEST_ID:  requestId,
 				utils.HEADER_TRIGGER_URL: req.URL.String(),
 				utils.HEADER_ROUTERID:    utils.GetRouterid(),
-			}, rsp, nil); e != nil {
-				if he, ok := e.(utils.HttpPostError); ok {
+			}, rsp, nil, commandSensitiveFields[path]...); e != nil {
+				if he, ok := e.(*utils.HttpPostError); ok {
 					if he.StatusCode() == 404 {
 						// if a 404 error, that means the mgmt server has received
 						// a previous reply or has been timeout
@@ -138,14 +233,18 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 			} else {
 				return nil
 			}
-		}, 60, 1)
+		})
 		utils.LogError(err)
+		finishTask(taskUuid, rsp, err)
 	}
 
 	handler := func(w http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(utils.HEADER_REQUEST_ID)
 		ctx := &CommandContext{
 			responseWriter: w,
 			request:        req,
+			requestId:      requestId,
+			ctx:            utils.WithRequestId(context.Background(), requestId),
 		}
 
 		if !async {
@@ -157,9 +256,9 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 					}
 
 					if e, ok := err.(error); ok {
-						log.Warnf("%+v\n", errors.Wrap(e, fmt.Sprintf("command[path:%s] failed", path)))
+						ctx.Log().Warnf("%+v\n", errors.Wrap(e, fmt.Sprintf("command[path:%s] failed", path)))
 					} else {
-						log.Warnf("%+v\n", errors.Wrap(errors.New(err.(string)), fmt.Sprintf("command[path:%s] failed", path)))
+						ctx.Log().Warnf("%+v\n", errors.Wrap(errors.New(err.(string)), fmt.Sprintf("command[path:%s] failed", path)))
 					}
 
 					syncReply(reply, w, req)
@@ -174,6 +273,8 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 			return
 		}
 
+		startTask(req.Header.Get(TASK_UUID), path, ctx.requestId)
+
 		// reply first, and the response body is ignored
 		// this is an ack that we have received the request
 		syncReply("", w, req)
@@ -190,9 +291,9 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 					}
 
 					if e, ok := err.(error); ok {
-						log.Warnf("%+v\n", errors.Wrap(e, fmt.Sprintf("command[path:%s] failed", path)))
+						ctx.Log().Warnf("%+v\n", errors.Wrap(e, fmt.Sprintf("command[path:%s] failed", path)))
 					} else {
-						log.Warnf("%+v\n", errors.Wrap(errors.New(err.(string)), fmt.Sprintf("command[path:%s] failed", path)))
+						ctx.Log().Warnf("%+v\n", errors.Wrap(errors.New(err.(string)), fmt.Sprintf("command[path:%s] failed", path)))
 					}
 
 					asyncReply(reply, req)
@@ -209,10 +310,14 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 	}
 
 	w.handler = func(w http.ResponseWriter, req *http.Request) {
+		// the logs, commands and callback of the request carry the ID
+		requestId := requestIdOf(req)
+		req.Header.Set(utils.HEADER_REQUEST_ID, requestId)
+
 		// drain the body
 		body, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			log.Warnf("unable to dump the http request[url:%v], %v", req.URL, err)
+			requestLog(req).Warnf("unable to dump the http request[url:%v], %v", req.URL, err)
 
 			reply := CommandResponseHeader{
 				Success: false,
@@ -228,11 +333,11 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 			return
 		}
 
-		log.WithFields(log.Fields{
+		requestLog(req).WithFields(log.Fields{
 			CALLBACK_URL: req.Header.Get(CALLBACK_URL),
 			TASK_UUID:    req.Header.Get(TASK_UUID),
 			"Host":       req.Header.Get("Host"),
-		}).Debugf("[RECV] %v, body: %s", req.URL, string(body))
+		}).Debugf("[RECV] %v, body: %s", req.URL, utils.RedactJson(body, commandSensitiveFields[path]...))
 
 		// re-fill the body
 		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
@@ -247,6 +352,29 @@ func Start() {
 	startServer()
 }
 
+// CommandInfo describes a registered command
+type CommandInfo struct {
+	Path  string `json:"path"`
+	Async bool   `json:"async"`
+}
+
+// Commands returns the registered commands sorted by the paths
+func Commands() []CommandInfo {
+	var ret []CommandInfo
+	for path, w := range commandHandlers {
+		ret = append(ret, CommandInfo{Path: path, Async: w.async})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+	return ret
+}
+
+func isLoopbackIp(ip string) bool {
+	i := net.ParseIP(ip)
+	return i != nil && i.IsLoopback()
+}
+
 type dispatcher func(w http.ResponseWriter, req *http.Request)
 
 func (d dispatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -277,7 +405,6 @@ func dispatch(w http.ResponseWriter, req *http.Request) {
 
 	// async command
 	callbackURL := req.Header.Get(CALLBACK_URL)
-	CALLBACK_IP, _ = utils.GetIpFromUrl(callbackURL)
 	if callbackURL == "" {
 		err := fmt.Sprintf("no field '%s' found in the HTTP header but the plugin registers the path[%s]"+
 			" as an async command", CALLBACK_URL, path)
@@ -297,6 +424,11 @@ func dispatch(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// the local tools, e.g. baremetalctl, listen on the loopback
+	if ip, _ := utils.GetIpFromUrl(callbackURL); !isLoopbackIp(ip) {
+		CALLBACK_IP = ip
+	}
+
 	wrap.handler(w, req)
 }
 
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
 	"sync"
+	"time"
 	"baremetal/utils"
 
 	"github.com/Sirupsen/logrus"
@@ -14,6 +16,14 @@ import (
 var (
 	vyosScriptLock = &sync.Mutex{}
 	fileLockPath   = "/home/vyos/baremetal/.vyosfilelock"
+	// serializes every VyOS commit, it's separated from fileLockPath which is held
+	// through the whole command, so a commit inside a VyosLock command doesn't wait
+	// for itself. The init scripts should commit with 'flock /home/vyos/baremetal/.vyoscommitlock'
+	commitLockPath = "/home/vyos/baremetal/.vyoscommitlock"
+
+	// VyosScriptRunnerFunc runs the configure mode commands instead of VyOS
+	// if it's set, e.g. by VyosSimulator in tests
+	VyosScriptRunnerFunc func(ctx context.Context, commands string) error
 )
 
 /*
@@ -53,6 +63,11 @@ fi
 `
 */
 
+const (
+	VYOS_LOCK_TIMEOUT        = 5 * time.Minute
+	VYOS_COMMIT_LOCK_TIMEOUT = 2 * time.Minute
+)
+
 const vyosScriptTempl = `#!/bin/vbash
 source /opt/vyatta/etc/functions/script-template
 
@@ -92,11 +107,16 @@ func FindNicNameByMacFromConfiguration(mac, configuration string) (string, bool)
 	return "", false
 }
 
-func FindNicNameByMac(mac string) (string, bool) {
-	return FindNicNameByMacFromConfiguration(mac, VyosShowConfiguration())
+func FindNicNameByMac(ctx context.Context, mac string) (string, bool) {
+	return FindNicNameByMacFromConfiguration(mac, VyosShowConfiguration(ctx))
 }
 
-func RunVyosScriptAsUserVyos(command string) {
+func RunVyosScriptAsUserVyos(ctx context.Context, command string) {
+	if VyosScriptRunnerFunc != nil {
+		utils.PanicOnError(VyosScriptRunnerFunc(ctx, command+"\ncommit"))
+		return
+	}
+
 	template := vyosScriptTempl
 	command = fmt.Sprintf(template, command)
 	tmpfile, err := ioutil.TempFile("", "zvr")
@@ -107,35 +127,66 @@ func RunVyosScriptAsUserVyos(command string) {
 	utils.PanicOnError(err)
 	tmpfile.Sync()
 	tmpfile.Close()
-	logrus.Debugf("[Configure VYOS]: %s\n", command)
+	secrets := VyosCommandSecrets(command)
+	logrus.Debugf("[Configure VYOS]: %s\n", utils.RedactSecrets(command, secrets...))
 	bash := utils.Bash{
 		Command: fmt.Sprintf(`chown vyos:users %s; chmod +x %s; su - vyos -c %v`, tmpfile.Name(), tmpfile.Name(), tmpfile.Name()),
+		Secrets: secrets,
 	}
-	bash.Run()
+	utils.PanicOnError(withVyosCommitLock(func() error {
+		bash.RunWithContext(ctx)
+		return nil
+	}))
 	bash.PanicIfError()
 }
 
-func RunVyosScript(command string, args map[string]string) {
+func RunVyosScript(ctx context.Context, command string, args map[string]string) {
+	if VyosScriptRunnerFunc != nil {
+		utils.PanicOnError(VyosScriptRunnerFunc(ctx, command+"\ncommit"))
+		return
+	}
+
 	template := vyosScriptTempl
+	secrets := VyosCommandSecrets(command)
 	bash := &utils.Bash{
 		Command:   fmt.Sprintf(template, command),
 		Arguments: args,
 		NoLog:     true,
 		UseTemp:   true,
+		Secrets:   secrets,
 	}
-	logrus.Debugf("[Configure VYOS]: %s\n", command)
-	bash.Run()
+	logrus.Debugf("[Configure VYOS]: %s\n", utils.RedactSecrets(command, secrets...))
+	utils.PanicOnError(withVyosCommitLock(func() error {
+		bash.RunWithContext(ctx)
+		return nil
+	}))
 	bash.PanicIfError()
 }
 
+func withVyosCommitLock(fn func() error) error {
+	return utils.WithFileLock(commitLockPath, VYOS_COMMIT_LOCK_TIMEOUT, fn)
+}
+
+// lockVyos serializes the commands in the agent by vyosScriptLock, and with other
+// processes, e.g. a second agent, by fileLockPath
+func lockVyos() func() {
+	vyosScriptLock.Lock()
+	vyosFileLock, err := utils.LockFileExclTimeout(fileLockPath, VYOS_LOCK_TIMEOUT)
+	if err != nil {
+		vyosScriptLock.Unlock()
+		panic(err)
+	}
+
+	return func() {
+		utils.LogError(vyosFileLock.Unlock())
+		vyosScriptLock.Unlock()
+	}
+}
+
 func VyosLock(fn CommandHandler) CommandHandler {
 	return func(ctx *CommandContext) interface{} {
-		vyosScriptLock.Lock()
-		defer vyosScriptLock.Unlock()
-
-		if vyosFileLock, err := utils.LockFileExcl(fileLockPath); err == nil {
-			defer vyosFileLock.Unlock()
-		}
+		unlock := lockVyos()
+		defer unlock()
 
 		return fn(ctx)
 	}
@@ -143,12 +194,8 @@ func VyosLock(fn CommandHandler) CommandHandler {
 
 func VyosLockInterface(fn func()) func() {
 	return func() {
-		vyosScriptLock.Lock()
-		defer vyosScriptLock.Unlock()
-
-		if vyosFileLock, err := utils.LockFileExcl(fileLockPath); err == nil {
-			defer vyosFileLock.Unlock()
-		}
+		unlock := lockVyos()
+		defer unlock()
 
 		fn()
 	}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"context"
 	"testing"
 	"baremetal/utils"
 )
 
 func TestFindNicNameByMac(t *testing.T) {
+	ctx := context.Background()
 	text := `
 interfaces {
     ethernet eth0 {
@@ -25,19 +27,19 @@ interfaces {
     loopback lo {
     }
 }`
-	ConfigurationSourceFunc = func() string {
+	ConfigurationSourceFunc = func(ctx context.Context) string {
 		return text
 	}
 
-	name, ok := FindNicNameByMac("fa:da:21:1f:1a:00")
+	name, ok := FindNicNameByMac(ctx, "fa:da:21:1f:1a:00")
 	utils.Assert(ok, "not found")
 	utils.Assert("eth0" == name, "fa:da:21:1f:1a:00 mismatch")
 
-	name, ok = FindNicNameByMac("fa:da:21:1f:1a:11")
+	name, ok = FindNicNameByMac(ctx, "fa:da:21:1f:1a:11")
 	utils.Assert(ok, "not found")
 	utils.Assert("eth1" == name, "fa:da:21:1f:1a:11 mismatch")
 
-	name, ok = FindNicNameByMac("fa:da:21:1f:fa:11")
+	name, ok = FindNicNameByMac(ctx, "fa:da:21:1f:fa:11")
 	utils.Assert(!ok, "wrong found")
 }
 
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TASK_STATE_RUNNING   = "running"
+	TASK_STATE_SUCCEEDED = "succeeded"
+	TASK_STATE_FAILED    = "failed"
+
+	// the finished tasks kept for the inspection, the oldest are dropped
+	MAX_FINISHED_TASKS = 200
+)
+
+// Task is an async command, from receiving it to posting its reply
+type Task struct {
+	TaskUuid  string    `json:"taskUuid"`
+	Path      string    `json:"path"`
+	RequestId string    `json:"requestId"`
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime,omitempty"`
+	// why the reply was not posted to the callback URL
+	CallbackError string `json:"callbackError,omitempty"`
+}
+
+var (
+	tasks         = map[string]*Task{}
+	finishedTasks []string
+	tasksLock     sync.Mutex
+)
+
+func startTask(taskUuid string, path string, requestId string) {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+	// a task re-sent after it finished is running again, it's added back to
+	// finishedTasks when it finishes
+	if t, ok := tasks[taskUuid]; ok && t.State != TASK_STATE_RUNNING {
+		for i, id := range finishedTasks {
+			if id == taskUuid {
+				finishedTasks = append(finishedTasks[:i], finishedTasks[i+1:]...)
+				break
+			}
+		}
+	}
+	tasks[taskUuid] = &Task{
+		TaskUuid:  taskUuid,
+		Path:      path,
+		RequestId: requestId,
+		State:     TASK_STATE_RUNNING,
+		StartTime: time.Now(),
+	}
+}
+
+func finishTask(taskUuid string, rsp interface{}, callbackErr error) {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+	t, ok := tasks[taskUuid]
+	if !ok || t.State != TASK_STATE_RUNNING {
+		return
+	}
+
+	t.State = TASK_STATE_SUCCEEDED
+	if h, ok := rsp.(CommandResponseHeader); ok && !h.Success {
+		t.State = TASK_STATE_FAILED
+		t.Error = h.Error
+	}
+	if callbackErr != nil {
+		t.CallbackError = callbackErr.Error()
+	}
+	t.EndTime = time.Now()
+
+	finishedTasks = append(finishedTasks, taskUuid)
+	for len(finishedTasks) > MAX_FINISHED_TASKS {
+		delete(tasks, finishedTasks[0])
+		finishedTasks = finishedTasks[1:]
+	}
+}
+
+// GetTask returns a copy of the running or recently finished task, or nil
+func GetTask(taskUuid string) *Task {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+	if t, ok := tasks[taskUuid]; ok {
+		c := *t
+		return &c
+	}
+	return nil
+}
+
+// Tasks returns the running and recently finished tasks, the latest first
+func Tasks() []Task {
+	tasksLock.Lock()
+	ret := make([]Task, 0, len(tasks))
+	for _, t := range tasks {
+		ret = append(ret, *t)
+	}
+	tasksLock.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].StartTime.After(ret[j].StartTime)
+	})
+	return ret
+}
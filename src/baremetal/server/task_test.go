@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"baremetal/utils"
+)
+
+func TestTaskTracking(t *testing.T) {
+	startTask("task-ok", "/test/ok", "req-ok")
+	time.Sleep(time.Millisecond)
+	startTask("task-failed", "/test/failed", "req-failed")
+
+	task := GetTask("task-ok")
+	utils.Assert(task != nil && task.State == TASK_STATE_RUNNING, "running")
+
+	finishTask("task-ok", CommandResponseHeader{Success: true}, nil)
+	finishTask("task-failed", CommandResponseHeader{Success: false, Error: "on purpose"}, fmt.Errorf("callback failed"))
+	// a reply is tracked once
+	finishTask("task-ok", CommandResponseHeader{Success: false}, nil)
+
+	task = GetTask("task-ok")
+	utils.Assertf(task.State == TASK_STATE_SUCCEEDED && !task.EndTime.IsZero(), "unexpected task %+v", task)
+	task = GetTask("task-failed")
+	utils.Assertf(task.State == TASK_STATE_FAILED && task.Error == "on purpose" && task.CallbackError == "callback failed",
+		"unexpected task %+v", task)
+
+	list := Tasks()
+	utils.Assertf(len(list) >= 2 && list[0].TaskUuid == "task-failed", "the latest first, %+v", list)
+
+	// a re-sent task is tracked once
+	startTask("task-failed", "/test/failed", "req-resent")
+	utils.Assert(GetTask("task-failed").State == TASK_STATE_RUNNING, "running again")
+	finishTask("task-failed", nil, nil)
+	count := 0
+	for _, id := range finishedTasks {
+		if id == "task-failed" {
+			count++
+		}
+	}
+	utils.Assertf(count == 1, "task-failed is in the finished tasks %d times", count)
+
+	for i := 0; i < MAX_FINISHED_TASKS; i++ {
+		id := fmt.Sprintf("task-%d", i)
+		startTask(id, "/test", id)
+		finishTask(id, nil, nil)
+	}
+	utils.Assert(GetTask("task-ok") == nil, "the oldest finished tasks are dropped")
+	utils.Assert(GetTask(fmt.Sprintf("task-%d", MAX_FINISHED_TASKS-1)) != nil, "the latest are kept")
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"baremetal/utils"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type vyosConfigDiff struct {
+	deletes []string
+	sets    []string
+}
+
+func (d *vyosConfigDiff) delete(n *VyosConfigNode) {
+	d.deletes = append(d.deletes, fmt.Sprintf("delete %s", n.String()))
+}
+
+func (d *vyosConfigDiff) set(n *VyosConfigNode) {
+	for _, c := range n.FullString() {
+		d.sets = append(d.sets, fmt.Sprintf("set %s", c))
+	}
+}
+
+// the order of children is not compared, VyOS orders the rules by number
+// rather than by the order they are set. A changed leaf value is deleted
+// before the new one is set because the leaf may be a multi-value one
+func (d *vyosConfigDiff) diff(current, desired *VyosConfigNode) {
+	for _, c := range current.children {
+		if desired.getNode(c.name) == nil {
+			d.delete(c)
+		}
+	}
+
+	for _, c := range desired.children {
+		cc := current.getNode(c.name)
+		if cc == nil {
+			d.set(c)
+		} else if !c.isValueNode() || !cc.isValueNode() {
+			d.diff(cc, c)
+		}
+	}
+}
+
+func (d *vyosConfigDiff) commands() []string {
+	return append(d.deletes, d.sets...)
+}
+
+// DiffVyosConfig returns the set/delete commands turning the current config into
+// the desired one, all deletes come before the sets. If paths are given only the
+// subtrees under them (e.g. "firewall", "nat source") are compared
+func DiffVyosConfig(current, desired *VyosConfigTree, paths ...string) []string {
+	current.init()
+	desired.init()
+
+	d := &vyosConfigDiff{deletes: make([]string, 0), sets: make([]string, 0)}
+	if len(paths) == 0 {
+		d.diff(current.Root, desired.Root)
+		return d.commands()
+	}
+
+	for _, p := range paths {
+		cn := current.Get(p)
+		dn := desired.Get(p)
+		if cn == nil && dn != nil {
+			d.set(dn)
+		} else if cn != nil && dn == nil {
+			d.delete(cn)
+		} else if cn != nil && dn != nil {
+			d.diff(cn, dn)
+		}
+	}
+
+	return d.commands()
+}
+
+// SetDiff records the commands turning the tree into the desired one,
+// which are run by Apply, it returns false if there is no difference
+func (t *VyosConfigTree) SetDiff(desired *VyosConfigTree, paths ...string) bool {
+	commands := DiffVyosConfig(t, desired, paths...)
+	t.changeCommands = append(t.changeCommands, commands...)
+	return len(commands) != 0
+}
+
+// the config the agent is reached through, a diff deleting it would cut the
+// agent off
+var vyosProtectedConfig = []string{
+	"interfaces ethernet " + utils.MANAGEMENT_NIC_NAME,
+	"service ssh",
+}
+
+// CheckVyosDiffDeletes refuses the commands deleting the management nic or the
+// ssh config, or any of their parents
+func CheckVyosDiffDeletes(commands []string) error {
+	for _, c := range commands {
+		if !strings.HasPrefix(c, "delete ") {
+			continue
+		}
+		path := strings.TrimPrefix(c, "delete ")
+		for _, p := range vyosProtectedConfig {
+			if p == path || strings.HasPrefix(p, path+" ") {
+				return errors.Errorf("refuse to %s, the agent is reached through %s", c, p)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"baremetal/utils"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const vyosDiffCurrentConfig = `
+interfaces {
+    ethernet eth0 {
+        address 10.0.0.1/24
+        address 10.0.1.1/24
+        description "old port"
+    }
+    loopback lo {
+    }
+}
+nat {
+    source {
+        rule 100 {
+            outbound-interface eth0
+            translation {
+                address masquerade
+            }
+        }
+        rule 101 {
+            outbound-interface eth0
+            exclude
+        }
+    }
+}
+`
+
+const vyosDiffDesiredConfig = `
+interfaces {
+    loopback lo {
+    }
+    ethernet eth0 {
+        address 10.0.1.1/24
+        address 10.0.2.1/24
+        description "new port"
+    }
+}
+nat {
+    source {
+        rule 101 {
+            outbound-interface eth0
+            exclude
+        }
+        rule 102 {
+            outbound-interface eth1
+        }
+    }
+}
+service {
+    ssh {
+        port 22
+    }
+}
+`
+
+func TestVyosDiff(t *testing.T) {
+	current := NewParserFromConfiguration(vyosDiffCurrentConfig).Tree
+	desired := NewParserFromConfiguration(vyosDiffDesiredConfig).Tree
+
+	commands := DiffVyosConfig(current, desired)
+	expected := []string{
+		`delete interfaces ethernet eth0 address 10.0.0.1/24`,
+		`delete interfaces ethernet eth0 description "old port"`,
+		`delete nat source rule 100`,
+		`set interfaces ethernet eth0 address 10.0.2.1/24`,
+		`set interfaces ethernet eth0 description "new port"`,
+		`set nat source rule 102 outbound-interface eth1`,
+		`set service ssh port 22`,
+	}
+	utils.Assert(strings.Join(commands, "\n") == strings.Join(expected, "\n"), strings.Join(commands, "\n"))
+
+	utils.Assert(len(DiffVyosConfig(current, current)) == 0, "no diff to itself")
+	utils.Assert(len(DiffVyosConfig(desired, NewParserFromConfiguration(vyosDiffDesiredConfig).Tree)) == 0, "no diff to the same")
+
+	commands = DiffVyosConfig(current, desired, "nat source", "service", "system")
+	utils.Assert(len(commands) == 3, fmt.Sprint(commands))
+	utils.Assert(commands[0] == "delete nat source rule 100", commands[0])
+	utils.Assert(commands[2] == "set service ssh port 22", commands[2])
+
+	commands = DiffVyosConfig(current, desired, "interfaces loopback")
+	utils.Assert(len(commands) == 0, fmt.Sprint(commands))
+}
+
+func TestVyosSetDiff(t *testing.T) {
+	current := NewParserFromConfiguration(vyosDiffCurrentConfig).Tree
+	desired := NewParserFromConfiguration(vyosDiffDesiredConfig).Tree
+
+	utils.Assert(current.SetDiff(desired, "nat"), "has diff")
+	utils.Assert(current.CommandsAsString() == "delete nat source rule 100\nset nat source rule 102 outbound-interface eth1",
+		current.CommandsAsString())
+	utils.Assert(!desired.SetDiff(desired), "no diff")
+}
+
+func TestCheckVyosDiffDeletes(t *testing.T) {
+	for _, c := range []string{"delete interfaces ethernet eth0", "delete interfaces", "delete service ssh", "delete service"} {
+		utils.Assert(CheckVyosDiffDeletes([]string{"set firewall name a", c}) != nil, c)
+	}
+	utils.Assert(CheckVyosDiffDeletes([]string{"delete interfaces ethernet eth0 address 10.0.0.1/24",
+		"delete interfaces ethernet eth1", "delete service ssh2", "set service ssh port 22"}) == nil, "allowed")
+}
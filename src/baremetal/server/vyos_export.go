@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MarshalJSON converts the tree into nested objects keeping the order of nodes, a leaf
+// with one value is a string, a leaf with several values is an array and a node
+// without any child (e.g. "exclude") is an empty object
+func (t *VyosConfigTree) MarshalJSON() ([]byte, error) {
+	t.init()
+	buf := &bytes.Buffer{}
+	if err := marshalVyosNode(t.Root, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func marshalVyosNode(n *VyosConfigNode, buf *bytes.Buffer) error {
+	buf.WriteString("{")
+	for i, c := range n.children {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+
+		name, err := json.Marshal(c.name)
+		if err != nil {
+			return err
+		}
+		buf.Write(name)
+		buf.WriteString(":")
+
+		var value []byte
+		if c.isValueNode() {
+			value = []byte("{}")
+		} else if c.Size() == c.ValueSize() && c.Size() == 1 {
+			value, err = json.Marshal(c.Values()[0])
+		} else if c.Size() == c.ValueSize() {
+			value, err = json.Marshal(c.Values())
+		} else {
+			err = marshalVyosNode(c, buf)
+		}
+		if err != nil {
+			return err
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}")
+	return nil
+}
+
+// ParseVyosConfigJson is the reverse of VyosConfigTree.MarshalJSON
+func ParseVyosConfigJson(data []byte) (*VyosConfigTree, error) {
+	tree := &VyosConfigTree{}
+	tree.init()
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := expectJsonDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	if err := unmarshalVyosNode(dec, tree.Root); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the vyos config json")
+	}
+	return tree, nil
+}
+
+func expectJsonDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return errors.Errorf("expect %v but %v got", delim, tok)
+	}
+	return nil
+}
+
+func jsonScalar(tok json.Token) (string, error) {
+	switch v := tok.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", errors.Errorf("unexpected %v", tok)
+	}
+}
+
+// the opening { of the node has been consumed
+func unmarshalVyosNode(dec *json.Decoder, n *VyosConfigNode) error {
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		c := n.addNode(tok.(string))
+
+		if tok, err = dec.Token(); err != nil {
+			return err
+		}
+
+		if d, ok := tok.(json.Delim); ok && d == '{' {
+			if err := unmarshalVyosNode(dec, c); err != nil {
+				return err
+			}
+		} else if ok && d == '[' {
+			for dec.More() {
+				if tok, err = dec.Token(); err != nil {
+					return err
+				}
+				v, err := jsonScalar(tok)
+				if err != nil {
+					return err
+				}
+				c.addNode(v)
+			}
+			if err := expectJsonDelim(dec, ']'); err != nil {
+				return err
+			}
+		} else {
+			v, err := jsonScalar(tok)
+			if err != nil {
+				return err
+			}
+			c.addNode(v)
+		}
+	}
+
+	return expectJsonDelim(dec, '}')
+}
+
+// SetCommands returns the "set ..." commands creating the tree
+func (t *VyosConfigTree) SetCommands() []string {
+	t.init()
+	commands := make([]string, 0)
+	for _, l := range t.Root.FullString() {
+		commands = append(commands, fmt.Sprintf("set %s", l))
+	}
+	return commands
+}
+
+// ParseVyosSetCommands is the reverse of VyosConfigTree.SetCommands, empty lines
+// and lines starting with # are ignored
+func ParseVyosSetCommands(text string) (tree *VyosConfigTree, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("unable to parse the set commands: %v", r)
+		}
+	}()
+
+	tree = &VyosConfigTree{}
+	tree.init()
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ws := splitVyosPath(line)
+		if ws[0] != "set" || len(ws) < 2 {
+			return nil, errors.Errorf("line %d is not a set command: %s", i+1, line)
+		}
+		tree.AddValue(joinVyosPath(ws[1:]))
+	}
+
+	tree.changeCommands = make([]string, 0)
+	return tree, nil
+}
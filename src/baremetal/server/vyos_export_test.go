@@ -0,0 +1,52 @@
+package server
+
+import (
+	"baremetal/utils"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestVyosExportJson(t *testing.T) {
+	tree := NewParserFromConfiguration(vyosDiffCurrentConfig).Tree
+	tree.Set(`system login banner pre-login "say \"hi\""`)
+
+	data, err := json.Marshal(tree)
+	utils.PanicOnError(err)
+	expected := `{"interfaces":{"ethernet":{"eth0":{"address":["10.0.0.1/24","10.0.1.1/24"],"description":"old port"}},"loopback":"lo"},` +
+		`"nat":{"source":{"rule":{"100":{"outbound-interface":"eth0","translation":{"address":"masquerade"}},"101":{"outbound-interface":"eth0","exclude":{}}}}},` +
+		`"system":{"login":{"banner":{"pre-login":"say \"hi\""}}}}`
+	utils.Assert(string(data) == expected, string(data))
+
+	parsed, err := ParseVyosConfigJson(data)
+	utils.PanicOnError(err)
+	utils.Assert(parsed.String() == tree.String(), parsed.String())
+	utils.Assert(len(DiffVyosConfig(tree, parsed)) == 0, "no diff")
+
+	parsed, err = ParseVyosConfigJson([]byte(`{"service":{"ssh":{"port":22,"disable-host-validation":{}}}}`))
+	utils.PanicOnError(err)
+	utils.Assert(parsed.Get("service ssh port").Value() == "22", parsed.String())
+	utils.Assert(parsed.Get("service ssh disable-host-validation") != nil, parsed.String())
+
+	for _, bad := range []string{`[]`, `{"a":null}`, `{"a":{"b":[{}]}}`, `{"a":`} {
+		_, err = ParseVyosConfigJson([]byte(bad))
+		utils.Assertf(err != nil, "%s should fail", bad)
+	}
+}
+
+func TestVyosExportSetCommands(t *testing.T) {
+	tree := NewParserFromConfiguration(vyosDiffCurrentConfig).Tree
+	commands := tree.SetCommands()
+	utils.Assert(commands[0] == "set interfaces ethernet eth0 address 10.0.0.1/24", commands[0])
+	utils.Assert(commands[2] == `set interfaces ethernet eth0 description "old port"`, commands[2])
+
+	parsed, err := ParseVyosSetCommands("# saved by ops\n\n" + strings.Join(commands, "\n"))
+	utils.PanicOnError(err)
+	utils.Assert(parsed.String() == tree.String(), parsed.String())
+	utils.Assert(!parsed.HasChanges(), parsed.CommandsAsString())
+
+	_, err = ParseVyosSetCommands("delete nat")
+	utils.Assert(err != nil, "delete is not allowed")
+	_, err = ParseVyosSetCommands(`set system host-name "x`)
+	utils.Assert(err != nil, "unterminated quote")
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"baremetal/utils"
+	"context"
+	"strconv"
+	"strings"
+)
+
+// ResetVyos deletes the configuration of the ethernet interfaces when the vyos
+// boots, see ResetEthernetInterfaces
+func ResetVyos(ctx context.Context) {
+	tree := NewParserFromShowConfiguration(ctx).Tree
+	tree.ResetEthernetInterfaces()
+	tree.Apply(ctx, true)
+}
+
+// SetBootstrapConfig sets the vyos configuration of the bootstrap info: the ssh
+// key and port, the ethernet nics and their firewall, and the routes. The virtual
+// links and their firewall are not known by the vyos and are left to the caller.
+// The default route nic and gateway are returned if the vyos firewall is used
+func (t *VyosConfigTree) SetBootstrapConfig(info *utils.BootstrapInfo, setPassword bool) (defaultNic, defaultGW string) {
+	sshtype, key, id := info.SshKey()
+	t.Setf("system login user vyos authentication public-keys %s key %s", id, key)
+	t.Setf("system login user vyos authentication public-keys %s type %s", id, sshtype)
+
+	setNic := func(nic *utils.BootstrapNic) {
+		if nic.IsDefaultRoute {
+			t.Setf("protocols static route 0.0.0.0/0 next-hop %s", nic.Gateway)
+		}
+
+		// the address and mtu of a virtual link have been set when creating it
+		if nic.Link() != nil {
+			return
+		}
+
+		t.Setf("interfaces ethernet %s address %s", nic.Name, nic.Cidr())
+		t.Setf("interfaces ethernet %s duplex auto", nic.Name)
+		t.Setf("interfaces ethernet %s speed auto", nic.Name)
+		// set arp_ignore see https://phabricator.vyos.net/T300
+		t.Setf("interfaces ethernet %s ip enable-arp-ignore", nic.Name)
+		if nic.Mtu != 0 {
+			t.Setf("interfaces ethernet %s mtu %d", nic.Name, nic.Mtu)
+		}
+	}
+
+	t.Setf("service ssh port %v", info.SshPort)
+	t.Setf("service ssh listen-address %v", info.ManagementNic.Ip)
+
+	for _, nic := range info.Nics() {
+		setNic(nic)
+		if info.SkipVyosIptables {
+			continue
+		}
+		if nic.IsDefaultRoute {
+			defaultGW = nic.Gateway
+			defaultNic = nic.Name
+		}
+		if nic.Link() == nil {
+			t.SetNicDefaultFirewall(nic.Name, nic.Ip, nic.IsPrivate(), info.SshPort)
+		}
+	}
+
+	t.Set("system time-zone Asia/Shanghai")
+
+	if setPassword {
+		t.Setf("system login user vyos authentication plaintext-password %v", info.VyosPassword)
+	}
+
+	for _, r := range info.Routes {
+		if r.NextHop != "" {
+			t.Setf("protocols static route %s next-hop %s", r.Destination, r.NextHop)
+		} else {
+			t.Setf("protocols static interface-route %s next-hop-interface %s", r.Destination, r.Nic)
+		}
+	}
+
+	return defaultNic, defaultGW
+}
+
+// ResetEthernetInterfaces deletes the configuration of all ethernet interfaces but
+// their hw-id, in case someone saved the configuration manually before, the vyos
+// must be stateless
+func (t *VyosConfigTree) ResetEthernetInterfaces() {
+	keyNode := t.Get("interfaces ethernet")
+	if keyNode == nil {
+		return
+	}
+
+	for _, node := range keyNode.Children() {
+		for _, eth := range node.Children() {
+			str := eth.String()
+			if !strings.Contains(str, "hw-id") {
+				t.Delete(str)
+			}
+		}
+	}
+}
+
+// SetNicDefaultFirewall sets the firewall of a nic when the vyos boots, ssh is
+// only allowed on eth0, a private nic accepts all incoming traffic
+func (t *VyosConfigTree) SetNicDefaultFirewall(nicname, ip string, private bool, sshPort int) {
+	t.SetFirewallRule(nicname, "local", &VyosFirewallRule{
+		Action:             "accept",
+		States:             []string{"established", "related"},
+		DestinationAddress: ip,
+	})
+	t.SetFirewallRule(nicname, "local", &VyosFirewallRule{
+		Action:             "accept",
+		Protocol:           "icmp",
+		DestinationAddress: ip,
+	})
+
+	if private {
+		t.SetFirewallRule(nicname, "in", &VyosFirewallRule{
+			Action: "accept",
+			States: []string{"established", "related", "invalid", "new"},
+		})
+	} else {
+		t.SetFirewallRule(nicname, "in", &VyosFirewallRule{
+			Action: "accept",
+			States: []string{"established", "related"},
+		})
+	}
+
+	t.SetFirewallRule(nicname, "in", &VyosFirewallRule{
+		Number: VYOS_FIREWALL_RESERVED_RULE_NUMBER,
+		Action: "accept",
+		States: []string{"new"},
+	})
+	t.SetFirewallRule(nicname, "in", &VyosFirewallRule{Action: "accept", Protocol: "icmp"})
+
+	sshAction := "reject"
+	if nicname == "eth0" {
+		sshAction = "accept"
+	}
+	t.SetFirewallRule(nicname, "local", &VyosFirewallRule{
+		Action:             sshAction,
+		Protocol:           "tcp",
+		DestinationAddress: ip,
+		DestinationPort:    strconv.Itoa(sshPort),
+	})
+
+	t.SetFirewallDefaultAction(nicname, "local", "reject")
+	t.SetFirewallDefaultAction(nicname, "in", "reject")
+
+	t.AttachFirewallToInterface(nicname, "local")
+	t.AttachFirewallToInterface(nicname, "in")
+}
@@ -1,10 +1,11 @@
 package server
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode"
 	"baremetal/utils"
 
 	log "github.com/Sirupsen/logrus"
@@ -31,6 +32,88 @@ var (
 	UNIT_TEST = false
 )
 
+// characters needing the value to be quoted when it's put back into a command,
+// the commands are run by bash so the value is double quoted with escapes
+const vyosSpecialChars = " \t\n\"'\\$`;&|<>(){}*?#!~"
+
+// tokenize the output of showCfg or a set/delete path, a token is either
+// a word separated by spaces or a single/double quoted string in which
+// backslash escapes the next character (only in double quotes). Comments
+// like "/* Warning: Do not remove the following line. */" are dropped,
+// newlines are kept as "\n" tokens for the parser
+func tokenizeVyosConfig(text string) []string {
+	words := make([]string, 0)
+	rs := []rune(text)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		if c == '\n' {
+			words = append(words, "\n")
+			i++
+		} else if unicode.IsSpace(c) {
+			i++
+		} else if c == '/' && i+1 < len(rs) && rs[i+1] == '*' {
+			i += 2
+			for ; i < len(rs) && !(rs[i] == '*' && i+1 < len(rs) && rs[i+1] == '/'); i++ {
+				if rs[i] == '\n' {
+					words = append(words, "\n")
+				}
+			}
+			if i >= len(rs) {
+				panic(errors.New(fmt.Sprintf("unterminated comment in: %s", text)))
+			}
+			i += 2
+		} else if c == '"' || c == '\'' {
+			w := make([]rune, 0)
+			for i++; i < len(rs) && rs[i] != c; i++ {
+				if c == '"' && rs[i] == '\\' && i+1 < len(rs) {
+					i++
+				}
+				w = append(w, rs[i])
+			}
+			if i >= len(rs) {
+				panic(errors.New(fmt.Sprintf("unterminated quoted string in: %s", text)))
+			}
+			words = append(words, string(w))
+			i++
+		} else {
+			start := i
+			for ; i < len(rs) && !unicode.IsSpace(rs[i]); i++ {
+			}
+			words = append(words, string(rs[start:i]))
+		}
+	}
+
+	return words
+}
+
+// split a config path like `interfaces ethernet eth0 description "a b"`
+func splitVyosPath(config string) []string {
+	ws := make([]string, 0)
+	for _, w := range tokenizeVyosConfig(config) {
+		if w != "\n" {
+			ws = append(ws, w)
+		}
+	}
+	return ws
+}
+
+func quoteVyosValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, vyosSpecialChars) {
+		return value
+	}
+
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "$", "\\$", "`", "\\`")
+	return "\"" + r.Replace(value) + "\""
+}
+
+func joinVyosPath(words []string) string {
+	ws := make([]string, len(words))
+	for i, w := range words {
+		ws[i] = quoteVyosValue(w)
+	}
+	return strings.Join(ws, " ")
+}
+
 func matchToken(words []string) (int, role, []string, string) {
 	ws := make([]string, 0)
 	next := 0
@@ -74,17 +157,7 @@ func (parser *VyosParser) GetValue(key string) (string, bool) {
 func (parser *VyosParser) Parse(text string) *VyosConfigTree {
 	parser.parsed = true
 
-	words := make([]string, 0)
-	for _, s := range strings.Split(text, "\n") {
-		scanner := bufio.NewScanner(strings.NewReader(s))
-		scanner.Split(bufio.ScanWords)
-		ws := make([]string, 0)
-		for scanner.Scan() {
-			ws = append(ws, scanner.Text())
-		}
-		ws = append(ws, "\n")
-		words = append(words, ws...)
-	}
+	words := append(tokenizeVyosConfig(text), "\n")
 
 	offset := 0
 	tree := &VyosConfigTree{Root: &VyosConfigNode{}}
@@ -125,24 +198,24 @@ func (parser *VyosParser) Parse(text string) *VyosConfigTree {
 	return tree
 }
 
-var ConfigurationSourceFunc = func() string {
+var ConfigurationSourceFunc = func(ctx context.Context) string {
 	bash := utils.Bash{
 		Command: "/bin/cli-shell-api showCfg",
 		NoLog:   true,
 	}
 
-	_, o, _, _ := bash.RunWithReturn()
+	_, o, _, _ := bash.RunWithContext(ctx)
 	bash.PanicIfError()
 	return o
 }
 
-func VyosShowConfiguration() string {
-	return ConfigurationSourceFunc()
+func VyosShowConfiguration(ctx context.Context) string {
+	return ConfigurationSourceFunc(ctx)
 }
 
-func NewParserFromShowConfiguration() *VyosParser {
+func NewParserFromShowConfiguration(ctx context.Context) *VyosParser {
 	p := &VyosParser{}
-	p.Parse(ConfigurationSourceFunc())
+	p.Parse(ConfigurationSourceFunc(ctx))
 	return p
 }
 
@@ -190,14 +263,15 @@ func (n *VyosConfigNode) String() string {
 	stack := &utils.Stack{}
 	p := n
 	for {
-		if p == nil {
+		// the root node has no name
+		if p == nil || p.parent == nil {
 			return func() string {
 				sl := stack.Slice()
 				ss := make([]string, len(sl))
 				for i, s := range sl {
 					ss[i] = s.(string)
 				}
-				return strings.TrimSpace(strings.Join(ss, " "))
+				return joinVyosPath(ss)
 			}()
 		}
 
@@ -273,7 +347,10 @@ func (n *VyosConfigNode) Getf(f string, args ...interface{}) *VyosConfigNode {
 }
 
 func (n *VyosConfigNode) Get(config string) *VyosConfigNode {
-	cs := strings.Split(config, " ")
+	return n.get(splitVyosPath(config)...)
+}
+
+func (n *VyosConfigNode) get(cs ...string) *VyosConfigNode {
 	current := n
 
 	for _, c := range cs {
@@ -323,7 +400,7 @@ func (t *VyosConfigTree) HasChanges() bool {
 	return len(t.changeCommands) != 0
 }
 
-func (t *VyosConfigTree) Apply(asVyosUser bool) {
+func (t *VyosConfigTree) Apply(ctx context.Context, asVyosUser bool) {
 
 	if len(t.changeCommands) == 0 {
 		log.Debug("[Vyos Configuration] no changes to apply")
@@ -331,15 +408,15 @@ func (t *VyosConfigTree) Apply(asVyosUser bool) {
 	}
 
 	command := strings.Join(t.changeCommands, "\n")
-	if UNIT_TEST {
+	if UNIT_TEST && VyosScriptRunnerFunc == nil {
 		fmt.Println(command)
 		return
 	}
 
 	if asVyosUser {
-		RunVyosScriptAsUserVyos(command)
+		RunVyosScriptAsUserVyos(ctx, command)
 	} else {
-		RunVyosScript(command, nil)
+		RunVyosScript(ctx, command, nil)
 	}
 }
 
@@ -373,7 +450,7 @@ func (t *VyosConfigTree) has(config ...string) bool {
 }
 
 func (t *VyosConfigTree) Has(config string) bool {
-	return t.has(strings.Split(config, " ")...)
+	return t.has(splitVyosPath(config)...)
 }
 
 func (t *VyosConfigTree) AttachFirewallToInterface(ethname, direction string) {
@@ -410,17 +487,8 @@ func (t *VyosConfigTree) SetFirewallOnInterface(ethname, direction string, rules
 		panic(fmt.Sprintf("the direction can only be [in, out, local], but %s get", direction))
 	}
 
-	currentRuleNum := -1
-	for i := 1; i <= 9999; i++ {
-		if c := t.Getf("firewall name %s.%s rule %v", ethname, direction, i); c == nil {
-			currentRuleNum = i
-			break
-		}
-	}
-
-	if currentRuleNum == -1 {
-		panic(fmt.Sprintf("No firewall rule number found for the interface %s.%s. You have set more than 9999 rules???", ethname, direction))
-	}
+	currentRuleNum, err := t.FirewallRuleChain(ethname, direction).Allocate(VYOS_RULE_RANGE_NORMAL)
+	utils.PanicOnError(err)
 
 	for _, rule := range rules {
 		t.Setf("firewall name %v.%v rule %v %s", ethname, direction, currentRuleNum, rule)
@@ -440,18 +508,8 @@ func (t *VyosConfigTree) SetFirewallWithRuleNumber(ethname, direction string, nu
 }
 
 func (t *VyosConfigTree) SetDnat(rules ...string) int {
-	currentRuleNum := -1
-
-	for i := 1; i <= 9999; i++ {
-		if c := t.Getf("nat destination rule %v", i); c == nil {
-			currentRuleNum = i
-			break
-		}
-	}
-
-	if currentRuleNum == -1 {
-		panic("No rule number avaible for dnat. You have set more than 9999 rules???")
-	}
+	currentRuleNum, err := t.DnatRuleChain().Allocate(VYOS_RULE_RANGE_NORMAL)
+	utils.PanicOnError(err)
 
 	for _, rule := range rules {
 		t.Setf("nat destination rule %v %s", currentRuleNum, rule)
@@ -506,15 +564,7 @@ func (t *VyosConfigTree) SetSnatWithRuleNumber(ruleNum int, rules ...string) {
 }
 
 func (t *VyosConfigTree) SetSnatWithStartRuleNumber(startNum int, rules ...string) int {
-	currentRuleNum := -1
-
-	for i := startNum; i <= 9999; i++ {
-		if c := t.Getf("nat source rule %v", i); c == nil {
-			currentRuleNum = i
-			break
-		}
-	}
-
+	currentRuleNum := t.SnatRuleChain().findFree(startNum, VYOS_MAX_RULE_NUMBER)
 	if currentRuleNum == -1 {
 		panic("No rule number avaible for source nat. You have set more than 9999 rules???")
 	}
@@ -527,17 +577,22 @@ func (t *VyosConfigTree) SetSnatWithStartRuleNumber(startNum int, rules ...strin
 }
 
 func (t *VyosConfigTree) SetSnatExclude(rules ...string) int {
-	return t.SetSnatWithStartRuleNumber(1, rules...)
+	currentRuleNum, err := t.SnatRuleChain().Allocate(VYOS_RULE_RANGE_EXCLUDE)
+	utils.PanicOnError(err)
+	t.SetSnatWithRuleNumber(currentRuleNum, rules...)
+	return currentRuleNum
 }
 
-/*now the SNAT rule is splited 3 parts,
+/*now the SNAT rule is splited 3 parts, see SnatRuleChain
 [1, 1023] exclude rule, call SetSnatExclude
 [1024,xxxx-1] normal rules (such as eip), call SetSnat
 [xxxx, 9999] in snat (call SetSnatWithRuleNumber),
 */
 func (t *VyosConfigTree) SetSnat(rules ...string) int {
-	var SNAT_RULE_NUMBER_FOR_EIP = 1024
-	return t.SetSnatWithStartRuleNumber(SNAT_RULE_NUMBER_FOR_EIP, rules...)
+	currentRuleNum, err := t.SnatRuleChain().Allocate(VYOS_RULE_RANGE_NORMAL)
+	utils.PanicOnError(err)
+	t.SetSnatWithRuleNumber(currentRuleNum, rules...)
+	return currentRuleNum
 }
 
 func (t *VyosConfigTree) FindFirstNotExcludeSNATRule(startNum int) int {
@@ -610,27 +665,37 @@ func (t *VyosConfigTree) Setf(f string, args ...interface{}) bool {
 }
 
 // if existing value is different from the config
-// delete the old one and set the new one
+// delete the old one and set the new one.
+// a key already having several values is a multi-value key (e.g. address),
+// the value is added to it unless it's already there
 func (t *VyosConfigTree) Set(config string) bool {
 	t.init()
-	cs := strings.Split(config, " ")
-	key := strings.Join(cs[:len(cs)-1], " ")
+	cs := splitVyosPath(config)
+	utils.Assertf(len(cs) > 0, "empty config to set")
+	config = joinVyosPath(cs)
+	key := joinVyosPath(cs[:len(cs)-1])
 	value := cs[len(cs)-1]
-	keyNode := t.Get(key)
+	keyNode := t.Root.get(cs[:len(cs)-1]...)
 	if keyNode != nil && keyNode.ValueSize() > 0 {
 		// the key found
-		cvalue := keyNode.Value()
-		if value != cvalue {
-			keyNode.deleteNode(cvalue)
-			keyNode.addNode(value)
-			// the value is changed, delete the old one
-			t.changeCommands = append(t.changeCommands, fmt.Sprintf("delete %s", key))
-			t.changeCommands = append(t.changeCommands, fmt.Sprintf("set %s", config))
-			return true
-		} else {
-			// the value is unchanged
-			return false
+		cvalues := keyNode.Values()
+		for _, cvalue := range cvalues {
+			if cvalue == value {
+				// the value is unchanged
+				return false
+			}
+		}
+
+		if len(cvalues) > 1 {
+			return t.AddValue(config)
 		}
+
+		keyNode.deleteNode(cvalues[0])
+		keyNode.addNode(value)
+		// the value is changed, delete the old one
+		t.changeCommands = append(t.changeCommands, fmt.Sprintf("delete %s", key))
+		t.changeCommands = append(t.changeCommands, fmt.Sprintf("set %s", config))
+		return true
 	} else {
 		// the key not found
 		current := t.Root
@@ -642,6 +707,24 @@ func (t *VyosConfigTree) Set(config string) bool {
 	}
 }
 
+// add the value to a multi-value key (e.g. address) without deleting
+// the existing ones, return false if the value is already there
+func (t *VyosConfigTree) AddValue(config string) bool {
+	t.init()
+	cs := splitVyosPath(config)
+	utils.Assertf(len(cs) > 0, "empty config to set")
+	if t.Root.get(cs...) != nil {
+		return false
+	}
+
+	current := t.Root
+	for _, c := range cs {
+		current = current.addNode(c)
+	}
+	t.changeCommands = append(t.changeCommands, fmt.Sprintf("set %s", joinVyosPath(cs)))
+	return true
+}
+
 func (t *VyosConfigTree) SetMultiple(config ...string) bool {
 	for _, c := range config {
 		t.SetWithoutCheckExisting(c)
@@ -677,7 +760,7 @@ func (t *VyosConfigTree) Delete(config string) bool {
 	}
 
 	n.deleteSelf()
-	t.changeCommands = append(t.changeCommands, fmt.Sprintf("delete %s", config))
+	t.changeCommands = append(t.changeCommands, fmt.Sprintf("delete %s", joinVyosPath(splitVyosPath(config))))
 	return true
 }
 
@@ -708,7 +791,7 @@ func (t *VyosConfigTree) String() string {
 					for i, s := range sl {
 						ss[i] = s.(string)
 					}
-					return strings.Join(ss, " ")
+					return joinVyosPath(ss)
 				}())
 				path.Pop()
 
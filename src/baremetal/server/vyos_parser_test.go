@@ -1,19 +1,22 @@
 package server
 
 import (
+	"context"
 	"testing"
 	"fmt"
+	"strings"
 	"baremetal/utils"
 )
 
 func TestSetFirewall(t *testing.T) {
+	ctx := context.Background()
 	UNIT_TEST = true
 
-	ConfigurationSourceFunc = func() string {
+	ConfigurationSourceFunc = func(ctx context.Context) string {
 		return ""
 	}
 
-	tree := NewParserFromShowConfiguration().Tree
+	tree := NewParserFromShowConfiguration(ctx).Tree
 
 	tree.SetFirewallOnInterface("eth0", "local",
 		fmt.Sprintf("destination port %v", 7758),
@@ -32,7 +35,7 @@ func TestSetFirewall(t *testing.T) {
 	)
 	tree.AttachFirewallToInterface("eth0", "local")
 
-	tree.Apply(false)
+	tree.Apply(ctx, false)
 }
 
 func TestVyosParser1(t *testing.T) {
@@ -339,4 +342,90 @@ nat {
 	tree.SwapSnatRule(1, 2)
 	fmt.Printf("\nTest_SwapSNATRule1: \n")
 	fmt.Println(tree.String())
-}
\ No newline at end of file
+}
+
+func TestVyosParserQuotedValues(t *testing.T) {
+	text := `
+interfaces {
+    ethernet eth0 {
+        address 172.20.14.209/16
+        address 10.0.0.1/24
+        description "management port rule"
+        hw-id fa:da:21:1f:1a:00
+    }
+}
+system {
+    login {
+        banner {
+            pre-login "say \"hello\" to $USER\\"
+        }
+        user vyos {
+            authentication {
+                plaintext-password "a b"
+            }
+        }
+    }
+    package {
+        repository community {
+            username ""
+        }
+    }
+}
+
+
+/* Warning: Do not remove the following line. */
+/* === vyatta-config-version: "cluster@1:config-management@1:conntrack@1" === */
+/* Release version: VyOS 1.1.7 */
+`
+	tree := NewParserFromConfiguration(text).Tree
+	utils.Assert(tree.Get("interfaces ethernet eth0 description").Value() == "management port rule", "description")
+	utils.Assert(tree.Get(`system login user vyos authentication plaintext-password`).Value() == "a b", "password")
+	utils.Assert(tree.Get("system login banner pre-login").Value() == `say "hello" to $USER\`, "banner")
+	utils.Assert(tree.Get("system package repository community username").Value() == "", "username")
+	utils.Assert(tree.Get(`interfaces ethernet eth0 description "management port rule"`) != nil, "quoted get")
+	utils.Assert(len(tree.Root.Children()) == 2, fmt.Sprint(tree.Root.ChildNodeKeys()))
+
+	addrs := tree.Get("interfaces ethernet eth0 address").Values()
+	utils.Assert(len(addrs) == 2 && addrs[1] == "10.0.0.1/24", fmt.Sprint(addrs))
+
+	// setting existing values changes nothing
+	for _, c := range tree.Root.FullString() {
+		utils.Assertf(!tree.Set(c), "%s should be unchanged", c)
+	}
+	utils.Assert(!tree.HasChanges(), tree.CommandsAsString())
+
+	// a multi-value key gets the new value added
+	utils.Assert(tree.Set("interfaces ethernet eth0 address 10.0.1.1/24"), "add address")
+	utils.Assert(tree.Get("interfaces ethernet eth0 address").ValueSize() == 3, "3 addresses")
+	utils.Assert(tree.Set(`interfaces ethernet eth0 description "rule for eth0"`), "change description")
+	utils.Assert(tree.Get("interfaces ethernet eth0 description").Value() == "rule for eth0", "new description")
+	utils.Assert(tree.Delete(`system login user vyos authentication plaintext-password "a b"`), "delete password")
+
+	expected := []string{
+		`set interfaces ethernet eth0 address 10.0.1.1/24`,
+		`delete interfaces ethernet eth0 description`,
+		`set interfaces ethernet eth0 description "rule for eth0"`,
+		`delete system login user vyos authentication plaintext-password "a b"`,
+	}
+	utils.Assert(tree.CommandsAsString() == strings.Join(expected, "\n"), tree.CommandsAsString())
+
+	// the string form can be parsed back into the same tree
+	copy := &VyosConfigTree{}
+	for _, c := range strings.Split(tree.String(), "\n") {
+		copy.AddValue(c)
+	}
+	utils.Assert(copy.String() == tree.String(), copy.String())
+	fmt.Println(tree.String())
+}
+
+func TestVyosTokenizer(t *testing.T) {
+	ws := tokenizeVyosConfig(`a "b c" 'd "e"' /* x
+y */ f`)
+	utils.Assert(fmt.Sprintf("%q", ws) == `["a" "b c" "d \"e\"" "\n" "f"]`, fmt.Sprintf("%q", ws))
+
+	for _, v := range []string{"", "a b", `a"b`, "a$b", `a\b`, "it's", "`x`"} {
+		ws = splitVyosPath("k " + quoteVyosValue(v))
+		utils.Assertf(len(ws) == 2 && ws[1] == v, "%q round trips to %q", v, ws)
+	}
+	utils.Assert(quoteVyosValue("10.0.0.1/24") == "10.0.0.1/24", "no quote needed")
+}
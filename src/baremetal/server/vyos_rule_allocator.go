@@ -0,0 +1,194 @@
+package server
+
+import (
+	"baremetal/utils"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	VYOS_MIN_RULE_NUMBER = 1
+	VYOS_MAX_RULE_NUMBER = 9999
+
+	VYOS_RULE_RANGE_NORMAL   = "normal"
+	VYOS_RULE_RANGE_EXCLUDE  = "exclude"
+	VYOS_RULE_RANGE_RESERVED = "reserved"
+
+	// the firewall rule accepting state new for route entries, see ZSTAC-6170
+	VYOS_FIREWALL_RESERVED_RULE_NUMBER = 9999
+	VYOS_SNAT_NORMAL_START_RULE_NUMBER = 1024
+)
+
+// VyosRuleRange is a named range of rule numbers in a chain, both ends included
+type VyosRuleRange struct {
+	Name  string `json:"name"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+type VyosRuleRangeUsage struct {
+	VyosRuleRange
+	Used    int `json:"used"`
+	Free    int `json:"free"`
+	Highest int `json:"highest,omitempty"`
+}
+
+// VyosRuleChain allocates rule numbers under a path like "nat source rule"
+type VyosRuleChain struct {
+	tree   *VyosConfigTree
+	path   string
+	ranges []VyosRuleRange
+}
+
+func (t *VyosConfigTree) FirewallRuleChain(ethname, direction string) *VyosRuleChain {
+	return &VyosRuleChain{
+		tree: t,
+		path: fmt.Sprintf("firewall name %s.%s rule", ethname, direction),
+		ranges: []VyosRuleRange{
+			{VYOS_RULE_RANGE_NORMAL, VYOS_MIN_RULE_NUMBER, VYOS_FIREWALL_RESERVED_RULE_NUMBER - 1},
+			{VYOS_RULE_RANGE_RESERVED, VYOS_FIREWALL_RESERVED_RULE_NUMBER, VYOS_FIREWALL_RESERVED_RULE_NUMBER},
+		},
+	}
+}
+
+func (t *VyosConfigTree) DnatRuleChain() *VyosRuleChain {
+	return &VyosRuleChain{
+		tree:   t,
+		path:   "nat destination rule",
+		ranges: []VyosRuleRange{{VYOS_RULE_RANGE_NORMAL, VYOS_MIN_RULE_NUMBER, VYOS_MAX_RULE_NUMBER}},
+	}
+}
+
+// the exclude rules must be matched before the others, e.g. the ipsec traffic
+func (t *VyosConfigTree) SnatRuleChain() *VyosRuleChain {
+	return &VyosRuleChain{
+		tree: t,
+		path: "nat source rule",
+		ranges: []VyosRuleRange{
+			{VYOS_RULE_RANGE_EXCLUDE, VYOS_MIN_RULE_NUMBER, VYOS_SNAT_NORMAL_START_RULE_NUMBER - 1},
+			{VYOS_RULE_RANGE_NORMAL, VYOS_SNAT_NORMAL_START_RULE_NUMBER, VYOS_MAX_RULE_NUMBER},
+		},
+	}
+}
+
+func (c *VyosRuleChain) getRange(name string) (VyosRuleRange, error) {
+	for _, r := range c.ranges {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return VyosRuleRange{}, errors.Errorf("no rule range %s in %s", name, c.path)
+}
+
+// the used rule numbers in the range, sorted
+func (c *VyosRuleChain) used(r VyosRuleRange) []int {
+	nums := []int{}
+	if n := c.tree.Get(c.path); n != nil {
+		for _, rule := range n.children {
+			if num, err := strconv.Atoi(rule.name); err == nil && num >= r.Start && num <= r.End {
+				nums = append(nums, num)
+			}
+		}
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+func (c *VyosRuleChain) usedSet(r VyosRuleRange) map[int]bool {
+	set := map[int]bool{}
+	for _, num := range c.used(r) {
+		set[num] = true
+	}
+	return set
+}
+
+func (c *VyosRuleChain) findFree(start, end int) int {
+	used := c.usedSet(VyosRuleRange{Start: start, End: end})
+	for i := start; i <= end; i++ {
+		if !used[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// move renumbers a rule, the tree records a delete of the old rule and sets of the new one
+func (c *VyosRuleChain) move(from, to int) {
+	n := c.tree.Getf("%s %d", c.path, from)
+	utils.Assertf(n != nil, "no rule %d in %s", from, c.path)
+	utils.Assertf(c.tree.Getf("%s %d", c.path, to) == nil, "the rule %d in %s already exists", to, c.path)
+
+	prefix := joinVyosPath(splitVyosPath(c.path))
+	oldPrefix := fmt.Sprintf("%s %d", prefix, from)
+	lines := n.FullString()
+	n.Delete()
+	for _, l := range lines {
+		c.tree.AddValue(fmt.Sprintf("%s %d%s", prefix, to, strings.TrimPrefix(l, oldPrefix)))
+	}
+}
+
+// Allocate returns the first free number in the range
+func (c *VyosRuleChain) Allocate(rangeName string) (int, error) {
+	r, err := c.getRange(rangeName)
+	if err != nil {
+		return -1, err
+	}
+
+	if num := c.findFree(r.Start, r.End); num != -1 {
+		return num, nil
+	}
+	return -1, errors.Errorf("the rule range %s[%d-%d] of %s is full", r.Name, r.Start, r.End, c.path)
+}
+
+// Append returns a number after all rules in the range, the range is compacted
+// if its last number is taken
+func (c *VyosRuleChain) Append(rangeName string) (int, error) {
+	r, err := c.getRange(rangeName)
+	if err != nil {
+		return -1, err
+	}
+
+	used := c.used(r)
+	if len(used) == 0 {
+		return r.Start, nil
+	}
+	if used[len(used)-1] < r.End {
+		return used[len(used)-1] + 1, nil
+	}
+	if len(used) == r.End-r.Start+1 {
+		return -1, errors.Errorf("the rule range %s[%d-%d] of %s is full", r.Name, r.Start, r.End, c.path)
+	}
+
+	c.Compact(rangeName)
+	return r.Start + len(used), nil
+}
+
+// Compact renumbers the rules in the range to consecutive numbers from the start
+// of the range, the order of the rules is kept
+func (c *VyosRuleChain) Compact(rangeName string) {
+	r, err := c.getRange(rangeName)
+	utils.PanicOnError(err)
+
+	for i, num := range c.used(r) {
+		if num != r.Start+i {
+			c.move(num, r.Start+i)
+		}
+	}
+}
+
+func (c *VyosRuleChain) Utilization() []VyosRuleRangeUsage {
+	usages := []VyosRuleRangeUsage{}
+	for _, r := range c.ranges {
+		used := c.used(r)
+		u := VyosRuleRangeUsage{VyosRuleRange: r, Used: len(used), Free: r.End - r.Start + 1 - len(used)}
+		if len(used) > 0 {
+			u.Highest = used[len(used)-1]
+		}
+		usages = append(usages, u)
+	}
+	return usages
+}
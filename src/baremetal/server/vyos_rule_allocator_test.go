@@ -0,0 +1,90 @@
+package server
+
+import (
+	"baremetal/utils"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func snatRuleOrder(t *VyosConfigTree) string {
+	rules := []string{}
+	for _, r := range t.Get("nat source rule").Children() {
+		rules = append(rules, fmt.Sprintf("%s:%s", r.name, r.Get("description").Value()))
+	}
+	return strings.Join(rules, " ")
+}
+
+func TestVyosRuleAllocator(t *testing.T) {
+	tree := NewParserFromConfiguration(`
+nat {
+    source {
+        rule 1 {
+            description a
+            exclude
+        }
+        rule 2 {
+            description b
+            exclude
+        }
+        rule 1024 {
+            description eip1
+        }
+        rule 1030 {
+            description eip2
+        }
+    }
+}`).Tree
+	c := tree.SnatRuleChain()
+
+	num, err := c.Allocate(VYOS_RULE_RANGE_EXCLUDE)
+	utils.PanicOnError(err)
+	utils.Assert(num == 3, fmt.Sprint(num))
+	num, err = c.Allocate(VYOS_RULE_RANGE_NORMAL)
+	utils.PanicOnError(err)
+	utils.Assert(num == 1025, fmt.Sprint(num))
+	num, err = c.Append(VYOS_RULE_RANGE_NORMAL)
+	utils.PanicOnError(err)
+	utils.Assert(num == 1031, fmt.Sprint(num))
+	_, err = c.Allocate("unknown")
+	utils.Assert(err != nil, "unknown range")
+
+	// the order of the rules is kept
+	c.Compact(VYOS_RULE_RANGE_NORMAL)
+	utils.Assert(snatRuleOrder(tree) == "1:a 2:b 1024:eip1 1025:eip2", snatRuleOrder(tree))
+	utils.Assert(tree.CommandsAsString() == "delete nat source rule 1030\nset nat source rule 1025 description eip2",
+		tree.CommandsAsString())
+
+	usage := c.Utilization()
+	utils.Assert(len(usage) == 2, fmt.Sprint(usage))
+	utils.Assert(usage[0].Used == 2 && usage[0].Free == 1021 && usage[0].Highest == 2, fmt.Sprint(usage[0]))
+	utils.Assert(usage[1].Name == VYOS_RULE_RANGE_NORMAL && usage[1].Used == 2 && usage[1].Highest == 1025, fmt.Sprint(usage[1]))
+}
+
+func TestVyosRuleAllocatorFull(t *testing.T) {
+	tree := NewParserFromConfiguration("").Tree
+	c := tree.FirewallRuleChain("eth0", "local")
+	for i := 2; i < VYOS_FIREWALL_RESERVED_RULE_NUMBER; i += 2 {
+		tree.SetFirewallWithRuleNumber("eth0", "local", i, fmt.Sprintf("description r%d", i))
+	}
+
+	// the last number is taken, compact to append
+	num, err := c.Append(VYOS_RULE_RANGE_NORMAL)
+	utils.PanicOnError(err)
+	utils.Assert(num == 5000, fmt.Sprint(num))
+	utils.Assert(tree.Get("firewall name eth0.local rule 4999 description").Value() == "r9998", "compacted")
+
+	num = tree.SetFirewallOnInterface("eth0", "local", "action accept")
+	utils.Assert(num == 5000, fmt.Sprint(num))
+	for i := 5001; i < VYOS_FIREWALL_RESERVED_RULE_NUMBER; i++ {
+		tree.SetFirewallWithRuleNumber("eth0", "local", i, "action accept")
+	}
+
+	_, err = c.Allocate(VYOS_RULE_RANGE_NORMAL)
+	utils.Assert(err != nil, "the range should be full")
+	_, err = c.Append(VYOS_RULE_RANGE_NORMAL)
+	utils.Assert(err != nil, "the range should be full")
+	num, err = c.Allocate(VYOS_RULE_RANGE_RESERVED)
+	utils.PanicOnError(err)
+	utils.Assert(num == VYOS_FIREWALL_RESERVED_RULE_NUMBER, fmt.Sprint(num))
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"baremetal/utils"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// VyosFirewallRule is a rule of "firewall name <nic>.<direction> rule <number>",
+// ports are a port, a range like 1000-2000 or a comma separated list of them
+type VyosFirewallRule struct {
+	Number             int      `json:"number,omitempty"`
+	Action             string   `json:"action"`
+	Protocol           string   `json:"protocol,omitempty"`
+	SourceAddress      string   `json:"sourceAddress,omitempty"`
+	SourcePort         string   `json:"sourcePort,omitempty"`
+	DestinationAddress string   `json:"destinationAddress,omitempty"`
+	DestinationPort    string   `json:"destinationPort,omitempty"`
+	States             []string `json:"states,omitempty"`
+	Description        string   `json:"description,omitempty"`
+}
+
+// VyosNatRule is a rule of "nat source rule <number>" or "nat destination rule <number>"
+type VyosNatRule struct {
+	Number             int    `json:"number,omitempty"`
+	Description        string `json:"description,omitempty"`
+	Protocol           string `json:"protocol,omitempty"`
+	InboundInterface   string `json:"inboundInterface,omitempty"`
+	OutboundInterface  string `json:"outboundInterface,omitempty"`
+	SourceAddress      string `json:"sourceAddress,omitempty"`
+	SourcePort         string `json:"sourcePort,omitempty"`
+	DestinationAddress string `json:"destinationAddress,omitempty"`
+	DestinationPort    string `json:"destinationPort,omitempty"`
+	TranslationAddress string `json:"translationAddress,omitempty"`
+	TranslationPort    string `json:"translationPort,omitempty"`
+	Exclude            bool   `json:"exclude,omitempty"`
+}
+
+const (
+	VYOS_SNAT_MASQUERADE = "masquerade"
+)
+
+var (
+	vyosFirewallActions = []string{"accept", "drop", "reject"}
+	vyosFirewallStates  = []string{"established", "related", "new", "invalid"}
+	vyosProtocols       = []string{"all", "tcp", "udp", "tcp_udp", "icmp", "gre", "esp", "ah"}
+	vyosPortProtocols   = []string{"tcp", "udp", "tcp_udp"}
+)
+
+func inStrings(s string, sl []string) bool {
+	for _, x := range sl {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
+
+func validateVyosProtocol(proto string) error {
+	if proto == "" || inStrings(proto, vyosProtocols) {
+		return nil
+	}
+	if n, err := strconv.Atoi(proto); err == nil && n >= 0 && n <= 255 {
+		return nil
+	}
+	return errors.Errorf("invalid protocol %s, must be one of %v or a number", proto, vyosProtocols)
+}
+
+func validateVyosPort(port, proto string) error {
+	if port == "" {
+		return nil
+	}
+	if !inStrings(proto, vyosPortProtocols) {
+		return errors.Errorf("port %s requires the protocol to be one of %v, but %s got", port, vyosPortProtocols, proto)
+	}
+
+	for _, p := range strings.Split(port, ",") {
+		for _, n := range strings.SplitN(p, "-", 2) {
+			if i, err := strconv.Atoi(n); err != nil || i < 1 || i > 65535 {
+				return errors.Errorf("invalid port %s", port)
+			}
+		}
+	}
+	return nil
+}
+
+// an address is an ip, a cidr or a range like 10.0.0.1-10.0.0.9, optionally negated with "!"
+func validateVyosAddress(addr string) error {
+	if addr == "" {
+		return nil
+	}
+
+	a := strings.TrimPrefix(addr, "!")
+	if _, _, err := net.ParseCIDR(a); err == nil {
+		return nil
+	}
+	for _, ip := range strings.SplitN(a, "-", 2) {
+		if net.ParseIP(ip) == nil {
+			return errors.Errorf("invalid address %s", addr)
+		}
+	}
+	return nil
+}
+
+func (r *VyosFirewallRule) Validate() error {
+	if !inStrings(r.Action, vyosFirewallActions) {
+		return errors.Errorf("invalid action %s, must be one of %v", r.Action, vyosFirewallActions)
+	}
+	if err := validateVyosProtocol(r.Protocol); err != nil {
+		return err
+	}
+	for _, p := range []string{r.SourcePort, r.DestinationPort} {
+		if err := validateVyosPort(p, r.Protocol); err != nil {
+			return err
+		}
+	}
+	for _, a := range []string{r.SourceAddress, r.DestinationAddress} {
+		if err := validateVyosAddress(a); err != nil {
+			return err
+		}
+	}
+	for _, s := range r.States {
+		if !inStrings(s, vyosFirewallStates) {
+			return errors.Errorf("invalid state %s, must be one of %v", s, vyosFirewallStates)
+		}
+	}
+	return nil
+}
+
+// Render returns the config of the rule relative to the rule node
+func (r *VyosFirewallRule) Render() []string {
+	rules := []string{fmt.Sprintf("action %s", r.Action)}
+	if r.Protocol != "" {
+		rules = append(rules, fmt.Sprintf("protocol %s", r.Protocol))
+	}
+	if r.SourceAddress != "" {
+		rules = append(rules, fmt.Sprintf("source address %s", quoteVyosValue(r.SourceAddress)))
+	}
+	if r.SourcePort != "" {
+		rules = append(rules, fmt.Sprintf("source port %s", r.SourcePort))
+	}
+	if r.DestinationAddress != "" {
+		rules = append(rules, fmt.Sprintf("destination address %s", quoteVyosValue(r.DestinationAddress)))
+	}
+	if r.DestinationPort != "" {
+		rules = append(rules, fmt.Sprintf("destination port %s", r.DestinationPort))
+	}
+	for _, s := range r.States {
+		rules = append(rules, fmt.Sprintf("state %s enable", s))
+	}
+	if r.Description != "" {
+		rules = append(rules, fmt.Sprintf("description %s", quoteVyosValue(r.Description)))
+	}
+	return rules
+}
+
+// Validate checks the rule as a source nat rule if snat is true, otherwise as a destination one
+func (r *VyosNatRule) Validate(snat bool) error {
+	if snat && r.OutboundInterface == "" {
+		return errors.New("outbound interface is required by source nat rules")
+	}
+	if !snat && r.InboundInterface == "" {
+		return errors.New("inbound interface is required by destination nat rules")
+	}
+	for _, nic := range []string{r.InboundInterface, r.OutboundInterface} {
+		if nic == "" {
+			continue
+		}
+		if err := utils.CheckLinkName(nic); err != nil {
+			return err
+		}
+	}
+	if !r.Exclude && r.TranslationAddress == "" && r.TranslationPort == "" {
+		return errors.New("translation is required unless the rule is an exclude one")
+	}
+	if err := validateVyosProtocol(r.Protocol); err != nil {
+		return err
+	}
+	for _, p := range []string{r.SourcePort, r.DestinationPort, r.TranslationPort} {
+		if err := validateVyosPort(p, r.Protocol); err != nil {
+			return err
+		}
+	}
+	for _, a := range []string{r.SourceAddress, r.DestinationAddress} {
+		if err := validateVyosAddress(a); err != nil {
+			return err
+		}
+	}
+	if !(snat && r.TranslationAddress == VYOS_SNAT_MASQUERADE) {
+		if err := validateVyosAddress(r.TranslationAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Render returns the config of the rule relative to the rule node
+func (r *VyosNatRule) Render() []string {
+	rules := []string{}
+	if r.InboundInterface != "" {
+		rules = append(rules, fmt.Sprintf("inbound-interface %s", r.InboundInterface))
+	}
+	if r.OutboundInterface != "" {
+		rules = append(rules, fmt.Sprintf("outbound-interface %s", r.OutboundInterface))
+	}
+	if r.Description != "" {
+		rules = append(rules, fmt.Sprintf("description %s", quoteVyosValue(r.Description)))
+	}
+	if r.Protocol != "" {
+		rules = append(rules, fmt.Sprintf("protocol %s", r.Protocol))
+	}
+	if r.SourceAddress != "" {
+		rules = append(rules, fmt.Sprintf("source address %s", quoteVyosValue(r.SourceAddress)))
+	}
+	if r.SourcePort != "" {
+		rules = append(rules, fmt.Sprintf("source port %s", r.SourcePort))
+	}
+	if r.DestinationAddress != "" {
+		rules = append(rules, fmt.Sprintf("destination address %s", quoteVyosValue(r.DestinationAddress)))
+	}
+	if r.DestinationPort != "" {
+		rules = append(rules, fmt.Sprintf("destination port %s", r.DestinationPort))
+	}
+	if r.TranslationAddress != "" {
+		rules = append(rules, fmt.Sprintf("translation address %s", r.TranslationAddress))
+	}
+	if r.TranslationPort != "" {
+		rules = append(rules, fmt.Sprintf("translation port %s", r.TranslationPort))
+	}
+	if r.Exclude {
+		rules = append(rules, "exclude")
+	}
+	return rules
+}
+
+func nodeValue(n *VyosConfigNode, path string) string {
+	if c := n.Get(path); c != nil && c.ValueSize() > 0 {
+		return c.Value()
+	}
+	return ""
+}
+
+func ruleNumber(n *VyosConfigNode) int {
+	num, _ := strconv.Atoi(n.name)
+	return num
+}
+
+// ParseVyosFirewallRule converts a rule node like the one returned by FindFirewallRuleByDescription
+func ParseVyosFirewallRule(n *VyosConfigNode) *VyosFirewallRule {
+	r := &VyosFirewallRule{
+		Number:             ruleNumber(n),
+		Action:             nodeValue(n, "action"),
+		Protocol:           nodeValue(n, "protocol"),
+		SourceAddress:      nodeValue(n, "source address"),
+		SourcePort:         nodeValue(n, "source port"),
+		DestinationAddress: nodeValue(n, "destination address"),
+		DestinationPort:    nodeValue(n, "destination port"),
+		Description:        nodeValue(n, "description"),
+	}
+	if states := n.Get("state"); states != nil {
+		for _, s := range states.children {
+			if inStrings("enable", s.Values()) {
+				r.States = append(r.States, s.name)
+			}
+		}
+	}
+	return r
+}
+
+// ParseVyosNatRule converts a rule node like the one returned by FindSnatRuleDescription
+func ParseVyosNatRule(n *VyosConfigNode) *VyosNatRule {
+	return &VyosNatRule{
+		Number:             ruleNumber(n),
+		Description:        nodeValue(n, "description"),
+		Protocol:           nodeValue(n, "protocol"),
+		InboundInterface:   nodeValue(n, "inbound-interface"),
+		OutboundInterface:  nodeValue(n, "outbound-interface"),
+		SourceAddress:      nodeValue(n, "source address"),
+		SourcePort:         nodeValue(n, "source port"),
+		DestinationAddress: nodeValue(n, "destination address"),
+		DestinationPort:    nodeValue(n, "destination port"),
+		TranslationAddress: nodeValue(n, "translation address"),
+		TranslationPort:    nodeValue(n, "translation port"),
+		Exclude:            n.Get("exclude") != nil,
+	}
+}
+
+// appendRule returns a number after all rules in the range, so the rules are
+// matched in the order they are set
+func (c *VyosRuleChain) appendRule(rangeName string) int {
+	num, err := c.Append(rangeName)
+	utils.PanicOnError(err)
+	return num
+}
+
+// SetFirewallRule validates the rule and sets it after the other rules of the
+// chain, or with r.Number if it's not 0, the rule number is returned
+func (t *VyosConfigTree) SetFirewallRule(ethname, direction string, r *VyosFirewallRule) int {
+	utils.PanicOnError(r.Validate())
+	num := r.Number
+	if num == 0 {
+		num = t.FirewallRuleChain(ethname, direction).appendRule(VYOS_RULE_RANGE_NORMAL)
+	}
+	t.SetFirewallWithRuleNumber(ethname, direction, num, r.Render()...)
+	return num
+}
+
+// SetDnatRule validates the rule and sets it after the other rules, or with
+// r.Number if it's not 0, the rule number is returned
+func (t *VyosConfigTree) SetDnatRule(r *VyosNatRule) int {
+	utils.PanicOnError(r.Validate(false))
+	num := r.Number
+	if num == 0 {
+		num = t.DnatRuleChain().appendRule(VYOS_RULE_RANGE_NORMAL)
+	}
+	for _, rule := range r.Render() {
+		t.Setf("nat destination rule %v %s", num, rule)
+	}
+	return num
+}
+
+// SetSnatRule validates the rule and sets it with r.Number if it's not 0, otherwise
+// after the other exclude rules or the other normal rules, see SnatRuleChain
+func (t *VyosConfigTree) SetSnatRule(r *VyosNatRule) int {
+	utils.PanicOnError(r.Validate(true))
+	num := r.Number
+	if num == 0 && r.Exclude {
+		num = t.SnatRuleChain().appendRule(VYOS_RULE_RANGE_EXCLUDE)
+	} else if num == 0 {
+		num = t.SnatRuleChain().appendRule(VYOS_RULE_RANGE_NORMAL)
+	}
+	t.SetSnatWithRuleNumber(num, r.Render()...)
+	return num
+}
+
+func (t *VyosConfigTree) FindFirewallRule(ethname, direction, des string) *VyosFirewallRule {
+	if n := t.FindFirewallRuleByDescription(ethname, direction, des); n != nil {
+		return ParseVyosFirewallRule(n)
+	}
+	return nil
+}
+
+func (t *VyosConfigTree) FindDnatRule(des string) *VyosNatRule {
+	if n := t.FindDnatRuleDescription(des); n != nil {
+		return ParseVyosNatRule(n)
+	}
+	return nil
+}
+
+func (t *VyosConfigTree) FindSnatRule(des string) *VyosNatRule {
+	if n := t.FindSnatRuleDescription(des); n != nil {
+		return ParseVyosNatRule(n)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"baremetal/utils"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVyosFirewallRule(t *testing.T) {
+	r := &VyosFirewallRule{
+		Action:          "accept",
+		Protocol:        "tcp",
+		SourceAddress:   "10.0.0.0/24",
+		DestinationPort: "22,8000-8080",
+		States:          []string{"new", "established"},
+		Description:     "ssh and web",
+	}
+	utils.PanicOnError(r.Validate())
+
+	tree := NewParserFromConfiguration("").Tree
+	num := tree.SetFirewallRule("eth0", "local", r)
+	utils.Assert(num == 1, fmt.Sprint(num))
+
+	found := tree.FindFirewallRule("eth0", "local", "ssh and web")
+	utils.Assert(found != nil, "rule not found")
+	r.Number = 1
+	utils.Assert(fmt.Sprintf("%+v", found) == fmt.Sprintf("%+v", r), fmt.Sprintf("%+v", found))
+	utils.Assert(tree.FindFirewallRule("eth0", "local", "ssh") == nil, "should not be found")
+
+	// the rule is parsed back the same from showCfg
+	tree = NewParserFromConfiguration(`
+firewall {
+    name eth0.local {
+        rule 3 {
+            action accept
+            description "ssh and web"
+            destination {
+                port 22,8000-8080
+            }
+            protocol tcp
+            source {
+                address 10.0.0.0/24
+            }
+            state {
+                established enable
+                new enable
+            }
+        }
+    }
+}`).Tree
+	found = tree.FindFirewallRule("eth0", "local", "ssh and web")
+	utils.Assert(found.Number == 3 && len(found.States) == 2 && found.DestinationPort == "22,8000-8080", fmt.Sprintf("%+v", found))
+
+	invalid := []*VyosFirewallRule{
+		{Action: "allow"},
+		{Action: "accept", Protocol: "tpc"},
+		{Action: "accept", DestinationPort: "22"},
+		{Action: "accept", Protocol: "tcp", DestinationPort: "70000"},
+		{Action: "accept", SourceAddress: "10.0.0.300"},
+		{Action: "accept", States: []string{"establish"}},
+	}
+	for _, r := range invalid {
+		utils.Assertf(r.Validate() != nil, "%+v should be invalid", r)
+	}
+	utils.PanicOnError((&VyosFirewallRule{Action: "drop", Protocol: "6", DestinationAddress: "!10.0.0.1-10.0.0.9"}).Validate())
+}
+
+func TestVyosNatRule(t *testing.T) {
+	tree := NewParserFromConfiguration("").Tree
+
+	dnat := &VyosNatRule{
+		Description:        "pf-1",
+		Protocol:           "tcp",
+		InboundInterface:   "eth0",
+		DestinationAddress: "100.64.0.10",
+		DestinationPort:    "80",
+		TranslationAddress: "192.168.0.10",
+		TranslationPort:    "8080",
+	}
+	utils.Assert(tree.SetDnatRule(dnat) == 1, "dnat rule number")
+
+	snat := &VyosNatRule{Description: "eip-1", OutboundInterface: "eth0", SourceAddress: "192.168.0.10", TranslationAddress: "100.64.0.10"}
+	utils.Assert(tree.SetSnatRule(snat) == 1024, "snat rule number")
+	exclude := &VyosNatRule{Description: "ipsec-1", OutboundInterface: "eth0", DestinationAddress: "10.0.0.0/8", Exclude: true}
+	utils.Assert(tree.SetSnatRule(exclude) == 1, "exclude rule number")
+
+	dnat.Number = 1
+	found := tree.FindDnatRule("pf-1")
+	utils.Assert(fmt.Sprintf("%+v", found) == fmt.Sprintf("%+v", dnat), fmt.Sprintf("%+v", found))
+	found = tree.FindSnatRule("ipsec-1")
+	utils.Assert(found.Exclude && found.Number == 1, fmt.Sprintf("%+v", found))
+	utils.Assert(strings.Contains(tree.CommandsAsString(), "set nat source rule 1 exclude"), tree.CommandsAsString())
+
+	invalid := []*VyosNatRule{
+		{OutboundInterface: "eth0"},
+		{OutboundInterface: "eth0", TranslationAddress: "masquerad"},
+		{OutboundInterface: "eth0", TranslationAddress: "1.1.1.1", SourcePort: "22"},
+		{OutboundInterface: "eth0 translation address 2.2.2.2", TranslationAddress: "1.1.1.1"},
+		{OutboundInterface: "eth0", InboundInterface: "eth1\nset system", TranslationAddress: "1.1.1.1"},
+	}
+	for _, r := range invalid {
+		utils.Assertf(r.Validate(true) != nil, "%+v should be invalid", r)
+	}
+	utils.PanicOnError((&VyosNatRule{OutboundInterface: "eth0", TranslationAddress: VYOS_SNAT_MASQUERADE}).Validate(true))
+	utils.Assert((&VyosNatRule{InboundInterface: "eth0", TranslationAddress: VYOS_SNAT_MASQUERADE}).Validate(false) != nil, "masquerade for dnat")
+	utils.Assert((&VyosNatRule{TranslationAddress: "1.1.1.1"}).Validate(false) != nil, "dnat without inbound interface")
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"strings"
+)
+
+// the nodes whose values are secrets, e.g.
+// system login user vyos authentication plaintext-password xxx
+var vyosSecretNodes = map[string]bool{
+	"plaintext-password": true,
+	"encrypted-password": true,
+	"pre-shared-secret":  true,
+	"password":           true,
+	"secret":             true,
+	"key":                true,
+}
+
+// VyosCommandSecrets returns the secret values in the set and delete commands,
+// both the raw and the quoted forms are returned so they can be masked by
+// utils.RedactSecrets wherever the commands are logged
+func VyosCommandSecrets(commands string) []string {
+	var secrets []string
+	for _, line := range strings.Split(commands, "\n") {
+		words := splitVyosPath(line)
+		if len(words) < 3 || (words[0] != "set" && words[0] != "delete") {
+			continue
+		}
+
+		if vyosSecretNodes[words[len(words)-2]] {
+			value := words[len(words)-1]
+			secrets = append(secrets, value)
+			if quoted := quoteVyosValue(value); quoted != value {
+				secrets = append(secrets, quoted)
+			}
+		}
+	}
+	return secrets
+}
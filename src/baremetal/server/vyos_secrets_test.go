@@ -0,0 +1,26 @@
+package server
+
+import (
+	"baremetal/utils"
+	"strings"
+	"testing"
+)
+
+func TestVyosCommandSecrets(t *testing.T) {
+	commands := strings.Join([]string{
+		"set system login user vyos authentication plaintext-password vrouter12#",
+		`set system login user vyos authentication encrypted-password "\$6\$salt\$hash"`,
+		"set system login user vyos authentication public-keys root@mn key AAAAB3NzaC1yc2E",
+		"set system login user vyos authentication public-keys root@mn type ssh-rsa",
+		"set interfaces ethernet eth0 address 172.20.12.34/16",
+		"delete vpn ipsec site-to-site peer 1.1.1.1 authentication pre-shared-secret abc123",
+	}, "\n")
+
+	secrets := VyosCommandSecrets(commands)
+	redacted := utils.RedactSecrets(commands, secrets...)
+	for _, s := range []string{"vrouter12#", "salt", "AAAAB3NzaC1yc2E", "abc123"} {
+		utils.Assertf(!strings.Contains(redacted, s), "%s is not masked in %s", s, redacted)
+	}
+	utils.Assert(strings.Contains(redacted, "type ssh-rsa"), "the key type is not a secret")
+	utils.Assert(strings.Contains(redacted, "172.20.12.34/16"), "the address is not a secret")
+}
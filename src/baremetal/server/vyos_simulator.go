@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// the tag nodes are shown with their child on the same line, e.g. "ethernet eth0 {"
+var vyosTagNodes = map[string]bool{
+	"ethernet": true, "loopback": true, "bonding": true, "bridge": true, "vif": true,
+	"name": true, "rule": true, "route": true, "next-hop": true, "interface": true,
+	"user": true, "public-keys": true, "server": true, "repository": true, "facility": true,
+	"device": true, "address-group": true, "network-group": true, "port-group": true,
+	"shared-network-name": true, "subnet": true, "static-mapping": true, "tunnel": true,
+	"peer": true, "esp-group": true, "ike-group": true, "table": true,
+}
+
+// the leaves holding a list of values, setting them adds a value instead of replacing
+var vyosMultiValueNodes = map[string]bool{
+	"address": true, "member": true, "name-server": true, "domain-search": true, "network": true,
+}
+
+// ShowConfiguration renders the tree like the output of showCfg
+func (t *VyosConfigTree) ShowConfiguration() string {
+	t.init()
+	lines := make([]string, 0)
+	for _, n := range t.Root.children {
+		lines = renderVyosNode(n, "", lines)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func renderVyosNode(n *VyosConfigNode, indent string, lines []string) []string {
+	name := quoteVyosValue(n.name)
+	if n.isValueNode() {
+		return append(lines, indent+name)
+	}
+
+	if n.Size() == n.ValueSize() {
+		for _, v := range n.Values() {
+			lines = append(lines, fmt.Sprintf("%s%s %s", indent, name, quoteVyosValue(v)))
+		}
+		return lines
+	}
+
+	if !vyosTagNodes[n.name] {
+		lines = append(lines, fmt.Sprintf("%s%s {", indent, name))
+		for _, c := range n.children {
+			lines = renderVyosNode(c, indent+"    ", lines)
+		}
+		return append(lines, indent+"}")
+	}
+
+	for _, c := range n.children {
+		if c.isValueNode() {
+			lines = append(lines, fmt.Sprintf("%s%s %s", indent, name, quoteVyosValue(c.name)))
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("%s%s %s {", indent, name, quoteVyosValue(c.name)))
+		for _, cc := range c.children {
+			lines = renderVyosNode(cc, indent+"    ", lines)
+		}
+		lines = append(lines, indent+"}")
+	}
+	return lines
+}
+
+func cloneVyosConfigTree(t *VyosConfigTree) *VyosConfigTree {
+	t.init()
+	c := &VyosConfigTree{}
+	c.init()
+	for _, l := range t.Root.FullString() {
+		c.AddValue(l)
+	}
+	c.changeCommands = make([]string, 0)
+	return c
+}
+
+// VyosSimulator is an in-memory VyOS for tests, it runs the configure mode commands
+// of the agent and keeps the committed configuration
+type VyosSimulator struct {
+	lock    sync.Mutex
+	running *VyosConfigTree
+	// the commands of each commit
+	History [][]string
+}
+
+func NewVyosSimulator(config string) *VyosSimulator {
+	return &VyosSimulator{
+		running: NewParserFromConfiguration(config).Tree,
+		History: make([][]string, 0),
+	}
+}
+
+// Install makes the agent read and configure the simulator instead of VyOS,
+// the returned function restores the previous hooks
+func (s *VyosSimulator) Install() func() {
+	source, runner := ConfigurationSourceFunc, VyosScriptRunnerFunc
+	ConfigurationSourceFunc = s.ShowConfiguration
+	VyosScriptRunnerFunc = s.Run
+	return func() {
+		ConfigurationSourceFunc, VyosScriptRunnerFunc = source, runner
+	}
+}
+
+func (s *VyosSimulator) ShowConfiguration(ctx context.Context) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.running.ShowConfiguration()
+}
+
+func (s *VyosSimulator) Tree() *VyosConfigTree {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return cloneVyosConfigTree(s.running)
+}
+
+func (s *VyosSimulator) set(working *VyosConfigTree, ws []string) {
+	key := working.Root.get(ws[:len(ws)-1]...)
+	if key != nil && key.ValueSize() == 1 && key.Size() == 1 && !vyosMultiValueNodes[key.name] {
+		working.Set(joinVyosPath(ws))
+	} else {
+		working.AddValue(joinVyosPath(ws))
+	}
+}
+
+// Run runs the commands like a VyOS configure session, changes not committed
+// are discarded at the end. Any error aborts the session
+func (s *VyosSimulator) Run(ctx context.Context, commands string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("%v", r)
+		}
+	}()
+
+	working := cloneVyosConfigTree(s.running)
+	for _, line := range strings.Split(commands, "\n") {
+		// the prompt answer of commit-confirm
+		if i := strings.Index(line, "<<<"); i >= 0 {
+			line = line[:i]
+		}
+
+		ws := splitVyosPath(line)
+		if len(ws) == 0 {
+			continue
+		}
+
+		switch ws[0] {
+		case "set":
+			if len(ws) < 2 {
+				return errors.Errorf("incomplete command: %s", line)
+			}
+			s.set(working, ws[1:])
+		case "delete":
+			if len(ws) < 2 {
+				return errors.Errorf("incomplete command: %s", line)
+			}
+			if !working.Delete(joinVyosPath(ws[1:])) {
+				return errors.Errorf("nothing to delete, the specified node does not exist: %s", line)
+			}
+		case "commit", "commit-confirm":
+			if working.HasChanges() {
+				s.History = append(s.History, working.Commands())
+			}
+			s.running = cloneVyosConfigTree(working)
+			working = cloneVyosConfigTree(s.running)
+		case "discard":
+			working = cloneVyosConfigTree(s.running)
+		case "configure", "exit", "save", "confirm", "comment":
+		default:
+			return errors.Errorf("invalid command: %s", line)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"baremetal/utils"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const vyosSimulatorBootConfig = `interfaces {
+    ethernet eth0 {
+        address 172.20.14.209/16
+        address 10.0.0.1/24
+        description "saved by someone"
+        hw-id fa:da:21:1f:1a:00
+    }
+    ethernet eth1 {
+        hw-id fa:da:21:1f:1a:01
+    }
+    loopback lo
+}
+system {
+    host-name vyos
+    login {
+        user vyos {
+            authentication {
+                plaintext-password "a b"
+            }
+        }
+    }
+}
+/* Warning: Do not remove the following line. */
+`
+
+func TestVyosSimulator(t *testing.T) {
+	ctx := context.Background()
+	s := NewVyosSimulator(vyosSimulatorBootConfig)
+
+	// the rendered config is parsed back into the same tree
+	utils.Assert(s.ShowConfiguration(ctx) == strings.Replace(vyosSimulatorBootConfig,
+		"/* Warning: Do not remove the following line. */\n", "", 1), s.ShowConfiguration(ctx))
+	utils.Assert(NewParserFromConfiguration(s.ShowConfiguration(ctx)).Tree.String() == s.Tree().String(), s.Tree().String())
+
+	utils.PanicOnError(s.Run(ctx, `set interfaces ethernet eth0 address 10.0.1.1/24
+set system host-name router
+set system login user vyos authentication plaintext-password "c d"
+commit
+set system host-name lost
+discard
+delete interfaces ethernet eth1
+set service ssh port 22
+commit-confirm 1 <<< "y"
+set service ssh port 2222`))
+
+	tree := s.Tree()
+	utils.Assert(tree.Get("interfaces ethernet eth0 address").ValueSize() == 3, tree.String())
+	utils.Assert(tree.Get("system host-name").Value() == "router", tree.String())
+	utils.Assert(tree.Get("system login user vyos authentication plaintext-password").Value() == "c d", tree.String())
+	utils.Assert(tree.Get("interfaces ethernet eth1") == nil, tree.String())
+	utils.Assert(tree.Get("service ssh port").Value() == "22", "uncommitted changes are discarded")
+	utils.Assert(len(s.History) == 2, fmt.Sprint(s.History))
+	utils.Assert(strings.Contains(s.ShowConfiguration(ctx), "        plaintext-password \"c d\"\n"), s.ShowConfiguration(ctx))
+
+	for _, bad := range []string{"sett a b\ncommit", "set\ncommit", "delete service dns\ncommit", `set system host-name "x`} {
+		before := s.ShowConfiguration(ctx)
+		utils.Assertf(s.Run(ctx, bad) != nil, "%s should fail", bad)
+		utils.Assertf(s.ShowConfiguration(ctx) == before, "%s should change nothing", bad)
+	}
+}
+
+// what zvrboot does to the vyos
+func TestVyosSimulatorBoot(t *testing.T) {
+	ctx := context.Background()
+	s := NewVyosSimulator(vyosSimulatorBootConfig)
+	defer s.Install()()
+
+	tree := NewParserFromShowConfiguration(ctx).Tree
+	tree.ResetEthernetInterfaces()
+	tree.Apply(ctx, true)
+
+	tree = NewParserFromShowConfiguration(ctx).Tree
+	utils.Assert(tree.Get("interfaces ethernet eth0 address") == nil, tree.String())
+	utils.Assert(tree.Get("interfaces ethernet eth0 hw-id").Value() == "fa:da:21:1f:1a:00", tree.String())
+
+	tree.Setf("interfaces ethernet eth0 address 172.20.14.209/16")
+	tree.SetNicDefaultFirewall("eth0", "172.20.14.209", false, 22)
+	tree.SetNicDefaultFirewall("eth1", "192.168.0.1", true, 22)
+	tree.Apply(ctx, true)
+
+	tree = NewParserFromShowConfiguration(ctx).Tree
+	utils.Assert(tree.Get("interfaces ethernet eth0 firewall local name").Value() == "eth0.local", tree.String())
+	utils.Assert(tree.Get("firewall name eth0.local rule 3 action").Value() == "accept", tree.String())
+	utils.Assert(tree.Get("firewall name eth1.local rule 3 action").Value() == "reject", tree.String())
+	utils.Assert(tree.Get("firewall name eth1.in rule 1 state new").Value() == "enable", tree.String())
+	utils.Assert(tree.Get("firewall name eth0.in rule 9999 state new").Value() == "enable", tree.String())
+	utils.Assert(tree.Get("firewall name eth0.in default-action").Value() == "reject", tree.String())
+	fmt.Println(s.ShowConfiguration(ctx))
+}
+
+// configureVyos of zvrboot end to end, the saved config of eth0 is reset and the
+// bootstrap info is applied
+func TestVyosSimulatorBootstrap(t *testing.T) {
+	ctx := context.Background()
+	s := NewVyosSimulator(vyosSimulatorBootConfig)
+	defer s.Install()()
+
+	info, err := utils.ParseBootstrapInfo([]byte(`{
+		"managementNic": {"deviceName": "eth0", "mac": "fa:da:21:1f:1a:00", "ip": "172.20.14.209", "netmask": "255.255.0.0",
+			"gateway": "172.20.0.1", "category": "Private"},
+		"additionalNics": [
+			{"deviceName": "eth1", "mac": "fa:da:21:1f:1a:01", "ip": "10.86.4.132", "netmask": "255.255.255.0",
+				"gateway": "10.86.4.1", "isDefaultRoute": true, "category": "Public", "mtu": 1450}
+		],
+		"publicKey": "ssh-rsa AAAAB3NzaC1yc2E root@mn",
+		"sshPort": 2222,
+		"vyosPassword": "password",
+		"routes": [{"destination": "10.0.0.0/8", "nextHop": "10.86.4.254"}, {"destination": "10.1.0.0/16", "nic": "eth1"}]
+	}`))
+	utils.PanicOnError(err)
+
+	ResetVyos(ctx)
+	tree := NewParserFromShowConfiguration(ctx).Tree
+	defaultNic, defaultGW := tree.SetBootstrapConfig(info, true)
+	tree.Apply(ctx, true)
+	utils.Assert(defaultNic == "eth1" && defaultGW == "10.86.4.1", defaultNic+" "+defaultGW)
+
+	tree = NewParserFromShowConfiguration(ctx).Tree
+	utils.Assert(tree.Get("interfaces ethernet eth0 description") == nil, "the saved config is reset")
+	utils.Assert(tree.Get("interfaces ethernet eth0 address").ValueSize() == 1, tree.String())
+	utils.Assert(tree.Get("interfaces ethernet eth0 address").Value() == "172.20.14.209/16", tree.String())
+	utils.Assert(tree.Get("interfaces ethernet eth0 hw-id").Value() == "fa:da:21:1f:1a:00", tree.String())
+	utils.Assert(tree.Get("interfaces ethernet eth1 mtu").Value() == "1450", tree.String())
+	utils.Assert(tree.Get("service ssh port").Value() == "2222", tree.String())
+	utils.Assert(tree.Get("service ssh listen-address").Value() == "172.20.14.209", tree.String())
+	utils.Assert(tree.Get("system login user vyos authentication public-keys root@mn type").Value() == "ssh-rsa", tree.String())
+	utils.Assert(tree.Get("system login user vyos authentication plaintext-password").Value() == "password", tree.String())
+	utils.Assert(tree.Get("protocols static route 0.0.0.0/0 next-hop 10.86.4.1") != nil, tree.String())
+	utils.Assert(tree.Get("protocols static route 10.0.0.0/8 next-hop 10.86.4.254") != nil, tree.String())
+	utils.Assert(tree.Get("protocols static interface-route 10.1.0.0/16 next-hop-interface eth1") != nil, tree.String())
+	utils.Assert(tree.Get("firewall name eth1.local default-action").Value() == "reject", tree.String())
+	utils.Assert(tree.Get("interfaces ethernet eth1 firewall in name").Value() == "eth1.in", tree.String())
+
+	// the iptables is used instead of the vyos firewall
+	s = NewVyosSimulator(vyosSimulatorBootConfig)
+	defer s.Install()()
+	info.SkipVyosIptables = true
+	ResetVyos(ctx)
+	tree = NewParserFromShowConfiguration(ctx).Tree
+	defaultNic, _ = tree.SetBootstrapConfig(info, false)
+	tree.Apply(ctx, true)
+
+	tree = NewParserFromShowConfiguration(ctx).Tree
+	utils.Assert(defaultNic == "", defaultNic)
+	utils.Assert(tree.Get("firewall") == nil, tree.String())
+	utils.Assert(tree.Get("system login user vyos authentication plaintext-password").Value() == "a b", tree.String())
+	utils.Assert(len(s.History) == 2, fmt.Sprint(s.History))
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"baremetal/utils"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	VYOS_CONFIG_ARCHIVE_DIR  = "/home/vyos/baremetal/config-archive"
+	MAX_VYOS_CONFIG_ARCHIVES = 20
+)
+
+// the commands run in configure mode, the last one is supposed to be a commit
+const vyosConfigureScriptTempl = `#!/bin/vbash
+source /opt/vyatta/etc/functions/script-template
+
+configure
+%s
+
+if [ $? -ne 0 ]; then
+	echo "fail to commit"
+	exit 1
+else
+	exit
+fi
+
+`
+
+// the last commands of a transaction: commit-confirm makes VyOS revert the commit
+// by itself if it's not confirmed in time, it's the last resort in case the agent
+// loses its connection and cannot roll back, its prompt is answered from stdin
+const (
+	vyosCommitConfirmTempl = "%s\ncommit-confirm %d <<< \"y\""
+	vyosConfirmCommand     = "confirm"
+)
+
+var (
+	vyosConfigArchiveDir = VYOS_CONFIG_ARCHIVE_DIR
+
+	// VyosConfigVerifier checks the agent still works after a transactional apply,
+	// the change is rolled back if it returns an error
+	VyosConfigVerifier = verifyAgentReachable
+)
+
+// VyosConfigArchive is the configuration committed by a transactional apply
+type VyosConfigArchive struct {
+	Id     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Config string    `json:"config,omitempty"`
+}
+
+// the management node talks to the agent through its listening address and the
+// agent replies to the management node, so both must survive the commit
+func verifyAgentReachable(ctx context.Context) error {
+	if ip := commandOptions.Ip; ip != "" && ip != "0.0.0.0" {
+		assigned, err := isLocalAddress(ip)
+		if err != nil {
+			return err
+		}
+		if !assigned {
+			return errors.Errorf("the listening address %s of the agent is no longer on any interface", ip)
+		}
+	}
+
+	if ip := ManagementNodeIp(); ip != "" {
+		cmd := &utils.Command{
+			Argv:    []string{"ping", "-c", "3", "-W", "1", ip},
+			Timeout: 10 * time.Second,
+		}
+		if _, err := cmd.Run(ctx); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("the management node %s is not reachable", ip))
+		}
+	}
+
+	return nil
+}
+
+func isLocalAddress(ip string) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.String() == ip {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func runVyosConfigureCommands(ctx context.Context, commands string) error {
+	if VyosScriptRunnerFunc != nil {
+		return VyosScriptRunnerFunc(ctx, commands)
+	}
+
+	bash := &utils.Bash{
+		Command: fmt.Sprintf(vyosConfigureScriptTempl, commands),
+		NoLog:   true,
+		UseTemp: true,
+		Secrets: VyosCommandSecrets(commands),
+	}
+	return withVyosCommitLock(func() error {
+		return bash.RunChecked(ctx)
+	})
+}
+
+// RollbackVyosConfig brings the running configuration back to the config text,
+// only the difference is committed
+func RollbackVyosConfig(ctx context.Context, config string) error {
+	tree := NewParserFromShowConfiguration(ctx).Tree
+	commands := DiffVyosConfig(tree, NewParserFromConfiguration(config).Tree)
+	if len(commands) == 0 {
+		return nil
+	}
+
+	log.Debugf("[Configure VYOS] roll back: %s", utils.RedactSecrets(strings.Join(commands, "\n"), VyosCommandSecrets(strings.Join(commands, "\n"))...))
+	if UNIT_TEST && VyosScriptRunnerFunc == nil {
+		fmt.Println(strings.Join(commands, "\n"))
+		return nil
+	}
+	return runVyosConfigureCommands(ctx, strings.Join(commands, "\n")+"\ncommit")
+}
+
+// ApplyTransaction commits the changes with commit-confirm, then verifies the agent
+// with VyosConfigVerifier. On any failure the configuration before the apply is
+// restored and the error is returned, otherwise the new configuration is archived
+func (t *VyosConfigTree) ApplyTransaction(ctx context.Context, timeout time.Duration) error {
+	if len(t.changeCommands) == 0 {
+		log.Debug("[Vyos Configuration] no changes to apply")
+		return nil
+	}
+
+	command := strings.Join(t.changeCommands, "\n")
+	if UNIT_TEST && VyosScriptRunnerFunc == nil {
+		fmt.Println(command)
+		return nil
+	}
+
+	// commit-confirm counts in minutes
+	minutes := int((timeout + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+
+	before := VyosShowConfiguration(ctx)
+	log.Debugf("[Configure VYOS] commit-confirm %d: %s", minutes, utils.RedactSecrets(command, VyosCommandSecrets(command)...))
+	err := runVyosConfigureCommands(ctx, fmt.Sprintf(vyosCommitConfirmTempl, command, minutes))
+	if err == nil {
+		err = VyosConfigVerifier(ctx)
+	}
+
+	if err != nil {
+		log.Warnf("[Configure VYOS] roll back the failed apply: %s", err)
+		if rerr := RollbackVyosConfig(ctx, before); rerr != nil {
+			log.Warnf("[Configure VYOS] unable to roll back, wait for commit-confirm to revert: %s", rerr)
+			return errors.Wrap(err, fmt.Sprintf("and the rollback failed: %s", rerr))
+		}
+	}
+
+	// the rollback is a plain commit, so confirm in both cases to cancel the pending revert
+	if cerr := runVyosConfigureCommands(ctx, vyosConfirmCommand); cerr != nil {
+		log.Warnf("[Configure VYOS] unable to confirm the commit: %s", cerr)
+		if err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, aerr := ArchiveVyosConfig(VyosShowConfiguration(ctx)); aerr != nil {
+		log.Warnf("[Configure VYOS] unable to archive the configuration: %s", aerr)
+	}
+	return nil
+}
+
+// ArchiveVyosConfig keeps the config, only the latest MAX_VYOS_CONFIG_ARCHIVES are kept
+func ArchiveVyosConfig(config string) (*VyosConfigArchive, error) {
+	now := time.Now()
+	a := &VyosConfigArchive{Id: utils.NewArchiveId(now), Time: now, Config: config}
+	if err := utils.WriteArchive(vyosConfigArchiveDir, a.Id, a, MAX_VYOS_CONFIG_ARCHIVES); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// ListVyosConfigArchives returns the archives without config, the newest first
+func ListVyosConfigArchives() ([]*VyosConfigArchive, error) {
+	infos, err := utils.ListArchives(vyosConfigArchiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	archives := []*VyosConfigArchive{}
+	for _, i := range infos {
+		archives = append(archives, &VyosConfigArchive{Id: i.Id, Time: i.Time})
+	}
+
+	return archives, nil
+}
+
+func GetVyosConfigArchive(id string) (*VyosConfigArchive, error) {
+	a := &VyosConfigArchive{}
+	if err := utils.ReadArchive(vyosConfigArchiveDir, id, a); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"baremetal/utils"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVyosConfigArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vyos-config-archive")
+	utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	vyosConfigArchiveDir = dir
+	defer func() { vyosConfigArchiveDir = VYOS_CONFIG_ARCHIVE_DIR }()
+
+	archives, err := ListVyosConfigArchives()
+	utils.PanicOnError(err)
+	utils.Assert(len(archives) == 0, fmt.Sprint(archives))
+
+	var first *VyosConfigArchive
+	for i := 0; i < MAX_VYOS_CONFIG_ARCHIVES+2; i++ {
+		a, err := ArchiveVyosConfig(fmt.Sprintf("service {\n    ssh {\n        port %d\n    }\n}\n", i))
+		utils.PanicOnError(err)
+		if i == MAX_VYOS_CONFIG_ARCHIVES+1 {
+			first = a
+		}
+	}
+
+	archives, err = ListVyosConfigArchives()
+	utils.PanicOnError(err)
+	utils.Assert(len(archives) == MAX_VYOS_CONFIG_ARCHIVES, fmt.Sprint(len(archives)))
+	utils.Assert(archives[0].Id == first.Id && archives[0].Config == "", archives[0].Id)
+
+	a, err := GetVyosConfigArchive(first.Id)
+	utils.PanicOnError(err)
+	utils.Assert(NewParserFromConfiguration(a.Config).Tree.Get("service ssh port").Value() == "21", a.Config)
+}
+
+func TestVyosRollbackConfig(t *testing.T) {
+	ctx := context.Background()
+	UNIT_TEST = true
+	source := ConfigurationSourceFunc
+	defer func() { ConfigurationSourceFunc = source }()
+	ConfigurationSourceFunc = func(ctx context.Context) string {
+		return "service {\n    ssh {\n        port 2222\n    }\n}\n"
+	}
+
+	runner := VyosScriptRunnerFunc
+	defer func() { VyosScriptRunnerFunc = runner }()
+	scripts := []string{}
+	VyosScriptRunnerFunc = func(ctx context.Context, commands string) error {
+		scripts = append(scripts, commands)
+		return nil
+	}
+
+	utils.PanicOnError(RollbackVyosConfig(ctx, "service {\n    ssh {\n        port 22\n    }\n}\n"))
+	utils.Assert(len(scripts) == 1, fmt.Sprint(scripts))
+	utils.Assert(scripts[0] == "delete service ssh port 2222\nset service ssh port 22\ncommit", scripts[0])
+
+	// nothing is committed without difference
+	utils.PanicOnError(RollbackVyosConfig(ctx, ConfigurationSourceFunc(ctx)))
+	utils.Assert(len(scripts) == 1, fmt.Sprint(scripts))
+}
+
+func TestVyosConfigArchiveId(t *testing.T) {
+	for _, id := range []string{"../../etc/shadow", "1/../2", "", "12a"} {
+		_, err := GetVyosConfigArchive(id)
+		utils.Assert(err != nil && strings.Contains(err.Error(), "invalid archive id"), id)
+	}
+}
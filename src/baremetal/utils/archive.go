@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the archives are the json files <id>.json in a directory, the id is the
+// UnixNano of the time they are taken, e.g. the iptables snapshots and the
+// vyos config archives
+var archiveIdRegex = regexp.MustCompile(`^[0-9]+$`)
+
+type ArchiveInfo struct {
+	Id   string
+	Time time.Time
+}
+
+func NewArchiveId(t time.Time) string {
+	return fmt.Sprintf("%d", t.UnixNano())
+}
+
+// ArchivePath returns the file of the archive, the id comes from the API so
+// anything but digits is refused
+func ArchivePath(dir, id string) (string, error) {
+	if !archiveIdRegex.MatchString(id) {
+		return "", errors.Errorf("invalid archive id[%s], it must be digits", id)
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+// ListArchives returns the archives in dir, the newest first
+func ListArchives(dir string) ([]ArchiveInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []ArchiveInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, f := range files {
+		if id := strings.TrimSuffix(f.Name(), ".json"); id != f.Name() && archiveIdRegex.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	// ids are nanoseconds with the same number of digits
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	archives := []ArchiveInfo{}
+	for _, id := range ids {
+		a := ArchiveInfo{Id: id}
+		var nano int64
+		if _, err := fmt.Sscanf(id, "%d", &nano); err == nil {
+			a.Time = time.Unix(0, nano)
+		}
+		archives = append(archives, a)
+	}
+
+	return archives, nil
+}
+
+// WriteArchive saves v as the archive id, then only the latest keep archives are kept
+func WriteArchive(dir, id string, v interface{}, keep int) error {
+	path, err := ArchivePath(dir, id)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err = MkdirForFile(path, 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		return err
+	}
+
+	archives, err := ListArchives(dir)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(archives); i++ {
+		if err := os.Remove(filepath.Join(dir, archives[i].Id+".json")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ReadArchive(dir, id string, v interface{}) error {
+	path, err := ArchivePath(dir, id)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(b, v); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("unable to parse archive %s", path))
+	}
+	return nil
+}
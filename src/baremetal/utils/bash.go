@@ -2,11 +2,11 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"os/exec"
-	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
@@ -20,6 +20,10 @@ type Bash struct {
 	Arguments map[string]string
 	NoLog     bool
 	UseTemp   bool
+	// the command and its children are killed after the timeout, 0 means no timeout
+	Timeout time.Duration
+	// the secrets in the command and its output are masked in the logs and errors
+	Secrets []string
 
 	retCode int
 	stdout  string
@@ -53,31 +57,46 @@ func (b *Bash) build() error {
 }
 
 func (b *Bash) Run() error {
-	ret, so, se, err := b.RunWithReturn()
+	return b.RunChecked(context.Background())
+}
+
+// RunChecked is Run with the context, a non-zero exit is an error
+func (b *Bash) RunChecked(ctx context.Context) error {
+	ret, so, se, err := b.RunWithContext(ctx)
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("failed to execute the command[%s] because of an internal errro", b.Command))
+		return errors.Wrap(err, fmt.Sprintf("failed to execute the command[%s] because of an internal errro", b.redact(b.Command)))
 	}
 
 	if ret != 0 {
 		return errors.New(fmt.Sprintf("failed to exectue the command[%s]\nreturn code:%d\nstdout:%s\nstderr:%s\n",
-			b.Command, ret, so, se))
+			b.redact(b.Command), ret, b.redact(so), b.redact(se)))
 	}
 
 	return nil
 }
 
 func (b *Bash) RunWithReturn() (retCode int, stdout, stderr string, err error) {
+	return b.RunWithContext(context.Background())
+}
+
+// RunWithContext runs the command by the Command runner, the error is returned
+// only if the command cannot run to the end, e.g. it's killed after the Timeout
+func (b *Bash) RunWithContext(ctx context.Context) (retCode int, stdout, stderr string, err error) {
 	if err = b.build(); err != nil {
 		b.err = err
 		return -1, "", "", err
 	}
 
 	if !b.NoLog {
-		logrus.Debugf("shell start: %s", b.Command)
+		RequestLogger(ctx).Debugf("shell start: %s", b.redact(b.Command))
 	}
 
-	var so, se bytes.Buffer
-	var cmd *exec.Cmd
+	cmd := &Command{
+		Argv:    []string{"bash", "-c", b.Command},
+		Timeout: b.Timeout,
+		NoLog:   true,
+		Secrets: b.Secrets,
+	}
 
 	if b.UseTemp || len(b.Command) > 1024*4 {
 		content := []byte(b.Command)
@@ -89,45 +108,31 @@ func (b *Bash) RunWithReturn() (retCode int, stdout, stderr string, err error) {
 		PanicOnError(err)
 		err = tmpfile.Close()
 		PanicOnError(err)
-		cmd = exec.Command("bash", "-c", tmpfile.Name())
-		//ioutil.WriteFile(tmpfile.Name(), content, 0777)
-		//path := "/home/vyos/zvrcommand"
-		//ioutil.WriteFile(path, content, 0777)
-		//cmd = exec.Command("bash", "-c", path)
+		cmd.Argv = []string{"bash", "-c", tmpfile.Name()}
 		defer os.Remove(tmpfile.Name())
-	} else {
-		cmd = exec.Command("bash", "-c", b.Command)
 	}
 
-	cmd.Stdout = &so
-	cmd.Stderr = &se
-
-	var waitStatus syscall.WaitStatus
-	if err := cmd.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			waitStatus = exitError.Sys().(syscall.WaitStatus)
-			retCode = waitStatus.ExitStatus()
-		} else {
-			panic(errors.Errorf("unable to get return code, %s", err))
-		}
-	} else {
-		waitStatus = cmd.ProcessState.Sys().(syscall.WaitStatus)
-		retCode = waitStatus.ExitStatus()
+	result, err := cmd.Run(ctx)
+	if e, ok := err.(*CommandError); ok && e.Exited() {
+		err = nil
 	}
 
-	stdout = string(so.Bytes())
-	stderr = string(se.Bytes())
+	retCode = -1
+	if result != nil {
+		retCode, stdout, stderr = result.ExitCode, result.Stdout, result.Stderr
+	}
 
 	b.retCode = retCode
 	b.stdout = stdout
 	b.stderr = stderr
+	b.err = err
 
 	if !b.NoLog {
-		logrus.WithFields(logrus.Fields{
+		RequestLogger(ctx).WithFields(logrus.Fields{
 			"return code": fmt.Sprintf("%v", retCode),
-			"stdout":      stdout,
-			"stderr":      stderr,
-		}).Debugf("shell done: %s", b.Command)
+			"stdout":      b.redact(stdout),
+			"stderr":      b.redact(stderr),
+		}).Debugf("shell done: %s", b.redact(b.Command))
 	}
 
 	return
@@ -136,15 +141,19 @@ func (b *Bash) RunWithReturn() (retCode int, stdout, stderr string, err error) {
 func (bash *Bash) PanicIfError() {
 	if bash.err != nil {
 		panic(errors.New(fmt.Sprintf("shell failure[command: %v], internal error: %v",
-			bash.Command, bash.err)))
+			bash.redact(bash.Command), bash.err)))
 	}
 
 	if bash.retCode != 0 {
 		panic(errors.New(fmt.Sprintf("shell failure[command: %v, return code: %v, stdout: %v, stderr: %v",
-			bash.Command, bash.retCode, bash.stdout, bash.stderr)))
+			bash.redact(bash.Command), bash.retCode, bash.redact(bash.stdout), bash.redact(bash.stderr))))
 	}
 }
 
+func (b *Bash) redact(s string) string {
+	return RedactSecrets(s, b.Secrets...)
+}
+
 func NewBash() *Bash {
 	return &Bash{}
 }
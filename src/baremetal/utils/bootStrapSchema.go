@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the payloads without version are treated as version 1
+	BOOTSTRAP_INFO_VERSION = 1
+	MANAGEMENT_NIC_NAME    = "eth0"
+	PRIVATE_NIC_CATEGORY   = "Private"
+)
+
+// BootstrapNic is a nic in the bootstrap info, the management nic is always eth0
+type BootstrapNic struct {
+	Name              string `json:"deviceName"`
+	Mac               string `json:"mac"`
+	Ip                string `json:"ip"`
+	Netmask           string `json:"netmask"`
+	Gateway           string `json:"gateway"`
+	IsDefaultRoute    bool   `json:"isDefaultRoute"`
+	Category          string `json:"category"`
+	L2Type            string `json:"l2type"`
+	PhysicalInterface string `json:"physicalInterface"`
+	Vni               int    `json:"vni"`
+	Mtu               int    `json:"mtu"`
+	// ethernet, vlan, bond or bridge, a nic of L2VlanNetwork on another physical
+	// interface is a vlan by default, otherwise it is ethernet
+	Type     string   `json:"type"`
+	Slaves   []string `json:"slaves"`
+	BondMode string   `json:"bondMode"`
+}
+
+type BootstrapRoute struct {
+	Destination string `json:"destination"`
+	NextHop     string `json:"nextHop"`
+	Nic         string `json:"nic"`
+}
+
+// BootstrapInfo is sent through the virtio port (or the file on ESX) when the vyos boots
+type BootstrapInfo struct {
+	Version          int              `json:"version"`
+	ManagementNic    *BootstrapNic    `json:"managementNic"`
+	AdditionalNics   []*BootstrapNic  `json:"additionalNics"`
+	Routes           []BootstrapRoute `json:"routes"`
+	PublicKey        string           `json:"publicKey"`
+	SshPort          int              `json:"sshPort"`
+	VyosPassword     string           `json:"vyosPassword"`
+	ManagementNodeIp string           `json:"managementNodeIp"`
+	OtherRouters     []string         `json:"otherRouters"`
+	SkipVyosIptables bool             `json:"skipVyosIptables"`
+	RouterId         string           `json:"routerid"`
+}
+
+// BootstrapFieldError names the field of the bootstrap info which is wrong,
+// e.g. additionalNics[1].ip
+type BootstrapFieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *BootstrapFieldError) Error() string {
+	return fmt.Sprintf("invalid bootstrap info field %s: %s", e.Field, e.Message)
+}
+
+type BootstrapFieldErrors []*BootstrapFieldError
+
+func (es BootstrapFieldErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseBootstrapInfo parses, fills the defaults and validates the bootstrap info
+func ParseBootstrapInfo(content []byte) (*BootstrapInfo, error) {
+	info := &BootstrapInfo{}
+	if err := json.Unmarshal(content, info); err != nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, &BootstrapFieldError{Field: e.Field, Message: fmt.Sprintf("expect %v but got %s", e.Type, e.Value)}
+		}
+		return nil, errors.Wrap(err, "unable to JSON parse the bootstrap info")
+	}
+
+	info.setDefaults()
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (b *BootstrapInfo) setDefaults() {
+	if b.Version == 0 {
+		b.Version = BOOTSTRAP_INFO_VERSION
+	}
+	if b.SshPort == 0 {
+		b.SshPort = DEFAULT_SSH_PORT
+	}
+	if b.ManagementNic != nil && b.ManagementNic.Name == "" {
+		b.ManagementNic.Name = MANAGEMENT_NIC_NAME
+	}
+}
+
+type bootstrapValidator struct {
+	errs BootstrapFieldErrors
+}
+
+func (v *bootstrapValidator) fail(field, f string, args ...interface{}) {
+	v.errs = append(v.errs, &BootstrapFieldError{Field: field, Message: fmt.Sprintf(f, args...)})
+}
+
+func (v *bootstrapValidator) required(field, value string) bool {
+	if value == "" {
+		v.fail(field, "cannot be empty")
+		return false
+	}
+	return true
+}
+
+func (v *bootstrapValidator) ip(field, value string) {
+	if net.ParseIP(value) == nil || strings.Contains(value, ":") {
+		v.fail(field, "%s is not an IPv4 address", value)
+	}
+}
+
+func (v *bootstrapValidator) nic(field string, n *BootstrapNic) {
+	v.required(field+".deviceName", n.Name)
+	// the mac of a virtual link is optional, the kernel generates one
+	link := n.Link()
+	if link == nil && v.required(field+".mac", n.Mac) || n.Mac != "" {
+		if _, err := net.ParseMAC(n.Mac); err != nil {
+			v.fail(field+".mac", "%s is not a mac address", n.Mac)
+		}
+	}
+	if link != nil && n.Name != "" {
+		if err := link.Validate(); err != nil {
+			v.fail(field, "%s", err)
+		}
+	} else if n.Type != "" && n.Type != LINK_TYPE_ETHERNET {
+		v.fail(field+".type", "unsupported type %s", n.Type)
+	} else if n.Mtu != 0 && (n.Mtu < 68 || n.Mtu > 9216) {
+		v.fail(field+".mtu", "%d is not a valid mtu", n.Mtu)
+	}
+	if v.required(field+".ip", n.Ip) {
+		v.ip(field+".ip", n.Ip)
+	}
+	if v.required(field+".netmask", n.Netmask) {
+		if m := net.ParseIP(n.Netmask).To4(); m == nil {
+			v.fail(field+".netmask", "%s is not a netmask", n.Netmask)
+		} else if ones, bits := net.IPMask(m).Size(); ones == 0 && bits == 0 {
+			v.fail(field+".netmask", "%s is not a netmask", n.Netmask)
+		}
+	}
+	// the gateway is needed only if the default route goes through the nic
+	if n.IsDefaultRoute && v.required(field+".gateway", n.Gateway) || n.Gateway != "" {
+		v.ip(field+".gateway", n.Gateway)
+	}
+}
+
+// Validate checks all fields and returns BootstrapFieldErrors naming every wrong field
+func (b *BootstrapInfo) Validate() error {
+	v := &bootstrapValidator{}
+	if b.Version > BOOTSTRAP_INFO_VERSION {
+		v.fail("version", "%d is newer than the supported version %d", b.Version, BOOTSTRAP_INFO_VERSION)
+	}
+
+	if b.ManagementNic == nil {
+		v.fail("managementNic", "cannot be empty")
+	} else {
+		v.nic("managementNic", b.ManagementNic)
+		if b.ManagementNic.Name != MANAGEMENT_NIC_NAME {
+			v.fail("managementNic.deviceName", "must be %s but got %s", MANAGEMENT_NIC_NAME, b.ManagementNic.Name)
+		}
+	}
+
+	names := map[string]bool{MANAGEMENT_NIC_NAME: true}
+	for i, n := range b.AdditionalNics {
+		field := fmt.Sprintf("additionalNics[%d]", i)
+		if n == nil {
+			v.fail(field, "cannot be null")
+			continue
+		}
+		v.nic(field, n)
+		if names[n.Name] {
+			v.fail(field+".deviceName", "duplicated nic %s", n.Name)
+		}
+		names[n.Name] = true
+	}
+
+	for i, r := range b.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if _, _, err := net.ParseCIDR(r.Destination); err != nil {
+			v.fail(field+".destination", "%s is not a cidr", r.Destination)
+		}
+		if r.NextHop == "" && r.Nic == "" {
+			v.fail(field, "either nextHop or nic is required")
+		}
+		if r.NextHop != "" {
+			v.ip(field+".nextHop", r.NextHop)
+		}
+		if r.Nic != "" && !names[r.Nic] {
+			v.fail(field+".nic", "no nic %s in the bootstrap info", r.Nic)
+		}
+	}
+
+	// the key is like "ssh-rsa AAAA... root@host"
+	if v.required("publicKey", b.PublicKey) && len(strings.Fields(b.PublicKey)) < 2 {
+		v.fail("publicKey", "must be in the format of '<type> <key> [comment]'")
+	}
+	if b.SshPort < 1 || b.SshPort > 65535 {
+		v.fail("sshPort", "%d is not a port", b.SshPort)
+	}
+	v.required("vyosPassword", b.VyosPassword)
+	if b.ManagementNodeIp != "" {
+		v.ip("managementNodeIp", b.ManagementNodeIp)
+	}
+	for i, ip := range b.OtherRouters {
+		v.ip(fmt.Sprintf("otherRouters[%d]", i), ip)
+	}
+
+	if len(v.errs) != 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// Nics returns the management nic followed by the additional ones
+func (b *BootstrapInfo) Nics() []*BootstrapNic {
+	return append([]*BootstrapNic{b.ManagementNic}, b.AdditionalNics...)
+}
+
+// SshKey splits the public key into type, key and the comment used as the key id
+func (b *BootstrapInfo) SshKey() (keyType, key, id string) {
+	parts := strings.Fields(b.PublicKey)
+	id = "vyos"
+	if len(parts) > 2 {
+		id = parts[2]
+	}
+	return parts[0], parts[1], id
+}
+
+func (n *BootstrapNic) IsPrivate() bool {
+	return n.Category == PRIVATE_NIC_CATEGORY
+}
+
+// Cidr is the address of the nic in the format of 10.0.0.1/24
+func (n *BootstrapNic) Cidr() string {
+	ones, _ := net.IPMask(net.ParseIP(n.Netmask).To4()).Size()
+	return fmt.Sprintf("%s/%d", n.Ip, ones)
+}
+
+func (n *BootstrapNic) CidrContainsIp(ip string) bool {
+	return CheckCIDRContainsIp(ip, n.Cidr())
+}
+
+// Link returns the virtual link to create for the nic, or nil if it is a physical nic
+func (n *BootstrapNic) Link() *LinkSpec {
+	t := n.Type
+	if t == "" && n.L2Type == L2_VLAN_NETWORK && n.PhysicalInterface != "" && n.PhysicalInterface != n.Name {
+		t = LINK_TYPE_VLAN
+	}
+	if t != LINK_TYPE_VLAN && t != LINK_TYPE_BOND && t != LINK_TYPE_BRIDGE {
+		return nil
+	}
+
+	link := &LinkSpec{
+		Name:     n.Name,
+		Type:     t,
+		Slaves:   n.Slaves,
+		BondMode: n.BondMode,
+		Mac:      n.Mac,
+		Mtu:      n.Mtu,
+	}
+	if t == LINK_TYPE_VLAN {
+		link.Parent = n.PhysicalInterface
+		link.VlanId = n.Vni
+	}
+	if n.Ip != "" && n.Netmask != "" {
+		link.Addresses = []string{n.Cidr()}
+	}
+	return link
+}
+
+// Alias is set to the link of the nic to keep the l2 information
+func (n *BootstrapNic) Alias() string {
+	result := ""
+	if n.L2Type != "" {
+		result += fmt.Sprintf("l2type:%s;", n.L2Type)
+	}
+	if n.Category != "" {
+		result += fmt.Sprintf("category:%s;", n.Category)
+	}
+	if n.PhysicalInterface != "" {
+		result += fmt.Sprintf("physicalInterface:%s;", n.PhysicalInterface)
+	}
+	result += fmt.Sprintf("vni:%v;", n.Vni)
+	return result
+}
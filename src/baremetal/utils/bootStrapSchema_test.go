@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// a payload as written into the virtio port by the management node
+const kvmBootstrapPayload = `{
+	"managementNic": {"deviceName": "eth0", "mac": "fa:ac:6e:3b:4f:00", "ip": "172.20.12.34", "netmask": "255.255.0.0",
+		"gateway": "172.20.0.1", "isDefaultRoute": false, "l2type": "L2NoVlanNetwork", "category": "Private", "physicalInterface": "eth0", "vni": 0},
+	"additionalNics": [
+		{"deviceName": "eth1", "mac": "fa:ac:6e:3b:4f:01", "ip": "10.86.4.132", "netmask": "255.255.255.0",
+			"gateway": "10.86.4.1", "isDefaultRoute": true, "l2type": "L2VlanNetwork", "category": "Public", "physicalInterface": "eth1", "vni": 100},
+		{"deviceName": "eth2", "mac": "fa:ac:6e:3b:4f:02", "ip": "192.168.1.1", "netmask": "255.255.255.0", "isDefaultRoute": false}
+	],
+	"publicKey": "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC root@mn",
+	"sshPort": 22,
+	"vyosPassword": "vrouter12#",
+	"managementNodeIp": "172.20.0.10",
+	"otherRouters": ["172.20.12.35"],
+	"routes": [{"destination": "10.0.0.0/8", "nextHop": "10.86.4.254"}, {"destination": "10.1.0.0/16", "nic": "eth2"}]
+}`
+
+func TestParseBootstrapInfo(t *testing.T) {
+	info, err := ParseBootstrapInfo([]byte(kvmBootstrapPayload))
+	PanicOnError(err)
+
+	Assert(info.Version == BOOTSTRAP_INFO_VERSION, "version default")
+	Assert(len(info.Nics()) == 3, "nics")
+	Assert(info.ManagementNic.Cidr() == "172.20.12.34/16", info.ManagementNic.Cidr())
+	Assert(info.ManagementNic.CidrContainsIp(info.ManagementNodeIp), "management node ip")
+	Assert(info.ManagementNic.IsPrivate(), "private")
+	Assert(info.AdditionalNics[0].Alias() == "l2type:L2VlanNetwork;category:Public;physicalInterface:eth1;vni:100;", info.AdditionalNics[0].Alias())
+	// the gateway is optional if the nic is not the default route
+	Assert(info.AdditionalNics[1].Gateway == "", "gateway")
+
+	typ, key, id := info.SshKey()
+	Assert(typ == "ssh-rsa" && key == "AAAAB3NzaC1yc2EAAAADAQABAAABAQC" && id == "root@mn", "ssh key")
+}
+
+func TestParseBootstrapInfoDefaults(t *testing.T) {
+	// the minimal payload of old management nodes
+	info, err := ParseBootstrapInfo([]byte(`{
+		"managementNic": {"mac": "fa:ac:6e:3b:4f:00", "ip": "172.20.12.34", "netmask": "255.255.0.0", "gateway": "172.20.0.1"},
+		"publicKey": "ssh-rsa AAAAB3NzaC1yc2E",
+		"vyosPassword": "password"
+	}`))
+	PanicOnError(err)
+
+	Assert(info.ManagementNic.Name == MANAGEMENT_NIC_NAME, "management nic name")
+	Assert(info.SshPort == DEFAULT_SSH_PORT, "ssh port")
+	Assert(len(info.AdditionalNics) == 0, "additional nics")
+	_, _, id := info.SshKey()
+	Assert(id == "vyos", "key id")
+}
+
+func TestParseBootstrapInfoErrors(t *testing.T) {
+	cases := map[string][]string{
+		`{"managementNic": {"mac": "fa:ac:6e:3b:4f:00", "ip": "172.20.12.34", "netmask": "255.255.0.0", "isDefaultRoute": true},
+			"publicKey": "ssh-rsa AAAA", "vyosPassword": "password"}`: {"managementNic.gateway"},
+		`{"managementNic": {"mac": "fa:ac:6e:3b:4f", "ip": "172.20.12.300", "netmask": "255.0.255.0"},
+			"additionalNics": [{"mac": "fa:ac:6e:3b:4f:01", "ip": "10.0.0.1", "netmask": "255.0.0.0"}],
+			"publicKey": "ssh-rsa", "sshPort": 70000, "otherRouters": ["a.b.c.d"]}`: {
+			"managementNic.mac", "managementNic.ip", "managementNic.netmask", "additionalNics[0].deviceName",
+			"publicKey", "sshPort", "vyosPassword", "otherRouters[0]"},
+		`{"publicKey": "ssh-rsa AAAA", "vyosPassword": "password", "version": 2}`: {"version", "managementNic"},
+		`{"managementNic": {"mac": "fa:ac:6e:3b:4f:00", "ip": "172.20.12.34", "netmask": "255.255.0.0"},
+			"additionalNics": [{"deviceName": "eth0", "mac": "fa:ac:6e:3b:4f:01", "ip": "10.0.0.1", "netmask": "255.0.0.0"}],
+			"routes": [{"destination": "10.0.0.0"}, {"destination": "10.0.0.0/8", "nic": "eth3"}],
+			"publicKey": "ssh-rsa AAAA", "vyosPassword": "password"}`: {
+			"additionalNics[0].deviceName", "routes[0].destination", "routes[0]:", "routes[1].nic"},
+		`{"managementNic": {"mac": "fa:ac:6e:3b:4f:00", "ip": "172.20.12.34", "netmask": "255.255.0.0"}, "sshPort": "22"}`: {"sshPort"},
+	}
+
+	for payload, fields := range cases {
+		_, err := ParseBootstrapInfo([]byte(payload))
+		Assertf(err != nil, "expect error for %s", payload)
+		fmt.Println(err)
+		for _, f := range fields {
+			Assertf(strings.Contains(err.Error(), "field "+f), "expect %s in %s", f, err)
+		}
+	}
+}
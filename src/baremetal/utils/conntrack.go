@@ -0,0 +1,291 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ConntrackFilter selects conntrack entries, empty fields match everything.
+// Ports and state only work together with Proto as required by the conntrack tool
+type ConntrackFilter struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	Proto    string `json:"proto"`
+	SrcPort  int    `json:"srcPort"`
+	DestPort int    `json:"destPort"`
+	State    string `json:"state"`
+	Mark     string `json:"mark"`
+}
+
+// ConntrackTuple is one direction of a connection
+type ConntrackTuple struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	SrcPort  int    `json:"srcPort,omitempty"`
+	DestPort int    `json:"destPort,omitempty"`
+}
+
+type ConntrackEntry struct {
+	Proto    string         `json:"proto"`
+	Timeout  int            `json:"timeout"`
+	State    string         `json:"state,omitempty"`
+	Original ConntrackTuple `json:"original"`
+	Reply    ConntrackTuple `json:"reply"`
+	Mark     string         `json:"mark,omitempty"`
+	Flags    []string       `json:"flags,omitempty"`
+}
+
+type ConntrackSummary struct {
+	Total   int            `json:"total"`
+	ByState map[string]int `json:"byState"`
+	ByProto map[string]int `json:"byProto"`
+}
+
+// a big conntrack table takes seconds to list, but never minutes
+const CONNTRACK_TIMEOUT = 60 * time.Second
+
+var conntrackCountRegex = regexp.MustCompile(`(\d+) flow entries have been`)
+
+var (
+	conntrackProtos = []string{"tcp", "udp", "udplite", "icmp", "icmpv6", "sctp", "dccp", "gre"}
+	// the tcp states known by the conntrack tool
+	conntrackStates = []string{"NONE", "SYN_SENT", "SYN_RECV", "ESTABLISHED", "FIN_WAIT",
+		"CLOSE_WAIT", "LAST_ACK", "TIME_WAIT", "CLOSE", "LISTEN"}
+)
+
+func parseConntrackAddress(name, addr string) (string, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String(), nil
+	}
+	if _, cidr, err := net.ParseCIDR(addr); err == nil {
+		return cidr.String(), nil
+	}
+	return "", errors.Errorf("%s[%s] is not an IP address or a CIDR", name, addr)
+}
+
+// the mark is 'value' or 'value/mask', in decimal or hex
+func parseConntrackMark(mark string) (string, error) {
+	parts := strings.SplitN(mark, "/", 2)
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 0, 32)
+		if err != nil {
+			return "", errors.Errorf("mark[%s] must be a number or number/mask", mark)
+		}
+		parts[i] = strconv.FormatUint(v, 10)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// args validates the filter, all the values end up in the conntrack arguments
+func (f ConntrackFilter) args() ([]string, error) {
+	args := []string{}
+	if f.Src != "" {
+		src, err := parseConntrackAddress("src", f.Src)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-s", src)
+	}
+	if f.Dst != "" {
+		dst, err := parseConntrackAddress("dst", f.Dst)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-d", dst)
+	}
+	if f.Proto != "" {
+		proto := strings.ToLower(f.Proto)
+		if !containsString(conntrackProtos, proto) {
+			return nil, errors.Errorf("proto[%s] must be one of %v", f.Proto, conntrackProtos)
+		}
+		args = append(args, "-p", proto)
+	} else if f.SrcPort != 0 || f.DestPort != 0 || f.State != "" {
+		return nil, errors.New("proto must be specified when filtering by port or state")
+	}
+	for _, port := range []int{f.SrcPort, f.DestPort} {
+		if port < 0 || port > 65535 {
+			return nil, errors.Errorf("%d is not a valid port", port)
+		}
+	}
+	if f.SrcPort != 0 {
+		args = append(args, "--sport", strconv.Itoa(f.SrcPort))
+	}
+	if f.DestPort != 0 {
+		args = append(args, "--dport", strconv.Itoa(f.DestPort))
+	}
+	if f.State != "" {
+		state := strings.ToUpper(f.State)
+		if !containsString(conntrackStates, state) {
+			return nil, errors.Errorf("state[%s] must be one of %v", f.State, conntrackStates)
+		}
+		args = append(args, "--state", state)
+	}
+	if f.Mark != "" {
+		mark, err := parseConntrackMark(f.Mark)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--mark", mark)
+	}
+
+	return args, nil
+}
+
+// run the conntrack tool, it exits with 1 when no entry matches
+func runConntrack(ctx context.Context, op string, f ConntrackFilter) (string, int, error) {
+	args, err := f.args()
+	if err != nil {
+		return "", 0, err
+	}
+
+	cmd := &Command{
+		Argv:       append([]string{"conntrack", op}, args...),
+		Privileged: true,
+		NoLog:      op == "-L",
+		Timeout:    CONNTRACK_TIMEOUT,
+	}
+	res, err := cmd.Run(ctx)
+	if cerr, ok := err.(*CommandError); err != nil && (!ok || !cerr.Exited()) {
+		return "", 0, err
+	}
+
+	m := conntrackCountRegex.FindStringSubmatch(res.Stderr)
+	if m == nil {
+		if err != nil {
+			return "", 0, err
+		}
+		return res.Stdout, 0, nil
+	}
+
+	count, _ := strconv.Atoi(m[1])
+	if err != nil && count != 0 {
+		return "", 0, err
+	}
+
+	return res.Stdout, count, nil
+}
+
+// parse a line of "conntrack -L", e.g.
+// tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=5555 dport=22 src=10.0.0.2 dst=10.0.0.1 sport=22 dport=5555 [ASSURED] mark=0 use=1
+func parseConntrackEntry(line string) (*ConntrackEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, errors.Errorf("unable to parse conntrack entry[%s]", line)
+	}
+
+	entry := &ConntrackEntry{Proto: fields[0]}
+	timeout, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to parse conntrack entry[%s]", line))
+	}
+	entry.Timeout = timeout
+
+	// the first src= starts the original tuple, the second one starts the reply tuple
+	tuples := 0
+	tuple := &entry.Original
+	for _, f := range fields[3:] {
+		if strings.HasPrefix(f, "[") {
+			entry.Flags = append(entry.Flags, strings.Trim(f, "[]"))
+			continue
+		}
+
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			if tuples == 0 {
+				entry.State = f
+			}
+			continue
+		}
+
+		switch kv[0] {
+		case "src":
+			tuples++
+			if tuples == 2 {
+				tuple = &entry.Reply
+			}
+			tuple.Src = kv[1]
+		case "dst":
+			tuple.Dst = kv[1]
+		case "sport":
+			tuple.SrcPort, _ = strconv.Atoi(kv[1])
+		case "dport":
+			tuple.DestPort, _ = strconv.Atoi(kv[1])
+		case "mark":
+			entry.Mark = kv[1]
+		}
+	}
+
+	if tuples != 2 {
+		return nil, errors.Errorf("unable to parse conntrack entry[%s]", line)
+	}
+
+	return entry, nil
+}
+
+func parseConntrackEntries(content string) ([]*ConntrackEntry, error) {
+	entries := []*ConntrackEntry{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		entry, err := parseConntrackEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func ListConntrackEntries(ctx context.Context, f ConntrackFilter) ([]*ConntrackEntry, error) {
+	o, _, err := runConntrack(ctx, "-L", f)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConntrackEntries(o)
+}
+
+// DeleteConntrackEntries deletes the matched entries and returns how many were deleted,
+// an empty filter is refused to avoid flushing the whole table by mistake
+func DeleteConntrackEntries(ctx context.Context, f ConntrackFilter) (int, error) {
+	if f == (ConntrackFilter{}) {
+		return 0, errors.New("refuse to delete conntrack entries without any filter")
+	}
+
+	_, count, err := runConntrack(ctx, "-D", f)
+	return count, err
+}
+
+func SummarizeConntrackEntries(entries []*ConntrackEntry) ConntrackSummary {
+	summary := ConntrackSummary{
+		Total:   len(entries),
+		ByState: map[string]int{},
+		ByProto: map[string]int{},
+	}
+
+	for _, e := range entries {
+		summary.ByProto[e.Proto]++
+		if e.State != "" {
+			summary.ByState[e.State]++
+		} else if len(e.Flags) != 0 {
+			// udp and icmp have no state, use the flags instead e.g. UNREPLIED
+			flags := append([]string{}, e.Flags...)
+			sort.Strings(flags)
+			summary.ByState[strings.Join(flags, ",")]++
+		}
+	}
+
+	return summary
+}
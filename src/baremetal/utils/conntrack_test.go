@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseConntrackEntries(t *testing.T) {
+	content := `tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=5555 dport=22 src=10.0.0.2 dst=10.0.0.1 sport=22 dport=5555 [ASSURED] mark=0 use=1
+udp      17 29 src=10.0.0.1 dst=8.8.8.8 sport=4000 dport=53 [UNREPLIED] src=8.8.8.8 dst=10.0.0.1 sport=53 dport=4000 mark=3 use=1
+icmp     1 29 src=10.0.0.1 dst=10.0.0.3 type=8 code=0 id=1 src=10.0.0.3 dst=10.0.0.1 type=0 code=0 id=1 mark=0 use=1
+`
+	entries, err := parseConntrackEntries(content)
+	PanicOnError(err)
+	Assert(len(entries) == 3, fmt.Sprint(len(entries)))
+
+	tcp := entries[0]
+	Assert(tcp.Proto == "tcp" && tcp.Timeout == 431999 && tcp.State == "ESTABLISHED", fmt.Sprint(tcp))
+	Assert(tcp.Original.Src == "10.0.0.1" && tcp.Original.DestPort == 22, fmt.Sprint(tcp.Original))
+	Assert(tcp.Reply.Src == "10.0.0.2" && tcp.Reply.DestPort == 5555, fmt.Sprint(tcp.Reply))
+	Assert(len(tcp.Flags) == 1 && tcp.Flags[0] == "ASSURED", fmt.Sprint(tcp.Flags))
+
+	udp := entries[1]
+	Assert(udp.State == "" && udp.Mark == "3" && udp.Reply.Src == "8.8.8.8", fmt.Sprint(udp))
+
+	summary := SummarizeConntrackEntries(entries)
+	Assert(summary.Total == 3, fmt.Sprint(summary))
+	Assert(summary.ByProto["tcp"] == 1 && summary.ByProto["icmp"] == 1, fmt.Sprint(summary))
+	Assert(summary.ByState["ESTABLISHED"] == 1 && summary.ByState["UNREPLIED"] == 1, fmt.Sprint(summary))
+
+	_, err = parseConntrackEntries("tcp 6 abc")
+	Assert(err != nil, "should fail")
+}
+
+func TestConntrackFilterArgs(t *testing.T) {
+	args, err := ConntrackFilter{Dst: "10.0.0.1", Proto: "tcp", DestPort: 22, State: "established"}.args()
+	PanicOnError(err)
+	Assert(fmt.Sprint(args) == "[-d 10.0.0.1 -p tcp --dport 22 --state ESTABLISHED]", fmt.Sprint(args))
+
+	_, err = ConntrackFilter{DestPort: 22}.args()
+	Assert(err != nil, "should fail without proto")
+
+	for _, f := range []ConntrackFilter{
+		{Src: "10.0.0.1;reboot"},
+		{Dst: "10.0.0.0/33"},
+		{Proto: "tcp;reboot"},
+		{Proto: "tcp", State: "ESTABLISHED reboot"},
+		{Mark: "1 && reboot"},
+		{Proto: "tcp", DestPort: 70000},
+	} {
+		_, err = f.args()
+		Assert(err != nil, fmt.Sprint(f))
+	}
+
+	args, err = ConntrackFilter{Src: "10.0.0.0/24", Proto: "UDP", Mark: "0x10/0xff"}.args()
+	PanicOnError(err)
+	Assert(fmt.Sprint(args) == "[-s 10.0.0.0/24 -p udp --mark 16/255]", fmt.Sprint(args))
+}
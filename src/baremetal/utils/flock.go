@@ -1,17 +1,78 @@
 package utils
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
-	//"syscall"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
+const (
+	// serializes the iptables-save, compute and iptables-restore cycles of the
+	// agent, the init scripts should run iptables-restore with
+	// 'flock /home/vyos/baremetal/.iptableslock'
+	IPTABLES_LOCK_PATH    = "/home/vyos/baremetal/.iptableslock"
+	IPTABLES_LOCK_TIMEOUT = 2 * time.Minute
+	// the timeout of a single iptables, iptables-save or iptables-restore
+	IPTABLES_COMMAND_TIMEOUT = 30 * time.Second
+
+	fileLockRetryInterval = 50 * time.Millisecond
+)
+
+// FileLockHolder is written into the file by the exclusive holder, so the
+// waiters know who blocks them
+type FileLockHolder struct {
+	Pid     int       `json:"pid"`
+	Command string    `json:"command"`
+	Start   time.Time `json:"start"`
+}
+
+// Stale tells if the holder process has gone, the kernel releases the flock when
+// the process exits, so a stale holder which still blocks the lock means the
+// lock file is inherited by another process
+func (h *FileLockHolder) Stale() bool {
+	err := syscall.Kill(h.Pid, 0)
+	return err == syscall.ESRCH
+}
+
+func (h *FileLockHolder) String() string {
+	s := fmt.Sprintf("pid %d[%s] since %v", h.Pid, h.Command, h.Start.Format(time.RFC3339))
+	if h.Stale() {
+		s += ", the process has gone"
+	}
+	return s
+}
+
+// FileLockTimeoutError is returned when the lock cannot be got in time
+type FileLockTimeoutError struct {
+	Path    string
+	Timeout time.Duration
+	// nil if the lock is held by shared holders or a process not writing the metadata
+	Holder *FileLockHolder
+}
+
+func (e *FileLockTimeoutError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("unable to lock %s in %v", e.Path, e.Timeout)
+	}
+	return fmt.Sprintf("unable to lock %s in %v, held by %s", e.Path, e.Timeout, e.Holder)
+}
+
 // Filelock defines an file lock (shared or exclusive).
 type Filelock struct {
-	file *os.File
+	file      *os.File
+	exclusive bool
 }
 
-func doLockFile(path string, mode int) (*Filelock, error) {
+// doLockFile waits until the lock is got, or the timeout expires if it's not 0
+func doLockFile(path string, mode int, timeout time.Duration) (*Filelock, error) {
+	if err := MkdirForFile(path, 0755); err != nil {
+		return nil, err
+	}
 	// A shared or exclusive lock can be placed on a file regardless
 	// of the mode in which the file was opened.
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
@@ -19,33 +80,99 @@ func doLockFile(path string, mode int) (*Filelock, error) {
 		return nil, fmt.Errorf("open %s: %s", path, err)
 	}
 
-	//err = syscall.Flock(int(file.Fd()), mode)
-	//if err != nil {
-		//file.Close()
-		//return nil, fmt.Errorf("lock %s: %s", path, err)
-	//}
+	if timeout == 0 {
+		err = syscall.Flock(int(file.Fd()), mode)
+	} else {
+		deadline := time.Now().Add(timeout)
+		for {
+			err = syscall.Flock(int(file.Fd()), mode|syscall.LOCK_NB)
+			if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(fileLockRetryInterval)
+		}
+	}
 
-	return &Filelock{file}, nil
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		holder, _ := ReadFileLockHolder(path)
+		return nil, &FileLockTimeoutError{Path: path, Timeout: timeout, Holder: holder}
+	} else if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("lock %s: %s", path, err)
+	}
+
+	lck := &Filelock{file: file, exclusive: mode == syscall.LOCK_EX}
+	if lck.exclusive {
+		// the metadata left by a holder which died without unlocking
+		if holder, _ := ReadFileLockHolder(path); holder != nil && holder.Pid != os.Getpid() {
+			log.Debugf("the previous holder of %s did not unlock: %s", path, holder)
+		}
+		lck.writeHolder()
+	}
+	return lck, nil
+}
+
+func (lck *Filelock) writeHolder() {
+	command, _ := os.Executable()
+	b, _ := json.Marshal(&FileLockHolder{Pid: os.Getpid(), Command: command, Start: time.Now()})
+	if err := lck.file.Truncate(0); err == nil {
+		lck.file.WriteAt(b, 0)
+	}
+}
+
+// ReadFileLockHolder returns the exclusive holder of the lock, nil if no one
+// holds it or the holder doesn't write the metadata
+func ReadFileLockHolder(path string) (*FileLockHolder, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+	holder := &FileLockHolder{}
+	if err = json.Unmarshal(b, holder); err != nil {
+		return nil, err
+	}
+	return holder, nil
 }
 
 // LockFileShar imposes a share lock on a file
 func LockFileShar(path string) (*Filelock, error) {
-	//return doLockFile(path, syscall.LOCK_SH)
-	return doLockFile(path, 1)
+	return doLockFile(path, syscall.LOCK_SH, 0)
 }
 
 // LockFileExcl locks a file exclusively.
 func LockFileExcl(path string) (*Filelock, error) {
-	//return doLockFile(path, syscall.LOCK_EX)
-	return doLockFile(path, 0)
+	return doLockFile(path, syscall.LOCK_EX, 0)
 }
 
-// Unlock unlocks a lock holding by current process.
+// LockFileSharTimeout returns FileLockTimeoutError if the lock cannot be got in time
+func LockFileSharTimeout(path string, timeout time.Duration) (*Filelock, error) {
+	return doLockFile(path, syscall.LOCK_SH, timeout)
+}
+
+// LockFileExclTimeout returns FileLockTimeoutError if the lock cannot be got in time
+func LockFileExclTimeout(path string, timeout time.Duration) (*Filelock, error) {
+	return doLockFile(path, syscall.LOCK_EX, timeout)
+}
+
+// Unlock unlocks a lock holding by current process. The file is kept, removing
+// it would let a waiter lock the removed file while a newcomer locks a new one
 func (lck *Filelock) Unlock() error {
 	file := lck.file
-	//err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	if lck.exclusive {
+		file.Truncate(0)
+	}
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
 	file.Close()
-	os.Remove(file.Name())
-	//return err
-	return nil
+	return err
+}
+
+// WithFileLock runs fn holding the exclusive lock
+func WithFileLock(path string, timeout time.Duration, fn func() error) error {
+	lck, err := LockFileExclTimeout(path, timeout)
+	if err != nil {
+		return err
+	}
+	defer lck.Unlock()
+	return fn()
 }
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flock")
+	PanicOnError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lock")
+
+	// flock is per open file, so the locks in one process exclude each other too
+	lck, err := LockFileExcl(path)
+	PanicOnError(err)
+	holder, err := ReadFileLockHolder(path)
+	PanicOnError(err)
+	Assert(holder.Pid == os.Getpid() && !holder.Stale(), "holder")
+
+	start := time.Now()
+	_, err = LockFileExclTimeout(path, 200*time.Millisecond)
+	e, ok := err.(*FileLockTimeoutError)
+	Assert(ok && e.Holder != nil && e.Holder.Pid == os.Getpid(), "timeout with the holder")
+	Assert(time.Since(start) >= 200*time.Millisecond, "waited")
+	fmt.Println(err)
+
+	_, err = LockFileSharTimeout(path, 100*time.Millisecond)
+	Assert(err != nil, "shared lock while exclusive")
+
+	info, err := os.Stat(path)
+	PanicOnError(err)
+	Assertf(info.Mode().Perm()&^0640 == 0, "the lock file mode %v", info.Mode())
+
+	PanicOnError(lck.Unlock())
+	ok, _ = PathExists(path)
+	Assert(ok, "the lock file is kept")
+	holder, _ = ReadFileLockHolder(path)
+	Assert(holder == nil, "the holder is cleared")
+
+	s1, err := LockFileSharTimeout(path, 100*time.Millisecond)
+	PanicOnError(err)
+	s2, err := LockFileSharTimeout(path, 100*time.Millisecond)
+	PanicOnError(err)
+	_, err = LockFileExclTimeout(path, 100*time.Millisecond)
+	Assert(err != nil, "exclusive lock while shared")
+	PanicOnError(s1.Unlock())
+	PanicOnError(s2.Unlock())
+
+	// the waiter gets the lock once the holder unlocks
+	lck, err = LockFileExcl(path)
+	PanicOnError(err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lck.Unlock()
+	}()
+	err = WithFileLock(path, 2*time.Second, func() error { return nil })
+	PanicOnError(err)
+}
+
+func TestFileLockStaleHolder(t *testing.T) {
+	cmd := exec.Command("true")
+	PanicOnError(cmd.Run())
+
+	holder := &FileLockHolder{Pid: cmd.Process.Pid, Command: "true", Start: time.Now()}
+	Assert(holder.Stale(), "the process has gone")
+	fmt.Println(holder)
+}
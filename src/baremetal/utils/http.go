@@ -2,10 +2,12 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
@@ -21,8 +23,41 @@ func HttpPostWithoutHeaders(url string, obj interface{}) ([]byte, error) {
 }
 
 func HttpPostForObject(url string, headers map[string]string, obj interface{}, retObj interface{}) error {
-	headers["Content-Type"] = "application/json"
-	b, err := HttpPost(url, headers, obj)
+	return HttpPostForObjectRedacted(url, headers, obj, retObj)
+}
+
+// HttpPostForObjectRedacted masks the sensitive fields of the body in the log, see RedactJson
+func HttpPostForObjectRedacted(url string, headers map[string]string, obj interface{}, retObj interface{}, sensitiveFields ...string) error {
+	return HttpPostForObjectWithContext(context.Background(), url, headers, obj, retObj, sensitiveFields...)
+}
+
+// HttpPostForObjectWithContext gives up when the context is done, e.g. a deadline of the call
+func HttpPostForObjectWithContext(ctx context.Context, url string, headers map[string]string, obj interface{}, retObj interface{}, sensitiveFields ...string) error {
+	return httpForObject(ctx, http.MethodPost, url, headers, obj, retObj, sensitiveFields)
+}
+
+func HttpPostForObjectWithoutHeaders(url string, obj interface{}, retObj interface{}) error {
+	return HttpPostForObject(url, nil, obj, retObj)
+}
+
+func HttpGet(url string, headers map[string]string) ([]byte, error) {
+	return HttpDo(context.Background(), http.MethodGet, url, headers, nil, nil)
+}
+
+func HttpGetForObject(url string, headers map[string]string, retObj interface{}) error {
+	return httpForObject(context.Background(), http.MethodGet, url, headers, nil, retObj, nil)
+}
+
+func HttpPut(url string, headers map[string]string, obj interface{}) ([]byte, error) {
+	return HttpDo(context.Background(), http.MethodPut, url, headers, obj, nil)
+}
+
+func HttpPutForObject(url string, headers map[string]string, obj interface{}, retObj interface{}) error {
+	return httpForObject(context.Background(), http.MethodPut, url, headers, obj, retObj, nil)
+}
+
+func httpForObject(ctx context.Context, method string, url string, headers map[string]string, obj interface{}, retObj interface{}, sensitiveFields []string) error {
+	b, err := HttpDo(ctx, method, url, headers, obj, sensitiveFields)
 	if err != nil {
 		return err
 	}
@@ -39,10 +74,7 @@ func HttpPostForObject(url string, headers map[string]string, obj interface{}, r
 	return nil
 }
 
-func HttpPostForObjectWithoutHeaders(url string, obj interface{}, retObj interface{}) error {
-	return HttpPostForObject(url, nil, obj, retObj)
-}
-
+// HttpPostError is returned by all the HTTP helpers for the status codes other than 2xx
 type HttpPostError struct {
 	error
 	statusCode int
@@ -53,51 +85,61 @@ func (e *HttpPostError) StatusCode() int {
 }
 
 func HttpPost(url string, headers map[string]string, obj interface{}) ([]byte, error) {
+	return HttpDo(context.Background(), http.MethodPost, url, headers, obj, nil)
+}
+
+// HttpDo sends obj as the JSON body with the shared client, see ConfigureHttpClient,
+// the sensitive fields of the body are masked in the log
+func HttpDo(ctx context.Context, method string, url string, headers map[string]string, obj interface{}, sensitiveFields []string) ([]byte, error) {
 	var b []byte
 	var err error
 
 	if obj != nil {
 		b, err = json.Marshal(obj)
 		if err != nil {
-			return nil, errors.Wrap(err, fmt.Sprintf("unable to do HTTP post to %v", url))
+			return nil, errors.Wrap(err, fmt.Sprintf("unable to do HTTP %s to %v", method, url))
 		}
 	} else {
 		b = []byte("")
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("unable to do HTTP post to %v", url))
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to do HTTP %s to %v", method, url))
 	}
+	req = req.WithContext(ctx)
 
+	if obj != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	if headers != nil {
 		for k, v := range headers {
 			req.Header.Add(k, v)
 		}
 	}
 
-	c := &http.Client{}
-
 	triggerUrl := req.Header.Get(HEADER_TRIGGER_URL)
 	if triggerUrl != "" {
-		logrus.Debugf("[HTTP POST][ASYNC REPLY TO %s] %s, body: %s", triggerUrl, url, string(b))
+		logrus.Debugf("[HTTP %s][ASYNC REPLY TO %s] %s, body: %s", method, triggerUrl, url, RedactJson(b, sensitiveFields...))
 	} else {
-		logrus.Debugf("[HTTP POST] %s, body: %s", url, string(b))
+		logrus.Debugf("[HTTP %s] %s, body: %s", method, url, RedactJson(b, sensitiveFields...))
 	}
 
-	rsp, err := c.Do(req)
+	rsp, err := HttpClient().Do(req)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("unable to do HTTP post to %v", url))
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to do HTTP %s to %v", method, url))
 	}
 
 	defer rsp.Body.Close()
 
 	body, err := ioutil.ReadAll(rsp.Body)
-	LogError(err)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to read the response of HTTP %s to %v", method, url))
+	}
 
 	if rsp.StatusCode < 200 || rsp.StatusCode > 300 {
 		return nil, &HttpPostError{
-			errors.New(fmt.Sprintf("unable to post to the URL[%s], %s, %s", url, rsp.Status, string(body))),
+			errors.New(fmt.Sprintf("unable to %s to the URL[%s], %s, %s", strings.ToLower(method), url, rsp.Status, string(body))),
 			rsp.StatusCode,
 		}
 	}
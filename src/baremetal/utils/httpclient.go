@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_HTTP_CONNECT_TIMEOUT    = 10 * time.Second
+	DEFAULT_HTTP_TIMEOUT            = 60 * time.Second
+	DEFAULT_HTTP_IDLE_CONN_TIMEOUT  = 90 * time.Second
+	DEFAULT_HTTP_MAX_IDLE_CONNS     = 16
+	DEFAULT_HTTP_MAX_IDLE_PER_HOST  = 4
+	DEFAULT_HTTP_TLS_HANDSHAKE_TIME = 10 * time.Second
+)
+
+// HttpClientConfig is the 'http' section of the agent config, the timeouts are
+// in seconds and the defaults are used for the zero values
+type HttpClientConfig struct {
+	ConnectTimeout int `json:"connectTimeout"`
+	// the whole request including reading the body, a call can set a shorter
+	// deadline with its context
+	Timeout             int `json:"timeout"`
+	IdleConnTimeout     int `json:"idleConnTimeout"`
+	MaxIdleConns        int `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost"`
+	// e.g. http://proxy:3128, the HTTP_PROXY and NO_PROXY environment
+	// variables are used if it's empty
+	Proxy string `json:"proxy"`
+	// the PEM files of the CAs trusted besides the system ones
+	CaFiles []string `json:"caFiles"`
+}
+
+var (
+	httpClient     *http.Client
+	httpClientLock sync.RWMutex
+)
+
+func init() {
+	PanicOnError(ConfigureHttpClient(HttpClientConfig{}))
+}
+
+func seconds(n int, def time.Duration) time.Duration {
+	if n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return def
+}
+
+func newHttpClient(c HttpClientConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid HTTP proxy[%s]", c.Proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{}
+	if len(c.CaFiles) != 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		for _, f := range c.CaFiles {
+			pem, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no CA certificate found in %s", f)
+			}
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	maxIdle := c.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = DEFAULT_HTTP_MAX_IDLE_CONNS
+	}
+	maxIdlePerHost := c.MaxIdleConnsPerHost
+	if maxIdlePerHost <= 0 {
+		maxIdlePerHost = DEFAULT_HTTP_MAX_IDLE_PER_HOST
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   seconds(c.ConnectTimeout, DEFAULT_HTTP_CONNECT_TIMEOUT),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: DEFAULT_HTTP_TLS_HANDSHAKE_TIME,
+		IdleConnTimeout:     seconds(c.IdleConnTimeout, DEFAULT_HTTP_IDLE_CONN_TIMEOUT),
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdlePerHost,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   seconds(c.Timeout, DEFAULT_HTTP_TIMEOUT),
+	}, nil
+}
+
+// ConfigureHttpClient replaces the client shared by the HTTP helpers, it's
+// called at startup
+func ConfigureHttpClient(c HttpClientConfig) error {
+	client, err := newHttpClient(c)
+	if err != nil {
+		return err
+	}
+
+	httpClientLock.Lock()
+	old := httpClient
+	httpClient = client
+	httpClientLock.Unlock()
+
+	if old != nil {
+		old.Transport.(*http.Transport).CloseIdleConnections()
+	}
+	return nil
+}
+
+// HttpClient returns the client shared by the HTTP helpers
+func HttpClient() *http.Client {
+	httpClientLock.RLock()
+	defer httpClientLock.RUnlock()
+	return httpClient
+}
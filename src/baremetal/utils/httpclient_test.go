@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type httpTestObj struct {
+	Method string `json:"method"`
+	Value  string `json:"value"`
+}
+
+func TestHttpHelpers(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		obj := httpTestObj{}
+		if req.Body != nil {
+			b, _ := ioutil.ReadAll(req.Body)
+			json.Unmarshal(b, &obj)
+		}
+		if req.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		obj.Method = req.Method
+		json.NewEncoder(w).Encode(obj)
+	}))
+	defer s.Close()
+
+	ret := httpTestObj{}
+	PanicOnError(HttpGetForObject(s.URL+"/obj", nil, &ret))
+	Assertf(ret.Method == http.MethodGet, "unexpected response %v", ret)
+
+	ret = httpTestObj{}
+	PanicOnError(HttpPutForObject(s.URL+"/obj", nil, httpTestObj{Value: "v"}, &ret))
+	Assertf(ret.Method == http.MethodPut && ret.Value == "v", "unexpected response %v", ret)
+
+	// the callers pass nil headers
+	PanicOnError(HttpPostForObjectWithoutHeaders(s.URL+"/obj", httpTestObj{Value: "v"}, &ret))
+	Assertf(ret.Method == http.MethodPost, "unexpected response %v", ret)
+
+	_, err := HttpGet(s.URL+"/missing", nil)
+	he, ok := err.(*HttpPostError)
+	Assertf(ok && he.StatusCode() == http.StatusNotFound, "expected a 404 error, got %v", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = HttpPostForObjectWithContext(ctx, s.URL+"/slow", nil, nil, nil)
+	Assertf(err != nil && time.Since(start) < 900*time.Millisecond, "the deadline of the call is not honored, %v", err)
+
+	defer func() { PanicOnError(ConfigureHttpClient(HttpClientConfig{})) }()
+	PanicOnError(ConfigureHttpClient(HttpClientConfig{Timeout: 1}))
+	Assert(HttpClient().Timeout == time.Second, "configured timeout")
+}
+
+func TestHttpClientConfig(t *testing.T) {
+	defer func() { PanicOnError(ConfigureHttpClient(HttpClientConfig{})) }()
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	_, err := HttpGet(s.URL, nil)
+	Assert(err != nil, "the test CA is not trusted by default")
+
+	dir, err := ioutil.TempDir("", "httpclient")
+	PanicOnError(err)
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	PanicOnError(ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0644))
+
+	PanicOnError(ConfigureHttpClient(HttpClientConfig{CaFiles: []string{ca}}))
+	b, err := HttpGet(s.URL, nil)
+	PanicOnError(err)
+	Assert(string(b) == "ok", "trusted by the configured CA")
+
+	proxied := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// a proxy gets the absolute URL
+		proxied = strings.HasPrefix(req.RequestURI, "http://backend.invalid/")
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	PanicOnError(ConfigureHttpClient(HttpClientConfig{Proxy: proxy.URL}))
+	b, err = HttpGet("http://backend.invalid/path", nil)
+	PanicOnError(err)
+	Assert(proxied && string(b) == "proxied", "sent by the proxy")
+
+	Assert(ConfigureHttpClient(HttpClientConfig{Proxy: "proxy:3128"}) != nil, "invalid proxy")
+	Assert(ConfigureHttpClient(HttpClientConfig{CaFiles: []string{filepath.Join(dir, "none.pem")}}) != nil, "missing CA file")
+}
@@ -1,12 +1,17 @@
 package utils
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
-	"io/ioutil"
-	"os"
 	"sort"
 )
 
@@ -108,6 +113,91 @@ func commentCompare(comment1, comment2 string) int {
 	return rulesPriority[c1[0]] - rulesPriority[c2[0]];
 }
 
+/* return the comment group (the key of rulesPriority) and its priority,
+   an empty group is returned if the comment is not added by us */
+func GetCommentGroup(comment string) (string, int) {
+	group := strings.Split(comment, "for")[0]
+	if priority, ok := rulesPriority[group]; ok {
+		return group, priority
+	}
+
+	return "", 0
+}
+
+const (
+	LOG = "LOG"
+)
+
+const (
+	DHCP_SERVER_PORT = 67
+	TFTP_PORT        = 69
+)
+
+const (
+	MAX_MULTIPORT_PORTS   = 15
+	MAX_LOG_PREFIX_LENGTH = 29
+)
+
+/* iptables port range, rendered as start:end */
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func (r PortRange) isEmpty() bool {
+	return r.Start == 0 && r.End == 0
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d:%d", r.Start, r.End)
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	ports := strings.Split(s, ":")
+	if len(ports) != 2 {
+		return PortRange{}, errors.Errorf("%s is not a port range", s)
+	}
+
+	start, err := parsePort(ports[0])
+	if err != nil {
+		return PortRange{}, err
+	}
+	end, err := parsePort(ports[1])
+	if err != nil {
+		return PortRange{}, err
+	}
+	if start > end {
+		return PortRange{}, errors.Errorf("the start of the port range %s is greater than the end", s)
+	}
+
+	return PortRange{Start: start, End: end}, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	return port, checkPort(port)
+}
+
+func checkPort(port int) error {
+	if port < 0 || port > 65535 {
+		return errors.Errorf("%d is not a valid port", port)
+	}
+	return nil
+}
+
+/* hashlimit match, Mode is one or more of srcip,srcport,dstip,dstport,
+   if Above is true, the rule matches packets exceeding the Rate */
+type HashLimit struct {
+	Name  string `json:"name"`
+	Rate  string `json:"rate"`
+	Burst int    `json:"burst,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+	Above bool   `json:"above,omitempty"`
+}
+
 type IptablesRule struct {
 	chainName         string
 	proto             string
@@ -118,6 +208,22 @@ type IptablesRule struct {
 	comment           string
 	inNic, outNic     string
 	tcpflags          []string
+
+	/* only one of srcPort, srcPortRange and srcPorts is used, same as dest */
+	srcPortRange, destPortRange PortRange
+	srcPorts, destPorts         []int
+	/* the address, ipset and port matches are negated separately */
+	notSrc, notDest             bool
+	notSrcSet, notDestSet       bool
+	notSrcPort, notDestPort     bool
+	srcSet, destSet             string
+	/* tcpflags of the load balancer rules are kept but not matched, see WithTcpFlags */
+	matchTcpFlags               bool
+	connlimitAbove              int
+	connlimitMask               int
+	hashlimit                   *HashLimit
+	logPrefix                   string
+	logLevel                    string
 }
 
 func NewIptablesRule(proto string, src, dest string, srcPort, destPort int,
@@ -153,14 +259,159 @@ func NewSnatIptablesRule(src, dest, outNic, action, comment string) IptablesRule
 		outNic: outNic, inNic: "", tcpflags:nil}
 }
 
+func NewPortRangeIptablesRule(proto string, src, dest string, srcPorts, destPorts PortRange,
+	states []string, action string, comment string) IptablesRule {
+	rule := IptablesRule{proto: proto, src: src, dest: dest, srcPortRange: srcPorts,
+		destPortRange: destPorts, states: states, action: action, comment: comment}
+	PanicOnError(rule.checkPorts())
+	return rule
+}
+
+func NewMultiportIptablesRule(proto string, src, dest string, srcPorts, destPorts []int,
+	states []string, action string, comment string) IptablesRule {
+	rule := IptablesRule{proto: proto, src: src, dest: dest, srcPorts: srcPorts,
+		destPorts: destPorts, states: states, action: action, comment: comment}
+	PanicOnError(rule.checkPorts())
+	return rule
+}
+
+/* match the source or destination address against ipsets, an empty set name is ignored */
+func NewIpsetIptablesRule(proto string, srcSet, destSet string, destPort int,
+	states []string, action string, comment string) IptablesRule {
+	return IptablesRule{proto: proto, srcSet: srcSet, destSet: destSet, destPort: destPort,
+		states: states, action: action, comment: comment}
+}
+
+/* match when a source (grouped by mask) has more than 'above' connections */
+func NewConnlimitIptablesRule(proto string, dest string, destPort int, above int, mask int,
+	action string, comment string) IptablesRule {
+	return IptablesRule{proto: proto, dest: dest, destPort: destPort, connlimitAbove: above,
+		connlimitMask: mask, action: action, comment: comment}
+}
+
+func NewHashLimitIptablesRule(proto string, dest string, destPort int, limit HashLimit,
+	action string, comment string) IptablesRule {
+	Assert(limit.Name != "" && limit.Rate != "", "hashlimit name and rate cannot be empty")
+	return IptablesRule{proto: proto, dest: dest, destPort: destPort, hashlimit: &limit,
+		action: action, comment: comment}
+}
+
+/* drop packets to destPort exceeding rate (e.g. 10/second) from every source ip,
+   e.g. protect DHCP and TFTP of the PXE network */
+func NewPerSourceRateLimitIptablesRule(proto string, destPort int, rate string, burst int,
+	comment string) IptablesRule {
+	limit := HashLimit{Name: fmt.Sprintf("%s%d", proto, destPort), Rate: rate, Burst: burst,
+		Mode: "srcip", Above: true}
+	return NewHashLimitIptablesRule(proto, "", destPort, limit, DROP, comment)
+}
+
+func NewLogIptablesRule(proto string, src, dest string, destPort int, states []string,
+	logPrefix string, logLevel string, comment string) IptablesRule {
+	PanicOnError(checkIptablesLogPrefix(logPrefix))
+	return IptablesRule{proto: proto, src: src, dest: dest, destPort: destPort, states: states,
+		action: LOG, logPrefix: logPrefix, logLevel: logLevel, comment: comment}
+}
+
+func (iptableRule IptablesRule) WithInNic(nic string) IptablesRule {
+	iptableRule.inNic = nic
+	return iptableRule
+}
+
+/* negate the source address match */
+func (iptableRule IptablesRule) NegateSrc() IptablesRule {
+	iptableRule.notSrc = true
+	return iptableRule
+}
+
+/* negate the destination address match */
+func (iptableRule IptablesRule) NegateDest() IptablesRule {
+	iptableRule.notDest = true
+	return iptableRule
+}
+
+/* negate the source ipset match */
+func (iptableRule IptablesRule) NegateSrcSet() IptablesRule {
+	iptableRule.notSrcSet = true
+	return iptableRule
+}
+
+/* negate the destination ipset match */
+func (iptableRule IptablesRule) NegateDestSet() IptablesRule {
+	iptableRule.notDestSet = true
+	return iptableRule
+}
+
+/* match the tcp flags among FIN,SYN,RST,ACK, e.g. SYN for the new connections */
+func (iptableRule IptablesRule) WithTcpFlags(flags ...string) IptablesRule {
+	iptableRule.tcpflags = flags
+	iptableRule.matchTcpFlags = true
+	return iptableRule
+}
+
+/* the checks of the constructors, the rules unmarshalled from JSON get them too */
+func (iptableRule IptablesRule) checkPorts() error {
+	for _, port := range []int{iptableRule.srcPort, iptableRule.destPort} {
+		if err := checkPort(port); err != nil {
+			return err
+		}
+	}
+	for _, r := range []PortRange{iptableRule.srcPortRange, iptableRule.destPortRange} {
+		if checkPort(r.Start) != nil || checkPort(r.End) != nil || r.Start > r.End {
+			return errors.Errorf("invalid port range %s", r)
+		}
+	}
+	for _, ports := range [][]int{iptableRule.srcPorts, iptableRule.destPorts} {
+		if len(ports) > MAX_MULTIPORT_PORTS {
+			return errors.Errorf("multiport supports up to %d ports, but %d got", MAX_MULTIPORT_PORTS, len(ports))
+		}
+		for _, port := range ports {
+			if err := checkPort(port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func joinPorts(ports []int) string {
+	ps := make([]string, len(ports))
+	for i, p := range ports {
+		ps[i] = strconv.Itoa(p)
+	}
+	return strings.Join(ps, ",")
+}
+
+func parsePorts(s string) ([]int, error) {
+	ports := []int{}
+	for _, p := range strings.Split(s, ",") {
+		port, err := parsePort(p)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func negate(not bool, match string) string {
+	if not {
+		return "! " + match
+	}
+	return match
+}
+
 func (iptableRule IptablesRule)string() []string  {
 	rules := []string{}
 	if iptableRule.src != "" && iptableRule.action != DNAT {
-		rules = append(rules, "-s " + iptableRule.src)
+		rules = append(rules, negate(iptableRule.notSrc, "-s " + iptableRule.src))
 	}
 
 	if iptableRule.dest != "" && iptableRule.action != SNAT {
-		rules = append(rules, "-d " + iptableRule.dest)
+		rules = append(rules, negate(iptableRule.notDest, "-d " + iptableRule.dest))
+	}
+
+	if iptableRule.inNic != "" {
+		rules = append(rules, "-i " + iptableRule.inNic)
 	}
 
 	if iptableRule.outNic != "" {
@@ -171,22 +422,81 @@ func (iptableRule IptablesRule)string() []string  {
 		rules = append(rules, "-p " + iptableRule.proto)
 		if iptableRule.srcPort != 0 && iptableRule.action != DNAT {
 			rules = append(rules, "-m " + iptableRule.proto)
-			rules = append(rules, fmt.Sprintf("--sport %d ", iptableRule.srcPort))
+			rules = append(rules, negate(iptableRule.notSrcPort, fmt.Sprintf("--sport %d ", iptableRule.srcPort)))
+		} else if !iptableRule.srcPortRange.isEmpty() {
+			rules = append(rules, "-m " + iptableRule.proto)
+			rules = append(rules, negate(iptableRule.notSrcPort, "--sport " + iptableRule.srcPortRange.String()))
 		}
 
 		if iptableRule.destPort != 0 {
 			rules = append(rules, "-m " + iptableRule.proto)
-			rules = append(rules, fmt.Sprintf("--dport %d ", iptableRule.destPort))
+			rules = append(rules, negate(iptableRule.notDestPort, fmt.Sprintf("--dport %d ", iptableRule.destPort)))
+		} else if !iptableRule.destPortRange.isEmpty() {
+			rules = append(rules, "-m " + iptableRule.proto)
+			rules = append(rules, negate(iptableRule.notDestPort, "--dport " + iptableRule.destPortRange.String()))
+		}
+
+		if len(iptableRule.srcPorts) > 0 {
+			rules = append(rules, "-m multiport " + negate(iptableRule.notSrcPort, "--sports " + joinPorts(iptableRule.srcPorts)))
+		}
+
+		if len(iptableRule.destPorts) > 0 {
+			rules = append(rules, "-m multiport " + negate(iptableRule.notDestPort, "--dports " + joinPorts(iptableRule.destPorts)))
+		}
+
+		if iptableRule.matchTcpFlags && len(iptableRule.tcpflags) > 0 {
+			rules = append(rules, "-m tcp --tcp-flags FIN,SYN,RST,ACK " + strings.Join(iptableRule.tcpflags, ","))
 		}
 	}
 
+	if iptableRule.srcSet != "" {
+		rules = append(rules, "-m set " + negate(iptableRule.notSrcSet, "--match-set " + iptableRule.srcSet + " src"))
+	}
+
+	if iptableRule.destSet != "" {
+		rules = append(rules, "-m set " + negate(iptableRule.notDestSet, "--match-set " + iptableRule.destSet + " dst"))
+	}
+
 	rules = append(rules, "-m comment --comment " + iptableRule.comment)
 
 	if iptableRule.states != nil {
 		rules = append(rules, "-m state --state " + strings.Join(iptableRule.states, ","))
 	}
 
+	if iptableRule.connlimitAbove != 0 {
+		rule := fmt.Sprintf("-m connlimit --connlimit-above %d", iptableRule.connlimitAbove)
+		if iptableRule.connlimitMask != 0 {
+			rule += fmt.Sprintf(" --connlimit-mask %d", iptableRule.connlimitMask)
+		}
+		rules = append(rules, rule)
+	}
+
+	if limit := iptableRule.hashlimit; limit != nil {
+		rule := "-m hashlimit"
+		if limit.Above {
+			rule += " --hashlimit-above " + limit.Rate
+		} else {
+			rule += " --hashlimit-upto " + limit.Rate
+		}
+		if limit.Burst != 0 {
+			rule += fmt.Sprintf(" --hashlimit-burst %d", limit.Burst)
+		}
+		if limit.Mode != "" {
+			rule += " --hashlimit-mode " + limit.Mode
+		}
+		rules = append(rules, rule + " --hashlimit-name " + limit.Name)
+	}
+
 	switch iptableRule.action {
+	case LOG:
+		rule := "-j LOG"
+		if iptableRule.logPrefix != "" {
+			rule += fmt.Sprintf(" --log-prefix \"%s\"", iptableRule.logPrefix)
+		}
+		if iptableRule.logLevel != "" {
+			rule += " --log-level " + iptableRule.logLevel
+		}
+		rules = append(rules, rule)
 	case REJECT:
 		rules = append(rules, "-j REJECT --reject-with icmp-port-unreachable")
 	case DNAT:
@@ -204,44 +514,418 @@ func (iptableRule IptablesRule)string() []string  {
 	return rules
 }
 
-func SetDefaultRule(nic string, defaultAction string) error {
-	/* old default action maybe different, it can not be deleted in InsertFireWallRule,
-	 * so delete it before */
-	DeleteFirewallRuleByComment(nic, DefaultBottomRuleComment)
+/* the JSON form of IptablesRule, chain, group and priority are ignored when
+   unmarshalling, the chain of a rule is decided by the agent */
+type iptablesRuleJson struct {
+	Chain    string   `json:"chain"`
+	Proto    string   `json:"proto,omitempty"`
+	Src      string   `json:"src,omitempty"`
+	Dest     string   `json:"dest,omitempty"`
+	SrcPort  int      `json:"srcPort,omitempty"`
+	DestPort int      `json:"destPort,omitempty"`
+	States   []string `json:"states,omitempty"`
+	InNic    string   `json:"inNic,omitempty"`
+	OutNic   string   `json:"outNic,omitempty"`
+	TcpFlags []string `json:"tcpFlags,omitempty"`
+	Action   string   `json:"action"`
+	Comment  string   `json:"comment,omitempty"`
+	Group    string   `json:"group,omitempty"`
+	Priority int      `json:"priority"`
+
+	SrcPortRange   *PortRange `json:"srcPortRange,omitempty"`
+	DestPortRange  *PortRange `json:"destPortRange,omitempty"`
+	SrcPorts       []int      `json:"srcPorts,omitempty"`
+	DestPorts      []int      `json:"destPorts,omitempty"`
+	NotSrc         bool       `json:"notSrc,omitempty"`
+	NotDest        bool       `json:"notDest,omitempty"`
+	NotSrcSet      bool       `json:"notSrcSet,omitempty"`
+	NotDestSet     bool       `json:"notDestSet,omitempty"`
+	NotSrcPort     bool       `json:"notSrcPort,omitempty"`
+	NotDestPort    bool       `json:"notDestPort,omitempty"`
+	SrcSet         string     `json:"srcSet,omitempty"`
+	DestSet        string     `json:"destSet,omitempty"`
+	ConnlimitAbove int        `json:"connlimitAbove,omitempty"`
+	ConnlimitMask  int        `json:"connlimitMask,omitempty"`
+	HashLimit      *HashLimit `json:"hashLimit,omitempty"`
+	/* false for the load balancer rules, their tcpFlags are not matched */
+	MatchTcpFlags  bool       `json:"matchTcpFlags,omitempty"`
+	LogPrefix      string     `json:"logPrefix,omitempty"`
+	LogLevel       string     `json:"logLevel,omitempty"`
+}
 
-	rule := getDefaultIptablesRule()
-	if defaultAction == "reject" {
-		rule.action = REJECT
-	} else {
-		rule.action = ACCEPT
+func (iptableRule IptablesRule) MarshalJSON() ([]byte, error) {
+	group, priority := GetCommentGroup(iptableRule.comment)
+	return json.Marshal(iptablesRuleJson{
+		Chain: iptableRule.chainName, Proto: iptableRule.proto,
+		Src: iptableRule.src, Dest: iptableRule.dest,
+		SrcPort: iptableRule.srcPort, DestPort: iptableRule.destPort,
+		States: iptableRule.states, InNic: iptableRule.inNic, OutNic: iptableRule.outNic,
+		TcpFlags: iptableRule.tcpflags, MatchTcpFlags: iptableRule.matchTcpFlags, Action: iptableRule.action,
+		Comment: iptableRule.comment, Group: group, Priority: priority,
+		SrcPortRange: portRangeOrNil(iptableRule.srcPortRange),
+		DestPortRange: portRangeOrNil(iptableRule.destPortRange),
+		SrcPorts: iptableRule.srcPorts, DestPorts: iptableRule.destPorts,
+		NotSrc: iptableRule.notSrc, NotDest: iptableRule.notDest,
+		NotSrcSet: iptableRule.notSrcSet, NotDestSet: iptableRule.notDestSet,
+		NotSrcPort: iptableRule.notSrcPort, NotDestPort: iptableRule.notDestPort,
+		SrcSet: iptableRule.srcSet, DestSet: iptableRule.destSet,
+		ConnlimitAbove: iptableRule.connlimitAbove, ConnlimitMask: iptableRule.connlimitMask,
+		HashLimit: iptableRule.hashlimit,
+		LogPrefix: iptableRule.logPrefix, LogLevel: iptableRule.logLevel,
+	})
+}
+
+func (iptableRule *IptablesRule) UnmarshalJSON(b []byte) error {
+	r := iptablesRuleJson{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return err
 	}
-	rule.comment = DefaultBottomRuleComment
-	if err := InsertFireWallRule(nic, rule, LOCAL); err != nil {
+
+	*iptableRule = IptablesRule{proto: r.Proto, src: r.Src, dest: r.Dest,
+		srcPort: r.SrcPort, destPort: r.DestPort, states: r.States, inNic: r.InNic, outNic: r.OutNic,
+		tcpflags: r.TcpFlags, action: r.Action, comment: r.Comment,
+		srcPorts: r.SrcPorts, destPorts: r.DestPorts, notSrc: r.NotSrc, notDest: r.NotDest,
+		notSrcSet: r.NotSrcSet, notDestSet: r.NotDestSet,
+		notSrcPort: r.NotSrcPort, notDestPort: r.NotDestPort, matchTcpFlags: r.MatchTcpFlags,
+		srcSet: r.SrcSet, destSet: r.DestSet, connlimitAbove: r.ConnlimitAbove,
+		connlimitMask: r.ConnlimitMask, hashlimit: r.HashLimit,
+		logPrefix: r.LogPrefix, logLevel: r.LogLevel}
+	if r.SrcPortRange != nil {
+		iptableRule.srcPortRange = *r.SrcPortRange
+	}
+	if r.DestPortRange != nil {
+		iptableRule.destPortRange = *r.DestPortRange
+	}
+
+	if err := iptableRule.checkPorts(); err != nil {
 		return err
 	}
+	return checkIptablesLogPrefix(iptableRule.logPrefix)
+}
 
-	rule = getDefaultIptablesRule()
-	rule.states = []string {NEW}
-	rule.action = RETURN
-	rule.comment = DefaultBottomRuleComment
-	if err := InsertFireWallRule(nic, rule, IN); err != nil{
+func (iptableRule IptablesRule) Action() string {
+	return iptableRule.action
+}
+
+func (iptableRule IptablesRule) WithComment(comment string) IptablesRule {
+	iptableRule.comment = comment
+	return iptableRule
+}
+
+var ipsetNameRegex = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,31}$`)
+
+func checkIptablesAddress(field, addr string) error {
+	if addr == "" || net.ParseIP(addr) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(addr); err != nil {
+		return errors.Errorf("invalid %s[%s] of the iptables rule, it must be an ip or a cidr", field, addr)
+	}
+	return nil
+}
+
+/* the rules are written into the iptables-restore input line by line and
+   split on whitespaces, so the free text can't contain them */
+func checkIptablesText(field, text string) error {
+	if strings.ContainsAny(text, "\"'\\") || strings.ContainsFunc(text, unicode.IsSpace) {
+		return errors.Errorf("the %s[%s] of the iptables rule cannot contain whitespaces, quotes or backslashes", field, text)
+	}
+	return nil
+}
+
+/* the log prefix is double quoted in the rule, so only the spaces are allowed,
+   and the kernel keeps up to MAX_LOG_PREFIX_LENGTH characters of it */
+func checkIptablesLogPrefix(prefix string) error {
+	if len(prefix) > MAX_LOG_PREFIX_LENGTH {
+		return errors.Errorf("the log prefix[%s] of the iptables rule is longer than %d", prefix, MAX_LOG_PREFIX_LENGTH)
+	}
+	if strings.ContainsAny(prefix, "\"\\") || strings.ContainsFunc(prefix, unicode.IsControl) {
+		return errors.Errorf("the log prefix[%s] of the iptables rule cannot contain quotes, backslashes or control characters", prefix)
+	}
+	return nil
+}
+
+/* Validate checks the rules from the API, the fields are written into the
+   iptables-restore input as they are */
+func (iptableRule IptablesRule) Validate() error {
+	if !containsString([]string{"", TCP, UDP, ICMP, ESP, AH}, iptableRule.proto) {
+		return errors.Errorf("unknown proto %s of the iptables rule", iptableRule.proto)
+	}
+	if !containsString([]string{ACCEPT, RETURN, REJECT, DROP, LOG, DNAT, SNAT}, iptableRule.action) {
+		return errors.Errorf("unknown action %s of the iptables rule", iptableRule.action)
+	}
+	for _, state := range iptableRule.states {
+		if !containsString([]string{NEW, RELATED, ESTABLISHED, INVALID}, state) {
+			return errors.Errorf("unknown state %s of the iptables rule", state)
+		}
+	}
+	if err := iptableRule.checkPorts(); err != nil {
 		return err
 	}
+	for _, flag := range iptableRule.tcpflags {
+		if !containsString([]string{"FIN", SYN, "RST", "ACK", "NONE"}, flag) {
+			return errors.Errorf("unknown tcp flag %s of the iptables rule", flag)
+		}
+	}
 
-	rule = getDefaultIptablesRule()
-	if defaultAction == "reject" {
-		rule.action = REJECT
-	} else {
-		rule.action = ACCEPT
+	if err := checkIptablesAddress("src", iptableRule.src); err != nil {
+		return err
 	}
-	rule.comment = DefaultBottomRuleComment
-	if err := InsertFireWallRule(nic, rule, IN); err != nil {
+	if err := checkIptablesAddress("dest", iptableRule.dest); err != nil {
 		return err
 	}
+	for field, nic := range map[string]string{"inNic": iptableRule.inNic, "outNic": iptableRule.outNic} {
+		if nic == "" {
+			continue
+		}
+		if err := CheckLinkName(nic); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid %s of the iptables rule", field))
+		}
+	}
+	for field, set := range map[string]string{"srcSet": iptableRule.srcSet, "destSet": iptableRule.destSet} {
+		if set != "" && !ipsetNameRegex.MatchString(set) {
+			return errors.Errorf("invalid %s[%s] of the iptables rule, it must be 1 to 31 letters, digits, '.', ':', '_' or '-'", field, set)
+		}
+	}
+
+	if iptableRule.connlimitAbove < 0 || iptableRule.connlimitMask < 0 || iptableRule.connlimitMask > 32 {
+		return errors.Errorf("invalid connlimit %d/%d of the iptables rule", iptableRule.connlimitAbove, iptableRule.connlimitMask)
+	}
+	texts := map[string]string{"comment": iptableRule.comment, "logLevel": iptableRule.logLevel}
+	if limit := iptableRule.hashlimit; limit != nil {
+		if limit.Name == "" || limit.Rate == "" || limit.Burst < 0 {
+			return errors.New("the hashlimit of the iptables rule needs a name, a rate and a non-negative burst")
+		}
+		texts["hashLimit.name"], texts["hashLimit.rate"], texts["hashLimit.mode"] = limit.Name, limit.Rate, limit.Mode
+	}
+	for field, text := range texts {
+		if err := checkIptablesText(field, text); err != nil {
+			return err
+		}
+	}
+	return checkIptablesLogPrefix(iptableRule.logPrefix)
+}
+
+func portRangeOrNil(r PortRange) *PortRange {
+	if r.isEmpty() {
+		return nil
+	}
+	return &r
+}
+
+/* split a rule printed by "iptables -S", arguments with spaces are double quoted */
+func splitIptablesArgs(rule string) []string {
+	args := []string{}
+	var current []rune
+	quoted, escaped, started := false, false, false
+	for _, c := range rule {
+		switch {
+		case escaped:
+			current = append(current, c)
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			started = true
+		case c == ' ' && !quoted:
+			if started {
+				args = append(args, string(current))
+			}
+			current = nil
+			started = false
+		default:
+			current = append(current, c)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, string(current))
+	}
+
+	return args
+}
+
+/* parse a rule printed by "iptables -S", e.g.
+   -A eth0.zs.local -d 10.0.0.1/32 -p tcp -m tcp --dport 22 -m comment --comment Management-rules -j RETURN */
+func parseIptablesRule(rule string) (IptablesRule, error) {
+	r := IptablesRule{}
+	args := splitIptablesArgs(rule)
+	if len(args) < 2 || args[0] != "-A" {
+		return r, errors.Errorf("%s is not an appended iptables rule", rule)
+	}
+
+	r.chainName = args[1]
+	not := false
+	for i := 2; i < len(args); i++ {
+		next := func() string {
+			i++
+			if i < len(args) {
+				return args[i]
+			}
+			return ""
+		}
+		hashlimit := func() *HashLimit {
+			if r.hashlimit == nil {
+				r.hashlimit = &HashLimit{}
+			}
+			return r.hashlimit
+		}
+
+		var err error
+		switch args[i] {
+		case "!":
+			not = true
+			continue
+		case "-s":
+			r.src = next()
+			r.notSrc = not
+		case "-d":
+			r.dest = next()
+			r.notDest = not
+		case "-p":
+			r.proto = next()
+		case "-i":
+			r.inNic = next()
+		case "-o":
+			r.outNic = next()
+		case "--sport":
+			r.notSrcPort = not
+			if p := next(); strings.Contains(p, ":") {
+				r.srcPortRange, err = parsePortRange(p)
+			} else {
+				r.srcPort, err = parsePort(p)
+			}
+		case "--dport":
+			r.notDestPort = not
+			if p := next(); strings.Contains(p, ":") {
+				r.destPortRange, err = parsePortRange(p)
+			} else {
+				r.destPort, err = parsePort(p)
+			}
+		case "--sports":
+			r.notSrcPort = not
+			r.srcPorts, err = parsePorts(next())
+		case "--dports":
+			r.notDestPort = not
+			r.destPorts, err = parsePorts(next())
+		case "--match-set":
+			name := next()
+			if next() == "src" {
+				r.srcSet, r.notSrcSet = name, not
+			} else {
+				r.destSet, r.notDestSet = name, not
+			}
+		case "--state", "--ctstate":
+			r.states = strings.Split(next(), ",")
+		case "--tcp-flags":
+			next()
+			r.tcpflags = strings.Split(next(), ",")
+			r.matchTcpFlags = true
+		case "--connlimit-above":
+			r.connlimitAbove, err = strconv.Atoi(next())
+		case "--connlimit-mask":
+			r.connlimitMask, err = strconv.Atoi(next())
+		case "--hashlimit-above":
+			hashlimit().Rate, hashlimit().Above = next(), true
+		case "--hashlimit-upto":
+			hashlimit().Rate = next()
+		case "--hashlimit-burst":
+			hashlimit().Burst, err = strconv.Atoi(next())
+		case "--hashlimit-mode":
+			hashlimit().Mode = next()
+		case "--hashlimit-name":
+			hashlimit().Name = next()
+		case "--log-prefix":
+			r.logPrefix = next()
+		case "--log-level":
+			r.logLevel = next()
+		case "--comment":
+			r.comment = next()
+		case "-j":
+			r.action = next()
+		case "--to-destination":
+			/* DNAT keeps the translated address in src, see string() */
+			to := strings.Split(next(), ":")
+			r.src = to[0]
+			if len(to) > 1 {
+				r.srcPort, err = strconv.Atoi(to[1])
+			}
+		case "--to-source":
+			r.dest = next()
+		}
+
+		if err != nil {
+			return r, errors.Wrap(err, fmt.Sprintf("unable to parse iptables rule[%s]", rule))
+		}
+		not = false
+	}
+
+	return r, nil
+}
+
+func ListFirewallRules(ctx context.Context, nic string, ch Chain) ([]IptablesRule, error) {
+	lines, err := listRule(ctx, FirewallTable, getChainName(nic, ch))
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []IptablesRule{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+
+		rule, err := parseIptablesRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func SetDefaultRule(ctx context.Context, nic string, defaultAction string) error {
+	/* old default action maybe different, it can not be deleted in InsertFireWallRule,
+	 * so delete it before */
+	DeleteFirewallRuleByComment(ctx, nic, DefaultBottomRuleComment)
+
+	localRules, inRules := getNicDefaultRules(defaultAction)
+	for _, rule := range localRules {
+		if err := InsertFireWallRule(ctx, nic, rule, LOCAL); err != nil {
+			return err
+		}
+	}
+	for _, rule := range inRules {
+		if err := InsertFireWallRule(ctx, nic, rule, IN); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+/* the bottom rules of the local and in chains set by SetDefaultRule, in order */
+func getNicDefaultRules(defaultAction string) ([]IptablesRule, []IptablesRule) {
+	action := ACCEPT
+	if defaultAction == "reject" {
+		action = REJECT
+	}
+
+	local := getDefaultIptablesRule()
+	local.action = action
+
+	newConn := getDefaultIptablesRule()
+	newConn.states = []string {NEW}
+	newConn.action = RETURN
+
+	in := getDefaultIptablesRule()
+	in.action = action
+
+	return []IptablesRule{local}, []IptablesRule{newConn, in}
+}
+
 func getCommentsFromRule(rule string) string {
 	elements := strings.Split(rule, " ")
 	prev := ""
@@ -257,15 +941,15 @@ func getCommentsFromRule(rule string) string {
 	return strings.Trim(comment, "\"")
 }
 
-func InsertFireWallRule(nic string, rule IptablesRule, ch Chain)  error {
+func InsertFireWallRule(ctx context.Context, nic string, rule IptablesRule, ch Chain)  error {
 	rules := strings.Join(rule.string(), " ")
 	chainName := getChainName(nic, ch)
-	if exist, _ := isExist(FirewallTable, chainName, rules); exist {
+	if exist, _ := isExist(ctx, FirewallTable, chainName, rules); exist {
 		log.Debugf("iptables %s %s already existed", FirewallTable, rules)
 		return nil
 	}
 
-	olds, err := listRule(FirewallTable, chainName)
+	olds, err := listRule(ctx, FirewallTable, chainName)
 	if err != nil {
 		PanicOnError(fmt.Errorf("list iptables in %s faild %s", chainName, err.Error()))
 		return err
@@ -286,22 +970,12 @@ func InsertFireWallRule(nic string, rule IptablesRule, ch Chain)  error {
 		num++;
 	}
 
-	rules = fmt.Sprintf("sudo iptables -t %s -I %s %d %s", FirewallTable, chainName, num, rules)
-	cmd := Bash{
-		Command: rules,
-	}
-
-	ret,_,_,err := cmd.RunWithReturn();
-	if err != nil {
-		log.Debugf("%s failed %s", rules, err.Error())
+	args := append([]string{"-t", FirewallTable, "-I", chainName, strconv.Itoa(num)}, splitIptablesArgs(rules)...)
+	if err := runIptables(ctx, args...); err != nil {
+		log.Debugf("iptables %s failed %s", rules, err.Error())
 		return err
 	}
 
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", rules, ret)
-		return errors.Errorf("%s failed ret = %d", rules, ret)
-	}
-
 	return nil
 }
 
@@ -313,14 +987,14 @@ func GenerateNatRule(rule IptablesRule, ch Chain) string  {
 
 /* ipsec rules must at the head of all postrouting rules
   ipsec rules use InsertNatRule, other rules use append */
-func InsertNatRule(rule IptablesRule, ch Chain)  error {
+func InsertNatRule(ctx context.Context, rule IptablesRule, ch Chain)  error {
 	rules := strings.Join(rule.string(), " ")
-	if exist, _ := isExist(NatTable, ch.string(), rules); exist {
+	if exist, _ := isExist(ctx, NatTable, ch.string(), rules); exist {
 		log.Debugf("iptables %s %s already existed", NatTable, rules)
 		return nil
 	}
 
-	olds, err := listRule(NatTable, ch.string())
+	olds, err := listRule(ctx, NatTable, ch.string())
 	if err != nil {
 		PanicOnError(fmt.Errorf("list iptables in %s faild %s", ch.string(), err.Error()))
 		return err
@@ -341,48 +1015,44 @@ func InsertNatRule(rule IptablesRule, ch Chain)  error {
 		num++;
 	}
 
-	rules = fmt.Sprintf("sudo iptables -t %s -I %s %d %s", NatTable, ch.string(), num, rules)
-	cmd := Bash{
-		Command: rules,
-	}
-
-	ret,_,_,err := cmd.RunWithReturn();
-	if err != nil {
-		log.Debugf("%s failed %s", rules, err.Error())
+	args := append([]string{"-t", NatTable, "-I", ch.string(), strconv.Itoa(num)}, splitIptablesArgs(rules)...)
+	if err := runIptables(ctx, args...); err != nil {
+		log.Debugf("iptables %s failed %s", rules, err.Error())
 		return err
 	}
 
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", rules, ret)
-		return errors.Errorf("%s failed ret = %d", rules, ret)
-	}
-
 	return nil
 
 }
 
-func DeleteDNatRuleByComment(comment string) error {
-	deleteIptablesRuleByComment(NatTable, PREROUTING.string(), comment)
+func DeleteDNatRuleByComment(ctx context.Context, comment string) error {
+	deleteIptablesRuleByComment(ctx, NatTable, PREROUTING.string(), comment)
 	return nil
 }
 
-func DeleteSNatRuleByComment(comment string) error {
-	deleteIptablesRuleByComment(NatTable, POSTROUTING.string(), comment)
+func DeleteSNatRuleByComment(ctx context.Context, comment string) error {
+	deleteIptablesRuleByComment(ctx, NatTable, POSTROUTING.string(), comment)
 	return nil
 }
 
-func DeleteLocalFirewallRuleByComment(nic string, comment string) error  {
+func DeleteLocalFirewallRuleByComment(ctx context.Context, nic string, comment string) error  {
 	chainName := getChainName(nic, LOCAL)
-	deleteIptablesRuleByComment(FirewallTable, chainName, comment)
+	deleteIptablesRuleByComment(ctx, FirewallTable, chainName, comment)
+	return nil
+}
+
+func DeleteInFirewallRuleByComment(ctx context.Context, nic string, comment string) error  {
+	chainName := getChainName(nic, IN)
+	deleteIptablesRuleByComment(ctx, FirewallTable, chainName, comment)
 	return nil
 }
 
-func DeleteFirewallRuleByComment(nic string, comment string) error {
+func DeleteFirewallRuleByComment(ctx context.Context, nic string, comment string) error {
 	chainName := getChainName(nic, LOCAL)
-	deleteIptablesRuleByComment(FirewallTable, chainName, comment)
+	deleteIptablesRuleByComment(ctx, FirewallTable, chainName, comment)
 
 	chainName = getChainName(nic, IN)
-	deleteIptablesRuleByComment(FirewallTable, chainName, comment)
+	deleteIptablesRuleByComment(ctx, FirewallTable, chainName, comment)
 
 	return nil
 }
@@ -392,93 +1062,69 @@ func getDefaultIptablesRule() IptablesRule  {
 		states:nil, action: RETURN, comment:DefaultBottomRuleComment, inNic:"", outNic:""}
 }
 
-func DestroyNicFirewall(nic string)  {
+func DestroyNicFirewall(ctx context.Context, nic string)  {
 	var rules []string
 	var err error
 	chainName := getChainName(nic, LOCAL)
-	rules, err = listRule(FirewallTable, chainName)
+	rules, err = listRule(ctx, FirewallTable, chainName)
 	if (err == nil && len(rules) > 0) {
 		for _, rule := range rules {
-			deleteIptablesRule(FirewallTable, rule)
+			deleteIptablesRule(ctx, FirewallTable, rule)
 		}
 	}
-	r := fmt.Sprintf("sudo iptables -t %s -D INPUT -j %s", FirewallTable, chainName)
-	cmd := Bash{
-		Command: r,
-	}
-
-	ret,_,_,err := cmd.RunWithReturn();
-	if err != nil {
-		log.Debugf("%s failed %s", r, err.Error())
-	}
-
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", r, ret)
+	if err := runIptables(ctx, "-t", FirewallTable, "-D", "INPUT", "-j", chainName); err != nil {
+		log.Debugf("delete the jump to %s failed %s", chainName, err.Error())
 	}
 
 
 	chainName = getChainName(nic, IN)
-	rules, err = listRule(FirewallTable, chainName)
+	rules, err = listRule(ctx, FirewallTable, chainName)
 	if (err == nil && len(rules) > 0) {
 		for _, rule := range rules {
-			deleteIptablesRule(FirewallTable, rule)
+			deleteIptablesRule(ctx, FirewallTable, rule)
 		}
 	}
-	r = fmt.Sprintf("sudo iptables -t %s -D FORWARD -j %s", FirewallTable, chainName)
-	cmd = Bash{
-		Command: r,
-	}
-
-	ret,_,_,err = cmd.RunWithReturn();
-	if err != nil {
-		log.Debugf("%s failed %s", r, err.Error())
-	}
-
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", r, ret)
+	if err := runIptables(ctx, "-t", FirewallTable, "-D", "FORWARD", "-j", chainName); err != nil {
+		log.Debugf("delete the jump to %s failed %s", chainName, err.Error())
 	}
 }
 
-func InitNicFirewall(nic string, ip string, pubNic bool, defaultAction string)  error {
-	if err := initNicFireWallChain(nic); (err != nil) {
+func InitNicFirewall(ctx context.Context, nic string, ip string, pubNic bool, defaultAction string)  error {
+	if err := initNicFireWallChain(ctx, nic); (err != nil) {
 		log.Debugf("initNicFireWallChain failed %s", err.Error())
 		return err
 	}
 
-	return initNicFirewallDefaultRules(nic, ip, pubNic, defaultAction)
+	return initNicFirewallDefaultRules(ctx, nic, ip, pubNic, defaultAction)
 }
 
-func InitNatRule()  {
+func InitNatRule(ctx context.Context)  {
 	if !IsSkipVyosIptables() {
 		return
 	}
 
 	/*flush raw table to clear NOTRACK rule at startup*/
-	cmd := Bash{
-		Command: "sudo iptables -t raw -F",
-	}
-
-	cmd.Run(); cmd.PanicIfError()
+	PanicOnError(runIptables(ctx, "-t", "raw", "-F"))
 
 	ch := PREROUTING
-	if err := newChain(NatTable, "PREROUTING", ch.string(),  ""); err != nil {
+	if err := newChain(ctx, NatTable, "PREROUTING", ch.string(),  ""); err != nil {
 		return
 	}
 
 	ch = POSTROUTING
-	if err := newChain(NatTable, "POSTROUTING", ch.string(),  ""); err != nil {
+	if err := newChain(ctx, NatTable, "POSTROUTING", ch.string(),  ""); err != nil {
 		return
 	}
 }
 
-func initNicFirewallDefaultRules(nic string, ip string, pubNic bool, defaultAction string) error {
+func initNicFirewallDefaultRules(ctx context.Context, nic string, ip string, pubNic bool, defaultAction string) error {
 	/* add rules for FORWARD chain */
 	if pubNic {
 		rule := getDefaultIptablesRule()
 		rule.states = []string{RELATED, ESTABLISHED}
 		rule.action = RETURN
 		rule.comment = DefaultTopRuleComment
-		if err := InsertFireWallRule(nic, rule, IN); err != nil {
+		if err := InsertFireWallRule(ctx, nic, rule, IN); err != nil {
 			return err
 		}
 	} else {
@@ -486,7 +1132,7 @@ func initNicFirewallDefaultRules(nic string, ip string, pubNic bool, defaultActi
 		rule.states = []string{INVALID, NEW, RELATED, ESTABLISHED}
 		rule.action = RETURN
 		rule.comment = DefaultTopRuleComment
-		if err := InsertFireWallRule(nic, rule, IN); err != nil {
+		if err := InsertFireWallRule(ctx, nic, rule, IN); err != nil {
 			return err
 		}
 	}
@@ -495,25 +1141,25 @@ func initNicFirewallDefaultRules(nic string, ip string, pubNic bool, defaultActi
 	rule.proto = ICMP
 	rule.action = RETURN
 	rule.comment = DefaultTopRuleComment
-	if err := InsertFireWallRule(nic, rule, IN); err != nil {
+	if err := InsertFireWallRule(ctx, nic, rule, IN); err != nil {
 		return err
 	}
 
 	/* when this func is called in zvr, delete rules installed in zvrboot first */
-	DeleteFirewallRuleByComment(nic, DefaultBottomRuleComment)
+	DeleteFirewallRuleByComment(ctx, nic, DefaultBottomRuleComment)
 
 	rule = getDefaultIptablesRule()
 	rule.states = []string {NEW}
 	rule.action = RETURN
 	rule.comment = DefaultBottomRuleComment
-	if err := InsertFireWallRule(nic, rule, IN); err != nil{
+	if err := InsertFireWallRule(ctx, nic, rule, IN); err != nil{
 		return err
 	}
 
 	rule = getDefaultIptablesRule()
 	rule.action = defaultAction
 	rule.comment = DefaultBottomRuleComment
-	if err := InsertFireWallRule(nic, rule, IN); err != nil {
+	if err := InsertFireWallRule(ctx, nic, rule, IN); err != nil {
 		return err
 	}
 
@@ -523,7 +1169,7 @@ func initNicFirewallDefaultRules(nic string, ip string, pubNic bool, defaultActi
 	rule.states = []string {RELATED, ESTABLISHED}
 	rule.action = RETURN
 	rule.comment = DefaultTopRuleComment
-	if err := InsertFireWallRule(nic, rule, LOCAL); err != nil {
+	if err := InsertFireWallRule(ctx, nic, rule, LOCAL); err != nil {
 		return err
 	}
 
@@ -532,7 +1178,7 @@ func initNicFirewallDefaultRules(nic string, ip string, pubNic bool, defaultActi
 	rule.proto = ICMP
 	rule.action = RETURN
 	rule.comment = DefaultTopRuleComment
-	if err := InsertFireWallRule(nic, rule, LOCAL); err != nil {
+	if err := InsertFireWallRule(ctx, nic, rule, LOCAL); err != nil {
 		return err
 	}
 
@@ -543,7 +1189,7 @@ func initNicFirewallDefaultRules(nic string, ip string, pubNic bool, defaultActi
 		rule.destPort = 22
 		rule.action = RETURN
 		rule.comment = ManagementComment
-		if err := InsertFireWallRule(nic, rule, LOCAL); err != nil {
+		if err := InsertFireWallRule(ctx, nic, rule, LOCAL); err != nil {
 			return err
 		}
 
@@ -553,7 +1199,7 @@ func initNicFirewallDefaultRules(nic string, ip string, pubNic bool, defaultActi
 		rule.destPort = 7272
 		rule.action = RETURN
 		rule.comment = ManagementComment
-		if err := InsertFireWallRule(nic, rule, LOCAL); err != nil {
+		if err := InsertFireWallRule(ctx, nic, rule, LOCAL); err != nil {
 			return err
 		}
 
@@ -564,58 +1210,37 @@ func initNicFirewallDefaultRules(nic string, ip string, pubNic bool, defaultActi
 		rule.destPort = 22
 		rule.action = REJECT
 		rule.comment = ManagementComment
-		if err := InsertFireWallRule(nic, rule, LOCAL); err != nil {
+		if err := InsertFireWallRule(ctx, nic, rule, LOCAL); err != nil {
 			return err
 		}
 	}
 
 	rule = getDefaultIptablesRule()
 	rule.action = REJECT
-	if err := InsertFireWallRule(nic, rule, LOCAL); err != nil {
+	if err := InsertFireWallRule(ctx, nic, rule, LOCAL); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func deleteIptablesRule(tableName, rule string) error {
+func deleteIptablesRule(ctx context.Context, tableName, rule string) error {
 	newRule := strings.Replace(rule, "-A", "-D", 1)
-	r := fmt.Sprintf("sudo iptables -t %s %s", tableName, newRule)
-	cmd := Bash{
-		Command: r,
-	}
-
-	ret,_,_,err := cmd.RunWithReturn();
-	if err != nil {
-		log.Debugf("%s failed %s", r, err.Error())
+	if err := runIptables(ctx, append([]string{"-t", tableName}, splitIptablesArgs(newRule)...)...); err != nil {
+		log.Debugf("iptables -t %s %s failed %s", tableName, newRule, err.Error())
 		return err
 	}
 
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", r, ret)
-		return errors.Errorf("%s failed ret = %d", r, ret)
-	}
-
 	return nil
 }
 
-func deleteIptablesRuleByComment(tableName, chainName, comment string)  error {
-	rules, _ := listRule(tableName, chainName)
+func deleteIptablesRuleByComment(ctx context.Context, tableName, chainName, comment string)  error {
+	rules, _ := listRule(ctx, tableName, chainName)
 	for _, rule := range rules {
-		if strings.Contains(rule, comment) {
+		if ruleMatchesComment(rule, comment) {
 			newRule := strings.Replace(rule, "-A", "-D", 1)
-			r := fmt.Sprintf("sudo iptables -t %s %s", tableName, newRule)
-			cmd := Bash{
-				Command: r,
-			}
-
-			ret,_,_,err := cmd.RunWithReturn();
-			if err != nil {
-				log.Debugf("%s failed %s", r, err.Error())
-			}
-
-			if ret != 0 {
-				log.Debugf("%s failed ret = %d", r, ret)
+			if err := runIptables(ctx, append([]string{"-t", tableName}, splitIptablesArgs(newRule)...)...); err != nil {
+				log.Debugf("iptables -t %s %s failed %s", tableName, newRule, err.Error())
 			}
 		}
 	}
@@ -623,99 +1248,57 @@ func deleteIptablesRuleByComment(tableName, chainName, comment string)  error {
 	return nil
 }
 
-func isExist(tableName, chainName string, rulespec ...string) (bool, error)  {
+func isExist(ctx context.Context, tableName, chainName string, rulespec ...string) (bool, error)  {
 	rule := strings.Join(rulespec, " ")
-	cmd := Bash{
-		Command: fmt.Sprintf("sudo iptables -t %s -C %s %s", tableName, chainName, rule),
-	}
-
-	ret,_,_,err := cmd.RunWithReturn();
-	if err != nil {
+	if err := runIptables(ctx, append([]string{"-t", tableName, "-C", chainName}, splitIptablesArgs(rule)...)...); err != nil {
 		log.Debugf("iptables table: %s chain: %s check %s failed %s", tableName, chainName, rule, err.Error())
 		return false, err
 	}
 
-	if ret != 0 {
-		log.Debugf("iptables table: %s chain: %s check %s failed ret = %d", tableName, chainName, rule, ret)
-		return false, errors.Errorf("iptables table: %s chain: %s check %s failed ret = %d", tableName, chainName, rule, ret)
-	}
-
 	return true, nil
 }
 
-func initNicFireWallChain(nic string)  error{
+func initNicFireWallChain(ctx context.Context, nic string)  error{
 	chainName := getChainName(nic, LOCAL)
-	if err := newChain(FirewallTable, Predefined_local_chain, chainName,  nic); err != nil {
+	if err := newChain(ctx, FirewallTable, Predefined_local_chain, chainName,  nic); err != nil {
 		return err
 	}
 
 	chainName = getChainName(nic, IN)
-	if err := newChain(FirewallTable, Predefined_forward_chain, chainName, nic); err != nil {
+	if err := newChain(ctx, FirewallTable, Predefined_forward_chain, chainName, nic); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func newChain(tableName, parentChain, chainName, nicName string) error {
-	rule := fmt.Sprintf("sudo iptables -t %s -N %s", tableName, chainName)
-	cmd := Bash{
-		Command: rule,
-	}
-
-	ret,_,_,err := cmd.RunWithReturn();
-	if err != nil {
-		log.Debugf("%s failed %s", rule, err.Error())
+func newChain(ctx context.Context, tableName, parentChain, chainName, nicName string) error {
+	if err := runIptables(ctx, "-t", tableName, "-N", chainName); err != nil {
+		log.Debugf("create chain %s failed %s", chainName, err.Error())
 		return err
 	}
 
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d",rule, ret)
-		return errors.Errorf("%s failed ret = %d",rule, ret)
-	}
-
-	if nicName == "" {
-		rule = fmt.Sprintf("sudo iptables -t %s -I %s -j %s", tableName, parentChain, chainName)
-	} else {
-		rule = fmt.Sprintf("sudo iptables -t %s -I %s -i %s -j %s", tableName, parentChain, nicName, chainName)
-	}
-
-	cmd = Bash{
-		Command: rule,
+	args := []string{"-t", tableName, "-I", parentChain}
+	if nicName != "" {
+		args = append(args, "-i", nicName)
 	}
-
-	ret,_,_,err = cmd.RunWithReturn();
-	if err != nil {
-		log.Debugf("%s failed %s", rule, err.Error())
+	if err := runIptables(ctx, append(args, "-j", chainName)...); err != nil {
+		log.Debugf("jump from %s to %s failed %s", parentChain, chainName, err.Error())
 		return err
 	}
 
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", rule, ret)
-		return errors.Errorf("%s failed ret = %d", rule, ret)
-	}
-
 	return nil
 }
 
-func listRule(tableName, chainName string) ([]string, error){
-	rule := fmt.Sprintf("sudo iptables -t %s -S %s", tableName, chainName)
-	cmd := Bash{
-		Command: rule,
-		NoLog: true,
-	}
-
-	ret,o,_,err := cmd.RunWithReturn();
+func listRule(ctx context.Context, tableName, chainName string) ([]string, error){
+	cmd := iptablesCommand("iptables", "-t", tableName, "-S", chainName)
+	cmd.NoLog = true
+	res, err := cmd.Run(ctx)
 	if err != nil {
-		log.Debugf("%s failed %s", rule, err.Error())
+		log.Debugf("list the rules of %s failed %s", chainName, err.Error())
 		return nil, err
 	}
-
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", rule, ret)
-		return nil, errors.Errorf("%s failed ret = %d", rule, ret)
-	}
-	rules := strings.Split(o, "\n")
+	rules := strings.Split(res.Stdout, "\n")
 
 	// strip trailing newline
 	if len(rules) > 0 && rules[len(rules)-1] == "" {
@@ -725,23 +1308,12 @@ func listRule(tableName, chainName string) ([]string, error){
 	return rules, nil
 }
 
-func getNatRuleSet() ([]string, []string, []string, error) {
-	cmds := fmt.Sprintf("sudo iptables-save -t nat")
-	cmd := Bash{
-		Command: cmds,
-		NoLog: true,
-	}
-
-	ret,o,_,err := cmd.RunWithReturn();
+func getNatRuleSet(ctx context.Context) ([]string, []string, []string, error) {
+	o, err := iptablesSave(ctx, "nat")
 	if err != nil {
-		log.Debugf("%s failed %s", cmds, err.Error())
+		log.Debugf("iptables-save -t nat failed %s", err.Error())
 		return nil, nil, nil, err
 	}
-
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", cmds, ret)
-		return nil, nil, nil, errors.Errorf("%s failed ret = %d", cmds, ret)
-	}
 	rules := strings.Split(o, "\n")
 
 	// strip trailing newline
@@ -771,23 +1343,12 @@ func getNatRuleSet() ([]string, []string, []string, error) {
 	return snat, dnat, other, nil
 }
 
-func getFirewallRuleSet() ([]string, map[string][]string, error) {
-	cmds := fmt.Sprintf("sudo iptables-save -t filter")
-	cmd := Bash{
-		Command: cmds,
-		NoLog: true,
-	}
-
-	ret,o,_,err := cmd.RunWithReturn();
+func getFirewallRuleSet(ctx context.Context) ([]string, map[string][]string, error) {
+	o, err := iptablesSave(ctx, "filter")
 	if err != nil {
-		log.Debugf("%s failed %s", cmds, err.Error())
+		log.Debugf("iptables-save -t filter failed %s", err.Error())
 		return nil, nil, err
 	}
-
-	if ret != 0 {
-		log.Debugf("%s failed ret = %d", cmds, ret)
-		return nil, nil, errors.Errorf("%s failed ret = %d", cmds, ret)
-	}
 	rules := strings.Split(o, "\n")
 
 	// strip trailing newline
@@ -845,46 +1406,102 @@ func insertRuleIntoBuffer(ruleset []string, rules []IptablesRule, comment, chain
 	return temp
 }
 
-func restoreIptablesRulesSet(ruleSet []string, tableName string) error  {
-	tmpFile, err := ioutil.TempFile(os.TempDir(), "iptable-restore")
-	if err != nil {
-		log.Debugf("create iptable-restore temp file failed %s", err.Error())
-		return err
+func restoreIptablesRulesSet(ctx context.Context, ruleSet []string, tableName string) error  {
+	/* keep a snapshot so that a bad sync can be rolled back */
+	if _, err := SnapshotIptables(ctx); err != nil {
+		log.Warnf("unable to snapshot iptables before restoring table %s, %s", tableName, err)
 	}
 
-	// Remember to clean up the file afterwards
-	defer os.Remove(tmpFile.Name())
+	return restoreIptablesTable(ctx, strings.Join(ruleSet, "\n"), tableName)
+}
+
+/* iptables-restore replaces the whole table, the caller must hold the
+   withIptablesLock from the iptables-save the content is computed from */
+func restoreIptablesTable(ctx context.Context, content string, tableName string) error {
+	cmd := iptablesCommand("iptables-restore", "--table="+tableName)
+	cmd.Stdin = strings.NewReader(content)
 
-	content := strings.Join(ruleSet, "\n")
-	if _, err = tmpFile.Write([]byte(content)); err != nil {
-		log.Debugf("write to temp file failed %s, rules: %s", content, err.Error())
+	if _, err := cmd.Run(ctx); err != nil {
+		log.Debugf("iptables-restore --table=%s failed %s", tableName, err.Error())
 		return err
 	}
 
-	// Close the file
-	if err := tmpFile.Close(); err != nil {
-		log.Debugf("close temp file failed %s", err.Error())
-		return err
+	return nil
+}
+
+// withIptablesLock runs fn holding IPTABLES_LOCK_PATH, so the tables read by
+// iptables-save are not changed by another agent call before fn restores them
+func withIptablesLock(fn func() error) error {
+	err := WithFileLock(IPTABLES_LOCK_PATH, IPTABLES_LOCK_TIMEOUT, fn)
+	if _, ok := err.(*FileLockTimeoutError); ok {
+		log.Debugf("lock %s failed %s", IPTABLES_LOCK_PATH, err.Error())
 	}
+	return err
+}
+
+var (
+	iptablesRestoreWaitOnce sync.Once
+	iptablesRestoreWait     bool
+)
+
+// iptables-restore supports -w since iptables 1.6.2
+func iptablesRestoreSupportsWait() bool {
+	iptablesRestoreWaitOnce.Do(func() {
+		cmd := iptablesCommand("iptables-restore", "--help")
+		cmd.NoLog = true
+		// the result is returned even if it exits with non-zero after printing the help
+		if res, _ := cmd.Run(context.Background()); res != nil {
+			iptablesRestoreWait = strings.Contains(res.Stdout+res.Stderr, "--wait")
+		}
+	})
+	return iptablesRestoreWait
+}
 
-	cmds := fmt.Sprintf("sudo iptables-restore  --table=%s < %s", tableName, tmpFile.Name())
-	cmd := Bash{
-		Command: cmds,
+// iptablesCommand runs iptables, iptables-save or iptables-restore with
+// privilege, -w is passed to wait for the xtables lock held by others
+func iptablesCommand(argv ...string) *Command {
+	if argv[0] == "iptables" || (argv[0] == "iptables-restore" && iptablesRestoreSupportsWait()) {
+		argv = append([]string{argv[0], "-w"}, argv[1:]...)
 	}
+	return &Command{
+		Argv:       argv,
+		Privileged: true,
+		Timeout:    IPTABLES_COMMAND_TIMEOUT,
+	}
+}
 
-	_,_,_,err = cmd.RunWithReturn();
-	if err != nil {
-		log.Debugf("%s failed %s", cmds, err.Error())
-		return err
+// runIptables runs iptables with the args, a non-zero exit is an error
+func runIptables(ctx context.Context, args ...string) error {
+	_, err := iptablesCommand(append([]string{"iptables"}, args...)...).Run(ctx)
+	return err
+}
+
+// iptablesRuleComment returns the comment of a rule printed by iptables -S or iptables-save
+func iptablesRuleComment(rule string) string {
+	args := splitIptablesArgs(rule)
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "--comment" {
+			return args[i+1]
+		}
 	}
+	return ""
+}
 
-	return nil
+// ruleMatchesComment matches the comment of the rule exactly, except that a
+// group comment like SNATComment, which ends with "-for-", matches all the
+// rules of the group
+func ruleMatchesComment(rule string, comment string) bool {
+	c := iptablesRuleComment(rule)
+	if strings.HasSuffix(comment, "-for-") {
+		return strings.HasPrefix(c, comment)
+	}
+	return c == comment
 }
 
 func removeRules(rules []string, comment string) []string {
 	temp := []string{}
 	for _, r := range rules {
-		if !strings.Contains(r, comment) {
+		if !ruleMatchesComment(r, comment) {
 			temp = append(temp, r)
 		}
 	}
@@ -897,9 +1514,14 @@ func removeRules(rules []string, comment string) []string {
    3. add synced rules into zs.snat or zs.dnat
    4. assemble zs.snat, zs.dnat into other */
 
-func SyncNatRule(snatRules, dnatRules []IptablesRule, comment string) error {
+func buildNatRuleSet(ctx context.Context, snatRules, dnatRules []IptablesRule, comment string) ([]string, error) {
 	/* #1 */
-	snat, dnat, other, _ := getNatRuleSet()
+	snat, dnat, other, err := getNatRuleSet(ctx)
+	if err != nil {
+		return nil, err
+	} else if len(other) < 2 {
+		return nil, errors.Errorf("unexpected iptables-save output of table %s", NatTable)
+	}
 
 	/* #2 */
 	snat = removeRules(snat, comment)
@@ -919,16 +1541,21 @@ func SyncNatRule(snatRules, dnatRules []IptablesRule, comment string) error {
 	temp = append(temp, snat...)
 	temp = append(temp, other[len(other)-2:]...)
 
-	return restoreIptablesRulesSet(temp, NatTable)
+	return temp, nil
 }
 
 /* 1. splits nat rules: into 2 groups: a map include all configured filters， and other
    2. remove to be synced type
    3. add synced rules into zs.snat or zs.dnat
    4. assemble zs.snat, zs.dnat into other */
-func SyncFirewallRule(rulesMap map[string][]IptablesRule, comment string, ch Chain) error {
+func buildFirewallRuleSet(ctx context.Context, rulesMap map[string][]IptablesRule, comment string, ch Chain) ([]string, error) {
 	/* #1 */
-	other, filtersMap, _ := getFirewallRuleSet()
+	other, filtersMap, err := getFirewallRuleSet(ctx)
+	if err != nil {
+		return nil, err
+	} else if len(other) < 2 {
+		return nil, errors.Errorf("unexpected iptables-save output of table %s", FirewallTable)
+	}
 
 	/* #2 */
 	for chainName, filters := range filtersMap {
@@ -962,16 +1589,21 @@ func SyncFirewallRule(rulesMap map[string][]IptablesRule, comment string, ch Cha
 	}
 	temp = append(temp, other[len(other) -2:]...)
 
-	return restoreIptablesRulesSet(temp, FirewallTable)
+	return temp, nil
 }
 
 /* 1. splits nat rules: into 2 groups: a map include all configured filters， and other
    2. remove to be synced type
    3. add synced rules into zs.snat or zs.dnat
    4. assemble zs.snat, zs.dnat into other */
-func SyncLocalAndInFirewallRule(rulesMap, localRulesMap map[string][]IptablesRule, comment string) error {
+func buildLocalAndInFirewallRuleSet(ctx context.Context, rulesMap, localRulesMap map[string][]IptablesRule, comment string) ([]string, error) {
 	/* #1 */
-	other, filtersMap, _ := getFirewallRuleSet()
+	other, filtersMap, err := getFirewallRuleSet(ctx)
+	if err != nil {
+		return nil, err
+	} else if len(other) < 2 {
+		return nil, errors.Errorf("unexpected iptables-save output of table %s", FirewallTable)
+	}
 
 	/* #2 */
 	for chainName, filters := range filtersMap {
@@ -1015,5 +1647,164 @@ func SyncLocalAndInFirewallRule(rulesMap, localRulesMap map[string][]IptablesRul
 	}
 	temp = append(temp, other[len(other) -2:]...)
 
-	return restoreIptablesRulesSet(temp, FirewallTable)
+	return temp, nil
+}
+
+func SyncNatRule(ctx context.Context, snatRules, dnatRules []IptablesRule, comment string) error {
+	return withIptablesLock(func() error {
+		ruleSet, err := buildNatRuleSet(ctx, snatRules, dnatRules, comment)
+		if err != nil {
+			return err
+		}
+
+		return restoreIptablesRulesSet(ctx, ruleSet, NatTable)
+	})
+}
+
+func SyncFirewallRule(ctx context.Context, rulesMap map[string][]IptablesRule, comment string, ch Chain) error {
+	return withIptablesLock(func() error {
+		ruleSet, err := buildFirewallRuleSet(ctx, rulesMap, comment, ch)
+		if err != nil {
+			return err
+		}
+
+		return restoreIptablesRulesSet(ctx, ruleSet, FirewallTable)
+	})
+}
+
+func SyncLocalAndInFirewallRule(ctx context.Context, rulesMap, localRulesMap map[string][]IptablesRule, comment string) error {
+	return withIptablesLock(func() error {
+		ruleSet, err := buildLocalAndInFirewallRuleSet(ctx, rulesMap, localRulesMap, comment)
+		if err != nil {
+			return err
+		}
+
+		return restoreIptablesRulesSet(ctx, ruleSet, FirewallTable)
+	})
+}
+
+/* dry-run of SyncNatRule, nothing is applied */
+func PreviewSyncNatRule(ctx context.Context, snatRules, dnatRules []IptablesRule, comment string) (*IptablesRestorePreview, error) {
+	ruleSet, err := buildNatRuleSet(ctx, snatRules, dnatRules, comment)
+	if err != nil {
+		return nil, err
+	}
+
+	return previewIptablesRulesSet(ctx, ruleSet, NatTable)
+}
+
+/* dry-run of SyncFirewallRule, nothing is applied */
+func PreviewSyncFirewallRule(ctx context.Context, rulesMap map[string][]IptablesRule, comment string, ch Chain) (*IptablesRestorePreview, error) {
+	ruleSet, err := buildFirewallRuleSet(ctx, rulesMap, comment, ch)
+	if err != nil {
+		return nil, err
+	}
+
+	return previewIptablesRulesSet(ctx, ruleSet, FirewallTable)
+}
+
+/* dry-run of SyncLocalAndInFirewallRule, nothing is applied */
+func PreviewSyncLocalAndInFirewallRule(ctx context.Context, rulesMap, localRulesMap map[string][]IptablesRule, comment string) (*IptablesRestorePreview, error) {
+	ruleSet, err := buildLocalAndInFirewallRuleSet(ctx, rulesMap, localRulesMap, comment)
+	if err != nil {
+		return nil, err
+	}
+
+	return previewIptablesRulesSet(ctx, ruleSet, FirewallTable)
+}
+
+
+func containsString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+/* the chain of an iptables-save rule line, or "" */
+func savedRuleChain(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "-A" {
+		return ""
+	}
+	return fields[1]
+}
+
+func removeChainRulesByComment(lines []string, chainNames []string, comment string) []string {
+	temp := []string{}
+	for _, l := range lines {
+		c := savedRuleChain(l)
+		if c != "" && containsString(chainNames, c) && ruleMatchesComment(l, comment) {
+			continue
+		}
+		temp = append(temp, l)
+	}
+	return temp
+}
+
+/* appends the rules after the last rule of the chain, or before COMMIT if it has none */
+func appendChainRules(lines []string, chainName string, rules []IptablesRule) []string {
+	pos, commit := -1, len(lines)
+	for i, l := range lines {
+		if savedRuleChain(l) == chainName {
+			pos = i + 1
+		} else if l == "COMMIT" && commit == len(lines) {
+			commit = i
+		}
+	}
+	if pos == -1 {
+		pos = commit
+	}
+
+	added := []string{}
+	for _, rule := range rules {
+		added = append(added, fmt.Sprintf("-A %s %s", chainName, strings.Join(rule.string(), " ")))
+	}
+
+	temp := append([]string{}, lines[:pos]...)
+	temp = append(temp, added...)
+	return append(temp, lines[pos:]...)
+}
+
+/* dry-run of DeleteFirewallRuleByComment, or of the chain specific ones if chains are given */
+func PreviewDeleteFirewallRuleByComment(ctx context.Context, nic string, comment string, chains ...Chain) (*IptablesRestorePreview, error) {
+	if len(chains) == 0 {
+		chains = []Chain{LOCAL, IN}
+	}
+	chainNames := []string{}
+	for _, ch := range chains {
+		chainNames = append(chainNames, getChainName(nic, ch))
+	}
+
+	return previewFirewallChange(ctx, func(lines []string) []string {
+		return removeChainRulesByComment(lines, chainNames, comment)
+	})
+}
+
+/* dry-run of SetDefaultRule */
+func PreviewSetDefaultRule(ctx context.Context, nic string, defaultAction string) (*IptablesRestorePreview, error) {
+	localRules, inRules := getNicDefaultRules(defaultAction)
+	return previewFirewallChange(ctx, func(lines []string) []string {
+		lines = removeChainRulesByComment(lines, []string{getChainName(nic, LOCAL), getChainName(nic, IN)}, DefaultBottomRuleComment)
+		lines = appendChainRules(lines, getChainName(nic, LOCAL), localRules)
+		return appendChainRules(lines, getChainName(nic, IN), inRules)
+	})
+}
+
+/* dry-run of DestroyNicFirewall */
+func PreviewDestroyNicFirewall(ctx context.Context, nic string) (*IptablesRestorePreview, error) {
+	local, in := getChainName(nic, LOCAL), getChainName(nic, IN)
+	jumps := []string{fmt.Sprintf("-A INPUT -j %s", local), fmt.Sprintf("-A FORWARD -j %s", in)}
+	return previewFirewallChange(ctx, func(lines []string) []string {
+		temp := []string{}
+		for _, l := range lines {
+			if c := savedRuleChain(l); c == local || c == in || containsString(jumps, l) {
+				continue
+			}
+			temp = append(temp, l)
+		}
+		return temp
+	})
 }
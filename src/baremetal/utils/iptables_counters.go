@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IptablesRuleCounter is the packet and byte counter of a rule in the zs.* chains,
+// Index is the position of the rule in its chain starting from 1
+type IptablesRuleCounter struct {
+	Table   string `json:"table"`
+	Chain   string `json:"chain"`
+	Index   int    `json:"index"`
+	Comment string `json:"comment"`
+	Group   string `json:"group"`
+	Rule    string `json:"rule"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// IptablesGroupCounter sums the counters of the rules in a comment group
+type IptablesGroupCounter struct {
+	Group   string `json:"group"`
+	Rules   int    `json:"rules"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func isAgentChain(chainName string) bool {
+	return strings.Contains(chainName, "zs.")
+}
+
+// parse the output of "iptables-save -c", e.g.
+// [12:3456] -A eth0.zs.local -p icmp -m comment --comment Default-rules-top -j RETURN
+func parseIptablesSaveCounters(table, content string) ([]IptablesRuleCounter, error) {
+	counters := []IptablesRuleCounter{}
+	indexes := map[string]int{}
+	for _, line := range strings.Split(content, "\n") {
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		end := strings.Index(line, "]")
+		if end < 0 {
+			return nil, errors.Errorf("unable to parse iptables counter[%s]", line)
+		}
+
+		c := IptablesRuleCounter{Table: table}
+		if _, err := fmt.Sscanf(line[1:end], "%d:%d", &c.Packets, &c.Bytes); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("unable to parse iptables counter[%s]", line))
+		}
+
+		c.Rule = strings.TrimSpace(line[end+1:])
+		c.Chain = savedRuleChain(c.Rule)
+		if !isAgentChain(c.Chain) {
+			continue
+		}
+		indexes[c.Chain]++
+		c.Index = indexes[c.Chain]
+
+		// the comment is all that's needed, so the rules with the matches the
+		// parser doesn't know are still counted
+		c.Comment = iptablesRuleComment(c.Rule)
+		c.Group, _ = GetCommentGroup(c.Comment)
+		counters = append(counters, c)
+	}
+
+	return counters, nil
+}
+
+// GetIptablesRuleCounters returns the counters of all rules in the zs.* chains
+// of the filter and nat tables
+func GetIptablesRuleCounters(ctx context.Context) ([]IptablesRuleCounter, error) {
+	counters := []IptablesRuleCounter{}
+	for _, table := range []string{FirewallTable, NatTable} {
+		cmd := iptablesCommand("iptables-save", "-c", "-t", table)
+		cmd.NoLog = true
+		res, err := cmd.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		cs, err := parseIptablesSaveCounters(table, res.Stdout)
+		if err != nil {
+			return nil, err
+		}
+		counters = append(counters, cs...)
+	}
+
+	return counters, nil
+}
+
+// SumIptablesCountersByGroup aggregates the counters by comment group, rules
+// not added by the agent are summed in the group ""
+func SumIptablesCountersByGroup(counters []IptablesRuleCounter) []IptablesGroupCounter {
+	groups := map[string]*IptablesGroupCounter{}
+	for _, c := range counters {
+		g, ok := groups[c.Group]
+		if !ok {
+			g = &IptablesGroupCounter{Group: c.Group}
+			groups[c.Group] = g
+		}
+		g.Rules++
+		g.Packets += c.Packets
+		g.Bytes += c.Bytes
+	}
+
+	sums := []IptablesGroupCounter{}
+	for _, g := range groups {
+		sums = append(sums, *g)
+	}
+	sort.Slice(sums, func(i, j int) bool {
+		return rulesPriority[sums[i].Group] > rulesPriority[sums[j].Group]
+	})
+
+	return sums
+}
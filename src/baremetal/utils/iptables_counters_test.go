@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseIptablesSaveCounters(t *testing.T) {
+	content := `# Generated by iptables-save v1.4.21
+*filter
+:INPUT ACCEPT [120:9600]
+:eth0.zs.local - [0:0]
+[100:8000] -A INPUT -j VYATTA_PRE_FW_IN_HOOK
+[10:840] -A eth0.zs.local -d 10.0.0.1/32 -m comment --comment Default-rules-top -m state --state RELATED,ESTABLISHED -j RETURN
+[0:0] -A eth0.zs.local -d 10.0.0.1/32 -p tcp -m tcp --dport 22 -m comment --comment Management-rules -j RETURN
+[3:180] -A eth0.zs.local -p udp -m udp --dport 53 -m comment --comment PF-rules-for-pf1 -j RETURN
+[2:120] -A eth0.zs.local -p udp -m udp --dport 54 -m comment --comment PF-rules-for-pf2 -j RETURN
+[1:60] -A eth0.zs.local -p tcp -m comment --comment PF-rules-for-pf2 -j DNAT --to-destination 10.0.0.2:1000-2000
+COMMIT
+# Completed`
+
+	counters, err := parseIptablesSaveCounters(FirewallTable, content)
+	PanicOnError(err)
+	Assert(len(counters) == 5, fmt.Sprint(len(counters)))
+	Assert(counters[0].Index == 1 && counters[0].Packets == 10 && counters[0].Bytes == 840, fmt.Sprint(counters[0]))
+	Assert(counters[1].Group == ManagementComment && counters[1].Packets == 0, fmt.Sprint(counters[1]))
+	Assert(counters[2].Comment == "PF-rules-for-pf1" && counters[2].Index == 3, fmt.Sprint(counters[2]))
+	Assert(counters[4].Comment == "PF-rules-for-pf2" && counters[4].Index == 5, fmt.Sprint(counters[4]))
+
+	groups := SumIptablesCountersByGroup(counters)
+	Assert(len(groups) == 3, fmt.Sprint(groups))
+	Assert(groups[0].Group == DefaultTopRuleComment, fmt.Sprint(groups))
+	Assert(groups[2].Group == "PF-rules-" && groups[2].Rules == 3 && groups[2].Packets == 6, fmt.Sprint(groups))
+}
@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	IPTABLES_SNAPSHOT_DIR  = "/home/vyos/baremetal/iptables-snapshots"
+	MAX_IPTABLES_SNAPSHOTS = 20
+)
+
+var (
+	iptablesSnapshotDir   = IPTABLES_SNAPSHOT_DIR
+	iptablesSnapshotTable = []string{FirewallTable, NatTable}
+
+	iptablesRollbackLock    = &sync.Mutex{}
+	iptablesRollbackTimer   *time.Timer
+	iptablesRollbackPending *IptablesSnapshot
+	// bumped by every schedule and confirm, a timer which fired but waited for
+	// the lock meanwhile finds the generation changed and does nothing
+	iptablesRollbackGeneration uint64
+)
+
+// IptablesSnapshot is the iptables-save output of the tables managed by the agent
+type IptablesSnapshot struct {
+	Id     string            `json:"id"`
+	Time   time.Time         `json:"time"`
+	Tables map[string]string `json:"tables,omitempty"`
+}
+
+// IptablesRestorePreview is the result of a dry-run sync, Content is the file
+// which would be passed to iptables-restore
+type IptablesRestorePreview struct {
+	Table   string   `json:"table"`
+	Content string   `json:"content"`
+	Diff    []string `json:"diff"`
+}
+
+func iptablesSave(ctx context.Context, tableName string) (string, error) {
+	cmd := iptablesCommand("iptables-save", "-t", tableName)
+	cmd.NoLog = true
+	res, err := cmd.Run(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return res.Stdout, nil
+}
+
+func sameIptablesTables(s1, s2 *IptablesSnapshot) bool {
+	for _, table := range iptablesSnapshotTable {
+		if len(diffLines(strings.Split(s1.Tables[table], "\n"), strings.Split(s2.Tables[table], "\n"))) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SnapshotIptables saves the filter and nat tables, if nothing changed since the
+// last snapshot the last one is returned
+func SnapshotIptables(ctx context.Context) (*IptablesSnapshot, error) {
+	now := time.Now()
+	s := &IptablesSnapshot{Id: NewArchiveId(now), Time: now, Tables: map[string]string{}}
+	for _, table := range iptablesSnapshotTable {
+		content, err := iptablesSave(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+		s.Tables[table] = content
+	}
+
+	if last, err := ListIptablesSnapshots(); err == nil && len(last) > 0 {
+		if l, err := GetIptablesSnapshot(last[0].Id); err == nil && sameIptablesTables(l, s) {
+			return l, nil
+		}
+	}
+
+	if err := writeIptablesSnapshot(s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func writeIptablesSnapshot(s *IptablesSnapshot) error {
+	return WriteArchive(iptablesSnapshotDir, s.Id, s, MAX_IPTABLES_SNAPSHOTS)
+}
+
+// ListIptablesSnapshots returns the snapshots without table content, the newest first
+func ListIptablesSnapshots() ([]*IptablesSnapshot, error) {
+	archives, err := ListArchives(iptablesSnapshotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []*IptablesSnapshot{}
+	for _, a := range archives {
+		snapshots = append(snapshots, &IptablesSnapshot{Id: a.Id, Time: a.Time})
+	}
+
+	return snapshots, nil
+}
+
+func GetIptablesSnapshot(id string) (*IptablesSnapshot, error) {
+	s := &IptablesSnapshot{}
+	if err := ReadArchive(iptablesSnapshotDir, id, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func restoreIptablesSnapshot(ctx context.Context, s *IptablesSnapshot) error {
+	err := withIptablesLock(func() error {
+		for _, table := range iptablesSnapshotTable {
+			if content, ok := s.Tables[table]; ok {
+				if err := restoreIptablesTable(ctx, content, table); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("iptables restored to snapshot %s taken at %v", s.Id, s.Time)
+	return nil
+}
+
+// RollbackIptables restores the tables to the snapshot taken 'steps' syncs ago,
+// 1 means the snapshot taken just before the last sync. The current tables are
+// snapshotted first and returned as previous, so the rollback can be undone by
+// rolling back 1 step
+func RollbackIptables(ctx context.Context, steps int) (restored *IptablesSnapshot, previous *IptablesSnapshot, err error) {
+	snapshots, err := ListIptablesSnapshots()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if steps < 1 || steps > len(snapshots) {
+		return nil, nil, errors.Errorf("cannot rollback %d steps, there are %d snapshots", steps, len(snapshots))
+	}
+
+	restored, err = GetIptablesSnapshot(snapshots[steps-1].Id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if previous, err = SnapshotIptables(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	return restored, previous, restoreIptablesSnapshot(ctx, restored)
+}
+
+// ScheduleIptablesRollback restores the snapshot after timeout unless
+// ConfirmIptablesChange is called, when a rollback is already pending the
+// earlier snapshot is kept
+func ScheduleIptablesRollback(s *IptablesSnapshot, timeout time.Duration) {
+	iptablesRollbackLock.Lock()
+	defer iptablesRollbackLock.Unlock()
+
+	if iptablesRollbackTimer != nil {
+		iptablesRollbackTimer.Stop()
+		s = iptablesRollbackPending
+	}
+
+	log.Debugf("iptables will be rolled back to snapshot %s in %v unless confirmed", s.Id, timeout)
+	iptablesRollbackGeneration++
+	generation := iptablesRollbackGeneration
+	iptablesRollbackPending = s
+	iptablesRollbackTimer = time.AfterFunc(timeout, func() {
+		iptablesRollbackLock.Lock()
+		defer iptablesRollbackLock.Unlock()
+
+		if iptablesRollbackGeneration != generation {
+			return
+		}
+
+		log.Warnf("iptables change is not confirmed in %v, roll back to snapshot %s", timeout, s.Id)
+		// the request which scheduled the rollback has finished long ago
+		ctx := context.Background()
+		if _, err := SnapshotIptables(ctx); err != nil {
+			log.Warnf("unable to snapshot iptables before rolling back, %s", err)
+		}
+		LogError(restoreIptablesSnapshot(ctx, s))
+		iptablesRollbackTimer = nil
+		iptablesRollbackPending = nil
+	})
+}
+
+// ConfirmIptablesChange cancels the pending rollback, it returns false if
+// there is nothing to confirm
+func ConfirmIptablesChange() bool {
+	iptablesRollbackLock.Lock()
+	defer iptablesRollbackLock.Unlock()
+
+	if iptablesRollbackTimer == nil {
+		return false
+	}
+
+	iptablesRollbackTimer.Stop()
+	iptablesRollbackGeneration++
+	log.Debugf("iptables change confirmed, cancel rollback to snapshot %s", iptablesRollbackPending.Id)
+	iptablesRollbackTimer = nil
+	iptablesRollbackPending = nil
+	return true
+}
+
+// previewFirewallChange applies the change to the iptables-save lines of the
+// filter table, for the dry-run of the changes made by single iptables calls
+func previewFirewallChange(ctx context.Context, change func(lines []string) []string) (*IptablesRestorePreview, error) {
+	current, err := iptablesSave(ctx, FirewallTable)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(current, "\n"), "\n")
+	ruleSet := change(lines)
+	return &IptablesRestorePreview{
+		Table:   FirewallTable,
+		Content: strings.Join(ruleSet, "\n"),
+		Diff:    diffLines(lines, ruleSet),
+	}, nil
+}
+
+func previewIptablesRulesSet(ctx context.Context, ruleSet []string, tableName string) (*IptablesRestorePreview, error) {
+	current, err := iptablesSave(ctx, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IptablesRestorePreview{
+		Table:   tableName,
+		Content: strings.Join(ruleSet, "\n"),
+		Diff:    diffLines(strings.Split(current, "\n"), ruleSet),
+	}, nil
+}
+
+// diffLines returns the lines removed from old (prefixed by "-") and added
+// in new (prefixed by "+"), iptables-save comments and blank lines are ignored
+func diffLines(old, new []string) []string {
+	filter := func(lines []string) []string {
+		ret := []string{}
+		for _, l := range lines {
+			if l != "" && !strings.HasPrefix(l, "#") {
+				ret = append(ret, l)
+			}
+		}
+		return ret
+	}
+	old = filter(old)
+	new = filter(new)
+
+	// longest common subsequence
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		if old[i] == new[j] {
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			diff = append(diff, "-"+old[i])
+			i++
+		} else {
+			diff = append(diff, "+"+new[j])
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		diff = append(diff, "-"+old[i])
+	}
+	for ; j < len(new); j++ {
+		diff = append(diff, "+"+new[j])
+	}
+
+	return diff
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffLines(t *testing.T) {
+	old := []string{"# Generated by iptables-save", "*filter", "-A a -j RETURN", "-A b -j RETURN", "COMMIT"}
+	new := []string{"# Generated later", "*filter", "-A a -j RETURN", "-A c -j RETURN", "COMMIT"}
+
+	diff := diffLines(old, new)
+	Assert(strings.Join(diff, "\n") == "--A b -j RETURN\n+-A c -j RETURN", strings.Join(diff, "\n"))
+	Assert(len(diffLines(old, old)) == 0, "same lines have no diff")
+}
+
+func TestIptablesSnapshotPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptables-snapshots")
+	PanicOnError(err)
+	defer os.RemoveAll(dir)
+
+	iptablesSnapshotDir = dir
+	defer func() { iptablesSnapshotDir = IPTABLES_SNAPSHOT_DIR }()
+
+	now := time.Now()
+	for i := 0; i < MAX_IPTABLES_SNAPSHOTS+3; i++ {
+		tm := now.Add(time.Duration(i) * time.Second)
+		s := &IptablesSnapshot{Id: fmt.Sprintf("%d", tm.UnixNano()), Time: tm,
+			Tables: map[string]string{FirewallTable: fmt.Sprintf("-A a%d -j RETURN", i)}}
+		PanicOnError(writeIptablesSnapshot(s))
+	}
+
+	snapshots, err := ListIptablesSnapshots()
+	PanicOnError(err)
+	Assert(len(snapshots) == MAX_IPTABLES_SNAPSHOTS, fmt.Sprint(len(snapshots)))
+
+	latest, err := GetIptablesSnapshot(snapshots[0].Id)
+	PanicOnError(err)
+	Assert(latest.Tables[FirewallTable] == fmt.Sprintf("-A a%d -j RETURN", MAX_IPTABLES_SNAPSHOTS+2), latest.Tables[FirewallTable])
+}
@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseIptablesRule(t *testing.T) {
+	r, err := parseIptablesRule("-A eth0.zs.local -d 10.0.0.1/32 -p tcp -m tcp --dport 22 -m comment --comment Management-rules -j RETURN")
+	Assert(err == nil, fmt.Sprintf("%v", err))
+	Assert(r.chainName == "eth0.zs.local", r.chainName)
+	Assert(r.dest == "10.0.0.1/32", r.dest)
+	Assert(r.proto == TCP, r.proto)
+	Assert(r.destPort == 22, fmt.Sprint(r.destPort))
+	Assert(r.comment == ManagementComment, r.comment)
+	Assert(r.action == RETURN, r.action)
+
+	r, err = parseIptablesRule(`-A eth1.zs.in -m comment --comment "PF-rules-for-a b" -m state --state RELATED,ESTABLISHED -j RETURN`)
+	Assert(err == nil, fmt.Sprintf("%v", err))
+	Assert(r.comment == "PF-rules-for-a b", r.comment)
+	Assert(strings.Join(r.states, ",") == "RELATED,ESTABLISHED", strings.Join(r.states, ","))
+
+	r, err = parseIptablesRule("-A zs.dnat -d 172.20.0.10/32 -p tcp -m tcp --dport 80 -m comment --comment PF-rules-for-pf1 -j DNAT --to-destination 192.168.0.10:8080")
+	Assert(err == nil, fmt.Sprintf("%v", err))
+	Assert(r.src == "192.168.0.10" && r.srcPort == 8080, fmt.Sprintf("%s:%d", r.src, r.srcPort))
+
+	_, err = parseIptablesRule("-N eth0.zs.local")
+	Assert(err != nil, "-N is not a rule")
+}
+
+func TestIptablesRuleJson(t *testing.T) {
+	rule := NewIptablesRule(UDP, "", "10.0.0.1/32", 0, 67, nil, ACCEPT, DHCPRuleComment)
+	r, err := parseIptablesRule("-A eth0.zs.local " + strings.Join(rule.string(), " "))
+	Assert(err == nil, fmt.Sprintf("%v", err))
+
+	b, err := json.Marshal(r)
+	Assert(err == nil, fmt.Sprintf("%v", err))
+	m := map[string]interface{}{}
+	PanicOnError(json.Unmarshal(b, &m))
+	Assert(m["group"] == DHCPRuleComment, string(b))
+	Assert(m["priority"] == float64(700), string(b))
+	Assert(m["destPort"] == float64(67), string(b))
+	fmt.Println(string(b))
+}
+
+func TestGetCommentGroup(t *testing.T) {
+	group, priority := GetCommentGroup("EIP-rules-for-10.0.0.1")
+	Assert(group == "EIP-rules-" && priority == 300, group)
+
+	group, _ = GetCommentGroup("unknown")
+	Assert(group == "", group)
+}
+
+func TestRemoveRulesByComment(t *testing.T) {
+	rules := []string{
+		"-A eth0.zs.in -p tcp -m tcp --dport 22 -m comment --comment PF-rules-for-10.0.0.1 -j RETURN",
+		"-A eth0.zs.in -p tcp -m tcp --dport 80 -m comment --comment PF-rules-for-10.0.0.10 -j RETURN",
+		`-A eth0.zs.in -m comment --comment "PF-rules-for-10.0.0.1 quoted" -j RETURN`,
+		"-A eth0.zs.in -m comment --comment Default-rules-bottom -j RETURN",
+	}
+
+	left := removeRules(rules, "PF-rules-for-10.0.0.1")
+	Assertf(len(left) == 3 && left[0] == rules[1], "only the exact comment is removed, %v", left)
+
+	left = removeRules(rules, PortFordingRuleComment)
+	Assertf(len(left) == 1 && left[0] == rules[3], "the group comment removes the group, %v", left)
+
+	Assert(iptablesRuleComment(rules[2]) == "PF-rules-for-10.0.0.1 quoted", iptablesRuleComment(rules[2]))
+	Assert(iptablesRuleComment("-A eth0.zs.in -j RETURN") == "", "no comment")
+}
+
+func TestRichIptablesRuleString(t *testing.T) {
+	rule := NewPortRangeIptablesRule(TCP, "", "10.0.0.1/32", PortRange{}, PortRange{Start: 8000, End: 8080},
+		nil, ACCEPT, DHCPRuleComment)
+	s := strings.Join(rule.string(), " ")
+	Assert(strings.Contains(s, "--dport 8000:8080"), s)
+
+	rule = NewMultiportIptablesRule(UDP, "", "", nil, []int{DHCP_SERVER_PORT, TFTP_PORT}, nil, ACCEPT, DHCPRuleComment)
+	s = strings.Join(rule.string(), " ")
+	Assert(strings.Contains(s, "-m multiport --dports 67,69"), s)
+
+	rule = NewIpsetIptablesRule(UDP, "pxe-clients", "", TFTP_PORT, nil, DROP, DHCPRuleComment).NegateSrcSet().WithInNic("eth1")
+	s = strings.Join(rule.string(), " ")
+	Assert(strings.Contains(s, "-m set ! --match-set pxe-clients src"), s)
+	Assert(strings.Contains(s, "-i eth1"), s)
+
+	rule = NewConnlimitIptablesRule(TCP, "", 22, 10, 32, REJECT, ManagementComment)
+	s = strings.Join(rule.string(), " ")
+	Assert(strings.Contains(s, "-m connlimit --connlimit-above 10 --connlimit-mask 32"), s)
+
+	rule = NewPerSourceRateLimitIptablesRule(UDP, DHCP_SERVER_PORT, "10/second", 20, DHCPRuleComment)
+	s = strings.Join(rule.string(), " ")
+	Assert(strings.Contains(s, "-m hashlimit --hashlimit-above 10/second --hashlimit-burst 20 --hashlimit-mode srcip --hashlimit-name udp67"), s)
+	Assert(strings.HasSuffix(s, "-j DROP"), s)
+
+	rule = NewLogIptablesRule(TCP, "", "", 22, []string{NEW}, "ssh-new", "4", ManagementComment)
+	s = strings.Join(rule.string(), " ")
+	Assert(strings.HasSuffix(s, `-j LOG --log-prefix "ssh-new" --log-level 4`), s)
+
+	// the load balancer rules never matched their tcp flags
+	rule = NewLoadBalancerIptablesRule(TCP, "10.0.0.1/32", 80, ACCEPT, LbRuleComment, []string{SYN})
+	s = strings.Join(rule.string(), " ")
+	Assert(!strings.Contains(s, "--tcp-flags"), s)
+	s = strings.Join(rule.WithTcpFlags(SYN).string(), " ")
+	Assert(strings.Contains(s, "--tcp-flags FIN,SYN,RST,ACK SYN"), s)
+}
+
+func TestIptablesRuleNegationRoundTrip(t *testing.T) {
+	for _, rule := range []string{
+		"-A eth0.zs.in ! -s 10.0.0.0/8 -p tcp -m tcp ! --dport 22 -m set --match-set blocked src -m comment --comment PF-rules-for-x -j DROP",
+		"-A eth0.zs.in -s 10.0.0.0/8 -p tcp -m multiport ! --sports 1,2 -m set ! --match-set blocked src -m comment --comment PF-rules-for-x -j DROP",
+	} {
+		r, err := parseIptablesRule(rule)
+		Assert(err == nil, fmt.Sprintf("%v", err))
+		s := strings.Join(strings.Fields(strings.Join(r.string(), " ")), " ")
+		Assert(s == strings.TrimPrefix(rule, "-A eth0.zs.in "), s)
+	}
+
+	_, err := parseIptablesRule("-A eth0.zs.in -p tcp -m tcp --dport 80:20 -j DROP")
+	Assert(err != nil, "start > end")
+	_, err = parseIptablesRule("-A eth0.zs.in -p tcp -m tcp --dport 70000 -j DROP")
+	Assert(err != nil, "out of range")
+}
+
+func TestParseRichIptablesRule(t *testing.T) {
+	r, err := parseIptablesRule("-A eth0.zs.local ! -s 10.0.0.0/8 -i eth0 -p udp -m udp --dport 60:70 " +
+		"-m multiport --sports 1,2 -m set ! --match-set blocked dst -m comment --comment DHCP-rules " +
+		"-m connlimit --connlimit-above 5 --connlimit-mask 24 " +
+		"-m hashlimit --hashlimit-above 10/sec --hashlimit-burst 5 --hashlimit-mode srcip --hashlimit-name udp67 " +
+		`-j LOG --log-prefix "dhcp " --log-level 4`)
+	Assert(err == nil, fmt.Sprintf("%v", err))
+	Assert(r.notSrc && r.src == "10.0.0.0/8", r.src)
+	Assert(r.inNic == "eth0", r.inNic)
+	Assert(r.destPortRange == PortRange{Start: 60, End: 70}, r.destPortRange.String())
+	Assert(joinPorts(r.srcPorts) == "1,2", joinPorts(r.srcPorts))
+	Assert(r.destSet == "blocked" && r.notDestSet && !r.notDest, r.destSet)
+	Assert(r.connlimitAbove == 5 && r.connlimitMask == 24, "connlimit")
+	Assert(r.hashlimit != nil && r.hashlimit.Above && r.hashlimit.Rate == "10/sec" && r.hashlimit.Name == "udp67", "hashlimit")
+	Assert(r.action == LOG && r.logPrefix == "dhcp " && r.logLevel == "4", r.logPrefix)
+
+	b, err := json.Marshal(r)
+	Assert(err == nil, fmt.Sprintf("%v", err))
+	r2 := IptablesRule{}
+	PanicOnError(json.Unmarshal(b, &r2))
+	Assert(strings.Join(r.string(), " ") == strings.Join(r2.string(), " "), string(b))
+}
+
+func TestPreviewFirewallChangeLines(t *testing.T) {
+	lines := []string{
+		"*filter",
+		":eth0.zs.local - [0:0]",
+		":eth0.zs.in - [0:0]",
+		"-A INPUT -j eth0.zs.local",
+		"-A eth0.zs.local -p tcp -m comment --comment PF-rules-for-a -j ACCEPT",
+		"-A eth0.zs.local -m comment --comment " + DefaultBottomRuleComment + " -j ACCEPT",
+		"COMMIT",
+	}
+
+	removed := removeChainRulesByComment(lines, []string{"eth0.zs.local"}, DefaultBottomRuleComment)
+	Assert(len(removed) == len(lines)-1, strings.Join(removed, "\n"))
+	Assert(len(removeChainRulesByComment(lines, []string{"eth0.zs.in"}, "PF-rules-for-a")) == len(lines), "other chains are kept")
+
+	local, in := getNicDefaultRules("reject")
+	added := appendChainRules(removed, "eth0.zs.local", local)
+	Assert(strings.Contains(added[5], "-j REJECT") && strings.HasPrefix(added[5], "-A eth0.zs.local"), added[5])
+	added = appendChainRules(added, "eth0.zs.in", in)
+	Assert(added[len(added)-1] == "COMMIT", added[len(added)-1])
+	Assert(strings.HasPrefix(added[len(added)-3], "-A eth0.zs.in") && strings.Contains(added[len(added)-3], "RETURN"), added[len(added)-3])
+}
+
+func TestIptablesCommandWait(t *testing.T) {
+	cmd := iptablesCommand("iptables", "-t", "filter", "-S")
+	Assert(strings.Join(cmd.Argv, " ") == "iptables -w -t filter -S", strings.Join(cmd.Argv, " "))
+	Assert(cmd.Privileged && cmd.Timeout == IPTABLES_COMMAND_TIMEOUT, "privileged with timeout")
+
+	cmd = iptablesCommand("iptables-save", "-t", "nat")
+	Assert(strings.Join(cmd.Argv, " ") == "iptables-save -t nat", strings.Join(cmd.Argv, " "))
+}
+
+func TestIptablesRuleValidate(t *testing.T) {
+	rule := NewIptablesRule(TCP, "10.0.0.0/8", "10.0.0.1", 0, 22, []string{NEW}, ACCEPT, ManagementComment).WithInNic("eth0")
+	PanicOnError(rule.Validate())
+	PanicOnError(NewLogIptablesRule(TCP, "", "", 22, nil, "ssh new", "4", ManagementComment).Validate())
+
+	for _, b := range []string{
+		`{"action":"ACCEPT","src":"10.0.0.1\n-A INPUT -j ACCEPT"}`,
+		`{"action":"ACCEPT","src":"10.0.0.0/8 -j ACCEPT"}`,
+		`{"action":"ACCEPT","proto":"tcp -m foo"}`,
+		`{"action":"ACCEPT -m foo"}`,
+		`{"action":"ACCEPT","states":["NEW,ESTABLISHED"]}`,
+		`{"action":"ACCEPT","inNic":"eth0 -j DROP"}`,
+		`{"action":"ACCEPT","srcSet":"a b"}`,
+		`{"action":"ACCEPT","comment":"x\"y"}`,
+		`{"action":"DROP","hashLimit":{"name":"x","rate":"1/s --hashlimit-mode x"}}`,
+	} {
+		r := IptablesRule{}
+		PanicOnError(json.Unmarshal([]byte(b), &r))
+		Assertf(r.Validate() != nil, "%s is accepted", b)
+	}
+
+	r := IptablesRule{}
+	PanicOnError(json.Unmarshal([]byte(`{"chain":"INPUT","action":"ACCEPT"}`), &r))
+	Assert(r.chainName == "", "the chain is not set by the client")
+}
+
+func TestIptablesRuleJsonChecks(t *testing.T) {
+	for _, b := range []string{
+		`{"action":"ACCEPT","proto":"tcp","destPortRange":{"start":80,"end":20}}`,
+		`{"action":"ACCEPT","proto":"tcp","destPortRange":{"start":80,"end":70000}}`,
+		`{"action":"ACCEPT","proto":"tcp","destPort":-1}`,
+		`{"action":"ACCEPT","proto":"tcp","destPorts":[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16]}`,
+		`{"action":"LOG","logPrefix":"a\" -j ACCEPT"}`,
+		`{"action":"LOG","logPrefix":"a\nb"}`,
+		`{"action":"LOG","logPrefix":"a-prefix-longer-than-29-chars-"}`,
+	} {
+		r := IptablesRule{}
+		Assertf(json.Unmarshal([]byte(b), &r) != nil, "%s is accepted", b)
+	}
+
+	// the load balancer rules keep their tcp flags unmatched after a round-trip
+	for _, rule := range []IptablesRule{
+		NewLoadBalancerIptablesRule(TCP, "10.0.0.1/32", 80, ACCEPT, LbRuleComment, []string{SYN}),
+		NewIptablesRule(TCP, "", "10.0.0.1/32", 0, 80, nil, ACCEPT, PortFordingRuleComment).WithTcpFlags(SYN),
+	} {
+		b, err := json.Marshal(rule)
+		PanicOnError(err)
+		r := IptablesRule{}
+		PanicOnError(json.Unmarshal(b, &r))
+		Assert(strings.Join(r.string(), " ") == strings.Join(rule.string(), " "), string(b))
+	}
+}
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	LINK_TYPE_ETHERNET = "ethernet"
+	LINK_TYPE_VLAN     = "vlan"
+	LINK_TYPE_BOND     = "bond"
+	LINK_TYPE_BRIDGE   = "bridge"
+
+	BOND_MODE_LACP          = "802.3ad"
+	BOND_MODE_ACTIVE_BACKUP = "active-backup"
+
+	L2_VLAN_NETWORK = "L2VlanNetwork"
+
+	// the max length of a linux interface name
+	MAX_LINK_NAME_LENGTH = 15
+
+	// an ip command only talks to the kernel, it never takes long
+	IP_COMMAND_TIMEOUT = 30 * time.Second
+)
+
+var (
+	linkLog = Logger("link")
+
+	linkNameRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,15}$`)
+)
+
+// CheckLinkName checks an interface name from the API before it's passed to
+// the ip commands
+func CheckLinkName(name string) error {
+	if !linkNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid interface name[%s], it must be 1 to %d letters, digits, '.', '_' or '-'",
+			name, MAX_LINK_NAME_LENGTH)
+	}
+	return nil
+}
+
+// RunIpCommands runs the ip commands in order, it stops at the first failure
+func RunIpCommands(ctx context.Context, cmds [][]string) error {
+	for _, argv := range cmds {
+		cmd := &Command{
+			Argv:       append([]string{"ip"}, argv...),
+			Privileged: true,
+			Timeout:    IP_COMMAND_TIMEOUT,
+		}
+		if _, err := cmd.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LinkSpec describes a virtual link built on the physical nics, the vlan
+// sub-interface of Parent, or the bond/bridge of Slaves
+type LinkSpec struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Parent    string   `json:"parent"`
+	VlanId    int      `json:"vlanId"`
+	Slaves    []string `json:"slaves"`
+	BondMode  string   `json:"bondMode"`
+	Mac       string   `json:"mac"`
+	Mtu       int      `json:"mtu"`
+	Addresses []string `json:"addresses"`
+}
+
+// Validate returns an error describing the first wrong field, the default bond mode is 802.3ad
+func (l *LinkSpec) Validate() error {
+	if err := CheckLinkName(l.Name); err != nil {
+		return err
+	}
+	if l.Parent != "" {
+		if err := CheckLinkName(l.Parent); err != nil {
+			return fmt.Errorf("invalid parent of the link[%s], %s", l.Name, err)
+		}
+	}
+
+	switch l.Type {
+	case LINK_TYPE_VLAN:
+		if l.Parent == "" {
+			return fmt.Errorf("parent is required for the vlan link[%s]", l.Name)
+		}
+		if l.VlanId < 1 || l.VlanId > 4094 {
+			return fmt.Errorf("invalid vlan id[%d] for the link[%s]", l.VlanId, l.Name)
+		}
+	case LINK_TYPE_BOND:
+		if l.BondMode == "" {
+			l.BondMode = BOND_MODE_LACP
+		}
+		if l.BondMode != BOND_MODE_LACP && l.BondMode != BOND_MODE_ACTIVE_BACKUP {
+			return fmt.Errorf("unsupported bond mode[%s] for the link[%s], only %s and %s are supported",
+				l.BondMode, l.Name, BOND_MODE_LACP, BOND_MODE_ACTIVE_BACKUP)
+		}
+		if len(l.Slaves) == 0 {
+			return fmt.Errorf("slaves are required for the bond link[%s]", l.Name)
+		}
+	case LINK_TYPE_BRIDGE:
+	default:
+		return fmt.Errorf("unsupported type[%s] of the link[%s]", l.Type, l.Name)
+	}
+
+	for _, s := range l.Slaves {
+		if err := CheckLinkName(s); err != nil {
+			return fmt.Errorf("invalid slave of the link[%s], %s", l.Name, err)
+		}
+		if s == l.Name {
+			return fmt.Errorf("invalid slave[%s] of the link[%s]", s, l.Name)
+		}
+	}
+	if l.Mac != "" {
+		if _, err := net.ParseMAC(l.Mac); err != nil {
+			return fmt.Errorf("invalid mac[%s] for the link[%s]", l.Mac, l.Name)
+		}
+	}
+	if l.Mtu != 0 && (l.Mtu < 68 || l.Mtu > 9216) {
+		return fmt.Errorf("invalid mtu[%d] for the link[%s]", l.Mtu, l.Name)
+	}
+	for _, addr := range l.Addresses {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return fmt.Errorf("invalid address[%s] for the link[%s], it must be a cidr", addr, l.Name)
+		}
+	}
+	return nil
+}
+
+// addCommands returns the arguments of the ip commands creating the link, they
+// are run in order and the slaves must be down before being enslaved
+func (l *LinkSpec) addCommands() [][]string {
+	var cmds [][]string
+	switch l.Type {
+	case LINK_TYPE_VLAN:
+		cmds = append(cmds, []string{"link", "add", "link", l.Parent, "name", l.Name, "type", "vlan", "id", strconv.Itoa(l.VlanId)})
+	case LINK_TYPE_BOND:
+		cmds = append(cmds, []string{"link", "add", l.Name, "type", "bond", "mode", l.BondMode, "miimon", "100"})
+	case LINK_TYPE_BRIDGE:
+		cmds = append(cmds, []string{"link", "add", l.Name, "type", "bridge"})
+	}
+
+	for _, s := range l.Slaves {
+		cmds = append(cmds, []string{"link", "set", "dev", s, "down"})
+		cmds = append(cmds, []string{"link", "set", "dev", s, "master", l.Name})
+	}
+
+	cmds = append(cmds, l.configureCommands()...)
+
+	for _, s := range l.Slaves {
+		cmds = append(cmds, []string{"link", "set", "dev", s, "up"})
+	}
+	return cmds
+}
+
+// configureCommands applies the mac, mtu and addresses, it is safe to run them on an existing link
+func (l *LinkSpec) configureCommands() [][]string {
+	var cmds [][]string
+	if l.Mac != "" {
+		cmds = append(cmds, []string{"link", "set", "dev", l.Name, "address", l.Mac})
+	}
+	if l.Mtu != 0 {
+		cmds = append(cmds, []string{"link", "set", "dev", l.Name, "mtu", strconv.Itoa(l.Mtu)})
+	}
+	for _, addr := range l.Addresses {
+		cmds = append(cmds, []string{"addr", "replace", addr, "dev", l.Name})
+	}
+	cmds = append(cmds, []string{"link", "set", "dev", l.Name, "up"})
+	return cmds
+}
+
+func LinkExists(name string) bool {
+	ok, _ := PathExists(fmt.Sprintf("/sys/class/net/%s", name))
+	return ok
+}
+
+// AddLink creates the link, if it already exists only the mac, mtu and addresses are applied
+func AddLink(ctx context.Context, l *LinkSpec) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+
+	if l.Parent != "" && !LinkExists(l.Parent) {
+		return fmt.Errorf("the parent[%s] of the link[%s] does not exist", l.Parent, l.Name)
+	}
+	for _, s := range l.Slaves {
+		if !LinkExists(s) {
+			return fmt.Errorf("the slave[%s] of the link[%s] does not exist", s, l.Name)
+		}
+	}
+
+	cmds := l.addCommands()
+	if LinkExists(l.Name) {
+		linkLog.Debugf("the link %s exists, only configure it", l.Name)
+		cmds = l.configureCommands()
+	}
+
+	if err := RunIpCommands(ctx, cmds); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("unable to add the link[%s]", l.Name))
+	}
+	return nil
+}
+
+// DeleteLink deletes a vlan, bond or bridge, the slaves are released and kept up
+func DeleteLink(ctx context.Context, name string) error {
+	if err := CheckLinkName(name); err != nil {
+		return err
+	}
+	if !LinkExists(name) {
+		return nil
+	}
+
+	if ok, _ := PathExists(fmt.Sprintf("/sys/class/net/%s/device", name)); ok {
+		return fmt.Errorf("the link[%s] is a physical nic and cannot be deleted", name)
+	}
+
+	return RunIpCommands(ctx, [][]string{{"link", "delete", "dev", name}})
+}
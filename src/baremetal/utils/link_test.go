@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLinkSpecValidate(t *testing.T) {
+	bond := &LinkSpec{Name: "bond0", Type: LINK_TYPE_BOND, Slaves: []string{"eth1", "eth2"}}
+	PanicOnError(bond.Validate())
+	Assert(bond.BondMode == BOND_MODE_LACP, "default bond mode")
+
+	invalid := []*LinkSpec{
+		{Name: "", Type: LINK_TYPE_BRIDGE},
+		{Name: "averyveryverylongname", Type: LINK_TYPE_BRIDGE},
+		{Name: "eth1.100", Type: LINK_TYPE_VLAN, VlanId: 100},
+		{Name: "eth1.5000", Type: LINK_TYPE_VLAN, Parent: "eth1", VlanId: 5000},
+		{Name: "bond0", Type: LINK_TYPE_BOND},
+		{Name: "bond0", Type: LINK_TYPE_BOND, Slaves: []string{"eth1"}, BondMode: "balance-rr"},
+		{Name: "br0", Type: LINK_TYPE_BRIDGE, Slaves: []string{"br0"}},
+		{Name: "br0", Type: LINK_TYPE_BRIDGE, Mtu: 10000},
+		{Name: "br0", Type: LINK_TYPE_BRIDGE, Addresses: []string{"10.0.0.1"}},
+		{Name: "br0", Type: "macvlan"},
+		{Name: "x;reboot", Type: LINK_TYPE_BRIDGE},
+		{Name: "eth1.100", Type: LINK_TYPE_VLAN, Parent: "eth1 && reboot", VlanId: 100},
+		{Name: "bond0", Type: LINK_TYPE_BOND, Slaves: []string{"eth1", "$(reboot)"}},
+		{Name: "br0", Type: LINK_TYPE_BRIDGE, Slaves: []string{""}},
+	}
+	for _, l := range invalid {
+		err := l.Validate()
+		Assertf(err != nil, "expect error for %+v", l)
+		fmt.Println(err)
+	}
+}
+
+func joinIpCommands(cmds [][]string) string {
+	lines := []string{}
+	for _, argv := range cmds {
+		lines = append(lines, strings.Join(argv, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestLinkSpecCommands(t *testing.T) {
+	vlan := &LinkSpec{Name: "eth1.100", Type: LINK_TYPE_VLAN, Parent: "eth1", VlanId: 100, Mtu: 1496, Addresses: []string{"10.0.0.2/24"}}
+	cmds := joinIpCommands(vlan.addCommands())
+	fmt.Println(cmds)
+	Assert(cmds == `link add link eth1 name eth1.100 type vlan id 100
+link set dev eth1.100 mtu 1496
+addr replace 10.0.0.2/24 dev eth1.100
+link set dev eth1.100 up`, "vlan commands")
+
+	bond := &LinkSpec{Name: "bond0", Type: LINK_TYPE_BOND, BondMode: BOND_MODE_ACTIVE_BACKUP, Slaves: []string{"eth1", "eth2"}}
+	cmds = joinIpCommands(bond.addCommands())
+	fmt.Println(cmds)
+	Assert(cmds == `link add bond0 type bond mode active-backup miimon 100
+link set dev eth1 down
+link set dev eth1 master bond0
+link set dev eth2 down
+link set dev eth2 master bond0
+link set dev bond0 up
+link set dev eth1 up
+link set dev eth2 up`, "bond commands")
+
+	Assert(DeleteLink(context.Background(), "eth0;reboot") != nil, "invalid name")
+}
+
+func TestBootstrapNicLink(t *testing.T) {
+	info, err := ParseBootstrapInfo([]byte(`{
+		"managementNic": {"mac": "fa:ac:6e:3b:4f:00", "ip": "172.20.12.34", "netmask": "255.255.0.0"},
+		"additionalNics": [
+			{"deviceName": "eth1", "mac": "fa:ac:6e:3b:4f:01", "ip": "10.86.4.132", "netmask": "255.255.255.0",
+				"l2type": "L2VlanNetwork", "physicalInterface": "eth1", "vni": 100},
+			{"deviceName": "bond0", "type": "bond", "slaves": ["eth2", "eth3"], "ip": "192.168.1.1", "netmask": "255.255.255.0", "mtu": 9000},
+			{"deviceName": "bond0.200", "l2type": "L2VlanNetwork", "physicalInterface": "bond0", "vni": 200,
+				"ip": "192.168.2.1", "netmask": "255.255.255.0"}
+		],
+		"publicKey": "ssh-rsa AAAA",
+		"vyosPassword": "password"
+	}`))
+	PanicOnError(err)
+
+	Assert(info.ManagementNic.Link() == nil, "management nic")
+	// a vlan network on the nic itself is tagged by the host
+	Assert(info.AdditionalNics[0].Link() == nil, "eth1")
+
+	bond := info.AdditionalNics[1].Link()
+	Assert(bond.Type == LINK_TYPE_BOND && bond.BondMode == "" && bond.Mtu == 9000, "bond")
+	Assert(bond.Addresses[0] == "192.168.1.1/24", "bond address")
+
+	vlan := info.AdditionalNics[2].Link()
+	Assert(vlan.Type == LINK_TYPE_VLAN && vlan.Parent == "bond0" && vlan.VlanId == 200, "vlan")
+
+	_, err = ParseBootstrapInfo([]byte(`{
+		"managementNic": {"mac": "fa:ac:6e:3b:4f:00", "ip": "172.20.12.34", "netmask": "255.255.0.0"},
+		"additionalNics": [{"deviceName": "bond0", "type": "bond", "ip": "192.168.1.1", "netmask": "255.255.255.0"},
+			{"deviceName": "eth4", "type": "team", "mac": "fa:ac:6e:3b:4f:04", "ip": "192.168.3.1", "netmask": "255.255.255.0"}],
+		"publicKey": "ssh-rsa AAAA",
+		"vyosPassword": "password"
+	}`))
+	fmt.Println(err)
+	Assert(err != nil && strings.Contains(err.Error(), "field additionalNics[0]:") &&
+		strings.Contains(err.Error(), "field additionalNics[1].type"), "invalid links")
+}
@@ -6,6 +6,9 @@ import (
 	"strings"
 	"os"
 	"io"
+	"sort"
+	"sync"
+	"time"
 	log "github.com/Sirupsen/logrus"
 )
 
@@ -44,14 +47,208 @@ func (f *logFormatter) Format(entry *log.Entry) ([]byte, error) {
 	return append([]byte(msg), '\n'), nil
 }
 
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+
+	// the logs not from a subsystem, and the subsystems without their own level
+	DEFAULT_LOG_SUBSYSTEM = "default"
+)
+
+// LogConfig is the 'log' section of the agent config
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+	// rotate the file when it's bigger than it, DEFAULT_LOG_MAX_SIZE_MB if it's 0
+	MaxSizeMB int `json:"maxSizeMB"`
+	// DEFAULT_LOG_MAX_BACKUPS if it's 0
+	MaxBackups int `json:"maxBackups"`
+	// the days to keep the backups, 30 if it's 0
+	MaxAgeDays int `json:"maxAgeDays"`
+	// gzip the backups, true if it's not set
+	Compress *bool `json:"compress"`
+	// the levels of the subsystems, e.g. {"route": "debug", "supervisor": "warn"}
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+type subsystemLogger struct {
+	logger *log.Logger
+	// follow the default level if not set
+	explicit bool
+}
+
+var (
+	logLock          sync.Mutex
+	logPath          string
+	logStdout        bool
+	logFile          *RotatingFile
+	subsystemLoggers = map[string]*subsystemLogger{}
+)
+
+// Logger returns the logger of a subsystem, its level can be changed at runtime
+// apart from the default one, the entries have a 'subsystem' field
+func Logger(subsystem string) *log.Entry {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	s, ok := subsystemLoggers[subsystem]
+	if !ok {
+		std := log.StandardLogger()
+		l := log.New()
+		l.Out = std.Out
+		l.Formatter = std.Formatter
+		l.Hooks = std.Hooks
+		l.SetLevel(std.GetLevel())
+		s = &subsystemLogger{logger: l}
+		subsystemLoggers[subsystem] = s
+	}
+	return s.logger.WithField("subsystem", subsystem)
+}
+
+// SetLogLevel changes the level of a subsystem, or the default level for
+// DEFAULT_LOG_SUBSYSTEM which the subsystems without their own level follow
+func SetLogLevel(subsystem string, level string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	return setLogLevel(subsystem, lvl)
+}
+
+func setLogLevel(subsystem string, lvl log.Level) error {
+	if subsystem == DEFAULT_LOG_SUBSYSTEM {
+		log.SetLevel(lvl)
+		for _, s := range subsystemLoggers {
+			if !s.explicit {
+				s.logger.SetLevel(lvl)
+			}
+		}
+		return nil
+	}
+
+	s, ok := subsystemLoggers[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown log subsystem[%s], it must be one of %s", subsystem, strings.Join(logSubsystems(), ", "))
+	}
+	s.logger.SetLevel(lvl)
+	s.explicit = true
+	return nil
+}
+
+func logSubsystems() []string {
+	names := []string{DEFAULT_LOG_SUBSYSTEM}
+	for name := range subsystemLoggers {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// GetLogLevels returns the levels of the default and all subsystems
+func GetLogLevels() map[string]string {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	levels := map[string]string{DEFAULT_LOG_SUBSYSTEM: log.GetLevel().String()}
+	for name, s := range subsystemLoggers {
+		levels[name] = s.logger.GetLevel().String()
+	}
+	return levels
+}
+
+func setLogOutput(out io.Writer, formatter log.Formatter) {
+	log.SetOutput(out)
+	log.SetFormatter(formatter)
+	for _, s := range subsystemLoggers {
+		s.logger.SetOutput(out)
+		s.logger.SetFormatter(formatter)
+	}
+}
+
 func InitLog(logpath string, stdout bool) {
-	log.SetLevel(log.DebugLevel)
-	log.SetFormatter(&logFormatter{})
-	logFile, err := CreateFileIfNotExists(logpath, os.O_WRONLY | os.O_APPEND, 0666); PanicOnError(err)
-	if stdout {
-		multi := io.MultiWriter(logFile, os.Stdout)
-		log.SetOutput(multi)
-	} else {
-		log.SetOutput(logFile)
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	logPath = logpath
+	logStdout = stdout
+	PanicOnError(configureLog(LogConfig{}))
+}
+
+// ConfigureLog applies the log config after InitLog, the file is reopened with
+// the new rotation settings
+func ConfigureLog(c LogConfig) error {
+	logLock.Lock()
+	defer logLock.Unlock()
+	return configureLog(c)
+}
+
+func configureLog(c LogConfig) error {
+	level := log.DebugLevel
+	if c.Level != "" {
+		var err error
+		if level, err = log.ParseLevel(c.Level); err != nil {
+			return err
+		}
+	}
+
+	var formatter log.Formatter
+	switch c.Format {
+	case "", LOG_FORMAT_TEXT:
+		formatter = &logFormatter{}
+	case LOG_FORMAT_JSON:
+		formatter = &log.JSONFormatter{TimestampFormat: timeFormat}
+	default:
+		return fmt.Errorf("unknown log format[%s], it must be %s or %s", c.Format, LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+
+	subsystemLevels := map[string]log.Level{}
+	for name, l := range c.Subsystems {
+		if _, ok := subsystemLoggers[name]; !ok {
+			return fmt.Errorf("unknown log subsystem[%s], it must be one of %s", name, strings.Join(logSubsystems(), ", "))
+		}
+		lvl, err := log.ParseLevel(l)
+		if err != nil {
+			return fmt.Errorf("invalid log level of the subsystem[%s], %v", name, err)
+		}
+		subsystemLevels[name] = lvl
+	}
+
+	f := &RotatingFile{
+		Path:       logPath,
+		MaxSize:    int64(DEFAULT_LOG_MAX_SIZE_MB) << 20,
+		MaxBackups: DEFAULT_LOG_MAX_BACKUPS,
+		MaxAge:     DEFAULT_LOG_MAX_AGE,
+		Compress:   c.Compress == nil || *c.Compress,
+	}
+	if c.MaxSizeMB > 0 {
+		f.MaxSize = int64(c.MaxSizeMB) << 20
+	}
+	if c.MaxBackups > 0 {
+		f.MaxBackups = c.MaxBackups
+	}
+	if c.MaxAgeDays > 0 {
+		f.MaxAge = time.Duration(c.MaxAgeDays) * 24 * time.Hour
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	var out io.Writer = f
+	if logStdout {
+		out = io.MultiWriter(f, os.Stdout)
+	}
+	setLogOutput(out, formatter)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+
+	PanicOnError(setLogLevel(DEFAULT_LOG_SUBSYSTEM, level))
+	for name, lvl := range subsystemLevels {
+		PanicOnError(setLogLevel(name, lvl))
 	}
+	return nil
 }
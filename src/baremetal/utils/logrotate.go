@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_LOG_MAX_SIZE_MB = 100
+	DEFAULT_LOG_MAX_BACKUPS = 5
+	DEFAULT_LOG_MAX_AGE     = 30 * 24 * time.Hour
+
+	logBackupTimeFormat = "20060102-150405.000"
+)
+
+// RotatingFile is a log file rotated when it reaches MaxSize, the backups are
+// named 'path.<time>', optionally gzipped, and removed beyond MaxBackups or MaxAge
+type RotatingFile struct {
+	Path string
+	// bytes, 0 means no rotation
+	MaxSize int64
+	// 0 means no limit
+	MaxBackups int
+	// 0 means no limit
+	MaxAge   time.Duration
+	Compress bool
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+	// the backups are compressed and removed in the background, one rotation at a time
+	cleaning  sync.WaitGroup
+	cleanLock sync.Mutex
+}
+
+func (r *RotatingFile) open() error {
+	f, err := CreateFileIfNotExists(r.Path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			// keep logging to the current file rather than losing the logs
+			fmt.Fprintf(os.Stderr, "failed to rotate the log file %s, %v\n", r.Path, err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file to a backup and starts a new one
+func (r *RotatingFile) Rotate() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	return r.rotate()
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+
+	// the names must be unique even when rotating twice in a millisecond
+	now := time.Now()
+	backup := fmt.Sprintf("%s.%s", r.Path, now.Format(logBackupTimeFormat))
+	for fileExists(backup) || fileExists(backup+".gz") {
+		now = now.Add(time.Millisecond)
+		backup = fmt.Sprintf("%s.%s", r.Path, now.Format(logBackupTimeFormat))
+	}
+	if err := os.Rename(r.Path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.cleaning.Add(1)
+	go func() {
+		defer r.cleaning.Done()
+		r.cleanLock.Lock()
+		defer r.cleanLock.Unlock()
+		if r.Compress {
+			if err := gzipFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compress the log file %s, %v\n", backup, err)
+			}
+		}
+		r.removeOldBackups()
+	}()
+	return nil
+}
+
+// Backups returns the rotated files, the newest first
+func (r *RotatingFile) Backups() ([]string, error) {
+	matches, err := filepath.Glob(r.Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, r.Path+"."), ".gz")
+		if _, err := time.Parse(logBackupTimeFormat, suffix); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// the time format sorts in the time order
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+func (r *RotatingFile) removeOldBackups() {
+	backups, err := r.Backups()
+	if err != nil {
+		return
+	}
+	for i, b := range backups {
+		expired := false
+		if r.MaxAge > 0 {
+			if info, err := os.Stat(b); err == nil && time.Since(info.ModTime()) > r.MaxAge {
+				expired = true
+			}
+		}
+		if expired || (r.MaxBackups > 0 && i >= r.MaxBackups) {
+			os.Remove(b)
+		}
+	}
+}
+
+// Close closes the current file and waits for the background compression
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cleaning.Wait()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrotate")
+	PanicOnError(err)
+	defer os.RemoveAll(dir)
+
+	f := &RotatingFile{Path: filepath.Join(dir, "agent.log"), MaxSize: 100, MaxBackups: 2, Compress: true}
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 10; i++ {
+		_, err := f.Write([]byte(line))
+		PanicOnError(err)
+	}
+	PanicOnError(f.Close())
+
+	content, err := ioutil.ReadFile(f.Path)
+	PanicOnError(err)
+	Assertf(len(content) <= 100, "the current file has %d bytes", len(content))
+
+	backups, err := f.Backups()
+	PanicOnError(err)
+	fmt.Println(backups)
+	Assertf(len(backups) == 2, "expected 2 backups, got %v", backups)
+	for _, b := range backups {
+		Assertf(strings.HasSuffix(b, ".gz"), "backup %s is not compressed", b)
+		gz, err := os.Open(b)
+		PanicOnError(err)
+		zr, err := gzip.NewReader(gz)
+		PanicOnError(err)
+		data, err := ioutil.ReadAll(zr)
+		PanicOnError(err)
+		gz.Close()
+		Assertf(string(data) == line+line, "unexpected content of %s: %q", b, data)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	PanicOnError(SetLogLevel(DEFAULT_LOG_SUBSYSTEM, "info"))
+
+	l := Logger("test-levels")
+	Assert(l.Logger.GetLevel() == log.InfoLevel, "a new subsystem follows the default level")
+
+	PanicOnError(SetLogLevel("test-levels", "debug"))
+	PanicOnError(SetLogLevel(DEFAULT_LOG_SUBSYSTEM, "warn"))
+	levels := GetLogLevels()
+	fmt.Println(levels)
+	Assertf(levels["test-levels"] == "debug" && levels[DEFAULT_LOG_SUBSYSTEM] == "warning",
+		"unexpected levels %v", levels)
+
+	Assert(SetLogLevel("no-such-subsystem", "debug") != nil, "unknown subsystem")
+	Assert(SetLogLevel(DEFAULT_LOG_SUBSYSTEM, "verbose") != nil, "unknown level")
+}
+
+func TestConfigureLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logconfig")
+	PanicOnError(err)
+	defer os.RemoveAll(dir)
+	defer func() {
+		logLock.Lock()
+		defer logLock.Unlock()
+		setLogOutput(os.Stderr, &logFormatter{})
+		logFile.Close()
+		logFile = nil
+	}()
+
+	InitLog(filepath.Join(dir, "agent.log"), false)
+	Assert(ConfigureLog(LogConfig{Format: "xml"}) != nil, "unknown format")
+	Assert(ConfigureLog(LogConfig{Subsystems: map[string]string{"no-such-subsystem": "info"}}) != nil, "unknown subsystem")
+
+	Logger("test-config")
+	PanicOnError(ConfigureLog(LogConfig{Format: LOG_FORMAT_JSON, Level: "info",
+		Subsystems: map[string]string{"test-config": "error"}}))
+	log.Debugf("not logged")
+	log.Infof("logged")
+	Logger("test-config").Warnf("not logged")
+	Logger("test-config").Errorf("logged too")
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "agent.log"))
+	PanicOnError(err)
+	fmt.Print(string(content))
+	Assert(!strings.Contains(string(content), "not logged"), "filtered by the levels")
+	Assert(strings.Contains(string(content), `"msg":"logged"`), "json format")
+	Assert(strings.Contains(string(content), `"subsystem":"test-config"`), "subsystem field")
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,13 +10,13 @@ import (
 	"strconv"
 	"strings"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 )
 
 const (
 	VROUTER_ROUTE_PROTO = "vrouter"
 	//ZSTACK_ROUTE_PROTO_IDENTIFFER = "192" conflict with eigrp
+	// the routes are added with the number, so they don't need rt_protos to name it
 	VROUTER_ROUTE_PROTO_IDENTIFFER = "199"
 )
 
@@ -163,11 +164,12 @@ func GetIpFromUrl(url string) (string, error) {
 }
 
 func CheckVrouterRouteExists(ip string) bool {
-	bash := Bash{
-		Command: fmt.Sprintf("ip r list %s/32 proto %s", ip, VROUTER_ROUTE_PROTO),
+	cmd := &Command{
+		Argv:    []string{"ip", "route", "list", ip + "/32", "proto", VROUTER_ROUTE_PROTO_IDENTIFFER},
+		Timeout: IP_COMMAND_TIMEOUT,
 	}
-	_, o, _, _ := bash.RunWithReturn()
-	if o == "" {
+	res, err := cmd.Run(context.Background())
+	if err != nil || strings.TrimSpace(res.Stdout) == "" {
 		return false
 	}
 	return true
@@ -175,84 +177,54 @@ func CheckVrouterRouteExists(ip string) bool {
 
 func DeleteRouteIfExists(ip string) error {
 	if CheckVrouterRouteExists(ip) == true {
-		bash := Bash{
-			Command: fmt.Sprintf("ip route del %s/32", ip),
-		}
-		_, _, _, err := bash.RunWithReturn()
-		if err != nil {
-			return err
-		}
+		return RunIpCommands(context.Background(), [][]string{{"route", "del", ip + "/32"}})
 	}
 
 	return nil
 }
 
+// SetVrouterRoute sets a host route to ip with proto vrouter, it's not
+// persisted, use AddStaticRoute for the routes surviving a restart
 func SetVrouterRoute(ip string, nic string, gw string) error {
-	SetVrouterRouteProtoIdentifier()
-	DeleteRouteIfExists(ip)
-
-	var bash Bash
-	if gw == "" {
-		bash = Bash{
-			Command: fmt.Sprintf("ip route add %s/32 dev %s proto %s", ip, nic, VROUTER_ROUTE_PROTO),
-		}
-	} else {
-		bash = Bash{
-			Command: fmt.Sprintf("ip route add %s/32 via %s dev %s proto %s", ip, gw, nic, VROUTER_ROUTE_PROTO),
-		}
+	if net.ParseIP(ip).To4() == nil {
+		return errors.New(fmt.Sprintf("invalid ip %s of the route", ip))
 	}
-
-	ret, _, _, err := bash.RunWithReturn()
-	if err != nil {
+	if gw != "" && net.ParseIP(gw).To4() == nil {
+		return errors.New(fmt.Sprintf("invalid gateway %s of the route to %s", gw, ip))
+	}
+	if err := CheckLinkName(nic); err != nil {
 		return err
 	}
-	// NOTE(WeiW): It will return 2 if exists
-	if ret != 0 && ret != 2 {
-		return errors.New(fmt.Sprintf("add route to %s/32 via %s dev %s failed", ip, gw, nic))
+	cmd := []string{"route", "replace", ip + "/32"}
+	if gw != "" {
+		cmd = append(cmd, "via", gw)
 	}
-
-	return nil
+	cmd = append(cmd, "dev", nic, "proto", VROUTER_ROUTE_PROTO_IDENTIFFER)
+	return RunIpCommands(context.Background(), [][]string{cmd})
 }
 
 func GetNicForRoute(ip string) string {
-	bash := Bash{
-		Command: fmt.Sprintf("ip -o r get %s | awk '{print $3}'", ip),
+	cmd := &Command{
+		Argv:    []string{"ip", "-o", "route", "get", ip},
+		Timeout: IP_COMMAND_TIMEOUT,
 	}
-	_, o, _, err := bash.RunWithReturn()
+	res, err := cmd.Run(context.Background())
 	PanicOnError(err)
-	o = strings.Replace(o, "\n", "", -1)
-	return o
-}
-
-func RemoveVrouterRoute(ip string) error {
-	SetVrouterRouteProtoIdentifier()
-	bash := Bash{
-		Command: fmt.Sprintf("ip route del %s/32 proto %s", ip, VROUTER_ROUTE_PROTO),
-	}
-	ret, _, _, err := bash.RunWithReturn()
-	if err != nil {
-		return err
-	}
-	if ret != 0 {
-		return errors.New(fmt.Sprintf("del route to %s/32 proto %s failed", ip, VROUTER_ROUTE_PROTO))
+	// e.g. 10.0.0.5 via 10.0.0.1 dev eth0 src 10.0.0.2
+	fields := strings.Fields(res.Stdout)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return fields[i+1]
+		}
 	}
-
-	return nil
+	return ""
 }
 
-func SetVrouterRouteProtoIdentifier() {
-	bash := Bash{
-		Command: "grep vrouter /etc/iproute2/rt_protos",
-	}
-	check, _, _, _ := bash.RunWithReturn()
-
-	if check != 0 {
-		log.Debugf("no route proto vrouter in /etc/iproute2/rt_protos")
-		bash = Bash{
-			Command: fmt.Sprintf("sudo bash -c \"echo -e '\n\n# Used by vrouter\n%s     vrouter' >> /etc/iproute2/rt_protos\"", VROUTER_ROUTE_PROTO_IDENTIFFER),
-		}
-		bash.Run()
+func RemoveVrouterRoute(ip string) error {
+	if net.ParseIP(ip).To4() == nil {
+		return errors.New(fmt.Sprintf("invalid ip %s of the route", ip))
 	}
+	return RunIpCommands(context.Background(), [][]string{{"route", "del", ip + "/32", "proto", VROUTER_ROUTE_PROTO_IDENTIFFER}})
 }
 
 func GetNicNumber(nic string) (int, error) {
@@ -301,25 +273,6 @@ func GetPrivteInterface() []string {
 }
 
 func CleanConnTrackConnection(ip string, proto string, port int) error {
-	var command string
-	if proto == "" {
-		command = fmt.Sprintf("sudo conntrack -d %s -D", ip)
-	} else if port == 0 {
-		command = fmt.Sprintf("sudo conntrack -d %s -p %s -D", ip, proto)
-	} else {
-		command = fmt.Sprintf("sudo conntrack -d %s -p %s --dport %d -D", ip, proto, port)
-	}
-
-	bash := Bash{
-		Command: command,
-	}
-	ret, _, _, err := bash.RunWithReturn()
-	if err != nil {
-		return err
-	}
-	if ret != 0 {
-		return errors.New(fmt.Sprintf("conntrack -d %s -p %s --dport %d -D failed return %d", ip, proto, port, ret))
-	}
-
-	return nil
+	_, err := DeleteConntrackEntries(context.Background(), ConntrackFilter{Dst: ip, Proto: proto, DestPort: port})
+	return err
 }
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// direct when the agent runs as root, otherwise sudo
+	PRIVILEGE_MODE_AUTO   = "auto"
+	PRIVILEGE_MODE_DIRECT = "direct"
+	PRIVILEGE_MODE_SUDO   = "sudo"
+	// a setuid helper runs the program, e.g. 'baremetal-priv iptables -S', it
+	// checks the program against its own allow-list, see PrivilegeHelperArgv
+	PRIVILEGE_MODE_HELPER = "helper"
+
+	DEFAULT_PRIVILEGE_HELPER = "/usr/local/bin/baremetal-priv"
+	// the helper only runs the programs in these directories, never the ones
+	// found in the PATH of the agent
+	PRIVILEGE_HELPER_PATH = "/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// the programs the agent runs with privilege, a program out of the list is
+// never run. The argv is passed to exec, never to a shell, so the check of
+// argv[0] covers the whole command
+var DefaultPrivilegedPrograms = []string{
+	"iptables", "iptables-save", "iptables-restore",
+	"conntrack", "ip", "arping",
+}
+
+// PrivilegeConfig is the 'privilege' section of the agent config
+type PrivilegeConfig struct {
+	Mode string `json:"mode"`
+	// the path of the helper, DEFAULT_PRIVILEGE_HELPER if it's empty
+	Helper string `json:"helper"`
+	// the base names of the programs, DefaultPrivilegedPrograms if it's empty
+	AllowList []string `json:"allowList"`
+}
+
+type privilege struct {
+	mode    string
+	helper  string
+	allowed map[string]bool
+}
+
+var (
+	currentPrivilege *privilege
+	privilegeLock    sync.RWMutex
+)
+
+func init() {
+	PanicOnError(ConfigurePrivilege(PrivilegeConfig{}))
+}
+
+// ConfigurePrivilege sets how the privileged programs are run, it's called at startup
+func ConfigurePrivilege(c PrivilegeConfig) error {
+	p := &privilege{mode: c.Mode, helper: c.Helper, allowed: map[string]bool{}}
+	switch p.mode {
+	case "", PRIVILEGE_MODE_AUTO:
+		p.mode = PRIVILEGE_MODE_SUDO
+		if os.Geteuid() == 0 {
+			p.mode = PRIVILEGE_MODE_DIRECT
+		}
+	case PRIVILEGE_MODE_DIRECT, PRIVILEGE_MODE_SUDO:
+	case PRIVILEGE_MODE_HELPER:
+		if p.helper == "" {
+			p.helper = DEFAULT_PRIVILEGE_HELPER
+		}
+		if !filepath.IsAbs(p.helper) {
+			return fmt.Errorf("the privilege helper[%s] must be an absolute path", p.helper)
+		}
+	default:
+		return fmt.Errorf("unknown privilege mode[%s], it must be one of %s, %s, %s and %s", c.Mode,
+			PRIVILEGE_MODE_AUTO, PRIVILEGE_MODE_DIRECT, PRIVILEGE_MODE_SUDO, PRIVILEGE_MODE_HELPER)
+	}
+
+	programs := c.AllowList
+	if len(programs) == 0 {
+		programs = DefaultPrivilegedPrograms
+	}
+	for _, program := range programs {
+		if strings.ContainsAny(program, "/ ") {
+			return fmt.Errorf("invalid program[%s] in the privilege allow-list, it must be a base name", program)
+		}
+		p.allowed[program] = true
+	}
+
+	privilegeLock.Lock()
+	defer privilegeLock.Unlock()
+	currentPrivilege = p
+	return nil
+}
+
+// PrivilegeMode returns the effective mode, auto is resolved to direct or sudo
+func PrivilegeMode() string {
+	privilegeLock.RLock()
+	defer privilegeLock.RUnlock()
+	return currentPrivilege.mode
+}
+
+// PrivilegedArgv returns the argv running the program with privilege, an error
+// is returned if the program is not in the allow-list
+func PrivilegedArgv(argv ...string) ([]string, error) {
+	return privilegedArgv(0, argv...)
+}
+
+// privilegedArgv is PrivilegedArgv killing the program after the timeout if
+// it's positive. The agent cannot kill the root child of sudo, so the program
+// is run by timeout(1) under sudo, the sudoers must allow timeout -s KILL for
+// the programs in the allow-list
+func privilegedArgv(timeout time.Duration, argv ...string) ([]string, error) {
+	Assert(len(argv) != 0, "argv cannot be empty")
+
+	privilegeLock.RLock()
+	p := currentPrivilege
+	privilegeLock.RUnlock()
+
+	if !p.allowed[filepath.Base(argv[0])] {
+		return nil, fmt.Errorf("the program[%s] is not in the privilege allow-list", argv[0])
+	}
+
+	switch p.mode {
+	case PRIVILEGE_MODE_SUDO:
+		if timeout > 0 {
+			seconds := strconv.Itoa(int((timeout + time.Second - 1) / time.Second))
+			return append([]string{"sudo", "timeout", "-s", "KILL", seconds}, argv...), nil
+		}
+		return append([]string{"sudo"}, argv...), nil
+	case PRIVILEGE_MODE_HELPER:
+		// the helper keeps the real uid of the agent, so the agent can kill it
+		return append([]string{p.helper}, argv...), nil
+	default:
+		return argv, nil
+	}
+}
+
+// PrivilegeHelperArgv is the check of the setuid helper, it returns the path and
+// the argv of the program to exec for the arguments of the helper. The program
+// must be in DefaultPrivilegedPrograms and is looked up in PRIVILEGE_HELPER_PATH
+// by its base name, so the caller cannot choose another binary by its path
+func PrivilegeHelperArgv(args []string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("no program to run")
+	}
+
+	program := filepath.Base(args[0])
+	allowed := false
+	for _, p := range DefaultPrivilegedPrograms {
+		allowed = allowed || p == program
+	}
+	if !allowed {
+		return "", nil, fmt.Errorf("the program[%s] is not in the allow-list of the helper", args[0])
+	}
+
+	for _, dir := range filepath.SplitList(PRIVILEGE_HELPER_PATH) {
+		path := filepath.Join(dir, program)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, append([]string{program}, args[1:]...), nil
+		}
+	}
+	return "", nil, fmt.Errorf("the program[%s] is not found in %s", program, PRIVILEGE_HELPER_PATH)
+}
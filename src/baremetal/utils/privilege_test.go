@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usePrivilege sets the privilege for a test, the returned function restores the default
+func usePrivilege(c PrivilegeConfig) func() {
+	PanicOnError(ConfigurePrivilege(c))
+	return func() {
+		PanicOnError(ConfigurePrivilege(PrivilegeConfig{}))
+	}
+}
+
+func TestConfigurePrivilege(t *testing.T) {
+	defer usePrivilege(PrivilegeConfig{})()
+	if os.Geteuid() == 0 {
+		Assert(PrivilegeMode() == PRIVILEGE_MODE_DIRECT, "auto as root")
+		argv, err := PrivilegedArgv("iptables", "-S")
+		PanicOnError(err)
+		Assert(strings.Join(argv, " ") == "iptables -S", strings.Join(argv, " "))
+	} else {
+		Assert(PrivilegeMode() == PRIVILEGE_MODE_SUDO, "auto as non-root")
+	}
+
+	usePrivilege(PrivilegeConfig{Mode: PRIVILEGE_MODE_SUDO})
+	argv, err := PrivilegedArgv("/sbin/ip", "link", "show")
+	PanicOnError(err)
+	Assert(strings.Join(argv, " ") == "sudo /sbin/ip link show", strings.Join(argv, " "))
+	// the root child of sudo is killed by timeout(1)
+	argv, err = privilegedArgv(1500*time.Millisecond, "ip", "link", "show")
+	PanicOnError(err)
+	Assert(strings.Join(argv, " ") == "sudo timeout -s KILL 2 ip link show", strings.Join(argv, " "))
+
+	for _, program := range []string{"tee", "kill", "bash"} {
+		_, err = PrivilegedArgv(program)
+		Assertf(err != nil, "%s is not allowed by default", program)
+	}
+
+	usePrivilege(PrivilegeConfig{Mode: PRIVILEGE_MODE_HELPER})
+	argv, err = privilegedArgv(time.Second, "/sbin/ip", "link", "show")
+	PanicOnError(err)
+	Assert(strings.Join(argv, " ") == DEFAULT_PRIVILEGE_HELPER+" /sbin/ip link show", strings.Join(argv, " "))
+
+	usePrivilege(PrivilegeConfig{Mode: PRIVILEGE_MODE_DIRECT, AllowList: []string{"ip"}})
+	_, err = PrivilegedArgv("iptables", "-S")
+	Assert(err != nil, "iptables is not allowed")
+	fmt.Println(err)
+
+	for _, c := range []PrivilegeConfig{
+		{Mode: "su"},
+		{Mode: PRIVILEGE_MODE_HELPER, Helper: "baremetal-priv"},
+		{Mode: PRIVILEGE_MODE_SUDO, AllowList: []string{"/bin/bash"}},
+	} {
+		err := ConfigurePrivilege(c)
+		Assertf(err != nil, "expect error for %+v", c)
+		fmt.Println(err)
+	}
+}
+
+func TestPrivilegedCommand(t *testing.T) {
+	defer usePrivilege(PrivilegeConfig{Mode: PRIVILEGE_MODE_DIRECT, AllowList: []string{"echo"}})()
+
+	result, err := (&Command{Argv: []string{"echo", "ok"}, Privileged: true}).Run(context.Background())
+	PanicOnError(err)
+	Assert(result.Stdout == "ok\n", result.Stdout)
+
+	_, err = (&Command{Argv: []string{"true"}, Privileged: true}).Run(context.Background())
+	Assert(err != nil && strings.Contains(err.Error(), "allow-list"), "true is not allowed")
+}
+
+func TestPrivilegeHelperArgv(t *testing.T) {
+	// the program is found by its base name in PRIVILEGE_HELPER_PATH
+	path, argv, err := PrivilegeHelperArgv([]string{"/tmp/ip", "link", "show"})
+	if err == nil {
+		Assert(strings.HasSuffix(path, "/ip") && !strings.HasPrefix(path, "/tmp"), path)
+		Assert(strings.Join(argv, " ") == "ip link show", strings.Join(argv, " "))
+	} else {
+		Assert(strings.Contains(err.Error(), "not found"), err.Error())
+	}
+
+	for _, args := range [][]string{{}, {"bash", "-c", "id"}, {"/usr/bin/tee", "/etc/passwd"}} {
+		_, _, err = PrivilegeHelperArgv(args)
+		Assertf(err != nil, "%v is not allowed", args)
+		fmt.Println(err)
+	}
+}
@@ -4,9 +4,14 @@ import (
 	"fmt"
 	"strings"
 	"strconv"
+	"syscall"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// FindFirstPIDByPS greps ps for the processes not started by the agent, the
+// daemons started by the agent should be run by the Supervisor which knows their pids
 func FindFirstPIDByPS(cmdline...string) (int, error) {
 	return FindFirstPIDByPSExtern(false, cmdline...)
 }
@@ -47,19 +52,18 @@ func KillProcess(pid int) error {
 	return KillProcess1(pid, 15)
 }
 
+// KillProcess1 sends SIGTERM then SIGKILL until the process is gone, the agent
+// can only kill its own processes, e.g. the daemons it started, the error of
+// SIGTERM like EPERM is returned at once
 func KillProcess1(pid int, waitTime uint) error {
-	b := Bash{
-		Command: fmt.Sprintf("sudo kill %v", pid),
+	if err := syscall.Kill(pid, syscall.SIGTERM); err == syscall.ESRCH {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("unable to kill the process %d", pid))
 	}
-	b.Run()
 
 	check := func() bool {
-		b := Bash{
-			Command: fmt.Sprintf("ps -p %v", pid),
-		}
-
-		ret, _, _, _ := b.RunWithReturn()
-		return ret != 0
+		return syscall.Kill(pid, 0) == syscall.ESRCH
 	}
 
 	if check() {
@@ -67,10 +71,7 @@ func KillProcess1(pid int, waitTime uint) error {
 	}
 
 	return LoopRunUntilSuccessOrTimeout(func() bool {
-		b := Bash{
-			Command: fmt.Sprintf("kill -9 %v", pid),
-		}
-		b.Run()
+		syscall.Kill(pid, syscall.SIGKILL)
 
 		return check()
 	}, time.Duration(waitTime) * time.Second, time.Duration(500) * time.Millisecond)
@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestKillProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	PanicOnError(cmd.Start())
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	PanicOnError(KillProcess1(cmd.Process.Pid, 5))
+	<-done
+	Assert(cmd.ProcessState.Sys().(syscall.WaitStatus).Signal() == syscall.SIGTERM, "killed by SIGTERM")
+
+	// the process is gone
+	PanicOnError(KillProcess1(cmd.Process.Pid, 5))
+}
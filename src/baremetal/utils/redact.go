@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// REDACTED replaces the secrets in the logs
+const REDACTED = "******"
+
+var (
+	// the JSON fields masked in all logs, compared case-insensitively
+	sensitiveFields = map[string]bool{
+		"password":     true,
+		"vyospassword": true,
+		"publickey":    true,
+		"privatekey":   true,
+		"secret":       true,
+		"token":        true,
+		"bmcpassword":  true,
+		"ipmipassword": true,
+	}
+	sensitiveFieldsLock sync.RWMutex
+)
+
+// RegisterSensitiveFields adds JSON fields masked in all logs
+func RegisterSensitiveFields(fields ...string) {
+	sensitiveFieldsLock.Lock()
+	defer sensitiveFieldsLock.Unlock()
+	for _, f := range fields {
+		sensitiveFields[strings.ToLower(f)] = true
+	}
+}
+
+func isSensitiveField(name string, extra []string) bool {
+	name = strings.ToLower(name)
+	for _, f := range extra {
+		if strings.ToLower(f) == name {
+			return true
+		}
+	}
+	sensitiveFieldsLock.RLock()
+	defer sensitiveFieldsLock.RUnlock()
+	return sensitiveFields[name]
+}
+
+func redactJsonValue(v interface{}, extra []string) interface{} {
+	switch o := v.(type) {
+	case map[string]interface{}:
+		for k, child := range o {
+			if isSensitiveField(k, extra) {
+				if child != nil {
+					o[k] = REDACTED
+				}
+			} else {
+				o[k] = redactJsonValue(child, extra)
+			}
+		}
+	case []interface{}:
+		for i, child := range o {
+			o[i] = redactJsonValue(child, extra)
+		}
+	}
+	return v
+}
+
+// RedactJson masks the values of the sensitive fields at any level of the JSON
+// body, the registered fields and the extra fields are masked. A body which is
+// not JSON is returned as it is
+func RedactJson(body []byte, extra ...string) string {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return string(body)
+	}
+
+	b, err := json.Marshal(redactJsonValue(v, extra))
+	if err != nil {
+		return string(body)
+	}
+	return string(b)
+}
+
+// RedactObject marshals the object and masks it like RedactJson
+func RedactObject(obj interface{}, extra ...string) string {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return ""
+	}
+	return RedactJson(b, extra...)
+}
+
+// RedactSecrets replaces all occurrences of the secrets in the string, the
+// longer ones first so a secret containing another one is masked as a whole
+func RedactSecrets(s string, secrets ...string) string {
+	if len(secrets) == 0 {
+		return s
+	}
+	sorted := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret != "" {
+			sorted = append(sorted, secret)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	for _, secret := range sorted {
+		s = strings.Replace(s, secret, REDACTED, -1)
+	}
+	return s
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRedactJson(t *testing.T) {
+	body := `{"managementNic":{"ip":"172.20.12.34"},"vyosPassword":"vrouter12#","publicKey":"ssh-rsa AAAA",
+		"bmc":[{"ip":"10.0.0.1","IpmiPassword":"admin","port":623}],"extra":{"pass":"x"},"token":null,"id":12345678901234567890}`
+	r := RedactJson([]byte(body), "pass")
+	fmt.Println(r)
+	for _, secret := range []string{"vrouter12#", "ssh-rsa", "admin", `"x"`} {
+		Assertf(!strings.Contains(r, secret), "%s is not masked in %s", secret, r)
+	}
+	Assert(strings.Contains(r, `"ip":"172.20.12.34"`) && strings.Contains(r, `"port":623`), "other fields")
+	Assert(strings.Contains(r, `"token":null`), "null is kept")
+	Assert(strings.Contains(r, "12345678901234567890"), "the number is kept as it is")
+
+	Assert(RedactJson([]byte("not a json")) == "not a json", "not json")
+	Assert(RedactJson([]byte(`""`)) == `""`, "empty string")
+
+	RegisterSensitiveFields("CommunityString")
+	r = RedactObject(map[string]string{"communityString": "public"})
+	Assert(r == `{"communityString":"******"}`, r)
+}
+
+func TestRedactSecrets(t *testing.T) {
+	Assert(RedactSecrets("ipmitool -P abc -P abcdef", "abc", "abcdef", "") == "ipmitool -P ****** -P ******", "secrets")
+	Assert(RedactSecrets("no secret") == "no secret", "no secret")
+
+	b := Bash{Command: "echo password; exit 1", Secrets: []string{"password"}}
+	err := b.Run()
+	Assert(err != nil && !strings.Contains(err.Error(), "password"), err.Error())
+
+	c := &Command{Argv: []string{"sh", "-c", "echo s3cret >&2; exit 1"}, Secrets: []string{"s3cret"}}
+	_, err = c.Run(context.Background())
+	Assert(err != nil && !strings.Contains(err.Error(), "s3cret"), err.Error())
+}
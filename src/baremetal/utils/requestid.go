@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// the log field and the HTTP header carrying the request ID
+	REQUEST_ID_FIELD  = "requestId"
+	HEADER_REQUEST_ID = "X-Request-Id"
+	// the environment variable of the commands run for a request
+	REQUEST_ID_ENV = "BAREMETAL_REQUEST_ID"
+)
+
+type requestIdKey struct{}
+
+// NewRequestId generates a random ID for the requests without a task UUID
+func NewRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithRequestId returns a context carrying the request ID, the commands run
+// with the context and the goroutines it's passed to get the ID
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestIdFromContext returns the request ID carried by the context, or ""
+func RequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// RequestLogger returns the standard logger with the request ID of the context
+func RequestLogger(ctx context.Context) *log.Entry {
+	entry := log.NewEntry(log.StandardLogger())
+	if id := RequestIdFromContext(ctx); id != "" {
+		entry = entry.WithField(REQUEST_ID_FIELD, id)
+	}
+	return entry
+}
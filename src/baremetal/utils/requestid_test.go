@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestRequestIdContext(t *testing.T) {
+	Assert(RequestIdFromContext(context.Background()) == "", "no request ID")
+
+	ctx := WithRequestId(context.Background(), "req-1")
+	Assert(RequestIdFromContext(ctx) == "req-1", "carried")
+	// the goroutines started by a handler get the ID with the context
+	done := make(chan string)
+	go func(ctx context.Context) {
+		done <- RequestIdFromContext(ctx)
+	}(ctx)
+	Assert(<-done == "req-1", "carried into the goroutine")
+	Assert(RequestIdFromContext(WithRequestId(ctx, "req-2")) == "req-2", "overridden")
+
+	_, ok := RequestLogger(context.Background()).Data[REQUEST_ID_FIELD]
+	Assert(!ok, "no request ID field")
+	Assert(RequestLogger(ctx).Data[REQUEST_ID_FIELD] == "req-1", "the request ID field")
+
+	Assert(NewRequestId() != NewRequestId(), "random IDs")
+}
+
+func TestRequestIdInLogsAndCommands(t *testing.T) {
+	var buf bytes.Buffer
+	std := log.StandardLogger()
+	out, formatter, level := std.Out, std.Formatter, std.Level
+	std.Out, std.Formatter = &buf, &logFormatter{}
+	std.SetLevel(log.DebugLevel)
+	defer func() {
+		std.Out, std.Formatter = out, formatter
+		std.SetLevel(level)
+	}()
+
+	ctx := WithRequestId(context.Background(), "req-log")
+	r, err := RunCommand(ctx, "sh", "-c", "echo $"+REQUEST_ID_ENV)
+	PanicOnError(err)
+	Assertf(strings.TrimSpace(r.Stdout) == "req-log", "the command got %s", r.Stdout)
+	_, _, _, err = (&Bash{Command: "true"}).RunWithContext(ctx)
+	PanicOnError(err)
+
+	r, err = RunCommand(context.Background(), "sh", "-c", "echo $"+REQUEST_ID_ENV)
+	PanicOnError(err)
+	Assertf(strings.TrimSpace(r.Stdout) == "", "the command got %s", r.Stdout)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	Assertf(len(lines) == 6, "unexpected logs %v", lines)
+	for _, l := range lines[:4] {
+		Assertf(strings.Contains(l, `"requestId":"req-log"`), "no request ID in %s", l)
+	}
+	for _, l := range lines[4:] {
+		Assertf(!strings.Contains(l, "requestId"), "the request ID leaks into %s", l)
+	}
+}
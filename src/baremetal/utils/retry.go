@@ -1,8 +1,13 @@
 package utils
 
 import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
 	"time"
 	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
 	"runtime"
 	"reflect"
 )
@@ -25,3 +30,94 @@ func Retry(fn func() error, retryTimes uint, interval uint) error {
 		retryTimes --
 	}
 }
+
+// RetryPolicy retries with exponential backoff, the n-th retry waits
+// InitialDelay * Multiplier^(n-1), capped by MaxDelay and randomized by Jitter
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	// 1 if it's less than 1, the delay is fixed then
+	Multiplier float64
+	// 0 means no cap
+	MaxDelay time.Duration
+	// in [0, 1], the delay d is randomized in [d*(1-Jitter), d*(1+Jitter)] so the
+	// agents don't retry at the same time
+	Jitter float64
+	// stop retrying after the time since the first attempt, 0 means no limit
+	MaxElapsed time.Duration
+	// the max attempts including the first one, 0 means no limit
+	MaxAttempts int
+	// tells if an error is worth retrying, all errors except PermanentError are if it's nil
+	Retryable func(error) bool
+}
+
+// PermanentError stops RetryPolicy.Do at once
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent marks the error not retryable
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// Delay returns the wait before the n-th retry, n starts from 1
+func (p *RetryPolicy) Delay(n int) time.Duration {
+	m := p.Multiplier
+	if m < 1 {
+		m = 1
+	}
+	d := float64(p.InitialDelay) * math.Pow(m, float64(n-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d = d * (1 - p.Jitter + 2*p.Jitter*rand.Float64())
+	}
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if _, ok := err.(*PermanentError); ok {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// Do calls fn until it succeeds, the error is not retryable, the limits of the
+// policy are reached or the context is done, the last error of fn is returned
+func (p *RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	for n := 1; ; n++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if !p.retryable(err) {
+			if pe, ok := err.(*PermanentError); ok {
+				return pe.Err
+			}
+			return err
+		}
+		if p.MaxAttempts > 0 && n >= p.MaxAttempts {
+			return errors.Wrap(err, fmt.Sprintf("gave up after %d attempts", n))
+		}
+
+		delay := p.Delay(n)
+		if p.MaxElapsed > 0 && time.Since(start)+delay > p.MaxElapsed {
+			return errors.Wrap(err, fmt.Sprintf("gave up after %v", time.Since(start)))
+		}
+
+		log.Debugf("attempt %d failed, retry in %v, %v", n, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrap(err, fmt.Sprintf("gave up because of %v", ctx.Err()))
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range expected {
+		Assertf(p.Delay(i+1) == d, "delay of retry %d is %v, expected %v", i+1, p.Delay(i+1), d)
+	}
+
+	p = &RetryPolicy{InitialDelay: time.Second}
+	Assert(p.Delay(3) == time.Second, "a policy without multiplier should use a fixed delay")
+
+	p = &RetryPolicy{InitialDelay: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := p.Delay(1)
+		Assertf(d >= 500*time.Millisecond && d <= 1500*time.Millisecond, "delay %v out of the jitter range", d)
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: time.Millisecond, Multiplier: 2, MaxAttempts: 5}
+
+	n := 0
+	err := p.Do(context.Background(), func(ctx context.Context) error {
+		n++
+		if n < 3 {
+			return fmt.Errorf("failure %d", n)
+		}
+		return nil
+	})
+	Assertf(err == nil && n == 3, "expected success at the 3rd attempt, got %v after %d", err, n)
+
+	n = 0
+	err = p.Do(context.Background(), func(ctx context.Context) error {
+		n++
+		return fmt.Errorf("failure %d", n)
+	})
+	Assertf(err != nil && n == 5, "expected failure after 5 attempts, got %v after %d", err, n)
+	fmt.Println(err)
+
+	n = 0
+	cause := fmt.Errorf("bad request")
+	err = p.Do(context.Background(), func(ctx context.Context) error {
+		n++
+		return Permanent(cause)
+	})
+	Assertf(err == cause && n == 1, "permanent error should stop retrying, got %v after %d", err, n)
+
+	n = 0
+	p.Retryable = func(e error) bool { return e != cause }
+	err = p.Do(context.Background(), func(ctx context.Context) error {
+		n++
+		return cause
+	})
+	Assertf(err == cause && n == 1, "non retryable error should stop retrying, got %v after %d", err, n)
+}
+
+func TestRetryPolicyLimits(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: 20 * time.Millisecond, MaxElapsed: 50 * time.Millisecond}
+	n := 0
+	err := p.Do(context.Background(), func(ctx context.Context) error {
+		n++
+		return fmt.Errorf("failure")
+	})
+	Assertf(err != nil && n <= 3, "expected giving up within the max elapsed time, got %v after %d", err, n)
+
+	p = &RetryPolicy{InitialDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	cause := fmt.Errorf("failure")
+	err = p.Do(ctx, func(ctx context.Context) error {
+		return cause
+	})
+	Assertf(time.Since(start) < time.Second, "a done context should interrupt the wait, took %v", time.Since(start))
+	Assertf(errors.Cause(err) == cause, "expected the last error, got %v", err)
+	fmt.Println(err)
+}
@@ -0,0 +1,603 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ROUTE_CONFIG_PATH = "/home/vyos/baremetal/routes.json"
+	// the main table, the routes without table are put into it
+	MAIN_ROUTE_TABLE = 254
+	// the priorities of the rules managed by the agent, the rules out of the
+	// range, e.g. the default ones and the policy routing of the vyos, are
+	// never touched
+	MIN_POLICY_RULE_PRIORITY = 20000
+	MAX_POLICY_RULE_PRIORITY = 29999
+	// the protocol of the persisted routes, it tells them apart from the host
+	// routes of SetVrouterRoute with proto vrouter (199), which are not persisted. It's
+	// numeric so no name is needed in rt_protos
+	STATIC_ROUTE_PROTO = "198"
+)
+
+// StaticRoute is installed with proto STATIC_ROUTE_PROTO, a route is identified
+// by its destination, table and metric like the kernel does
+type StaticRoute struct {
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway,omitempty"`
+	Dev         string `json:"dev,omitempty"`
+	Metric      int    `json:"metric,omitempty"`
+	Table       int    `json:"table,omitempty"`
+}
+
+// PolicyRule is a source based routing rule, a rule is identified by its priority
+type PolicyRule struct {
+	Priority    int    `json:"priority"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Iif         string `json:"iif,omitempty"`
+	Fwmark      int    `json:"fwmark,omitempty"`
+	Table       int    `json:"table"`
+}
+
+type RouteConfig struct {
+	Routes []StaticRoute `json:"routes"`
+	Rules  []PolicyRule  `json:"rules"`
+}
+
+var (
+	routeConfigPath = ROUTE_CONFIG_PATH
+	routeLock       sync.Mutex
+	routeLog        = Logger("route")
+)
+
+// normalizeCidr turns 10.0.0.1 into 10.0.0.1/32 and 10.0.0.1/8 into 10.0.0.0/8
+func normalizeCidr(s string) (string, error) {
+	if s == "default" {
+		return "0.0.0.0/0", nil
+	}
+	if !strings.Contains(s, "/") {
+		s = s + "/32"
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil || n.IP.To4() == nil {
+		return "", fmt.Errorf("%s is not an IPv4 cidr", s)
+	}
+	return n.String(), nil
+}
+
+func validateTable(table int) error {
+	if table < 0 || int64(table) > 0xFFFFFFFE {
+		return fmt.Errorf("invalid route table %d", table)
+	}
+	return nil
+}
+
+// Validate normalizes the destination and checks the other fields
+func (r *StaticRoute) Validate() error {
+	dst, err := normalizeCidr(r.Destination)
+	if err != nil {
+		return errors.Wrap(err, "invalid destination of the route")
+	}
+	r.Destination = dst
+
+	if r.Gateway == "" && r.Dev == "" {
+		return fmt.Errorf("either gateway or dev is required for the route to %s", r.Destination)
+	}
+	if r.Dev != "" {
+		if err := CheckLinkName(r.Dev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid dev of the route to %s", r.Destination))
+		}
+	}
+	if r.Gateway != "" && net.ParseIP(r.Gateway).To4() == nil {
+		return fmt.Errorf("invalid gateway %s of the route to %s", r.Gateway, r.Destination)
+	}
+	if r.Metric < 0 {
+		return fmt.Errorf("invalid metric %d of the route to %s", r.Metric, r.Destination)
+	}
+	if r.Table == MAIN_ROUTE_TABLE {
+		r.Table = 0
+	}
+	return validateTable(r.Table)
+}
+
+func (r StaticRoute) same(o StaticRoute) bool {
+	return r.Destination == o.Destination && r.Table == o.Table && r.Metric == o.Metric
+}
+
+// selector is the part of the ip command to find the route
+func (r StaticRoute) selector() []string {
+	s := []string{r.Destination}
+	if r.Metric != 0 {
+		s = append(s, "metric", strconv.Itoa(r.Metric))
+	}
+	if r.Table != 0 {
+		s = append(s, "table", strconv.Itoa(r.Table))
+	}
+	return s
+}
+
+func (r StaticRoute) addCommand() []string {
+	s := []string{"route", "replace", r.Destination}
+	if r.Gateway != "" {
+		s = append(s, "via", r.Gateway)
+	}
+	if r.Dev != "" {
+		s = append(s, "dev", r.Dev)
+	}
+	if r.Metric != 0 {
+		s = append(s, "metric", strconv.Itoa(r.Metric))
+	}
+	if r.Table != 0 {
+		s = append(s, "table", strconv.Itoa(r.Table))
+	}
+	return append(s, "proto", STATIC_ROUTE_PROTO)
+}
+
+func (r StaticRoute) deleteCommand() []string {
+	return append(append([]string{"route", "del"}, r.selector()...), "proto", STATIC_ROUTE_PROTO)
+}
+
+func checkPolicyRulePriority(priority int) error {
+	if priority < MIN_POLICY_RULE_PRIORITY || priority > MAX_POLICY_RULE_PRIORITY {
+		return fmt.Errorf("invalid priority %d of the rule, it must be in [%d, %d]",
+			priority, MIN_POLICY_RULE_PRIORITY, MAX_POLICY_RULE_PRIORITY)
+	}
+	return nil
+}
+
+// Validate normalizes the source and destination and checks the other fields
+func (r *PolicyRule) Validate() error {
+	if err := checkPolicyRulePriority(r.Priority); err != nil {
+		return err
+	}
+	if r.Source == "" && r.Destination == "" && r.Iif == "" && r.Fwmark == 0 {
+		return fmt.Errorf("the rule %d matches nothing, one of source, destination, iif and fwmark is required", r.Priority)
+	}
+	var err error
+	if r.Source != "" {
+		if r.Source, err = normalizeCidr(r.Source); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid source of the rule %d", r.Priority))
+		}
+	}
+	if r.Destination != "" {
+		if r.Destination, err = normalizeCidr(r.Destination); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid destination of the rule %d", r.Priority))
+		}
+	}
+	if r.Iif != "" {
+		if err := CheckLinkName(r.Iif); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid iif of the rule %d", r.Priority))
+		}
+	}
+	if r.Fwmark < 0 {
+		return fmt.Errorf("invalid fwmark %d of the rule %d", r.Fwmark, r.Priority)
+	}
+	if r.Table == 0 {
+		return fmt.Errorf("table is required for the rule %d", r.Priority)
+	}
+	return validateTable(r.Table)
+}
+
+func (r PolicyRule) addCommand() []string {
+	s := []string{"rule", "add", "priority", strconv.Itoa(r.Priority)}
+	if r.Source != "" {
+		s = append(s, "from", r.Source)
+	}
+	if r.Destination != "" {
+		s = append(s, "to", r.Destination)
+	}
+	if r.Iif != "" {
+		s = append(s, "iif", r.Iif)
+	}
+	if r.Fwmark != 0 {
+		s = append(s, "fwmark", strconv.Itoa(r.Fwmark))
+	}
+	return append(s, "table", strconv.Itoa(r.Table))
+}
+
+// deletePolicyRules deletes all rules of the priority, it never fails
+func deletePolicyRules(ctx context.Context, priority int) {
+	// a priority can have many rules, each del removes one of them
+	for i := 0; i < 1000; i++ {
+		cmd := &Command{
+			Argv:       []string{"ip", "rule", "del", "priority", strconv.Itoa(priority)},
+			Privileged: true,
+			Timeout:    IP_COMMAND_TIMEOUT,
+			NoLog:      true,
+		}
+		if _, err := cmd.Run(ctx); err != nil {
+			return
+		}
+	}
+}
+
+func loadRouteConfig() (*RouteConfig, error) {
+	config := &RouteConfig{}
+	content, err := ioutil.ReadFile(routeConfigPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to parse the route config %s", routeConfigPath))
+	}
+	return config, nil
+}
+
+// saveRouteConfig writes a temporary file and renames it, so a crash never leaves a broken config
+func saveRouteConfig(config *RouteConfig) error {
+	sort.Slice(config.Routes, func(i, j int) bool {
+		a, b := config.Routes[i], config.Routes[j]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		return a.Metric < b.Metric
+	})
+	sort.Slice(config.Rules, func(i, j int) bool {
+		return config.Rules[i].Priority < config.Rules[j].Priority
+	})
+
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = MkdirForFile(routeConfigPath, 0755); err != nil {
+		return err
+	}
+	tmp := routeConfigPath + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, routeConfigPath)
+}
+
+// AddStaticRoute installs or replaces the route and persists it
+func AddStaticRoute(ctx context.Context, r StaticRoute) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	config, err := loadRouteConfig()
+	if err != nil {
+		return err
+	}
+	if err = RunIpCommands(ctx, [][]string{r.addCommand()}); err != nil {
+		return err
+	}
+
+	routes := []StaticRoute{r}
+	for _, o := range config.Routes {
+		if !o.same(r) {
+			routes = append(routes, o)
+		}
+	}
+	config.Routes = routes
+	return saveRouteConfig(config)
+}
+
+// DeleteStaticRoute removes the route from the kernel and the persisted config,
+// the gateway and dev of the route are ignored
+func DeleteStaticRoute(ctx context.Context, r StaticRoute) error {
+	dst, err := normalizeCidr(r.Destination)
+	if err != nil {
+		return err
+	}
+	r.Destination = dst
+	if r.Table == MAIN_ROUTE_TABLE {
+		r.Table = 0
+	}
+
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	config, err := loadRouteConfig()
+	if err != nil {
+		return err
+	}
+	// the route may have gone with its link
+	if err := RunIpCommands(ctx, [][]string{r.deleteCommand()}); err != nil {
+		if cerr, ok := err.(*CommandError); !ok || !cerr.Exited() {
+			return err
+		}
+		routeLog.Debugf("the route %s does not exist in the kernel", strings.Join(r.selector(), " "))
+	}
+
+	routes := []StaticRoute{}
+	for _, o := range config.Routes {
+		if !o.same(r) {
+			routes = append(routes, o)
+		}
+	}
+	config.Routes = routes
+	return saveRouteConfig(config)
+}
+
+// AddPolicyRule replaces the rules of the same priority and persists it
+func AddPolicyRule(ctx context.Context, r PolicyRule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	config, err := loadRouteConfig()
+	if err != nil {
+		return err
+	}
+	deletePolicyRules(ctx, r.Priority)
+	if err = RunIpCommands(ctx, [][]string{r.addCommand()}); err != nil {
+		return err
+	}
+
+	rules := []PolicyRule{r}
+	for _, o := range config.Rules {
+		if o.Priority != r.Priority {
+			rules = append(rules, o)
+		}
+	}
+	config.Rules = rules
+	return saveRouteConfig(config)
+}
+
+func DeletePolicyRule(ctx context.Context, priority int) error {
+	if err := checkPolicyRulePriority(priority); err != nil {
+		return err
+	}
+
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	config, err := loadRouteConfig()
+	if err != nil {
+		return err
+	}
+	deletePolicyRules(ctx, priority)
+
+	rules := []PolicyRule{}
+	for _, o := range config.Rules {
+		if o.Priority != priority {
+			rules = append(rules, o)
+		}
+	}
+	config.Rules = rules
+	return saveRouteConfig(config)
+}
+
+// GetRouteConfig returns the persisted routes and rules
+func GetRouteConfig() (*RouteConfig, error) {
+	routeLock.Lock()
+	defer routeLock.Unlock()
+	return loadRouteConfig()
+}
+
+// parseIpRoutes parses the output of 'ip route show table all', the routes not
+// in the format of '<dst> [via <gw>] [dev <dev>] ...' are skipped
+func parseIpRoutes(content string) []StaticRoute {
+	var routes []StaticRoute
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// the type of the route, e.g. local, broadcast, unreachable
+		if net.ParseIP(strings.Split(fields[0], "/")[0]) == nil && fields[0] != "default" {
+			continue
+		}
+		dst, err := normalizeCidr(fields[0])
+		if err != nil {
+			continue
+		}
+
+		r := StaticRoute{Destination: dst}
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				r.Gateway = fields[i+1]
+			case "dev":
+				r.Dev = fields[i+1]
+			case "metric":
+				r.Metric, _ = strconv.Atoi(fields[i+1])
+			case "table":
+				if fields[i+1] != "main" {
+					r.Table, _ = strconv.Atoi(fields[i+1])
+				}
+			default:
+				continue
+			}
+			i++
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// parseIpRules parses the output of 'ip rule show', e.g.
+// 100:	from 10.0.0.0/24 to 192.168.0.0/16 iif eth1 fwmark 0x10 lookup 100
+func parseIpRules(content string) []PolicyRule {
+	var rules []PolicyRule
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		priority, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			continue
+		}
+
+		r := PolicyRule{Priority: priority}
+		for i := 1; i+1 < len(fields); i++ {
+			v := fields[i+1]
+			switch fields[i] {
+			case "from":
+				if v != "all" {
+					r.Source, _ = normalizeCidr(v)
+				}
+			case "to":
+				r.Destination, _ = normalizeCidr(v)
+			case "iif":
+				r.Iif = v
+			case "fwmark":
+				mark, _ := strconv.ParseInt(strings.Split(v, "/")[0], 0, 64)
+				r.Fwmark = int(mark)
+			case "lookup", "table":
+				if t, err := strconv.Atoi(v); err == nil {
+					r.Table = t
+				} else if v == "main" {
+					r.Table = MAIN_ROUTE_TABLE
+				}
+			default:
+				continue
+			}
+			i++
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func listIp(ctx context.Context, argv ...string) (string, error) {
+	cmd := &Command{
+		Argv:    append([]string{"ip"}, argv...),
+		NoLog:   true,
+		Timeout: IP_COMMAND_TIMEOUT,
+	}
+	res, err := cmd.Run(ctx)
+	if err != nil {
+		return "", err
+	}
+	return res.Stdout, nil
+}
+
+// ListKernelRoutes returns the persisted routes installed by the agent
+func ListKernelRoutes(ctx context.Context) ([]StaticRoute, error) {
+	o, err := listIp(ctx, "route", "show", "table", "all", "proto", STATIC_ROUTE_PROTO)
+	if err != nil {
+		return nil, err
+	}
+	return parseIpRoutes(o), nil
+}
+
+func ListKernelPolicyRules(ctx context.Context) ([]PolicyRule, error) {
+	o, err := listIp(ctx, "rule", "show")
+	if err != nil {
+		return nil, err
+	}
+	return parseIpRules(o), nil
+}
+
+// routeReconcilePlan makes the kernel same as the config
+type routeReconcilePlan struct {
+	deleteRoutes []StaticRoute
+	addRoutes    []StaticRoute
+	deleteRules  []int
+	addRules     []PolicyRule
+}
+
+// reconcilePlan only touches what the agent owns: the routes with proto
+// STATIC_ROUTE_PROTO and the rules in the managed priorities which are not in
+// the config are deleted, the routes in the config are always replaced
+func reconcilePlan(config *RouteConfig, routes []StaticRoute, rules []PolicyRule) *routeReconcilePlan {
+	plan := &routeReconcilePlan{}
+	for _, k := range routes {
+		found := false
+		for _, r := range config.Routes {
+			if r.same(k) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			plan.deleteRoutes = append(plan.deleteRoutes, k)
+		}
+	}
+	plan.addRoutes = config.Routes
+
+	wanted := map[int]PolicyRule{}
+	for _, r := range config.Rules {
+		wanted[r.Priority] = r
+	}
+	seen := map[int]bool{}
+	for _, k := range rules {
+		if checkPolicyRulePriority(k.Priority) != nil || seen[k.Priority] {
+			continue
+		}
+		seen[k.Priority] = true
+		if w, ok := wanted[k.Priority]; ok && w == k {
+			delete(wanted, k.Priority)
+			continue
+		}
+		plan.deleteRules = append(plan.deleteRules, k.Priority)
+	}
+	for _, r := range config.Rules {
+		if _, ok := wanted[r.Priority]; ok {
+			plan.addRules = append(plan.addRules, r)
+		}
+	}
+	return plan
+}
+
+// ReconcileRoutes installs the persisted routes and rules, it's called when the agent starts
+func ReconcileRoutes() error {
+	ctx := context.Background()
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	config, err := loadRouteConfig()
+	if err != nil {
+		return err
+	}
+	routes, err := ListKernelRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	rules, err := ListKernelPolicyRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	plan := reconcilePlan(config, routes, rules)
+	// run all commands, a route on a link which is gone must not stop the others
+	var errs []string
+	for _, r := range plan.deleteRoutes {
+		if err := RunIpCommands(ctx, [][]string{r.deleteCommand()}); err != nil {
+			routeLog.Debugf("unable to delete the route %s, %s", r.Destination, err)
+		}
+	}
+	for _, r := range plan.addRoutes {
+		if err := RunIpCommands(ctx, [][]string{r.addCommand()}); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, p := range plan.deleteRules {
+		deletePolicyRules(ctx, p)
+	}
+	for _, r := range plan.addRules {
+		if err := RunIpCommands(ctx, [][]string{r.addCommand()}); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticRouteValidate(t *testing.T) {
+	r := StaticRoute{Destination: "10.1.2.3/8", Gateway: "192.168.0.1", Table: MAIN_ROUTE_TABLE}
+	PanicOnError(r.Validate())
+	Assert(r.Destination == "10.0.0.0/8" && r.Table == 0, "normalized")
+	Assert(strings.Join(r.addCommand(), " ") == "route replace 10.0.0.0/8 via 192.168.0.1 proto 198", "add command")
+
+	r = StaticRoute{Destination: "172.20.0.10", Dev: "eth0", Metric: 10, Table: 100}
+	PanicOnError(r.Validate())
+	Assert(strings.Join(r.addCommand(), " ") == "route replace 172.20.0.10/32 dev eth0 metric 10 table 100 proto 198", "add command")
+	Assert(strings.Join(r.deleteCommand(), " ") == "route del 172.20.0.10/32 metric 10 table 100 proto 198", "delete command")
+
+	for _, r := range []StaticRoute{
+		{Destination: "10.0.0.0/33", Dev: "eth0"},
+		{Destination: "10.0.0.0/8"},
+		{Destination: "10.0.0.0/8", Gateway: "fe80::1"},
+		{Destination: "10.0.0.0/8", Dev: "eth0", Table: -1},
+		{Destination: "10.0.0.0/8", Dev: "eth0;reboot"},
+		{Destination: "10.0.0.0/8", Dev: "eth0 table 255"},
+	} {
+		err := r.Validate()
+		Assertf(err != nil, "expect error for %+v", r)
+		fmt.Println(err)
+	}
+}
+
+func TestPolicyRuleValidate(t *testing.T) {
+	r := PolicyRule{Priority: 20100, Source: "10.0.0.5/24", Iif: "eth1", Fwmark: 16, Table: 100}
+	PanicOnError(r.Validate())
+	Assert(strings.Join(r.addCommand(), " ") == "rule add priority 20100 from 10.0.0.0/24 iif eth1 fwmark 16 table 100", "add command")
+
+	for _, r := range []PolicyRule{
+		{Priority: 0, Source: "10.0.0.0/24", Table: 100},
+		{Priority: 100, Source: "10.0.0.0/24", Table: 100},
+		{Priority: 32766, Source: "10.0.0.0/24", Table: 100},
+		{Priority: 20100, Table: 100},
+		{Priority: 20100, Source: "10.0.0.0/24"},
+		{Priority: 20100, Destination: "a.b.c.d", Table: 100},
+		{Priority: 20100, Source: "10.0.0.0/24", Iif: "eth1$(reboot)", Table: 100},
+	} {
+		err := r.Validate()
+		Assertf(err != nil, "expect error for %+v", r)
+		fmt.Println(err)
+	}
+}
+
+func TestParseIpRoutesAndRules(t *testing.T) {
+	routes := parseIpRoutes(`default via 10.86.4.1 dev eth1 proto vrouter
+172.20.0.10 dev eth0 proto vrouter scope link
+10.0.0.0/8 via 192.168.0.1 dev eth2 table 100 proto vrouter metric 10
+local 10.86.4.132 dev eth1 table local proto kernel scope host src 10.86.4.132
+`)
+	Assertf(len(routes) == 3, "%+v", routes)
+	Assert(routes[0] == StaticRoute{Destination: "0.0.0.0/0", Gateway: "10.86.4.1", Dev: "eth1"}, "default route")
+	Assert(routes[1] == StaticRoute{Destination: "172.20.0.10/32", Dev: "eth0"}, "host route")
+	Assert(routes[2] == StaticRoute{Destination: "10.0.0.0/8", Gateway: "192.168.0.1", Dev: "eth2", Metric: 10, Table: 100}, "table route")
+
+	rules := parseIpRules(`0:	from all lookup local
+100:	from 10.0.0.0/24 to 192.168.0.0/16 iif eth1 fwmark 0x10 lookup 100
+200:	from 10.0.1.1 lookup main
+32766:	from all lookup main
+32767:	from all lookup default
+`)
+	Assertf(len(rules) == 5, "%+v", rules)
+	Assert(rules[1] == PolicyRule{Priority: 100, Source: "10.0.0.0/24", Destination: "192.168.0.0/16", Iif: "eth1", Fwmark: 16, Table: 100}, "rule 100")
+	Assert(rules[2] == PolicyRule{Priority: 200, Source: "10.0.1.1/32", Table: MAIN_ROUTE_TABLE}, "rule 200")
+}
+
+func TestReconcileRoutes(t *testing.T) {
+	config := &RouteConfig{
+		Routes: []StaticRoute{
+			{Destination: "172.20.0.10/32", Dev: "eth0"},
+			{Destination: "10.0.0.0/8", Gateway: "192.168.0.1", Table: 100},
+		},
+		Rules: []PolicyRule{
+			{Priority: 20100, Source: "10.0.0.0/24", Table: 100},
+			{Priority: 20200, Source: "10.0.1.0/24", Table: 200},
+		},
+	}
+	// the routes with proto STATIC_ROUTE_PROTO
+	routes := []StaticRoute{
+		{Destination: "172.20.0.10/32", Dev: "eth0"},
+		{Destination: "172.20.0.11/32", Dev: "eth0"},
+	}
+	rules := []PolicyRule{
+		{Priority: 0, Table: 255},
+		// the policy routing of the vyos
+		{Priority: 1, Source: "10.0.9.0/24", Table: 9},
+		{Priority: 20100, Source: "10.0.0.0/24", Table: 100},
+		{Priority: 20200, Source: "10.0.2.0/24", Table: 200},
+		{Priority: 20300, Source: "10.0.3.0/24", Table: 300},
+		{Priority: 20300, Source: "10.0.4.0/24", Table: 300},
+		{Priority: 32766, Table: MAIN_ROUTE_TABLE},
+	}
+
+	plan := reconcilePlan(config, routes, rules)
+	Assertf(len(plan.deleteRoutes) == 1 && plan.deleteRoutes[0].Destination == "172.20.0.11/32", "%+v", plan.deleteRoutes)
+	Assertf(len(plan.addRoutes) == 2, "%+v", plan.addRoutes)
+	Assertf(fmt.Sprint(plan.deleteRules) == "[20200 20300]", "%v", plan.deleteRules)
+	Assertf(len(plan.addRules) == 1 && plan.addRules[0].Priority == 20200, "%+v", plan.addRules)
+}
+
+func TestRouteConfigPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route")
+	PanicOnError(err)
+	defer os.RemoveAll(dir)
+	old := routeConfigPath
+	routeConfigPath = filepath.Join(dir, "routes.json")
+	defer func() { routeConfigPath = old }()
+
+	config, err := loadRouteConfig()
+	PanicOnError(err)
+	Assert(len(config.Routes) == 0 && len(config.Rules) == 0, "empty config")
+
+	config.Routes = []StaticRoute{{Destination: "10.0.0.0/8", Dev: "eth1", Table: 100}, {Destination: "172.20.0.10/32", Dev: "eth0"}}
+	config.Rules = []PolicyRule{{Priority: 20200, Source: "10.0.1.0/24", Table: 200}, {Priority: 20100, Source: "10.0.0.0/24", Table: 100}}
+	PanicOnError(saveRouteConfig(config))
+
+	loaded, err := loadRouteConfig()
+	PanicOnError(err)
+	Assert(loaded.Routes[0].Destination == "172.20.0.10/32" && loaded.Rules[0].Priority == 20100, "sorted")
+	ok, _ := PathExists(routeConfigPath + ".tmp")
+	Assert(!ok, "no temporary file")
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// the output pipes are closed this long after the command exits or is killed,
+// in case a child it leaves, e.g. the root child of sudo, keeps them open
+var commandWaitDelay = 5 * time.Second
+
+// Command runs a program with its arguments directly, no shell is involved so
+// the arguments never need to be quoted
+type Command struct {
+	Argv []string
+	// the environment like "KEY=value", the agent's environment is used if it's nil
+	Env   []string
+	Dir   string
+	Stdin io.Reader
+	// the command is killed after the timeout, 0 means no timeout other than the context's
+	Timeout time.Duration
+	NoLog   bool
+	// run the program by PrivilegedArgv, it must be in the privilege allow-list
+	Privileged bool
+	// the secrets in the arguments and the output are masked in the logs and errors
+	Secrets []string
+}
+
+type CommandResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Duration time.Duration
+}
+
+// CommandError is returned when the command fails to start, exits with non-zero
+// code, times out or is canceled, Result is nil if it fails to start
+type CommandError struct {
+	Argv    []string
+	Secrets []string
+	Result  *CommandResult
+	// context.DeadlineExceeded, context.Canceled or the error of starting the
+	// command, it's nil if the command exits with non-zero code
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	cmd := strings.Join(e.Argv, " ")
+	var msg string
+	switch {
+	case e.Result == nil:
+		msg = fmt.Sprintf("unable to start the command[%s], %v", cmd, e.Err)
+	case e.Err != nil:
+		msg = fmt.Sprintf("the command[%s] is killed after %v, %v\nstdout:%s\nstderr:%s",
+			cmd, e.Result.Duration, e.Err, e.Result.Stdout, e.Result.Stderr)
+	default:
+		msg = fmt.Sprintf("failed to execute the command[%s]\nreturn code:%d\nstdout:%s\nstderr:%s",
+			cmd, e.Result.ExitCode, e.Result.Stdout, e.Result.Stderr)
+	}
+	return RedactSecrets(msg, e.Secrets...)
+}
+
+// Timeout tells if the command is killed because of the deadline
+func (e *CommandError) Timeout() bool {
+	return e.Err == context.DeadlineExceeded
+}
+
+// Exited tells if the command ran to the end, then the exit code is valid
+func (e *CommandError) Exited() bool {
+	return e.Result != nil && e.Err == nil
+}
+
+func NewCommand(argv ...string) *Command {
+	return &Command{Argv: argv}
+}
+
+// Run runs the command and waits it, the command and all its children are
+// killed when the context is done or the timeout expires. The result is
+// returned with the error if the command has started
+func (c *Command) Run(ctx context.Context) (*CommandResult, error) {
+	Assert(len(c.Argv) != 0, "Argv cannot be empty")
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	argv := c.Argv
+	if c.Privileged {
+		var timeout time.Duration
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		var err error
+		if argv, err = privilegedArgv(timeout, c.Argv...); err != nil {
+			return nil, &CommandError{Argv: c.Argv, Secrets: c.Secrets, Err: err}
+		}
+	}
+
+	var so, se bytes.Buffer
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = c.Env
+	if id := RequestIdFromContext(ctx); id != "" {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, REQUEST_ID_ENV+"="+id)
+	}
+	cmd.Dir = c.Dir
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = &so
+	cmd.Stderr = &se
+	// run in a new process group so the children, e.g. the commands run by bash, can be killed together
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = commandWaitDelay
+
+	if !c.NoLog {
+		RequestLogger(ctx).Debugf("command start: %s", RedactSecrets(strings.Join(c.Argv, " "), c.Secrets...))
+	}
+
+	start := time.Now()
+	if err := ctx.Err(); err != nil {
+		return nil, &CommandError{Argv: c.Argv, Secrets: c.Secrets, Err: err}
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, &CommandError{Argv: c.Argv, Secrets: c.Secrets, Err: err}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var ctxErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+	}
+
+	result := &CommandResult{
+		ExitCode: exitCode(cmd.ProcessState),
+		Stdout:   so.String(),
+		Stderr:   se.String(),
+		Duration: time.Since(start),
+	}
+
+	if !c.NoLog {
+		RequestLogger(ctx).WithFields(logrus.Fields{
+			"return code": fmt.Sprintf("%v", result.ExitCode),
+			"stdout":      RedactSecrets(result.Stdout, c.Secrets...),
+			"stderr":      RedactSecrets(result.Stderr, c.Secrets...),
+			"duration":    result.Duration,
+		}).Debugf("command done: %s", RedactSecrets(strings.Join(c.Argv, " "), c.Secrets...))
+	}
+
+	if ctxErr != nil || result.ExitCode != 0 {
+		return result, &CommandError{Argv: c.Argv, Secrets: c.Secrets, Result: result, Err: ctxErr}
+	}
+	return result, nil
+}
+
+// exitCode returns 128 + signal like the shell if the process is killed by a signal
+func exitCode(state *os.ProcessState) int {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return -1
+	}
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// RunCommand runs argv with the context, it's the shortcut of Command.Run
+func RunCommand(ctx context.Context, argv ...string) (*CommandResult, error) {
+	return NewCommand(argv...).Run(ctx)
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandRun(t *testing.T) {
+	c := &Command{
+		Argv:  []string{"sh", "-c", `read line; echo "$line $FOO $(pwd)"`},
+		Env:   []string{"FOO=bar"},
+		Dir:   os.TempDir(),
+		Stdin: strings.NewReader("hello\n"),
+	}
+	result, err := c.Run(context.Background())
+	PanicOnError(err)
+	Assertf(result.Stdout == fmt.Sprintf("hello bar %s\n", os.TempDir()), "stdout: %s", result.Stdout)
+
+	// the arguments are passed as they are without a shell
+	result, err = RunCommand(context.Background(), "echo", "$HOME", "a b;ls")
+	PanicOnError(err)
+	Assertf(result.Stdout == "$HOME a b;ls\n", "stdout: %s", result.Stdout)
+
+	result, err = RunCommand(context.Background(), "sh", "-c", "echo oops >&2; exit 3")
+	e, ok := err.(*CommandError)
+	Assert(ok && e.Exited() && !e.Timeout(), "exit error")
+	Assert(result.ExitCode == 3 && result.Stderr == "oops\n", "exit code")
+	fmt.Println(err)
+
+	_, err = RunCommand(context.Background(), "/nonexistent/command")
+	e, ok = err.(*CommandError)
+	Assert(ok && e.Result == nil && !e.Exited(), "start error")
+	fmt.Println(err)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	// the children holding the stdout must be killed too, or the command never returns
+	start := time.Now()
+	c := &Command{Argv: []string{"sh", "-c", "sleep 10 & sleep 10"}, Timeout: 200 * time.Millisecond}
+	result, err := c.Run(context.Background())
+	e, ok := err.(*CommandError)
+	Assert(ok && e.Timeout() && !e.Exited(), "timeout error")
+	Assertf(result.ExitCode == 128+9, "exit code %d", result.ExitCode)
+	Assertf(time.Since(start) < 5*time.Second, "killed after %v", time.Since(start))
+	fmt.Println(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	_, err = RunCommand(ctx, "sleep", "10")
+	e, ok = err.(*CommandError)
+	Assert(ok && e.Err == context.Canceled, "canceled")
+
+	_, err = RunCommand(ctx, "true")
+	Assert(err != nil, "the canceled context")
+
+	// a child out of the process group, like the root child of sudo, survives
+	// the kill, the command returns without waiting for its output
+	defer func(delay time.Duration) { commandWaitDelay = delay }(commandWaitDelay)
+	commandWaitDelay = 100 * time.Millisecond
+	start = time.Now()
+	c = &Command{Argv: []string{"sh", "-c", "setsid sleep 3 & sleep 10"}, Timeout: 200 * time.Millisecond}
+	_, err = c.Run(context.Background())
+	Assert(err.(*CommandError).Timeout(), "timeout error")
+	Assertf(time.Since(start) < 2*time.Second, "returned after %v", time.Since(start))
+
+	b := Bash{Command: "sleep 10", Timeout: 100 * time.Millisecond}
+	ret, _, _, err := b.RunWithReturn()
+	Assert(ret != 0 && err != nil, "bash timeout")
+	Assert(b.Run() != nil, "bash run timeout")
+}
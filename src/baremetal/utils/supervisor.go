@@ -0,0 +1,334 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	PROCESS_STATE_STARTING = "starting"
+	PROCESS_STATE_RUNNING  = "running"
+	// waiting to be restarted after an exit
+	PROCESS_STATE_BACKOFF = "backoff"
+	PROCESS_STATE_STOPPED = "stopped"
+
+	DEFAULT_MIN_RESTART_BACKOFF = time.Second
+	DEFAULT_MAX_RESTART_BACKOFF = time.Minute
+	DEFAULT_STOP_TIMEOUT        = 10 * time.Second
+)
+
+// ProcessSpec describes a helper daemon, e.g. dnsmasq, it must run in the
+// foreground so the supervisor knows when it exits
+type ProcessSpec struct {
+	Name string
+	Argv []string
+	Env  []string
+	Dir  string
+	// run by PrivilegedArgv, the program must be in the privilege allow-list
+	Privileged bool
+	// the backoff doubles from MinBackoff to MaxBackoff when the process exits
+	// repeatedly, it's reset once the process runs longer than MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DaemonConfig is an entry of the 'daemons' section of the agent config, e.g.
+// {"name": "dnsmasq", "argv": ["dnsmasq", "-k", "-C", "/etc/dnsmasq.conf"], "privileged": true}
+type DaemonConfig struct {
+	Name       string   `json:"name"`
+	Argv       []string `json:"argv"`
+	Env        []string `json:"env"`
+	Dir        string   `json:"dir"`
+	Privileged bool     `json:"privileged"`
+	// the max backoff of the restarts, DEFAULT_MAX_RESTART_BACKOFF if it's 0
+	MaxBackoffSeconds int `json:"maxBackoffSeconds"`
+}
+
+type ProcessStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Pid       int       `json:"pid,omitempty"`
+	Restarts  int       `json:"restarts"`
+	StartTime time.Time `json:"startTime,omitempty"`
+	LastExit  string    `json:"lastExit,omitempty"`
+	ExitTime  time.Time `json:"exitTime,omitempty"`
+	NextStart time.Time `json:"nextStart,omitempty"`
+}
+
+type supervisedProcess struct {
+	spec   ProcessSpec
+	status ProcessStatus
+	cmd    *exec.Cmd
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Supervisor starts the helper daemons as its children, restarts them when they
+// exit and logs their output with the name as the prefix
+type Supervisor struct {
+	lock      sync.Mutex
+	processes map[string]*supervisedProcess
+	// logs a line of the output, replaced in tests
+	logLine func(name string, stderr bool, line string)
+}
+
+var (
+	supervisorLog     = Logger("supervisor")
+	DefaultSupervisor = NewSupervisor()
+)
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		processes: make(map[string]*supervisedProcess),
+		logLine: func(name string, stderr bool, line string) {
+			if stderr {
+				supervisorLog.Warnf("[%s] %s", name, line)
+			} else {
+				supervisorLog.Infof("[%s] %s", name, line)
+			}
+		},
+	}
+}
+
+// Start supervises a new process, the name must be unique
+func (s *Supervisor) Start(spec ProcessSpec) error {
+	if spec.Name == "" || len(spec.Argv) == 0 {
+		return fmt.Errorf("name and argv are required to supervise a process")
+	}
+	if spec.MinBackoff <= 0 {
+		spec.MinBackoff = DEFAULT_MIN_RESTART_BACKOFF
+	}
+	if spec.MaxBackoff < spec.MinBackoff {
+		spec.MaxBackoff = DEFAULT_MAX_RESTART_BACKOFF
+		if spec.MaxBackoff < spec.MinBackoff {
+			spec.MaxBackoff = spec.MinBackoff
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.processes[spec.Name]; ok {
+		return fmt.Errorf("the process[%s] is already supervised", spec.Name)
+	}
+
+	p := &supervisedProcess{
+		spec:   spec,
+		status: ProcessStatus{Name: spec.Name, State: PROCESS_STATE_STARTING},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.processes[spec.Name] = p
+	go s.run(p)
+	return nil
+}
+
+func (s *Supervisor) startProcess(p *supervisedProcess) (*exec.Cmd, *sync.WaitGroup, error) {
+	argv := p.spec.Argv
+	if p.spec.Privileged {
+		var err error
+		if argv, err = PrivilegedArgv(argv...); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = p.spec.Env
+	cmd.Dir = p.spec.Dir
+	// kill the children of the process together when stopping it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	// the pipes must be drained before cmd.Wait
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go s.pipeLog(p.spec.Name, false, stdout, wg)
+	go s.pipeLog(p.spec.Name, true, stderr, wg)
+	return cmd, wg, nil
+}
+
+func (s *Supervisor) pipeLog(name string, stderr bool, r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		s.logLine(name, stderr, scanner.Text())
+	}
+}
+
+func (s *Supervisor) run(p *supervisedProcess) {
+	defer close(p.done)
+	backoff := p.spec.MinBackoff
+
+	for {
+		cmd, wg, err := s.startProcess(p)
+		started := time.Now()
+
+		s.lock.Lock()
+		if err == nil {
+			p.cmd = cmd
+			p.status.State = PROCESS_STATE_RUNNING
+			p.status.Pid = cmd.Process.Pid
+			p.status.StartTime = started
+			p.status.NextStart = time.Time{}
+			// stopped before the process is known to Stop
+			select {
+			case <-p.stop:
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+			default:
+			}
+		}
+		s.lock.Unlock()
+
+		if err == nil {
+			supervisorLog.Debugf("the process %s started, pid %d", p.spec.Name, cmd.Process.Pid)
+			wg.Wait()
+			err = cmd.Wait()
+			if err == nil {
+				err = fmt.Errorf("exited with code 0")
+			}
+		}
+
+		// it's stable if it ran long enough, restart it quickly
+		if time.Since(started) > p.spec.MaxBackoff {
+			backoff = p.spec.MinBackoff
+		}
+
+		s.lock.Lock()
+		p.cmd = nil
+		p.status.Pid = 0
+		p.status.LastExit = err.Error()
+		p.status.ExitTime = time.Now()
+		select {
+		case <-p.stop:
+			p.status.State = PROCESS_STATE_STOPPED
+			s.lock.Unlock()
+			supervisorLog.Debugf("the process %s stopped", p.spec.Name)
+			return
+		default:
+		}
+		p.status.State = PROCESS_STATE_BACKOFF
+		p.status.NextStart = time.Now().Add(backoff)
+		s.lock.Unlock()
+
+		supervisorLog.Warnf("the process %s exited: %s, restart it in %v", p.spec.Name, err, backoff)
+		select {
+		case <-p.stop:
+			s.lock.Lock()
+			p.status.State = PROCESS_STATE_STOPPED
+			p.status.NextStart = time.Time{}
+			s.lock.Unlock()
+			return
+		case <-time.After(backoff):
+		}
+
+		s.lock.Lock()
+		p.status.Restarts++
+		s.lock.Unlock()
+
+		backoff *= 2
+		if backoff > p.spec.MaxBackoff {
+			backoff = p.spec.MaxBackoff
+		}
+	}
+}
+
+// Stop terminates the process and its children by SIGTERM, then SIGKILL if it's
+// still alive after the timeout, the process is not supervised any more
+func (s *Supervisor) Stop(name string, timeout time.Duration) error {
+	s.lock.Lock()
+	p, ok := s.processes[name]
+	if !ok {
+		s.lock.Unlock()
+		return fmt.Errorf("the process[%s] is not supervised", name)
+	}
+	delete(s.processes, name)
+	close(p.stop)
+	if p.cmd != nil {
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGTERM)
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	s.lock.Lock()
+	if p.cmd != nil {
+		supervisorLog.Warnf("the process %s is not stopped in %v, kill it", name, timeout)
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+	}
+	s.lock.Unlock()
+	<-p.done
+	return nil
+}
+
+// StartDaemons supervises the daemons of the agent config, the daemons
+// started before a failure are stopped
+func (s *Supervisor) StartDaemons(daemons []DaemonConfig) error {
+	started := []string{}
+	for _, d := range daemons {
+		err := s.Start(ProcessSpec{
+			Name:       d.Name,
+			Argv:       d.Argv,
+			Env:        d.Env,
+			Dir:        d.Dir,
+			Privileged: d.Privileged,
+			MaxBackoff: time.Duration(d.MaxBackoffSeconds) * time.Second,
+		})
+		if err != nil {
+			for _, name := range started {
+				LogError(s.Stop(name, DEFAULT_STOP_TIMEOUT))
+			}
+			return fmt.Errorf("unable to start the daemon[%s], %s", d.Name, err)
+		}
+		started = append(started, d.Name)
+	}
+	return nil
+}
+
+// StopAll stops all processes, it's called when the agent exits
+func (s *Supervisor) StopAll() {
+	s.lock.Lock()
+	names := make([]string, 0, len(s.processes))
+	for name := range s.processes {
+		names = append(names, name)
+	}
+	s.lock.Unlock()
+
+	for _, name := range names {
+		LogError(s.Stop(name, DEFAULT_STOP_TIMEOUT))
+	}
+}
+
+// Status returns the status of the supervised processes sorted by name
+func (s *Supervisor) Status() []ProcessStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]ProcessStatus, 0, len(s.processes))
+	for _, p := range s.processes {
+		result = append(result, p.status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
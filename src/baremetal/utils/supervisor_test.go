@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSupervisorRestart(t *testing.T) {
+	s := NewSupervisor()
+	var lock sync.Mutex
+	var lines []string
+	s.logLine = func(name string, stderr bool, line string) {
+		lock.Lock()
+		defer lock.Unlock()
+		lines = append(lines, fmt.Sprintf("%s %v %s", name, stderr, line))
+	}
+
+	PanicOnError(s.Start(ProcessSpec{
+		Name:       "crash",
+		Argv:       []string{"sh", "-c", "echo hello; echo oops >&2; exit 3"},
+		MinBackoff: 20 * time.Millisecond,
+		MaxBackoff: 80 * time.Millisecond,
+	}))
+	Assert(s.Start(ProcessSpec{Name: "crash", Argv: []string{"true"}}) != nil, "duplicated name")
+
+	LoopRunUntilSuccessOrTimeout(func() bool {
+		return s.Status()[0].Restarts >= 3
+	}, 5*time.Second, 20*time.Millisecond)
+
+	status := s.Status()[0]
+	fmt.Printf("%+v\n", status)
+	Assert(status.Restarts >= 3, "restarted")
+	Assert(strings.Contains(status.LastExit, "exit status 3"), status.LastExit)
+
+	PanicOnError(s.Stop("crash", time.Second))
+	Assert(len(s.Status()) == 0, "not supervised")
+	Assert(s.Stop("crash", time.Second) != nil, "stop twice")
+
+	lock.Lock()
+	defer lock.Unlock()
+	output := strings.Join(lines, "\n")
+	Assert(strings.Contains(output, "crash false hello") && strings.Contains(output, "crash true oops"), output)
+}
+
+func TestSupervisorStop(t *testing.T) {
+	s := NewSupervisor()
+	// the child of the shell must be killed too
+	PanicOnError(s.Start(ProcessSpec{Name: "sleep", Argv: []string{"sh", "-c", "sleep 30; sleep 30"}}))
+	LoopRunUntilSuccessOrTimeout(func() bool {
+		return s.Status()[0].State == PROCESS_STATE_RUNNING
+	}, 5*time.Second, 20*time.Millisecond)
+	Assert(s.Status()[0].Pid != 0, "pid")
+
+	start := time.Now()
+	s.StopAll()
+	Assertf(time.Since(start) < 5*time.Second, "stopped in %v", time.Since(start))
+
+	PanicOnError(s.Start(ProcessSpec{Name: "missing", Argv: []string{"/nonexistent/daemon"}, MinBackoff: time.Hour}))
+	LoopRunUntilSuccessOrTimeout(func() bool {
+		return s.Status()[0].State == PROCESS_STATE_BACKOFF
+	}, 5*time.Second, 20*time.Millisecond)
+	Assert(s.Status()[0].LastExit != "", "the start error")
+	PanicOnError(s.Stop("missing", time.Second))
+}
+
+func TestSupervisorStartDaemons(t *testing.T) {
+	s := NewSupervisor()
+	PanicOnError(s.StartDaemons([]DaemonConfig{
+		{Name: "a", Argv: []string{"sleep", "30"}},
+		{Name: "b", Argv: []string{"sleep", "30"}, MaxBackoffSeconds: 5},
+	}))
+	Assert(len(s.Status()) == 2, "two daemons")
+
+	// a failure stops the daemons started before it
+	err := s.StartDaemons([]DaemonConfig{
+		{Name: "c", Argv: []string{"sleep", "30"}},
+		{Name: "a", Argv: []string{"sleep", "30"}},
+	})
+	Assert(err != nil, "duplicated name")
+	fmt.Println(err)
+	Assert(len(s.Status()) == 2, "c is stopped")
+
+	s.StopAll()
+	Assert(len(s.Status()) == 0, "all stopped")
+}
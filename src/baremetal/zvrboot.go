@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -18,33 +18,20 @@ const (
 	VIRTIO_PORT_PATH     = "/dev/virtio-ports/applianceVm.port"
 	BOOTSTRAP_INFO_CACHE = "/home/vyos/baremetal/bootstrap-info.json"
 	TMP_LOCATION_FOR_ESX = "/tmp/bootstrap-info.json"
-	// use this rule number to set a rule which confirm route entry work issue ZSTAC-6170
-	ROUTE_STATE_NEW_ENABLE_FIREWALL_RULE_NUMBER = 9999
 )
 
-type nic struct {
-	mac                 string
-	ip                  string
-	name                string
-	netmask             string
-	isDefaultRoute      bool
-	gateway             string
-	category            string
-	l2type              string
-	l2PhysicalInterface string
-	vni                 int
-}
-
-var bootstrapInfo map[string]interface{} = make(map[string]interface{})
-var nics map[string]*nic = make(map[string]*nic)
+var bootstrapInfo *utils.BootstrapInfo
 
 func waitIptablesServiceOnline() {
-	bash := utils.Bash{
-		Command: "/sbin/iptables-save",
+	cmd := &utils.Command{
+		Argv:       []string{"iptables-save"},
+		Privileged: true,
+		NoLog:      true,
+		Timeout:    utils.IPTABLES_COMMAND_TIMEOUT,
 	}
 
 	utils.LoopRunUntilSuccessOrTimeout(func() bool {
-		err := bash.Run()
+		_, err := cmd.Run(context.Background())
 		if err != nil {
 			log.Debugf("iptables service seems not ready, %v", err)
 		}
@@ -84,8 +71,8 @@ func parseEsxBootInfo() {
 
 		content, err := ioutil.ReadFile(TMP_LOCATION_FOR_ESX)
 		utils.PanicOnError(err)
-		if err = json.Unmarshal(content, &bootstrapInfo); err != nil {
-			panic(errors.Wrap(err, fmt.Sprintf("unable to JSON parse:\n %s", string(content))))
+		if bootstrapInfo, err = utils.ParseBootstrapInfo(content); err != nil {
+			panic(errors.Wrap(err, fmt.Sprintf("invalid bootstrap info:\n %s", utils.RedactJson(content))))
 		}
 
 		err = utils.MkdirForFile(BOOTSTRAP_INFO_CACHE, 0666)
@@ -94,7 +81,7 @@ func parseEsxBootInfo() {
 		utils.PanicOnError(err)
 		err = os.Chmod(BOOTSTRAP_INFO_CACHE, 0777)
 		utils.PanicOnError(err)
-		log.Debugf("recieved bootstrap info:\n%s", string(content))
+		log.Debugf("recieved bootstrap info:\n%s", utils.RedactJson(content))
 		return true
 	}, time.Duration(300)*time.Second, time.Duration(1)*time.Second)
 }
@@ -108,8 +95,8 @@ func parseKvmBootInfo() {
 			return false
 		}
 
-		if err := json.Unmarshal(content, &bootstrapInfo); err != nil {
-			panic(errors.Wrap(err, fmt.Sprintf("unable to JSON parse:\n %s", string(content))))
+		if bootstrapInfo, err = utils.ParseBootstrapInfo(content); err != nil {
+			panic(errors.Wrap(err, fmt.Sprintf("invalid bootstrap info:\n %s", utils.RedactJson(content))))
 		}
 
 		err = utils.MkdirForFile(BOOTSTRAP_INFO_CACHE, 0666)
@@ -118,7 +105,7 @@ func parseKvmBootInfo() {
 		utils.PanicOnError(err)
 		err = os.Chmod(BOOTSTRAP_INFO_CACHE, 0777)
 		utils.PanicOnError(err)
-		log.Debugf("recieved bootstrap info:\n%s", string(content))
+		log.Debugf("recieved bootstrap info:\n%s", utils.RedactJson(content))
 		return true
 	}, time.Duration(300)*time.Second, time.Duration(1)*time.Second)
 }
@@ -126,28 +113,7 @@ func parseKvmBootInfo() {
 func resetVyos() {
 	// clear all configuration in case someone runs 'save' command manually before,
 	// to keep the vyos must be stateless
-
-	// delete all interfaces
-	tree := server.NewParserFromShowConfiguration().Tree
-
-	//tree.Delete("interfaces ethernet")
-	keyNode := tree.Get("interfaces ethernet")
-	if keyNode != nil {
-		// the key found
-		children := keyNode.Children()
-		if children != nil && len(children) > 0 {
-			for _, node := range children {
-				for _, eth := range node.Children() {
-					str := eth.String()
-					if !strings.Contains(str, "hw-id") {
-						tree.Delete(str)
-					}
-				}
-
-			}
-		}
-	}
-	tree.Apply(true)
+	server.ResetVyos(context.Background())
 
 	/*the API RunVyosScriptAsUserVyos doesn't work for this command.
 	the correct command sequence is that
@@ -165,67 +131,8 @@ func configureVyos() {
 	resetVyos()
 	var defaultNic, defaultGW string = "", ""
 
-	mgmtNic := bootstrapInfo["managementNic"].(map[string]interface{})
-	if mgmtNic == nil {
-		panic(errors.New("no field 'managementNic' in bootstrap info"))
-	}
-
-	eth0 := &nic{name: "eth0"}
-	var ok bool
-	eth0.mac, ok = mgmtNic["mac"].(string)
-	utils.PanicIfError(ok, errors.New("cannot find 'mac' field for the management nic"))
-	eth0.netmask, ok = mgmtNic["netmask"].(string)
-	utils.PanicIfError(ok, errors.New("cannot find 'netmask' field for the management nic"))
-	eth0.ip, ok = mgmtNic["ip"].(string)
-	utils.PanicIfError(ok, errors.New("cannot find 'ip' field for the management nic"))
-	eth0.isDefaultRoute = mgmtNic["isDefaultRoute"].(bool)
-	eth0.gateway = mgmtNic["gateway"].(string)
-	if mgmtNic["l2type"] != nil {
-		eth0.l2type = mgmtNic["l2type"].(string)
-		eth0.category = mgmtNic["category"].(string)
-	}
-	if mgmtNic["vni"] != nil {
-		eth0.vni = int(mgmtNic["vni"].(float64))
-	}
-	if mgmtNic["physicalInterface"] != nil {
-		eth0.l2PhysicalInterface = mgmtNic["physicalInterface"].(string)
-	}
-	nics[eth0.name] = eth0
-
-	var otherNics []interface{}
-	if v, ok := bootstrapInfo["additionalNics"]; ok {
-		otherNics = v.([]interface{})
-	}
-
-	if len(otherNics) > 0 {
-		for _, o := range otherNics {
-			onic := o.(map[string]interface{})
-			n := &nic{}
-			n.name, ok = onic["deviceName"].(string)
-			utils.PanicIfError(ok, fmt.Errorf("cannot find 'deviceName' field for the nic"))
-			n.mac, ok = onic["mac"].(string)
-			utils.PanicIfError(ok, errors.New("cannot find 'mac' field for the nic"))
-			n.netmask, ok = onic["netmask"].(string)
-			utils.PanicIfError(ok, fmt.Errorf("cannot find 'netmask' field for the nic[name:%s]", n.name))
-			n.ip, ok = onic["ip"].(string)
-			utils.PanicIfError(ok, fmt.Errorf("cannot find 'ip' field for the nic[name:%s]", n.name))
-
-			n.isDefaultRoute = onic["isDefaultRoute"].(bool)
-			n.gateway = onic["gateway"].(string)
-
-			if onic["l2type"] != nil {
-				n.l2type = onic["l2type"].(string)
-				n.category = onic["category"].(string)
-			}
-			if onic["vni"] != nil {
-				n.vni = int(onic["vni"].(float64))
-			}
-			if onic["physicalInterface"] != nil {
-				n.l2PhysicalInterface = onic["physicalInterface"].(string)
-			}
-			nics[n.name] = n
-		}
-	}
+	eth0 := bootstrapInfo.ManagementNic
+	nics := bootstrapInfo.Nics()
 
 	type deviceName struct {
 		expected string
@@ -235,19 +142,16 @@ func configureVyos() {
 
 	devNames := make([]*deviceName, 0)
 
-	// check integrity of nics
+	// the nics have been validated by the schema, rename them to the expected names
 	for _, nic := range nics {
-		utils.Assertf(nic.name != "", "name cannot be empty[mac:%s]", nic.mac)
-		utils.Assertf(nic.ip != "", "ip cannot be empty[nicname: %s]", nic.name)
-		utils.Assertf(nic.gateway != "", "gateway cannot be empty[nicname:%s]", nic.name)
-		utils.Assertf(nic.netmask != "", "netmask cannot be empty[nicname:%s]", nic.name)
-		utils.Assertf(nic.mac != "", "mac cannot be empty[nicname:%s]", nic.name)
-
-		nicname, err := utils.GetNicNameByMac(nic.mac)
+		if nic.Link() != nil {
+			continue
+		}
+		nicname, err := utils.GetNicNameByMac(nic.Mac)
 		utils.PanicOnError(err)
-		if nicname != nic.name {
+		if nicname != nic.Name {
 			devNames = append(devNames, &deviceName{
-				expected: nic.name,
+				expected: nic.Name,
 				actual:   nicname,
 			})
 		}
@@ -255,258 +159,116 @@ func configureVyos() {
 
 	if len(devNames) != 0 {
 		// shutdown links and change to temporary names
-		cmds := make([]string, 0)
+		cmds := make([][]string, 0)
 		for i, devname := range devNames {
 			devnum := 1000 + i
 
 			devname.swap = fmt.Sprintf("eth%v", devnum)
-			cmds = append(cmds, fmt.Sprintf("ip link set dev %v down", devname.actual))
-			cmds = append(cmds, fmt.Sprintf("ip link set dev %v name %v", devname.actual, devname.swap))
-		}
-
-		b := utils.Bash{
-			Command: strings.Join(cmds, "\n"),
+			cmds = append(cmds, []string{"link", "set", "dev", devname.actual, "down"})
+			cmds = append(cmds, []string{"link", "set", "dev", devname.actual, "name", devname.swap})
 		}
-
-		b.Run()
-		b.PanicIfError()
+		utils.PanicOnError(utils.RunIpCommands(context.Background(), cmds))
 
 		// change temporary names to real names and bring up links
-		cmds = make([]string, 0)
+		cmds = make([][]string, 0)
 		for _, devname := range devNames {
-			cmds = append(cmds, fmt.Sprintf("ip link set dev %v name %v", devname.swap, devname.expected))
-			cmds = append(cmds, fmt.Sprintf("ip link set dev %v up", devname.expected))
-		}
-
-		b = utils.Bash{
-			Command: strings.Join(cmds, "\n"),
+			cmds = append(cmds, []string{"link", "set", "dev", devname.swap, "name", devname.expected})
+			cmds = append(cmds, []string{"link", "set", "dev", devname.expected, "up"})
 		}
-
-		b.Run()
-		b.PanicIfError()
+		utils.PanicOnError(utils.RunIpCommands(context.Background(), cmds))
 	}
 
-	vyos := server.NewParserFromShowConfiguration()
-	tree := vyos.Tree
-
-	sshkey := bootstrapInfo["publicKey"].(string)
-	utils.Assert(sshkey != "", "cannot find 'publicKey' in bootstrap info")
-	sshkeyparts := strings.Split(sshkey, " ")
-	sshtype := sshkeyparts[0]
-	key := sshkeyparts[1]
-	id := sshkeyparts[2]
-
-	tree.Setf("system login user vyos authentication public-keys %s key %s", id, key)
-	tree.Setf("system login user vyos authentication public-keys %s type %s", id, sshtype)
-
-	makeAlias := func(nic *nic) string {
-		result := ""
-		if nic.l2type != "" {
-			result += fmt.Sprintf("l2type:%s;", nic.l2type)
-		}
-		if nic.category != "" {
-			result += fmt.Sprintf("category:%s;", nic.category)
-		}
-		if nic.l2PhysicalInterface != "" {
-			result += fmt.Sprintf("physicalInterface:%s;", nic.l2PhysicalInterface)
-		}
-		result += fmt.Sprintf("vni:%v;", nic.vni)
-		return result
-	}
-
-	setNic := func(nic *nic) {
-		cidr, err := utils.NetmaskToCIDR(nic.netmask)
-		utils.PanicOnError(err)
-		//tree.Setf("interfaces ethernet %s hw-id %s", nic.name, nic.mac)
-		tree.Setf("interfaces ethernet %s address %s", nic.name, fmt.Sprintf("%v/%v", nic.ip, cidr))
-		tree.Setf("interfaces ethernet %s duplex auto", nic.name)
-		//tree.Setf("interfaces ethernet %s smp_affinity auto", nic.name)
-		tree.Setf("interfaces ethernet %s speed auto", nic.name)
-		// set arp_ignore see https://phabricator.vyos.net/T300
-		tree.Setf("interfaces ethernet %s ip enable-arp-ignore", nic.name)
-
-		if nic.isDefaultRoute {
-			//tree.Setf("system gateway-address %v", nic.gateway)
-			tree.Setf("protocols static route 0.0.0.0/0 next-hop %s", nic.gateway)
-		}
-
-		if nic.l2type != "" {
-			b := utils.NewBash()
-			b.Command = fmt.Sprintf("ip link set dev %s alias '%s'", nic.name, makeAlias(nic))
-			b.Run()
+	// create the vlans, bonds and bridges in the order of the bootstrap info, so
+	// a vlan can be built on a bond listed before it
+	for _, nic := range nics {
+		if link := nic.Link(); link != nil {
+			utils.PanicOnError(utils.AddLink(context.Background(), link))
 		}
 	}
 
-	sshport := bootstrapInfo["sshPort"].(float64)
-	utils.Assert(sshport != 0, "sshport not found in bootstrap info")
-	tree.Setf("service ssh port %v", int(sshport))
-	tree.Setf("service ssh listen-address %v", eth0.ip)
+	vyos := server.NewParserFromShowConfiguration(context.Background())
+	tree := vyos.Tree
 
-	// configure firewall
 	/* skipVyosIptables is a flag to indicate how to configure firewall and nat */
-	skipVyosIptables := false
-	if v, ok := bootstrapInfo["skipVyosIptables"]; ok {
-		skipVyosIptables = v.(bool)
-	}
-	log.Debugf("bootstrapInfo %+v", bootstrapInfo)
-	log.Debugf("skipVyosIptables %+v", skipVyosIptables)
-
-	if skipVyosIptables {
-		for _, nic := range nics {
-			var err error
-			setNic(nic)
-			if nic.category == "Private" {
-				err = utils.InitNicFirewall(nic.name, nic.ip, false, utils.REJECT)
-			} else {
-				err = utils.InitNicFirewall(nic.name, nic.ip, true, utils.REJECT)
-			}
-			if err != nil {
-				log.Debugf("InitNicFirewall for nic: %s failed", err.Error())
+	log.Debugf("bootstrapInfo %s", utils.RedactObject(bootstrapInfo))
+	log.Debugf("skipVyosIptables %+v", bootstrapInfo.SkipVyosIptables)
+	defaultNic, defaultGW = tree.SetBootstrapConfig(bootstrapInfo, !isOnVMwareHypervisor())
+
+	for _, nic := range nics {
+		if nic.L2Type != "" {
+			if err := utils.RunIpCommands(context.Background(), [][]string{{"link", "set", "dev", nic.Name, "alias", nic.Alias()}}); err != nil {
+				log.Debugf("unable to set the alias of nic %s, %s", nic.Name, err)
 			}
 		}
-	} else {
-		for _, nic := range nics {
-			setNic(nic)
-			if nic.isDefaultRoute {
-				defaultGW = nic.gateway
-				defaultNic = nic.name
-			}
-			tree.SetFirewallOnInterface(nic.name, "local",
-				"action accept",
-				"state established enable",
-				"state related enable",
-				fmt.Sprintf("destination address %v", nic.ip),
-			)
-
-			tree.SetFirewallOnInterface(nic.name, "local",
-				"action accept",
-				"protocol icmp",
-				fmt.Sprintf("destination address %v", nic.ip),
-			)
-
-			if nic.category == "Private" {
-				tree.SetFirewallOnInterface(nic.name, "in",
-					"action accept",
-					"state established enable",
-					"state related enable",
-					"state invalid enable",
-					"state new enable",
-				)
-			} else {
-				tree.SetFirewallOnInterface(nic.name, "in",
-					"action accept",
-					"state established enable",
-					"state related enable",
-				)
-			}
 
-			tree.SetFirewallWithRuleNumber(nic.name, "in", ROUTE_STATE_NEW_ENABLE_FIREWALL_RULE_NUMBER,
-				"action accept",
-				"state new enable",
-			)
-
-			tree.SetFirewallOnInterface(nic.name, "in",
-				"action accept",
-				"protocol icmp",
-			)
-
-			// only allow ssh traffic on eth0, disable on others
-			if nic.name == "eth0" {
-				tree.SetFirewallOnInterface(nic.name, "local",
-					fmt.Sprintf("destination port %v", int(sshport)),
-					fmt.Sprintf("destination address %v", nic.ip),
-					"protocol tcp",
-					"action accept",
-				)
-			} else {
-				tree.SetFirewallOnInterface(nic.name, "local",
-					fmt.Sprintf("destination port %v", int(sshport)),
-					fmt.Sprintf("destination address %v", nic.ip),
-					"protocol tcp",
-					"action reject",
-				)
+		// the vyos only knows the ethernet interfaces, use the iptables for the virtual links
+		if bootstrapInfo.SkipVyosIptables || nic.Link() != nil {
+			if err := utils.InitNicFirewall(context.Background(), nic.Name, nic.Ip, !nic.IsPrivate(), utils.REJECT); err != nil {
+				log.Debugf("InitNicFirewall for nic: %s failed", err.Error())
 			}
-
-			tree.SetFirewallDefaultAction(nic.name, "local", "reject")
-			tree.SetFirewallDefaultAction(nic.name, "in", "reject")
-
-			tree.AttachFirewallToInterface(nic.name, "local")
-			tree.AttachFirewallToInterface(nic.name, "in")
 		}
 	}
 
-	tree.Set("system time-zone Asia/Shanghai")
-
-	password, found := bootstrapInfo["vyosPassword"]
-	utils.Assert(found && password != "", "vyosPassword cannot be empty")
-	if !isOnVMwareHypervisor() {
-		tree.Setf("system login user vyos authentication plaintext-password %v", password)
-	}
-
-	tree.Apply(true)
+	tree.Apply(context.Background(), true)
 
 	arping := func(nicname, ip, gateway string) {
-		b := utils.Bash{Command: fmt.Sprintf("sudo arping -q -A -w 1.5 -c 1 -I %s %s > /dev/null", nicname, ip)}
-		b.Run()
+		cmd := &utils.Command{
+			Argv:       []string{"arping", "-q", "-A", "-w", "1.5", "-c", "1", "-I", nicname, ip},
+			Privileged: true,
+			Timeout:    5 * time.Second,
+		}
+		if _, err := cmd.Run(context.Background()); err != nil {
+			log.Debugf("arping %s on %s failed, %s", ip, nicname, err)
+		}
 	}
 
 	// arping to advocate our mac addresses
-	arping("eth0", eth0.ip, eth0.gateway)
 	for _, nic := range nics {
-		arping(nic.name, nic.ip, nic.gateway)
+		arping(nic.Name, nic.Ip, nic.Gateway)
 	}
 
-	mgmtNodeIp := bootstrapInfo["managementNodeIp"]
-	if mgmtNodeIp == nil {
+	mgmtNodeIp := bootstrapInfo.ManagementNodeIp
+	if mgmtNodeIp == "" {
 		log.Debugf("can not get management node ip from bootstrap info, skip to config route")
 	} else {
-		mgmtNodeIpStr := mgmtNodeIp.(string)
-		log.Debugf("mgmtNodeIpStr: %s", mgmtNodeIpStr)
-		if utils.CheckMgmtCidrContainsIp(mgmtNodeIpStr, mgmtNic) == false {
+		log.Debugf("mgmtNodeIp: %s", mgmtNodeIp)
+		if !eth0.CidrContainsIp(mgmtNodeIp) {
 			log.Debugf("not contain")
 			// use eth0 anyway because eth0 must be connected to a bridge of host
-			// err := utils.SetVrouterRoute(mgmtNodeIpStr, "eth0", mgmtNic["gateway"].(string))
-			err := utils.SetVrouterRoute(mgmtNodeIpStr, "eth0", "")
+			// err := utils.SetVrouterRoute(mgmtNodeIp, "eth0", eth0.Gateway)
+			err := utils.SetVrouterRoute(mgmtNodeIp, "eth0", "")
 			utils.PanicOnError(err)
-		} else if utils.GetNicForRoute(mgmtNodeIpStr) != "eth0" {
+		} else if utils.GetNicForRoute(mgmtNodeIp) != "eth0" {
 			log.Debugf("not eth0")
-			err := utils.SetVrouterRoute(mgmtNodeIpStr, "eth0", "")
+			err := utils.SetVrouterRoute(mgmtNodeIp, "eth0", "")
 			utils.PanicOnError(err)
 		} else {
 			log.Debugf("the cidr of vr mgmt contains callback ip, skip to configure route")
 		}
 	}
 	// other routers via eth0
-	otherRouters := bootstrapInfo["otherRouters"]
-	if otherRouters != nil {
-		otherIps := otherRouters.([]interface{})
-		for _, ipi := range otherIps {
-			ip, ok := ipi.(string)
-			if ok && utils.GetNicForRoute(ip) != "eth0" {
-				log.Debugf("not eth0")
-				err := utils.SetVrouterRoute(ip, "eth0", "")
-				utils.PanicOnError(err)
-			}
+	for _, ip := range bootstrapInfo.OtherRouters {
+		if utils.GetNicForRoute(ip) != "eth0" {
+			log.Debugf("not eth0")
+			err := utils.SetVrouterRoute(ip, "eth0", "")
+			utils.PanicOnError(err)
 		}
 	}
 	/* this is workaround for zstac*/
 	log.Debugf("the vr public network %s at %s", defaultGW, defaultNic)
 	if defaultGW != "" {
 		//check default gw in route and it's workaround for ZSTAC-15742, the manage and public are in same cidr with different ranges
-		bash := utils.Bash{
-			Command: fmt.Sprintf("route -n| grep -w %s|grep -w %s", defaultGW, defaultNic),
+		cmd := &utils.Command{
+			Argv:    []string{"ip", "route", "show", "via", defaultGW, "dev", defaultNic},
+			Timeout: utils.IP_COMMAND_TIMEOUT,
 		}
-		ret, _, _, err := bash.RunWithReturn()
-		if err == nil && ret != 0 {
-			tree := server.NewParserFromShowConfiguration().Tree
+		res, err := cmd.Run(context.Background())
+		if err == nil && strings.TrimSpace(res.Stdout) == "" {
+			tree := server.NewParserFromShowConfiguration(context.Background()).Tree
 			//tree.Deletef("system gateway-address %v", defaultGW)
 			tree.Deletef("protocols static route 0.0.0.0/0")
-			tree.Apply(true)
-			b := utils.Bash{
-				Command: fmt.Sprintf("ip route add default via %s dev %s", defaultGW, defaultNic),
-			}
-			b.Run()
-			b.PanicIfError()
+			tree.Apply(context.Background(), true)
+			utils.PanicOnError(utils.RunIpCommands(context.Background(), [][]string{{"route", "add", "default", "via", defaultGW, "dev", defaultNic}}))
 		}
 	}
 }